@@ -0,0 +1,118 @@
+// Benchmark harness feeding synthetic sparkplug messages into the store
+// to measure the sustained processing throughput with many edge nodes.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"runtime"
+	"time"
+
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/store"
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/util"
+	"github.com/DATATRONiQ/go-sparkplug-primary/third_party/sparkplugb"
+	"google.golang.org/protobuf/proto"
+)
+
+var (
+	groups   = flag.Int("groups", 10, "Number of groups")
+	nodes    = flag.Int("nodes", 500, "Number of nodes per group")
+	devices  = flag.Int("devices", 2, "Number of devices per node")
+	metrics  = flag.Int("metrics", 20, "Number of metrics per node and device")
+	workers  = flag.Int("workers", runtime.NumCPU(), "Number of store workers")
+	duration = flag.Duration("duration", 10*time.Second, "Duration of the data phase")
+	logLevel = flag.String("log-level", "error", "Log level")
+)
+
+func main() {
+	flag.Parse()
+	util.InitLogger("text", "", *logLevel)
+	// keeps the memory of the message log bounded during long runs
+	store.MessageLogSize = 10000
+
+	msgChan := make(chan store.Message, 1000)
+	sm := store.NewStoreManager(msgChan, *workers)
+
+	fmt.Printf("groups=%d nodes/group=%d devices/node=%d metrics=%d workers=%d\n", *groups, *nodes, *devices, *metrics, *workers)
+
+	start := time.Now()
+	births := 0
+	forEachNode(func(groupID, nodeID string) {
+		msgChan <- message(groupID, nodeID, "", store.NodeBirth, true)
+		births++
+		for d := 0; d < *devices; d++ {
+			msgChan <- message(groupID, nodeID, fmt.Sprintf("device-%d", d), store.DeviceBirth, true)
+			births++
+		}
+	})
+	waitProcessed(sm, uint64(births))
+	fmt.Printf("birth phase: %d messages in %v\n", births, time.Since(start))
+
+	start = time.Now()
+	sent := births
+	deadline := start.Add(*duration)
+	for time.Now().Before(deadline) {
+		forEachNode(func(groupID, nodeID string) {
+			msgChan <- message(groupID, nodeID, "", store.NodeData, false)
+			sent++
+			for d := 0; d < *devices; d++ {
+				msgChan <- message(groupID, nodeID, fmt.Sprintf("device-%d", d), store.DeviceData, false)
+				sent++
+			}
+		})
+	}
+	close(msgChan)
+	<-sm.Done()
+
+	elapsed := time.Since(start)
+	data := sent - births
+	fmt.Printf("data phase: %d messages in %v (%.0f msg/s, %.0f metric updates/s)\n",
+		data, elapsed, float64(data)/elapsed.Seconds(), float64(data**metrics)/elapsed.Seconds())
+
+	groupsFetched := sm.Fetch()
+	fetchedNodes := 0
+	for _, group := range *groupsFetched {
+		fetchedNodes += len(group.Nodes)
+	}
+	fmt.Printf("store contains %d groups with %d nodes\n", len(*groupsFetched), fetchedNodes)
+}
+
+func forEachNode(fn func(groupID, nodeID string)) {
+	for g := 0; g < *groups; g++ {
+		for n := 0; n < *nodes; n++ {
+			fn(fmt.Sprintf("group-%d", g), fmt.Sprintf("node-%d", n))
+		}
+	}
+}
+
+func waitProcessed(sm *store.StoreManager, amount uint64) {
+	for sm.Processed() < amount {
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Creates a message with doubles for all metrics, including the metric names for births
+func message(groupID, nodeID, deviceID string, msgType store.Type, birth bool) store.Message {
+	now := uint64(time.Now().UnixMilli())
+	payload := &sparkplugb.Payload{Timestamp: proto.Uint64(now)}
+	for m := 0; m < *metrics; m++ {
+		metric := &sparkplugb.Payload_Metric{
+			Alias:     proto.Uint64(uint64(m)),
+			Timestamp: proto.Uint64(now),
+			Datatype:  proto.Uint32(uint32(sparkplugb.DataType_Double)),
+			Value:     &sparkplugb.Payload_Metric_DoubleValue{DoubleValue: float64(now % 1000)},
+		}
+		if birth {
+			metric.Name = proto.String(fmt.Sprintf("metric-%d", m))
+		}
+		payload.Metrics = append(payload.Metrics, metric)
+	}
+	return store.Message{
+		ReceivedAt: time.Now(),
+		GroupID:    groupID,
+		NodeID:     nodeID,
+		DeviceID:   deviceID,
+		Type:       msgType,
+		Payload:    payload,
+	}
+}
@@ -1,31 +1,315 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/alarm"
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/audit"
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/auth"
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/cluster"
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/config"
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/exporter"
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/grpcapi"
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/opcua"
 	"github.com/DATATRONiQ/go-sparkplug-primary/internal/server"
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/sink"
 	"github.com/DATATRONiQ/go-sparkplug-primary/internal/sparkplug"
 	"github.com/DATATRONiQ/go-sparkplug-primary/internal/store"
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/uns"
 	"github.com/DATATRONiQ/go-sparkplug-primary/internal/util"
-)
-
-var (
-	logFormat       = util.LookupEnv("LOG_FORMAT", "text")
-	logFile         = util.LookupEnv("LOG_FILE", "")
-	logLevel        = util.LookupEnv("LOG_LEVEL", "info")
-	mqttEndpoint    = util.LookupEnv("MQTT_ENDPOINT", "tcp://localhost:1883")
-	mqttClientID    = util.LookupEnv("MQTT_CLIENT_ID", "go-primary")
-	mqttUsername    = util.LookupEnv("MQTT_USERNAME", "")
-	mqttPassword    = util.LookupEnv("MQTT_PASSWORD", "")
-	sparkplugHostID = util.LookupEnv("SPARKPLUG_HOST_ID", "go-primary")
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/webhook"
+	"github.com/sirupsen/logrus"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "config" {
+		os.Exit(configCommand(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "hash-password" {
+		os.Exit(hashPasswordCommand())
+	}
+
+	cfg, err := config.Load(flag.CommandLine, os.Args[1:])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	util.InitLogger(cfg.Log.Format, cfg.Log.File, cfg.Log.Level)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	var cl *cluster.Cluster
+	if cfg.Cluster.ShareGroup != "" {
+		instanceID := cfg.Cluster.InstanceID
+		if instanceID == "" {
+			instanceID = cfg.MQTT.ClientID
+		}
+		cl = cluster.New(instanceID, cfg.Cluster.APIURL, cfg.Cluster.ShareGroup, cfg.Cluster.TopicPrefix, cfg.Cluster.HeartbeatInterval)
+		cl.ReorderTimeout = cfg.Cluster.ReorderTimeout
+	}
 
-	util.InitLogger(logFormat, logFile, logLevel)
+	auditLog, err := audit.Open(cfg.Audit.File, cfg.Audit.LogSize)
+	if err != nil {
+		logrus.Fatalf("Failed to open audit log: %v", err)
+	}
 
+	store.MessageLogSize = cfg.Store.MessageLogSize
+	store.EventHistorySize = cfg.Store.EventHistorySize
+	if cfg.GraphQL.Enabled {
+		store.ValueHistorySize = cfg.Store.ValueHistorySize
+	}
+	if err := applyWatchdog(cfg); err != nil {
+		logrus.Fatalf("Failed to set up the stale-data watchdog: %v", err)
+	}
+	var alarms *alarm.Engine
+	var rules []alarm.Rule
+	if cfg.Alarms.RulesFile != "" {
+		rules, err = alarm.LoadRules(cfg.Alarms.RulesFile)
+		if err != nil {
+			logrus.Fatalf("Failed to load alarm rules: %v", err)
+		}
+		if alarms, err = alarm.New(rules, cfg.Alarms.StateFile); err != nil {
+			logrus.Fatalf("Failed to set up alarming: %v", err)
+		}
+		store.AddUpdateHandler(alarms.Update)
+	}
+	var webhooks *webhook.Dispatcher
+	var subscriptions []webhook.Subscription
+	if cfg.Webhooks.File != "" {
+		subscriptions, err = webhook.LoadSubscriptions(cfg.Webhooks.File)
+		if err != nil {
+			logrus.Fatalf("Failed to load webhook subscriptions: %v", err)
+		}
+		if webhooks, err = webhook.New(subscriptions, cfg.Webhooks.DeadLetterSize); err != nil {
+			logrus.Fatalf("Failed to set up webhooks: %v", err)
+		}
+		store.AddEventHandler(webhooks.NotifyEvent)
+		if alarms != nil {
+			alarms.SetHandler(webhooks.NotifyAlarm)
+		}
+	}
+	var sinks *sink.Manager
+	var definitions []sink.Definition
+	if cfg.Sinks.File != "" {
+		definitions, err = sink.LoadDefinitions(cfg.Sinks.File)
+		if err != nil {
+			logrus.Fatalf("Failed to load sinks: %v", err)
+		}
+		if sinks, err = sink.New(definitions); err != nil {
+			logrus.Fatalf("Failed to set up sinks: %v", err)
+		}
+		store.AddUpdateHandler(sinks.HandleUpdate)
+		store.AddEventHandler(sinks.HandleEvent)
+	}
 	msgChan := make(chan store.Message, 100)
-	storeManager := store.NewStoreManager(msgChan)
+	storeManager := store.NewStoreManager(msgChan, cfg.Store.Workers)
+
+	client, err := sparkplug.StartMQTTClient(sparkplug.MQTTConfig{
+		Endpoints:     cfg.MQTT.Endpoints,
+		ClientID:      cfg.MQTT.ClientID,
+		HostID:        cfg.Sparkplug.HostID,
+		Username:      cfg.MQTT.Username,
+		Password:      cfg.MQTT.Password,
+		Filter:        cfg.TopicFilter(),
+		Standby:       cfg.Redundancy.Standby,
+		TakeoverDelay: cfg.Redundancy.TakeoverDelay,
+	}, cl, storeManager, auditLog, msgChan)
+	if err != nil {
+		logrus.Fatalf("Failed to connect to the MQTT broker: %v", err)
+	}
+
+	var bridge *uns.Bridge
+	if cfg.UNS.Enabled {
+		if bridge, err = uns.New(client, cfg.UNSConfig()); err != nil {
+			logrus.Fatalf("Failed to set up the unified namespace: %v", err)
+		}
+		store.AddUpdateHandler(bridge.PublishMetric)
+		store.AddEventHandler(bridge.PublishStatus)
+	}
+
+	var exp *exporter.Exporter
+	if cfg.Exporter.Enabled {
+		if exp, err = exporter.New(storeManager, cfg.ExporterFilter()); err != nil {
+			logrus.Fatalf("Failed to set up the sparkplug metrics exporter: %v", err)
+		}
+	}
+
+	var authenticator *auth.Authenticator
+	if cfg.Auth.Enabled {
+		// the configuration was validated, but the files may have changed since
+		if authenticator, err = auth.New(cfg.AuthConfig()); err != nil {
+			logrus.Fatalf("Failed to set up authentication: %v", err)
+		}
+	} else {
+		logrus.Warn("Authentication is disabled, the API is accessible without credentials")
+	}
+
+	var opcuaServer *opcua.Server
+	if cfg.OPCUA.Enabled {
+		if opcuaServer, err = opcua.Start(cfg.OPCUAConfig(), storeManager, client, auditLog, authenticator); err != nil {
+			logrus.Fatalf("Failed to start the OPC UA server: %v", err)
+		}
+	}
+
+	var grpcServer *grpcapi.Server
+	if cfg.GRPC.Enabled {
+		if grpcServer, err = grpcapi.Start(cfg.GRPCConfig(), storeManager, client, auditLog, authenticator); err != nil {
+			logrus.Fatalf("Failed to start the gRPC server: %v", err)
+		}
+	}
 
-	go sparkplug.StartMQTTClient(mqttEndpoint, mqttClientID, sparkplugHostID, mqttUsername, mqttPassword, msgChan)
+	r := &reloader{
+		args: os.Args[1:], cfg: cfg, client: client, exporter: exp, alarms: alarms, webhooks: webhooks, uns: bridge, sinks: sinks,
+		opcua: opcuaServer, rules: rules, subscriptions: subscriptions, definitions: definitions,
+	}
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			logrus.Info("Received SIGHUP, reloading configuration")
+			report, err := r.reload()
+			entry := audit.Entry{Action: audit.Reload, Source: audit.Signal, Details: "SIGHUP", Success: err == nil}
+			if err != nil {
+				entry.Error = err.Error()
+			} else {
+				entry.Settings = report.Applied
+			}
+			auditLog.Record(entry)
+		}
+	}()
+
+	srv, err := server.Start(server.Config{
+		Address:      cfg.HTTP.Address,
+		AdminAddress: cfg.HTTP.AdminAddress,
+		TLSCertFile:  cfg.HTTP.TLSCertFile,
+		TLSKeyFile:   cfg.HTTP.TLSKeyFile,
+		ReadTimeout:  cfg.HTTP.ReadTimeout,
+		WriteTimeout: cfg.HTTP.WriteTimeout,
+		IdleTimeout:  cfg.HTTP.IdleTimeout,
+		Mode:         cfg.HTTP.Mode,
+		Auth:         authenticator,
+		Audit:        auditLog,
+		Exporter:     exp,
+		Connection:   client,
+		Alarms:       alarms,
+		Webhooks:     webhooks,
+		Sinks:        sinks,
+		GraphQL:      cfg.GraphQL.Enabled,
+	}, storeManager, cl, client, r.reload)
+	if err != nil {
+		logrus.Fatalf("Failed to start HTTP server: %v", err)
+	}
+
+	<-ctx.Done()
+	stop()
+	logrus.Info("Shutting down")
+
+	// drain the messages already received while still connected, so the unified namespace bridge
+	// publishes the values and statuses resulting from them
+	client.StopReceiving()
+	close(msgChan)
+	select {
+	case <-storeManager.Done():
+		logrus.Infof("Processed all %d received messages", storeManager.Processed())
+	case <-time.After(cfg.ShutdownTimeout):
+		logrus.Warn("Timed out processing the remaining messages")
+	}
+	if bridge != nil {
+		bridge.Close()
+	}
+
+	// publish STATE OFFLINE and disconnect
+	client.Stop(cfg.ShutdownTimeout)
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		logrus.Warnf("Failed to shut down HTTP server gracefully: %v", err)
+	}
+	if opcuaServer != nil {
+		opcuaServer.Close()
+	}
+	if grpcServer != nil {
+		grpcServer.Shutdown(shutdownCtx)
+	}
+	if alarms != nil {
+		alarms.Close()
+	}
+	if webhooks != nil {
+		webhookCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+		defer cancel()
+		if err := webhooks.Close(webhookCtx); err != nil {
+			logrus.Warnf("Timed out delivering the remaining webhook notifications: %v", err)
+		}
+	}
+	if sinks != nil {
+		sinkCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+		defer cancel()
+		if err := sinks.Close(sinkCtx); err != nil {
+			logrus.Warnf("Timed out writing the remaining records to the sinks: %v", err)
+		}
+	}
+	if err := auditLog.Close(); err != nil {
+		logrus.Warnf("Failed to close audit log: %v", err)
+	}
+
+	logrus.Info("Shutdown complete")
+}
+
+// Handles the "config print" and "config validate" subcommands and returns the exit code
+func configCommand(args []string) int {
+	if len(args) == 0 || (args[0] != "print" && args[0] != "validate") {
+		fmt.Fprintln(os.Stderr, "usage: sparkplug-primary config <print|validate> [flags]")
+		return 2
+	}
+
+	fs := flag.NewFlagSet("config "+args[0], flag.ExitOnError)
+	cfg, loadErr := config.Load(fs, args[1:])
+
+	// the effective configuration is printed even if it is invalid, followed by the problems
+	if args[0] == "print" {
+		out, err := cfg.Masked()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		fmt.Print(string(out))
+	}
+
+	if loadErr != nil {
+		fmt.Fprintln(os.Stderr, loadErr)
+		return 1
+	}
+	if args[0] == "validate" {
+		fmt.Println("configuration is valid")
+	}
+	return 0
+}
 
-	server.Start(storeManager)
+// Handles the "hash-password" subcommand, printing the bcrypt hash of the password read from stdin
+// for the credentials file, and returns the exit code
+func hashPasswordCommand() int {
+	fmt.Fprintln(os.Stderr, "Password:")
+	password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && password == "" {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	hash, err := auth.HashPassword(strings.TrimRight(password, "\r\n"))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Println(hash)
+	return 0
 }
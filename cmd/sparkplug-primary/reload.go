@@ -0,0 +1,190 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/alarm"
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/config"
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/exporter"
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/opcua"
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/sink"
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/sparkplug"
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/store"
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/uns"
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/util"
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/webhook"
+	"github.com/sirupsen/logrus"
+)
+
+// Reloads the configuration from the same file, environment and flags the application was started with
+// and applies the settings which can be changed without restarting
+type reloader struct {
+	mu       sync.Mutex
+	args     []string
+	cfg      *config.Config
+	client   *sparkplug.Client
+	exporter *exporter.Exporter  // nil if the exporter is disabled
+	alarms   *alarm.Engine       // nil if alarming is disabled
+	webhooks *webhook.Dispatcher // nil if webhooks are disabled
+	uns      *uns.Bridge         // nil if the unified namespace is disabled
+	sinks    *sink.Manager       // nil if no sinks file is configured
+	opcua    *opcua.Server       // nil if the OPC UA server is disabled
+
+	// the applied alarm rules, webhook subscriptions and sinks, restored if a reload fails
+	rules         []alarm.Rule
+	subscriptions []webhook.Subscription
+	definitions   []sink.Definition
+}
+
+func (r *reloader) reload() (*config.ReloadReport, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	next, err := config.Load(flag.NewFlagSet(os.Args[0], flag.ContinueOnError), r.args)
+	if err != nil {
+		logrus.Errorf("Configuration reload failed, keeping the running configuration: %v", err)
+		return nil, err
+	}
+
+	running, report := r.cfg.Reload(next)
+
+	// everything which may be invalid is read and validated before anything is applied,
+	// so a failing reload keeps the running configuration as a whole
+	var rules []alarm.Rule
+	if r.alarms != nil {
+		// the rules file is read again on every reload, as its content may have changed
+		if rules, err = alarm.LoadRules(running.Alarms.RulesFile); err != nil {
+			logrus.Errorf("Failed to load the reloaded alarm rules, keeping the running configuration: %v", err)
+			return nil, err
+		}
+	}
+	var subscriptions []webhook.Subscription
+	if r.webhooks != nil {
+		// like the alarm rules, the webhook subscriptions are read again on every reload
+		if subscriptions, err = webhook.LoadSubscriptions(running.Webhooks.File); err != nil {
+			logrus.Errorf("Failed to load the reloaded webhook subscriptions, keeping the running configuration: %v", err)
+			return nil, err
+		}
+	}
+	var definitions []sink.Definition
+	if r.sinks != nil {
+		// like the webhook subscriptions, the sinks are read again on every reload; unchanged sinks keep running
+		if definitions, err = sink.LoadDefinitions(running.Sinks.File); err != nil {
+			logrus.Errorf("Failed to load the reloaded sinks, keeping the running configuration: %v", err)
+			return nil, err
+		}
+	}
+	watchdog, err := running.WatchdogConfig()
+	if err != nil {
+		logrus.Errorf("Invalid reloaded watchdog settings, keeping the running configuration: %v", err)
+		return nil, err
+	}
+
+	// applying a setting may still fail, e.g. subscribing or opening a sink, so every setting registers how it is undone
+	// before it is applied and a failure rolls back all settings applied so far, keeping the running configuration as a whole
+	var undo rollback
+	apply := func(what string, undoSetting func() error, applySetting func() error) error {
+		undo = append(undo, undoSetting)
+		if err := applySetting(); err != nil {
+			logrus.Errorf("Failed to apply the reloaded %s, keeping the running configuration: %v", what, err)
+			undo.run()
+			return fmt.Errorf("%s: %w", what, err)
+		}
+		return nil
+	}
+	if report.AppliedAny("sparkplug.") {
+		if err := apply("topic filter",
+			func() error { return r.client.SetFilter(r.cfg.TopicFilter()) },
+			func() error { return r.client.SetFilter(running.TopicFilter()) }); err != nil {
+			return nil, err
+		}
+	}
+	if report.AppliedAny("log.") {
+		if err := apply("log settings",
+			func() error { util.InitLogger(r.cfg.Log.Format, r.cfg.Log.File, r.cfg.Log.Level); return nil },
+			func() error { util.InitLogger(running.Log.Format, running.Log.File, running.Log.Level); return nil }); err != nil {
+			return nil, err
+		}
+	}
+	if report.AppliedAny("exporter.") && r.exporter != nil {
+		if err := apply("exporter filter",
+			func() error { return r.exporter.SetFilter(r.cfg.ExporterFilter()) },
+			func() error { return r.exporter.SetFilter(running.ExporterFilter()) }); err != nil {
+			return nil, err
+		}
+	}
+	if report.AppliedAny("watchdog.") {
+		if err := apply("watchdog settings",
+			func() error { return applyWatchdog(r.cfg) },
+			func() error { return store.SetWatchdog(watchdog) }); err != nil {
+			return nil, err
+		}
+	}
+	if report.AppliedAny("uns.") && r.uns != nil {
+		if err := apply("unified namespace settings",
+			func() error { return r.uns.SetConfig(r.cfg.UNSConfig()) },
+			func() error { return r.uns.SetConfig(running.UNSConfig()) }); err != nil {
+			return nil, err
+		}
+	}
+	if report.AppliedAny("opcua.") && r.opcua != nil {
+		if err := apply("OPC UA settings",
+			func() error { r.opcua.SetWritable(r.cfg.OPCUA.Writable); return nil },
+			func() error { r.opcua.SetWritable(running.OPCUA.Writable); return nil }); err != nil {
+			return nil, err
+		}
+	}
+	if r.alarms != nil {
+		if err := apply("alarm rules",
+			func() error { return r.alarms.SetRules(r.rules) },
+			func() error { return r.alarms.SetRules(rules) }); err != nil {
+			return nil, err
+		}
+	}
+	if r.webhooks != nil {
+		if err := apply("webhook subscriptions",
+			func() error { return r.webhooks.SetSubscriptions(r.subscriptions) },
+			func() error { return r.webhooks.SetSubscriptions(subscriptions) }); err != nil {
+			return nil, err
+		}
+	}
+	// the sinks are applied last, as rolling them back reopens the replaced ones
+	if r.sinks != nil {
+		if err := apply("sinks",
+			func() error { return r.sinks.SetDefinitions(r.definitions) },
+			func() error { return r.sinks.SetDefinitions(definitions) }); err != nil {
+			return nil, err
+		}
+	}
+
+	r.cfg, r.rules, r.subscriptions, r.definitions = running, rules, subscriptions, definitions
+	logrus.Infof("Configuration reloaded, applied %v", report.Applied)
+	if len(report.RestartRequired) > 0 {
+		logrus.Warnf("Changed settings %v require a restart", report.RestartRequired)
+	}
+	return report, nil
+}
+
+// Undoes the settings applied by a failed reload
+type rollback []func() error
+
+// Undoes the settings in reverse order, logging the ones which cannot be restored
+func (undo rollback) run() {
+	for i := len(undo) - 1; i >= 0; i-- {
+		if err := undo[i](); err != nil {
+			logrus.Errorf("Failed to restore the running configuration after a failed reload: %v", err)
+		}
+	}
+}
+
+// Applies the stale-data watchdog settings of the configuration
+func applyWatchdog(cfg *config.Config) error {
+	watchdog, err := cfg.WatchdogConfig()
+	if err != nil {
+		return err
+	}
+	return store.SetWatchdog(watchdog)
+}
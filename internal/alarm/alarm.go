@@ -0,0 +1,93 @@
+package alarm
+
+import (
+	"fmt"
+	"hash/fnv"
+	"time"
+
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/store"
+)
+
+// The state of an alarm in its ISA-18.2 lifecycle. Alarms which are cleared and acknowledged return to normal and are removed.
+type AlarmState string
+
+const (
+	Active       AlarmState = "active"       // The condition is met and the alarm is not acknowledged
+	Acknowledged AlarmState = "acknowledged" // The condition is met and the alarm is acknowledged
+	Cleared      AlarmState = "cleared"      // The condition is gone, but the alarm is not acknowledged yet
+	Shelved      AlarmState = "shelved"      // The alarm is suppressed by an operator until the shelve expires
+	Normal       AlarmState = "normal"       // The alarm is cleared and acknowledged, so it was removed
+)
+
+// A change of an alarm reported to the handler of the engine
+type EventType string
+
+const (
+	EventRaised       EventType = "alarm_raised"
+	EventCleared      EventType = "alarm_cleared"
+	EventAcknowledged EventType = "alarm_acknowledged"
+	EventShelved      EventType = "alarm_shelved"
+	EventUnshelved    EventType = "alarm_unshelved" // By an operator or because the shelve expired
+)
+
+// An alarm raised by a condition of a rule for a metric
+type Alarm struct {
+	ID             string     `json:"id"`
+	Rule           string     `json:"rule"`
+	Condition      Condition  `json:"condition"`
+	Description    string     `json:"description,omitempty"`
+	Priority       string     `json:"priority,omitempty"`
+	GroupID        string     `json:"groupId"`
+	NodeID         string     `json:"nodeId"`
+	DeviceID       string     `json:"deviceId,omitempty"`
+	Metric         string     `json:"metric"`
+	State          AlarmState `json:"state"`
+	Active         bool       `json:"active"`                   // Whether the condition is met
+	Acknowledged   bool       `json:"acknowledged"`             // Whether the last activation was acknowledged
+	Limit          float64    `json:"limit"`                    // The limit, maximum rate per second, state (0 or 1) or duration in seconds of the condition
+	Value          any        `json:"value"`                    // The value which raised the alarm
+	Occurrences    int        `json:"occurrences"`              // How often the alarm was raised since it was last normal
+	ActivatedAt    time.Time  `json:"activatedAt"`              // The time the alarm was last raised
+	ClearedAt      *time.Time `json:"clearedAt,omitempty"`      // The time the condition was last gone
+	AcknowledgedAt *time.Time `json:"acknowledgedAt,omitempty"` // The time the alarm was last acknowledged
+	AcknowledgedBy string     `json:"acknowledgedBy,omitempty"`
+	ShelvedUntil   *time.Time `json:"shelvedUntil,omitempty"`
+	ShelvedBy      string     `json:"shelvedBy,omitempty"`
+	Comment        string     `json:"comment,omitempty"` // The comment of the last acknowledgement or shelve
+}
+
+// Returns the ID of the alarm of the given rule, condition and metric path
+func alarmID(rule string, condition Condition, path string) string {
+	h := fnv.New64a()
+	h.Write([]byte(rule + "\x00" + string(condition) + "\x00" + path))
+	return fmt.Sprintf("%016x", h.Sum64())
+}
+
+// Returns the path of the metric of the alarm, "<group>/<node>[/<device>]/<metric>"
+func (a *Alarm) path() string {
+	return store.MetricUpdate{GroupID: a.GroupID, NodeID: a.NodeID, DeviceID: a.DeviceID, Name: a.Metric}.Path()
+}
+
+// Returns true if the alarm is shelved at the given time
+func (a *Alarm) shelved(now time.Time) bool {
+	return a.ShelvedUntil != nil && now.Before(*a.ShelvedUntil)
+}
+
+// Returns true if the alarm returned to normal, so it can be removed
+func (a *Alarm) normal(now time.Time) bool {
+	return !a.Active && a.Acknowledged && !a.shelved(now)
+}
+
+// Updates the state of the alarm from its flags
+func (a *Alarm) updateState(now time.Time) {
+	switch {
+	case a.shelved(now):
+		a.State = Shelved
+	case a.Active && a.Acknowledged:
+		a.State = Acknowledged
+	case a.Active:
+		a.State = Active
+	default:
+		a.State = Cleared
+	}
+}
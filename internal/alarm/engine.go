@@ -0,0 +1,625 @@
+package alarm
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/metrics"
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/store"
+	"github.com/sirupsen/logrus"
+)
+
+// The interval in which the engine applies the delays, unchanged conditions and shelve expiries
+const tickInterval = time.Second
+
+// Returned for alarms which do not exist
+var ErrNotFound = errors.New("alarm not found")
+
+// Identifies the condition of a rule for a metric
+type conditionKey struct {
+	rule      string
+	condition Condition
+	path      string
+}
+
+// The evaluation state of a condition of a rule for a metric
+type condition struct {
+	check  *check
+	update store.MetricUpdate // The last evaluated value
+	met    bool               // Whether the condition is met by the last value, before the delays
+	since  time.Time          // The time met last changed
+	active bool               // Whether the alarm is raised, after the delays
+
+	// the last numeric value and its timestamp for the rate of change, or the time the value last changed for unchanged conditions
+	last     float64
+	lastAt   time.Time
+	hasLast  bool
+	lastSeen any // the last value, for unchanged conditions
+}
+
+// The number of shards the conditions and alarms are partitioned into by metric path,
+// so the store workers evaluating different metrics do not wait for each other
+const shardCount = 64
+
+// The conditions and alarms of the metrics whose path hashes to the shard
+type shard struct {
+	mu         sync.Mutex
+	matches    map[string][]*check // the checks matching a metric path
+	conditions map[conditionKey]*condition
+	alarms     map[string]*Alarm
+	dirty      bool    // whether the alarms changed since they were persisted
+	events     []event // the changes of the alarms, reported to the handler once the shard is unlocked
+}
+
+// A change of an alarm reported to the handler
+type event struct {
+	t     EventType
+	alarm Alarm
+}
+
+func newShard() *shard {
+	return &shard{
+		matches:    make(map[string][]*check),
+		conditions: make(map[conditionKey]*condition),
+		alarms:     make(map[string]*Alarm),
+	}
+}
+
+// Records a copy of the changed alarm, to be reported after the shard is unlocked. Must be called with the lock held.
+func (s *shard) notify(t EventType, a *Alarm) {
+	s.events = append(s.events, event{t: t, alarm: *a})
+	s.dirty = true
+}
+
+// Unlocks the shard and returns the changes of its alarms since it was locked
+func (s *shard) unlock() []event {
+	events := s.events
+	s.events = nil
+	s.mu.Unlock()
+	return events
+}
+
+// Evaluates the alarm rules on the metric values applied to the store and manages the raised alarms
+type Engine struct {
+	rulesMu sync.RWMutex // held for reading while evaluating a value, so the rules are replaced between evaluations
+	checks  []*check
+	shards  [shardCount]*shard
+	handler atomic.Value // func(EventType, Alarm)
+
+	stateFile     string
+	persistMu     sync.Mutex // serializes writing the state file
+	persistFailed bool       // whether the last write failed, so the next tick retries it
+	persistErr    error      // the error of the last write of the state file, nil if it succeeded
+
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+// Creates an engine evaluating the given rules and starts applying the delays.
+// The alarms are persisted to the state file if given, so active alarms survive a restart.
+func New(rules []Rule, stateFile string) (*Engine, error) {
+	checks, err := compileRules(rules)
+	if err != nil {
+		return nil, err
+	}
+	e := &Engine{
+		checks:    checks,
+		stateFile: stateFile,
+		done:      make(chan struct{}),
+		stopped:   make(chan struct{}),
+	}
+	for i := range e.shards {
+		e.shards[i] = newShard()
+	}
+	if err := e.load(); err != nil {
+		return nil, err
+	}
+	e.registerMetrics()
+	go e.run()
+	return e, nil
+}
+
+// Returns the shard of the metric with the given path
+func (e *Engine) shard(path string) *shard {
+	h := fnv.New32a()
+	h.Write([]byte(path))
+	return e.shards[h.Sum32()%shardCount]
+}
+
+// Sets the handler called for every change of an alarm.
+// It is called without the engine locked, after the change was applied.
+func (e *Engine) SetHandler(handler func(EventType, Alarm)) {
+	e.handler.Store(handler)
+}
+
+// Calls the handler, if any, with the changes of the alarms. Must be called without a lock held.
+func (e *Engine) notify(events []event) {
+	handler, _ := e.handler.Load().(func(EventType, Alarm))
+	if handler == nil {
+		return
+	}
+	for _, ev := range events {
+		handler(ev.t, ev.alarm)
+	}
+}
+
+// Replaces the rules. Alarms of removed conditions are cleared.
+func (e *Engine) SetRules(rules []Rule) error {
+	checks, err := compileRules(rules)
+	if err != nil {
+		return err
+	}
+
+	e.rulesMu.Lock()
+	e.checks = checks
+	var events []event
+	now := time.Now()
+	for _, s := range e.shards {
+		s.mu.Lock()
+		s.matches = make(map[string][]*check)
+		for key, c := range s.conditions {
+			if next := findCheck(checks, key); next != nil {
+				c.check = next
+			} else {
+				delete(s.conditions, key)
+			}
+		}
+		for _, a := range s.alarms {
+			key := conditionKey{rule: a.Rule, condition: a.Condition, path: a.path()}
+			if a.Active && findCheck(checks, key) == nil {
+				s.clear(key, now)
+			}
+		}
+		// the priorities and descriptions of the rules may have changed
+		s.dirty = true
+		events = append(events, s.unlock()...)
+	}
+	e.rulesMu.Unlock()
+	e.notify(events)
+	return nil
+}
+
+// Returns the check of the given condition, nil if its rule was removed or no longer matches the metric
+func findCheck(checks []*check, key conditionKey) *check {
+	for _, ch := range checks {
+		if ch.rule.Name == key.rule && ch.condition == key.condition && ch.pattern.MatchString(key.path) {
+			return ch
+		}
+	}
+	return nil
+}
+
+// Evaluates the rules matching the metric of the given update, called by the store for every applied value.
+// Only the shard of the metric is locked, and the alarm changes are reported after it is unlocked.
+func (e *Engine) Update(u store.MetricUpdate) {
+	if u.IsNull {
+		return
+	}
+	path := u.Path()
+
+	e.rulesMu.RLock()
+	s := e.shard(path)
+	s.mu.Lock()
+	checks, ok := s.matches[path]
+	if !ok {
+		checks = make([]*check, 0)
+		for _, ch := range e.checks {
+			if ch.pattern.MatchString(path) {
+				checks = append(checks, ch)
+			}
+		}
+		s.matches[path] = checks
+	}
+	for _, ch := range checks {
+		key := conditionKey{rule: ch.rule.Name, condition: ch.condition, path: path}
+		// a changed alarm is persisted by the next tick, so the store is not blocked by writing the state file
+		s.evaluate(key, s.condition(key, ch), u)
+	}
+	events := s.unlock()
+	e.rulesMu.RUnlock()
+	e.notify(events)
+}
+
+// Returns the condition of the given key, restoring its state from a persisted alarm
+func (s *shard) condition(key conditionKey, ch *check) *condition {
+	c, ok := s.conditions[key]
+	if ok {
+		return c
+	}
+	c = &condition{check: ch}
+	if a, ok := s.alarms[alarmID(key.rule, key.condition, key.path)]; ok && a.Active {
+		c.met, c.active, c.since = true, true, a.ActivatedAt
+		if ch.condition == Unchanged {
+			// the value is still unchanged if it equals the value which raised the alarm
+			c.lastSeen, c.hasLast, c.lastAt = a.Value, true, a.ActivatedAt.Add(-ch.rule.UnchangedFor)
+		}
+	}
+	s.conditions[key] = c
+	return c
+}
+
+// Evaluates the condition on the given value and applies the delays
+func (s *shard) evaluate(key conditionKey, c *condition, u store.MetricUpdate) {
+	value, numeric := store.NumericValue(u.Value)
+	met := c.met
+	switch c.check.condition {
+	case Unchanged:
+		if !c.hasLast || !sameValue(u.Value, c.lastSeen) {
+			c.lastSeen, c.hasLast, c.lastAt = u.Value, true, u.ReceivedAt
+			met = false
+		}
+	case RateOfChange:
+		if !numeric {
+			return
+		}
+		// the rate is computed from the timestamps of the values, as buffered values may be received at once
+		if c.hasLast && u.Timestamp.After(c.lastAt) {
+			rate := math.Abs(value-c.last) / u.Timestamp.Sub(c.lastAt).Seconds()
+			met = c.check.met(rate, c.met)
+		}
+		if !c.hasLast || !u.Timestamp.Before(c.lastAt) {
+			c.last, c.lastAt, c.hasLast = value, u.Timestamp, true
+		}
+	case State:
+		if !numeric {
+			return
+		}
+		met = c.check.met(boolValue(value != 0), c.met)
+	default:
+		if !numeric {
+			return
+		}
+		met = c.check.met(value, c.met)
+	}
+	c.update = u
+	s.transition(key, c, met, u.ReceivedAt)
+}
+
+// Returns true if both values are equal, comparing numbers by value as persisted values lose their type
+func sameValue(a, b any) bool {
+	x, ok := store.NumericValue(a)
+	y, ok2 := store.NumericValue(b)
+	if ok && ok2 {
+		return x == y
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// Records whether the condition is met and raises or clears the alarm once the delay passed
+func (s *shard) transition(key conditionKey, c *condition, met bool, now time.Time) {
+	if met != c.met {
+		c.met, c.since = met, now
+	}
+	if c.met == c.active {
+		return
+	}
+	delay := c.check.rule.OffDelay
+	if c.met {
+		delay = c.check.rule.OnDelay
+	}
+	if now.Sub(c.since) < delay {
+		return
+	}
+	c.active = c.met
+	if c.active {
+		s.raise(key, c, now)
+	} else {
+		s.clear(key, now)
+	}
+}
+
+// Raises the alarm of the given condition
+func (s *shard) raise(key conditionKey, c *condition, now time.Time) {
+	id := alarmID(key.rule, key.condition, key.path)
+	a, ok := s.alarms[id]
+	if !ok {
+		a = &Alarm{
+			ID:        id,
+			Rule:      key.rule,
+			Condition: key.condition,
+			GroupID:   c.update.GroupID,
+			NodeID:    c.update.NodeID,
+			DeviceID:  c.update.DeviceID,
+			Metric:    c.update.Name,
+		}
+		s.alarms[id] = a
+	}
+	a.Description = c.check.rule.Description
+	a.Priority = c.check.rule.Priority
+	a.Limit = c.check.limit
+	a.Value = c.update.Value
+	a.Active = true
+	a.Acknowledged = false
+	a.Occurrences++
+	a.ActivatedAt = now
+	a.ClearedAt = nil
+	a.updateState(now)
+	logrus.Infof("Alarm %s raised: %s %s of %s, value %v", a.ID, a.Rule, a.Condition, key.path, a.Value)
+	s.notify(EventRaised, a)
+}
+
+// Clears the alarm of the given condition, which returns to normal if it is acknowledged
+func (s *shard) clear(key conditionKey, now time.Time) {
+	id := alarmID(key.rule, key.condition, key.path)
+	a, ok := s.alarms[id]
+	if !ok {
+		return
+	}
+	a.Active = false
+	a.ClearedAt = &now
+	a.updateState(now)
+	logrus.Infof("Alarm %s cleared: %s %s of %s", a.ID, a.Rule, a.Condition, key.path)
+	if a.normal(now) {
+		a.State = Normal
+		delete(s.alarms, id)
+	}
+	s.notify(EventCleared, a)
+}
+
+// Applies the delays, unchanged conditions and shelve expiries and persists the changed alarms in the tick interval
+// until the engine is closed
+func (e *Engine) run() {
+	defer close(e.stopped)
+	ticker := time.NewTicker(tickInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-e.done:
+			return
+		case now := <-ticker.C:
+			e.tick(now)
+			e.persist()
+		}
+	}
+}
+
+func (e *Engine) tick(now time.Time) {
+	for _, s := range e.shards {
+		s.mu.Lock()
+		for key, c := range s.conditions {
+			met := c.met
+			if c.check.condition == Unchanged && c.hasLast {
+				met = now.Sub(c.lastAt) >= c.check.rule.UnchangedFor
+			}
+			s.transition(key, c, met, now)
+		}
+		for id, a := range s.alarms {
+			if a.ShelvedUntil == nil || a.shelved(now) {
+				continue
+			}
+			a.ShelvedUntil, a.ShelvedBy = nil, ""
+			a.updateState(now)
+			if a.normal(now) {
+				a.State = Normal
+				delete(s.alarms, id)
+			}
+			s.notify(EventUnshelved, a)
+		}
+		e.notify(s.unlock())
+	}
+}
+
+// Returns all alarms sorted by activation time, newest first
+func (e *Engine) Alarms() []Alarm {
+	alarms := make([]Alarm, 0)
+	for _, s := range e.shards {
+		s.mu.Lock()
+		for _, a := range s.alarms {
+			alarms = append(alarms, *a)
+		}
+		s.mu.Unlock()
+	}
+	sort.Slice(alarms, func(i, j int) bool {
+		return alarms[i].ActivatedAt.After(alarms[j].ActivatedAt)
+	})
+	return alarms
+}
+
+// Returns the alarm of the given ID
+func (e *Engine) Alarm(id string) (Alarm, bool) {
+	for _, s := range e.shards {
+		s.mu.Lock()
+		a, ok := s.alarms[id]
+		var alarm Alarm
+		if ok {
+			alarm = *a
+		}
+		s.mu.Unlock()
+		if ok {
+			return alarm, true
+		}
+	}
+	return Alarm{}, false
+}
+
+// Acknowledges the alarm, which returns to normal if its condition is gone
+func (e *Engine) Acknowledge(id, principal, comment string) (Alarm, error) {
+	return e.change(id, EventAcknowledged, func(a *Alarm, now time.Time) error {
+		a.Acknowledged = true
+		a.AcknowledgedAt = &now
+		a.AcknowledgedBy = principal
+		a.Comment = comment
+		return nil
+	})
+}
+
+// Shelves the alarm for the given duration, suppressing it even if it is raised again
+func (e *Engine) Shelve(id, principal, comment string, duration time.Duration) (Alarm, error) {
+	if duration <= 0 {
+		return Alarm{}, fmt.Errorf("duration must be positive, got %v", duration)
+	}
+	return e.change(id, EventShelved, func(a *Alarm, now time.Time) error {
+		until := now.Add(duration)
+		a.ShelvedUntil = &until
+		a.ShelvedBy = principal
+		a.Comment = comment
+		return nil
+	})
+}
+
+// Unshelves the alarm, which returns to normal if its condition is gone and it is acknowledged
+func (e *Engine) Unshelve(id string) (Alarm, error) {
+	return e.change(id, EventUnshelved, func(a *Alarm, now time.Time) error {
+		if a.ShelvedUntil == nil {
+			return fmt.Errorf("alarm %s is not shelved", id)
+		}
+		a.ShelvedUntil, a.ShelvedBy = nil, ""
+		return nil
+	})
+}
+
+// Applies an operator action to the alarm and returns the changed alarm.
+// The ID does not tell the metric of the alarm, so the shards are searched for it.
+func (e *Engine) change(id string, t EventType, fn func(a *Alarm, now time.Time) error) (Alarm, error) {
+	for _, s := range e.shards {
+		s.mu.Lock()
+		a, ok := s.alarms[id]
+		if !ok {
+			s.mu.Unlock()
+			continue
+		}
+		now := time.Now()
+		if err := fn(a, now); err != nil {
+			alarm := *a
+			s.mu.Unlock()
+			return alarm, err
+		}
+		a.updateState(now)
+		if a.normal(now) {
+			a.State = Normal
+			delete(s.alarms, id)
+		}
+		s.notify(t, a)
+		alarm := *a
+		e.notify(s.unlock())
+		return alarm, nil
+	}
+	return Alarm{}, ErrNotFound
+}
+
+// The persisted alarms
+type stateFile struct {
+	Alarms []*Alarm `json:"alarms"`
+}
+
+// Loads the persisted alarms from the state file, if it exists
+func (e *Engine) load() error {
+	if e.stateFile == "" {
+		return nil
+	}
+	content, err := os.ReadFile(e.stateFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var state stateFile
+	if err := json.Unmarshal(content, &state); err != nil {
+		return fmt.Errorf("%s: %v", e.stateFile, err)
+	}
+	now := time.Now()
+	for _, a := range state.Alarms {
+		a.updateState(now)
+		e.shard(a.path()).alarms[a.ID] = a
+	}
+	logrus.Infof("Loaded %d alarms from %s", len(state.Alarms), e.stateFile)
+	return nil
+}
+
+// Writes the alarms to the state file if they changed since they were last written.
+// Each shard is only locked to take its snapshot, so writing the file does not block the store.
+func (e *Engine) persist() {
+	if e.stateFile == "" {
+		return
+	}
+	e.persistMu.Lock()
+	defer e.persistMu.Unlock()
+
+	dirty := e.persistFailed
+	state := stateFile{Alarms: make([]*Alarm, 0)}
+	for _, s := range e.shards {
+		s.mu.Lock()
+		dirty = dirty || s.dirty
+		s.dirty = false
+		for _, a := range s.alarms {
+			alarm := *a
+			state.Alarms = append(state.Alarms, &alarm)
+		}
+		s.mu.Unlock()
+	}
+	if !dirty {
+		return
+	}
+
+	content, err := json.Marshal(state)
+	if err == nil {
+		tmp := e.stateFile + ".tmp"
+		if err = os.WriteFile(tmp, content, 0600); err == nil {
+			err = os.Rename(tmp, e.stateFile)
+		}
+	}
+	// retried by the next tick if it failed
+	e.persistFailed, e.persistErr = err != nil, err
+	if err != nil {
+		logrus.Errorf("Failed to persist the alarms to %s: %v", e.stateFile, err)
+	}
+}
+
+// Returns an error if the state file cannot be written, which is checked by writing a temporary file
+// next to it unless the last write of the state file failed
+func (e *Engine) Check() error {
+	if e.stateFile == "" {
+		return nil
+	}
+	e.persistMu.Lock()
+	err := e.persistErr
+	e.persistMu.Unlock()
+	if err != nil {
+		return fmt.Errorf("last write of the alarm state file failed: %w", err)
+	}
+	f, err := os.CreateTemp(filepath.Dir(e.stateFile), filepath.Base(e.stateFile)+".check-*")
+	if err != nil {
+		return fmt.Errorf("alarm state file is not writable: %w", err)
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// Stops the engine and persists the alarms
+func (e *Engine) Close() {
+	close(e.done)
+	<-e.stopped
+	e.persist()
+}
+
+// Registers the gauge of the alarms by state, which is computed when scraped
+func (e *Engine) registerMetrics() {
+	metrics.NewGaugeFunc("sparkplug_primary_alarms", "Alarms by state and priority", []string{"state", "priority"},
+		func(emit func(v float64, labelValues ...string)) {
+			counts := make(map[[2]string]int)
+			for _, a := range e.Alarms() {
+				counts[[2]string{string(a.State), a.Priority}]++
+			}
+			keys := make([][2]string, 0, len(counts))
+			for key := range counts {
+				keys = append(keys, key)
+			}
+			sort.Slice(keys, func(i, j int) bool {
+				return keys[i][0] < keys[j][0] || (keys[i][0] == keys[j][0] && keys[i][1] < keys[j][1])
+			})
+			for _, key := range keys {
+				emit(float64(counts[key]), key[0], key[1])
+			}
+		})
+}
@@ -0,0 +1,372 @@
+package alarm
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/store"
+)
+
+func TestEnginePersistsOutsideUpdate(t *testing.T) {
+	stateFile := filepath.Join(t.TempDir(), "alarms.json")
+	high := 10.0
+	e, err := New([]Rule{{Name: "hot", Pattern: "g1/n1/temp", High: &high}}, stateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e.Update(store.MetricUpdate{GroupID: "g1", NodeID: "n1", Name: "temp", DataType: "Double", Value: 20.0, Timestamp: time.Now()})
+	if len(e.Alarms()) != 1 {
+		t.Fatalf("got %d alarms, want 1", len(e.Alarms()))
+	}
+	if _, err := os.Stat(stateFile); !os.IsNotExist(err) {
+		t.Fatalf("the state file was written by Update: %v", err)
+	}
+
+	e.Close()
+	restored, err := New(nil, stateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restored.Close()
+	if alarms := restored.Alarms(); len(alarms) != 1 || alarms[0].Rule != "hot" {
+		t.Errorf("got %v after restoring, want the alarm of rule hot", alarms)
+	}
+}
+
+func TestEngineCheckReportsUnwritableStateFile(t *testing.T) {
+	e, err := New(nil, filepath.Join(t.TempDir(), "alarms.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+	if err := e.Check(); err != nil {
+		t.Errorf("writable state file: %v", err)
+	}
+
+	high := 10.0
+	missing, err := New([]Rule{{Name: "hot", Pattern: "g1/n1/temp", High: &high}}, filepath.Join(t.TempDir(), "missing", "alarms.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer missing.Close()
+	if err := missing.Check(); err == nil {
+		t.Error("state file in a missing directory is reported writable")
+	}
+	missing.Update(store.MetricUpdate{GroupID: "g1", NodeID: "n1", Name: "temp", DataType: "Double", Value: 20.0, Timestamp: time.Now()})
+	missing.persist()
+	if err := missing.Check(); err == nil || !strings.Contains(err.Error(), "last write") {
+		t.Errorf("got %v after a failed write, want the write error", err)
+	}
+}
+
+// An engine without state file, recording the changes reported to its handler
+type testEngine struct {
+	*Engine
+	t      *testing.T
+	mu     sync.Mutex
+	events []EventType
+}
+
+func newTestEngine(t *testing.T, rules ...Rule) *testEngine {
+	t.Helper()
+	e, err := New(rules, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(e.Close)
+	te := &testEngine{Engine: e, t: t}
+	e.SetHandler(func(et EventType, a Alarm) {
+		// the handler is called without the engine locked, so it may call back into it
+		e.Alarms()
+		te.mu.Lock()
+		defer te.mu.Unlock()
+		te.events = append(te.events, et)
+	})
+	return te
+}
+
+// Evaluates a value of g1/n1/temp with the given timestamp, received at the given time
+func (e *testEngine) update(value float64, receivedAt, timestamp time.Time) {
+	e.Update(store.MetricUpdate{GroupID: "g1", NodeID: "n1", Name: "temp", DataType: "Double", Value: value, Timestamp: timestamp, ReceivedAt: receivedAt})
+}
+
+// Fails the test unless the alarm of the condition is in the given state, or absent if the state is normal
+func (e *testEngine) expect(condition Condition, state AlarmState) Alarm {
+	e.t.Helper()
+	for _, a := range e.Alarms() {
+		if a.Condition == condition {
+			if a.State != state {
+				e.t.Fatalf("%s alarm: got state %s, want %s", condition, a.State, state)
+			}
+			return a
+		}
+	}
+	if state != Normal {
+		e.t.Fatalf("%s alarm: got none, want state %s", condition, state)
+	}
+	return Alarm{}
+}
+
+// Fails the test unless the handler reported the given changes since the last call
+func (e *testEngine) expectEvents(want ...EventType) {
+	e.t.Helper()
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if fmt.Sprint(e.events) != fmt.Sprint(want) {
+		e.t.Fatalf("got events %v, want %v", e.events, want)
+	}
+	e.events = nil
+}
+
+// The start of the tests, the background ticks of the engine at the current time do not change the alarms of later values
+func testStart() time.Time {
+	return time.Now().Add(time.Hour)
+}
+
+func TestEngineDeadband(t *testing.T) {
+	high, low := 80.0, 20.0
+	e := newTestEngine(t, Rule{Name: "temp", Pattern: "g1/*/temp", High: &high, Low: &low, Deadband: 5})
+	now := testStart()
+
+	e.update(80, now, now)
+	e.expect(High, Normal)
+	e.update(85, now, now)
+	e.expect(High, Active)
+	e.expectEvents(EventRaised)
+	// within the deadband
+	e.update(76, now, now)
+	e.expect(High, Active)
+	e.update(75, now, now)
+	e.expect(High, Cleared)
+	e.expectEvents(EventCleared)
+	// raised again above the limit, not above the limit minus the deadband
+	e.update(78, now, now)
+	e.expect(High, Cleared)
+
+	e.update(19, now, now)
+	a := e.expect(Low, Active)
+	if a.Value != 19.0 || a.Limit != low {
+		t.Errorf("low alarm: value %v, limit %v", a.Value, a.Limit)
+	}
+	e.update(24, now, now)
+	e.expect(Low, Active)
+	e.update(25, now, now)
+	e.expect(Low, Cleared)
+}
+
+func TestEngineOnOffDelay(t *testing.T) {
+	high := 80.0
+	e := newTestEngine(t, Rule{Name: "temp", Pattern: "g1/n1/temp", High: &high, OnDelay: 10 * time.Second, OffDelay: 30 * time.Second})
+	start := testStart()
+
+	// a condition gone before the on delay passed raises no alarm
+	e.update(90, start, start)
+	e.tick(start.Add(5 * time.Second))
+	e.update(70, start.Add(6*time.Second), start.Add(6*time.Second))
+	e.tick(start.Add(20 * time.Second))
+	e.expect(High, Normal)
+
+	start = start.Add(time.Minute)
+	e.update(90, start, start)
+	e.tick(start.Add(9 * time.Second))
+	e.expect(High, Normal)
+	e.tick(start.Add(10 * time.Second))
+	a := e.expect(High, Active)
+	if !a.ActivatedAt.Equal(start.Add(10 * time.Second)) {
+		t.Errorf("activated at %v, want after the on delay", a.ActivatedAt)
+	}
+
+	// a later value still exceeding the limit raises no new alarm
+	e.update(95, start.Add(15*time.Second), start.Add(15*time.Second))
+	e.update(70, start.Add(20*time.Second), start.Add(20*time.Second))
+	e.tick(start.Add(49 * time.Second))
+	e.expect(High, Active)
+	e.tick(start.Add(50 * time.Second))
+	e.expect(High, Cleared)
+	e.expectEvents(EventRaised, EventCleared)
+	if a := e.expect(High, Cleared); a.Occurrences != 1 {
+		t.Errorf("got %d occurrences, want 1", a.Occurrences)
+	}
+}
+
+func TestEngineRateOfChangeUsesTimestamps(t *testing.T) {
+	rate := 5.0
+	e := newTestEngine(t, Rule{Name: "level", Pattern: "g1/n1/temp", RateOfChange: &rate})
+	now := testStart()
+
+	// buffered values sent at once, received at the same time: 1 per second by their timestamps
+	e.update(0, now, now)
+	e.update(60, now, now.Add(time.Minute))
+	e.expect(RateOfChange, Normal)
+	e.update(61, now, now.Add(61*time.Second))
+	e.expect(RateOfChange, Normal)
+
+	// 20 per second
+	e.update(81, now.Add(time.Second), now.Add(62*time.Second))
+	a := e.expect(RateOfChange, Active)
+	if a.Value != 81.0 || a.Limit != rate {
+		t.Errorf("rate of change alarm: value %v, limit %v", a.Value, a.Limit)
+	}
+	// an older value, e.g. of a reordered message, neither clears it nor becomes the reference
+	e.update(0, now.Add(2*time.Second), now.Add(30*time.Second))
+	e.expect(RateOfChange, Active)
+	e.update(82, now.Add(3*time.Second), now.Add(63*time.Second))
+	e.expect(RateOfChange, Cleared)
+}
+
+func TestEngineUnchanged(t *testing.T) {
+	e := newTestEngine(t, Rule{Name: "frozen", Pattern: "g1/n1/temp", UnchangedFor: 10 * time.Minute})
+	start := testStart()
+
+	e.update(21, start, start)
+	e.update(21, start.Add(5*time.Minute), start.Add(5*time.Minute))
+	e.tick(start.Add(9 * time.Minute))
+	e.expect(Unchanged, Normal)
+	e.tick(start.Add(10 * time.Minute))
+	a := e.expect(Unchanged, Active)
+	if a.Limit != (10 * time.Minute).Seconds() {
+		t.Errorf("limit %v, want the duration in seconds", a.Limit)
+	}
+
+	// the same value keeps it raised, a different one clears it and restarts the duration
+	e.update(21, start.Add(11*time.Minute), start.Add(11*time.Minute))
+	e.expect(Unchanged, Active)
+	e.update(22, start.Add(12*time.Minute), start.Add(12*time.Minute))
+	e.expect(Unchanged, Cleared)
+	e.tick(start.Add(21 * time.Minute))
+	e.expect(Unchanged, Cleared)
+	e.tick(start.Add(22 * time.Minute))
+	if a := e.expect(Unchanged, Active); a.Occurrences != 2 {
+		t.Errorf("got %d occurrences, want 2", a.Occurrences)
+	}
+}
+
+func TestEngineAcknowledge(t *testing.T) {
+	high := 80.0
+	e := newTestEngine(t, Rule{Name: "temp", Pattern: "g1/n1/temp", High: &high})
+	now := testStart()
+
+	if _, err := e.Acknowledge("unknown", "operator", ""); err != ErrNotFound {
+		t.Errorf("acknowledging an unknown alarm: got %v, want %v", err, ErrNotFound)
+	}
+
+	e.update(90, now, now)
+	id := e.expect(High, Active).ID
+	a, err := e.Acknowledge(id, "operator", "checking")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.State != Acknowledged || a.AcknowledgedBy != "operator" || a.Comment != "checking" || a.AcknowledgedAt == nil {
+		t.Errorf("acknowledged alarm: %+v", a)
+	}
+	// raising it again requires a new acknowledgement
+	e.update(70, now, now)
+	e.expect(High, Normal)
+	e.update(90, now, now)
+	e.expect(High, Active)
+	e.update(70, now, now)
+	e.expect(High, Cleared)
+	if a, err = e.Acknowledge(id, "operator", ""); err != nil || a.State != Normal {
+		t.Errorf("acknowledging the cleared alarm: got state %s, %v", a.State, err)
+	}
+	e.expect(High, Normal)
+	e.expectEvents(EventRaised, EventAcknowledged, EventCleared, EventRaised, EventCleared, EventAcknowledged)
+}
+
+func TestEngineShelve(t *testing.T) {
+	high := 80.0
+	e := newTestEngine(t, Rule{Name: "temp", Pattern: "g1/n1/temp", High: &high})
+	now := testStart()
+
+	e.update(90, now, now)
+	id := e.expect(High, Active).ID
+	if _, err := e.Shelve(id, "operator", "", 0); err == nil {
+		t.Error("shelved for no duration")
+	}
+	if _, err := e.Unshelve(id); err == nil {
+		t.Error("unshelved an alarm which is not shelved")
+	}
+	a, err := e.Shelve(id, "operator", "sensor replaced", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.State != Shelved || a.ShelvedBy != "operator" || a.ShelvedUntil == nil {
+		t.Errorf("shelved alarm: %+v", a)
+	}
+
+	// cleared, acknowledged and raised again while shelved, it stays shelved
+	e.update(70, now, now)
+	e.update(90, now, now)
+	if _, err := e.Acknowledge(id, "operator", ""); err != nil {
+		t.Fatal(err)
+	}
+	e.update(70, now, now)
+	e.expect(High, Shelved)
+
+	// returns to normal once the shelve expires, as it is cleared and acknowledged
+	e.tick(a.ShelvedUntil.Add(time.Second))
+	e.expect(High, Normal)
+	e.expectEvents(EventRaised, EventShelved, EventCleared, EventRaised, EventAcknowledged, EventCleared, EventUnshelved)
+
+	// unshelved early by an operator
+	e.update(90, now, now)
+	if _, err := e.Shelve(id, "operator", "", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if a, err := e.Unshelve(id); err != nil || a.State != Active || a.ShelvedUntil != nil {
+		t.Errorf("unshelved alarm: %+v, %v", a, err)
+	}
+}
+
+func TestEngineSetRulesClearsAlarmsOfRemovedRules(t *testing.T) {
+	high := 80.0
+	e := newTestEngine(t, Rule{Name: "temp", Pattern: "g1/n1/temp", High: &high}, Rule{Name: "other", Pattern: "g1/n1/temp", High: &high})
+	now := testStart()
+
+	e.update(90, now, now)
+	if alarms := e.Alarms(); len(alarms) != 2 {
+		t.Fatalf("got %d alarms, want 2", len(alarms))
+	}
+	if err := e.SetRules([]Rule{{Name: "temp", Pattern: "g1/n1/temp", High: &high, Priority: "high"}}); err != nil {
+		t.Fatal(err)
+	}
+	for _, a := range e.Alarms() {
+		if a.Rule == "other" && a.State != Cleared {
+			t.Errorf("alarm of the removed rule: got state %s, want %s", a.State, Cleared)
+		}
+	}
+	e.update(95, now, now)
+	e.expectEvents(EventRaised, EventRaised, EventCleared)
+}
+
+func TestEngineConcurrentUpdates(t *testing.T) {
+	high := 80.0
+	e := newTestEngine(t, Rule{Name: "temp", Pattern: "g1/*/temp", High: &high})
+	now := testStart()
+
+	const nodes = 16
+	var wg sync.WaitGroup
+	for n := 0; n < nodes; n++ {
+		wg.Add(1)
+		go func(nodeID string) {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				e.Update(store.MetricUpdate{GroupID: "g1", NodeID: nodeID, Name: "temp", Value: float64(70 + 20*(i%2)), Timestamp: now, ReceivedAt: now})
+				for _, a := range e.Alarms() {
+					e.Acknowledge(a.ID, "operator", "")
+				}
+			}
+		}(fmt.Sprintf("n%d", n))
+	}
+	wg.Wait()
+	// the last value of every node is above the limit
+	if alarms := e.Alarms(); len(alarms) != nodes {
+		t.Errorf("got %d alarms, want %d", len(alarms), nodes)
+	}
+}
@@ -0,0 +1,144 @@
+package alarm
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"time"
+
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/util"
+	"gopkg.in/yaml.v2"
+)
+
+// The condition of a rule raising an alarm
+type Condition string
+
+const (
+	HighHigh     Condition = "highHigh"     // The value is above the high-high limit
+	High         Condition = "high"         // The value is above the high limit
+	Low          Condition = "low"          // The value is below the low limit
+	LowLow       Condition = "lowLow"       // The value is below the low-low limit
+	State        Condition = "state"        // The boolean value equals the alarm state
+	RateOfChange Condition = "rateOfChange" // The value changes faster than the maximum rate per second
+	Unchanged    Condition = "unchanged"    // The value has not changed for the given duration
+)
+
+// A rule of the rules file, raising an alarm per condition for every metric matching its pattern
+type Rule struct {
+	Name         string        `yaml:"name"`
+	Pattern      string        `yaml:"pattern"`     // Glob pattern matched against "<group>/<node>[/<device>]/<metric>"
+	Description  string        `yaml:"description"` // Describes the alarm to the operator
+	Priority     string        `yaml:"priority"`    // E.g. low, medium, high or critical
+	HighHigh     *float64      `yaml:"highHigh"`
+	High         *float64      `yaml:"high"`
+	Low          *float64      `yaml:"low"`
+	LowLow       *float64      `yaml:"lowLow"`
+	State        *bool         `yaml:"state"`        // The value of a boolean metric which raises the alarm
+	RateOfChange *float64      `yaml:"rateOfChange"` // The maximum absolute change per second
+	UnchangedFor time.Duration `yaml:"unchangedFor"`
+	Deadband     float64       `yaml:"deadband"` // The distance from the limit or rate the value has to return by to clear the alarm
+	OnDelay      time.Duration `yaml:"onDelay"`  // The time the condition has to persist before the alarm is raised
+	OffDelay     time.Duration `yaml:"offDelay"` // The time the condition has to be gone before the alarm is cleared
+}
+
+// The alarm rules file
+type rulesFile struct {
+	Rules []Rule `yaml:"rules"`
+}
+
+// Reads and validates the rules of the given rules file
+func LoadRules(path string) ([]Rule, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file rulesFile
+	if err := yaml.UnmarshalStrict(content, &file); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if _, err := compileRules(file.Rules); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return file.Rules, nil
+}
+
+// A single condition of a rule
+type check struct {
+	rule      *Rule
+	pattern   *regexp.Regexp
+	condition Condition
+	limit     float64 // The limit or maximum rate, 1 for a state alarm on true and 0 on false
+}
+
+// Returns the conditions of the given rules
+func compileRules(rules []Rule) ([]*check, error) {
+	checks := make([]*check, 0)
+	names := make(map[string]bool)
+	for i := range rules {
+		rule := &rules[i]
+		if rule.Name == "" || rule.Pattern == "" {
+			return nil, fmt.Errorf("rules[%d]: name and pattern are required", i)
+		}
+		if names[rule.Name] {
+			return nil, fmt.Errorf("rules[%d]: duplicate name %q", i, rule.Name)
+		}
+		names[rule.Name] = true
+		if rule.Deadband < 0 || rule.OnDelay < 0 || rule.OffDelay < 0 || rule.UnchangedFor < 0 {
+			return nil, fmt.Errorf("rule %s: deadband, onDelay, offDelay and unchangedFor must not be negative", rule.Name)
+		}
+		pattern, err := util.Glob(rule.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("rule %s: %v", rule.Name, err)
+		}
+
+		add := func(condition Condition, limit float64) {
+			checks = append(checks, &check{rule: rule, pattern: pattern, condition: condition, limit: limit})
+		}
+		for _, limit := range []struct {
+			condition Condition
+			value     *float64
+		}{{HighHigh, rule.HighHigh}, {High, rule.High}, {Low, rule.Low}, {LowLow, rule.LowLow}, {RateOfChange, rule.RateOfChange}} {
+			if limit.value != nil {
+				add(limit.condition, *limit.value)
+			}
+		}
+		if rule.State != nil {
+			add(State, boolValue(*rule.State))
+		}
+		if rule.UnchangedFor > 0 {
+			add(Unchanged, rule.UnchangedFor.Seconds())
+		}
+		if rule.RateOfChange != nil && *rule.RateOfChange <= 0 {
+			return nil, fmt.Errorf("rule %s: rateOfChange must be positive", rule.Name)
+		}
+		if len(checks) == 0 || checks[len(checks)-1].rule != rule {
+			return nil, fmt.Errorf("rule %s: at least one of highHigh, high, low, lowLow, state, rateOfChange or unchangedFor is required", rule.Name)
+		}
+	}
+	return checks, nil
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// Returns true if the condition is met by the given value, or by the given rate of change per second.
+// While the condition is met, the value has to return by the deadband to clear it.
+func (c *check) met(value float64, met bool) bool {
+	deadband := c.rule.Deadband
+	if !met {
+		deadband = 0
+	}
+	switch c.condition {
+	case HighHigh, High, RateOfChange:
+		return value > c.limit-deadband
+	case Low, LowLow:
+		return value < c.limit+deadband
+	case State:
+		return value == c.limit
+	}
+	return false
+}
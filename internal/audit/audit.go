@@ -0,0 +1,259 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// The audited action
+type Action string
+
+const (
+	Command Action = "command" // An NCMD or DCMD writing metrics
+	Rebirth Action = "rebirth" // A rebirth request of an edge node
+	Reload  Action = "reload"  // A configuration reload
+
+	AcknowledgeAlarm Action = "acknowledge" // An acknowledgement of an alarm
+	ShelveAlarm      Action = "shelve"      // A shelve of an alarm
+	UnshelveAlarm    Action = "unshelve"    // An unshelve of an alarm
+)
+
+// The origin of an audited action
+type Source string
+
+const (
+	API     Source = "api"     // Requested via the REST API
+	MQTT    Source = "mqtt"    // Seen on the broker, published by another host
+	Signal  Source = "signal"  // Requested by a signal (SIGHUP)
+	Primary Source = "primary" // Issued automatically by this primary host
+	OPCUA   Source = "opcua"   // Requested by an OPC UA client
+	GRPC    Source = "grpc"    // Requested by a gRPC client
+)
+
+// A single entry of the audit log
+type Entry struct {
+	Time      time.Time `json:"time"`
+	Action    Action    `json:"action"`
+	Source    Source    `json:"source"`
+	Principal string    `json:"principal,omitempty"` // The authenticated API client
+	SourceIP  string    `json:"sourceIp,omitempty"`  // The IP address of the API client
+	GroupID   string    `json:"groupId,omitempty"`
+	NodeID    string    `json:"nodeId,omitempty"`
+	DeviceID  string    `json:"deviceId,omitempty"`
+	Metrics   []Metric  `json:"metrics,omitempty"`  // The metrics written by a command
+	Settings  []string  `json:"settings,omitempty"` // The settings applied by a reload
+	Details   string    `json:"details,omitempty"`
+	Success   bool      `json:"success"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// A metric written by a command
+type Metric struct {
+	Name     string `json:"name"`
+	DataType string `json:"dataType,omitempty"`
+	OldValue any    `json:"oldValue"` // The last value known to the primary when the command was issued
+	NewValue any    `json:"newValue"`
+}
+
+// Restricts the entries returned by a query, zero values match every entry
+type Filter struct {
+	Action    Action
+	Source    Source
+	Principal string
+	GroupID   string
+	NodeID    string
+	Since     time.Time
+	Until     time.Time
+	Limit     int              // Returns only the last Limit matching entries if positive
+	Allow     func(Entry) bool // Additionally restricts the entries if not nil
+}
+
+func (f Filter) matches(e Entry) bool {
+	return (f.Action == "" || e.Action == f.Action) &&
+		(f.Source == "" || e.Source == f.Source) &&
+		(f.Principal == "" || e.Principal == f.Principal) &&
+		(f.GroupID == "" || e.GroupID == f.GroupID) &&
+		(f.NodeID == "" || e.NodeID == f.NodeID) &&
+		(f.Since.IsZero() || !e.Time.Before(f.Since)) &&
+		(f.Until.IsZero() || e.Time.Before(f.Until)) &&
+		(f.Allow == nil || f.Allow(e))
+}
+
+// The append-only audit log. Entries are appended to a JSON lines file if configured,
+// the most recent entries are also kept in memory.
+type Log struct {
+	mu      sync.Mutex
+	path    string
+	file    *os.File
+	entries []Entry // ring buffer of the most recent entries
+	next    int
+	size    int
+	err     error // the error of the last write to the file
+}
+
+// Opens the audit log appending to the given file, or keeping the given amount of entries in memory only if the path is empty
+func Open(path string, size int) (*Log, error) {
+	l := &Log{path: path, entries: make([]Entry, 0), size: size}
+	if path != "" {
+		file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return nil, err
+		}
+		l.file = file
+	}
+	return l, nil
+}
+
+// Appends an entry to the audit log
+func (l *Log) Record(e Entry) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.size > 0 {
+		if len(l.entries) < l.size {
+			l.entries = append(l.entries, e)
+		} else {
+			l.entries[l.next] = e
+		}
+		l.next = (l.next + 1) % l.size
+	}
+
+	if l.file == nil {
+		return
+	}
+	line, err := json.Marshal(e)
+	if err == nil {
+		_, err = l.file.Write(append(line, '\n'))
+	}
+	if err == nil {
+		err = l.file.Sync()
+	}
+	if err != nil {
+		logrus.Errorf("Failed to write %s entry to audit log %s: %v", e.Action, l.path, err)
+	}
+	l.err = err
+}
+
+// Returns an error if the audit log file is not writable: it was closed or removed, or the last write failed
+func (l *Log) Check() error {
+	if l.path == "" {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return fmt.Errorf("audit log %s is closed", l.path)
+	}
+	if _, err := os.Stat(l.path); err != nil {
+		return err
+	}
+	if l.err != nil {
+		return fmt.Errorf("last write to audit log %s failed: %w", l.path, l.err)
+	}
+	return nil
+}
+
+// Returns the matching entries, oldest first. Queries the whole file if the log is persisted.
+func (l *Log) Query(f Filter) ([]Entry, error) {
+	result := make([]Entry, 0)
+	err := l.each(f, func(e Entry, _ []byte) error {
+		result = append(result, e)
+		if f.Limit > 0 && len(result) > 2*f.Limit {
+			// drop the older entries from time to time, so long files are queried in bounded memory
+			result = append(result[:0], result[len(result)-f.Limit:]...)
+		}
+		return nil
+	})
+	if f.Limit > 0 && len(result) > f.Limit {
+		result = result[len(result)-f.Limit:]
+	}
+	return result, err
+}
+
+// Writes the matching entries as JSON lines, oldest first
+func (l *Log) Export(w io.Writer, f Filter) error {
+	return l.each(f, func(e Entry, line []byte) error {
+		var err error
+		if line == nil {
+			line, err = json.Marshal(e)
+			if err != nil {
+				return err
+			}
+		}
+		if _, err = w.Write(line); err != nil {
+			return err
+		}
+		_, err = w.Write([]byte{'\n'})
+		return err
+	})
+}
+
+// Calls fn for every matching entry, oldest first, with the JSON line of the entry if read from the file
+func (l *Log) each(f Filter, fn func(e Entry, line []byte) error) error {
+	if l.path == "" {
+		l.mu.Lock()
+		entries := make([]Entry, 0, len(l.entries))
+		if len(l.entries) == l.size {
+			entries = append(entries, l.entries[l.next:]...)
+			entries = append(entries, l.entries[:l.next]...)
+		} else {
+			entries = append(entries, l.entries...)
+		}
+		l.mu.Unlock()
+
+		for _, e := range entries {
+			if f.matches(e) {
+				if err := fn(e, nil); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+
+	file, err := os.Open(l.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var e Entry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			// a line may be incomplete if the application was killed while writing it
+			logrus.Warnf("Skipping invalid line of audit log %s: %v", l.path, err)
+			continue
+		}
+		if f.matches(e) {
+			if err := fn(e, scanner.Bytes()); err != nil {
+				return err
+			}
+		}
+	}
+	return scanner.Err()
+}
+
+// Closes the file of the audit log
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
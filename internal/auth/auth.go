@@ -0,0 +1,130 @@
+package auth
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// The header carrying static API keys
+const APIKeyHeader = "X-API-Key"
+
+// Returned if a request carries no or invalid credentials
+var ErrUnauthenticated = errors.New("authentication required")
+
+// The settings of the API authentication
+type Config struct {
+	CredentialsFile string // YAML file with the API keys and users
+	JWKSFile        string // JWKS file with the keys verifying JWT bearer tokens
+	JWTIssuer       string // The required issuer (iss) of tokens, any if empty
+	JWTAudience     string // The required audience (aud) of tokens, any if empty
+	JWTRolesClaim   string // The claim holding the grants of a token
+}
+
+// Authenticates API requests by static API key, HTTP basic authentication or JWT bearer token
+type Authenticator struct {
+	cfg     Config
+	apiKeys []apiKey
+	users   map[string]user
+	jwks    []verificationKey
+}
+
+// Creates a new authenticator reading the configured credentials and JWKS files
+func New(cfg Config) (*Authenticator, error) {
+	if cfg.CredentialsFile == "" && cfg.JWKSFile == "" {
+		return nil, errors.New("a credentials file or a JWKS file is required")
+	}
+	a := &Authenticator{cfg: cfg, users: make(map[string]user)}
+	if cfg.CredentialsFile != "" {
+		apiKeys, users, err := readCredentials(cfg.CredentialsFile)
+		if err != nil {
+			return nil, fmt.Errorf("credentials file: %v", err)
+		}
+		a.apiKeys = apiKeys
+		a.users = users
+	}
+	if cfg.JWKSFile != "" {
+		jwks, err := readJWKS(cfg.JWKSFile)
+		if err != nil {
+			return nil, fmt.Errorf("JWKS file: %v", err)
+		}
+		a.jwks = jwks
+	}
+	return a, nil
+}
+
+// Returns whether HTTP basic authentication is offered
+func (a *Authenticator) Basic() bool {
+	return len(a.users) > 0
+}
+
+// Returns the principal of the given request, or ErrUnauthenticated if it carries no valid credentials
+func (a *Authenticator) Authenticate(r *http.Request) (*Principal, error) {
+	if key := r.Header.Get(APIKeyHeader); key != "" {
+		return a.apiKey(key)
+	}
+	if username, password, ok := r.BasicAuth(); ok {
+		return a.basic(username, password)
+	}
+	if scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " "); ok && strings.EqualFold(scheme, "Bearer") {
+		return a.bearer(strings.TrimSpace(token))
+	}
+	return nil, ErrUnauthenticated
+}
+
+// Returns the principal of the user with the given password, or ErrUnauthenticated if they do not match
+func (a *Authenticator) Password(username, password string) (*Principal, error) {
+	return a.basic(username, password)
+}
+
+func (a *Authenticator) apiKey(key string) (*Principal, error) {
+	// all keys are compared in constant time, so the timing does not reveal which key matched
+	var match *apiKey
+	for i := range a.apiKeys {
+		if subtle.ConstantTimeCompare([]byte(a.apiKeys[i].key), []byte(key)) == 1 {
+			match = &a.apiKeys[i]
+		}
+	}
+	if match == nil {
+		return nil, ErrUnauthenticated
+	}
+	return &Principal{Name: match.name, Method: "apiKey", Grants: match.grants}, nil
+}
+
+func (a *Authenticator) basic(username, password string) (*Principal, error) {
+	u, ok := a.users[username]
+	if !ok || bcrypt.CompareHashAndPassword(u.passwordHash, []byte(password)) != nil {
+		return nil, ErrUnauthenticated
+	}
+	return &Principal{Name: u.name, Method: "basic", Grants: u.grants}, nil
+}
+
+func (a *Authenticator) bearer(token string) (*Principal, error) {
+	if len(a.jwks) == 0 {
+		return nil, ErrUnauthenticated
+	}
+	claims, err := verifyJWT(token, a.jwks, a.cfg.JWTIssuer, a.cfg.JWTAudience, time.Now())
+	if err != nil {
+		logrus.Debugf("Rejected bearer token: %v", err)
+		return nil, ErrUnauthenticated
+	}
+
+	name, _ := claims["sub"].(string)
+	if preferred, ok := claims["preferred_username"].(string); ok && preferred != "" {
+		name = preferred
+	}
+	// tokens of an identity provider usually carry further roles unrelated to this application
+	grants := make([]Grant, 0)
+	for _, role := range claimRoles(claims, a.cfg.JWTRolesClaim) {
+		if grant, err := ParseGrant(role); err == nil {
+			grants = append(grants, grant)
+		}
+	}
+	return &Principal{Name: name, Method: "jwt", Grants: grants}, nil
+}
@@ -0,0 +1,89 @@
+package auth
+
+import (
+	"fmt"
+	"os"
+
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/yaml.v2"
+)
+
+// The credentials file listing the static API keys and the users for HTTP basic authentication
+type credentialsFile struct {
+	APIKeys []struct {
+		Name  string   `yaml:"name"`
+		Key   string   `yaml:"key"`
+		Roles []string `yaml:"roles"`
+	} `yaml:"apiKeys"`
+	Users []struct {
+		Name         string   `yaml:"name"`
+		PasswordHash string   `yaml:"passwordHash"` // bcrypt hash of the password
+		Roles        []string `yaml:"roles"`
+	} `yaml:"users"`
+}
+
+type apiKey struct {
+	name   string
+	key    string
+	grants []Grant
+}
+
+type user struct {
+	name         string
+	passwordHash []byte
+	grants       []Grant
+}
+
+// Reads the API keys and users from the given credentials file. Unknown settings are rejected.
+func readCredentials(path string) ([]apiKey, map[string]user, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	var file credentialsFile
+	if err := yaml.UnmarshalStrict(content, &file); err != nil {
+		return nil, nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	keys := make([]apiKey, 0, len(file.APIKeys))
+	seenKeys := make(map[string]bool)
+	for i, k := range file.APIKeys {
+		if k.Name == "" || k.Key == "" {
+			return nil, nil, fmt.Errorf("%s: apiKeys[%d]: name and key are required", path, i)
+		}
+		if seenKeys[k.Key] {
+			return nil, nil, fmt.Errorf("%s: API key %s: key is not unique", path, k.Name)
+		}
+		seenKeys[k.Key] = true
+		grants, err := ParseGrants(k.Roles)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: API key %s: %v", path, k.Name, err)
+		}
+		keys = append(keys, apiKey{name: k.Name, key: k.Key, grants: grants})
+	}
+
+	users := make(map[string]user, len(file.Users))
+	for i, u := range file.Users {
+		if u.Name == "" || u.PasswordHash == "" {
+			return nil, nil, fmt.Errorf("%s: users[%d]: name and passwordHash are required", path, i)
+		}
+		if _, ok := users[u.Name]; ok {
+			return nil, nil, fmt.Errorf("%s: user %s: name is not unique", path, u.Name)
+		}
+		if _, err := bcrypt.Cost([]byte(u.PasswordHash)); err != nil {
+			return nil, nil, fmt.Errorf("%s: user %s: passwordHash must be a bcrypt hash: %v", path, u.Name, err)
+		}
+		grants, err := ParseGrants(u.Roles)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: user %s: %v", path, u.Name, err)
+		}
+		users[u.Name] = user{name: u.Name, passwordHash: []byte(u.PasswordHash), grants: grants}
+	}
+	return keys, users, nil
+}
+
+// Returns the bcrypt hash of the given password for the credentials file
+func HashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	return string(hash), err
+}
@@ -0,0 +1,204 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Signs JWTs with the keys of a JWKS file written for the test
+type signer struct {
+	rsaKey *rsa.PrivateKey
+	ecKey  *ecdsa.PrivateKey
+	keys   []verificationKey
+}
+
+func newSigner(t *testing.T) *signer {
+	t.Helper()
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encode := func(i *big.Int) string { return base64.RawURLEncoding.EncodeToString(i.Bytes()) }
+	e := encode(big.NewInt(int64(rsaKey.E)))
+	set := map[string][]jwk{"keys": {
+		{Kty: "RSA", Kid: "rsa", N: encode(rsaKey.N), E: e},
+		// the same key, restricted to RS256
+		{Kty: "RSA", Kid: "rsa-rs256", Alg: "RS256", Use: "sig", N: encode(rsaKey.N), E: e},
+		{Kty: "EC", Kid: "ec", Crv: "P-256", X: encode(ecKey.X), Y: encode(ecKey.Y)},
+		// encryption keys are skipped
+		{Kty: "RSA", Kid: "enc", Use: "enc", N: encode(rsaKey.N), E: e},
+	}}
+	content, err := json.Marshal(set)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(path, content, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := readJWKS(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 3 {
+		t.Fatalf("read %d keys, want 3", len(keys))
+	}
+	return &signer{rsaKey: rsaKey, ecKey: ecKey, keys: keys}
+}
+
+// Returns a JWT with the given header and claims, signed according to the algorithm
+func (s *signer) token(t *testing.T, alg, kid string, claims map[string]any) string {
+	t.Helper()
+	segment := func(v any) string {
+		b, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+	header := map[string]any{"alg": alg, "typ": "JWT"}
+	if kid != "" {
+		header["kid"] = kid
+	}
+	input := segment(header) + "." + segment(claims)
+
+	var signature []byte
+	var err error
+	switch alg {
+	case "none":
+	case "HS256":
+		// the public key as HMAC secret, the classic algorithm confusion
+		mac := hmac.New(crypto.SHA256.New, s.rsaKey.N.Bytes())
+		mac.Write([]byte(input))
+		signature = mac.Sum(nil)
+	default:
+		h := algorithmHashes[alg].New()
+		h.Write([]byte(input))
+		digest := h.Sum(nil)
+		switch alg[:2] {
+		case "RS":
+			signature, err = rsa.SignPKCS1v15(rand.Reader, s.rsaKey, algorithmHashes[alg], digest)
+		case "PS":
+			signature, err = rsa.SignPSS(rand.Reader, s.rsaKey, algorithmHashes[alg], digest, nil)
+		case "ES":
+			var r, sig *big.Int
+			if r, sig, err = ecdsa.Sign(rand.Reader, s.ecKey, digest); err == nil {
+				signature = make([]byte, 64)
+				r.FillBytes(signature[:32])
+				sig.FillBytes(signature[32:])
+			}
+		}
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return input + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestVerifyJWT(t *testing.T) {
+	s := newSigner(t)
+	now := time.Unix(1700000000, 0)
+	const issuer, audience = "https://idp.example.com", "sparkplug-primary"
+	// returns valid claims, changed by the given function
+	claims := func(change func(map[string]any)) map[string]any {
+		c := map[string]any{"sub": "operator", "iss": issuer, "aud": audience, "exp": now.Add(time.Hour).Unix()}
+		if change != nil {
+			change(c)
+		}
+		return c
+	}
+
+	tests := []struct {
+		name   string
+		alg    string
+		kid    string
+		claims map[string]any
+		valid  bool
+	}{
+		{name: "RS256", alg: "RS256", kid: "rsa", claims: claims(nil), valid: true},
+		{name: "RS384 without kid", alg: "RS384", claims: claims(nil), valid: true},
+		{name: "PS256", alg: "PS256", kid: "rsa", claims: claims(nil), valid: true},
+		{name: "PS512", alg: "PS512", kid: "rsa", claims: claims(nil), valid: true},
+		{name: "ES256", alg: "ES256", kid: "ec", claims: claims(nil), valid: true},
+		{name: "RS256 of a key restricted to RS256", alg: "RS256", kid: "rsa-rs256", claims: claims(nil), valid: true},
+		{name: "PS256 of a key restricted to RS256", alg: "PS256", kid: "rsa-rs256", claims: claims(nil)},
+		{name: "unknown kid", alg: "RS256", kid: "other", claims: claims(nil)},
+		{name: "kid of an encryption key", alg: "RS256", kid: "enc", claims: claims(nil)},
+		{name: "RS256 with the kid of the EC key", alg: "RS256", kid: "ec", claims: claims(nil)},
+		{name: "ES256 with the kid of the RSA key", alg: "ES256", kid: "rsa", claims: claims(nil)},
+		{name: "none", alg: "none", claims: claims(nil)},
+		{name: "none with kid", alg: "none", kid: "rsa", claims: claims(nil)},
+		{name: "HS256 with the public key as secret", alg: "HS256", kid: "rsa", claims: claims(nil)},
+		{name: "expired", alg: "RS256", claims: claims(func(c map[string]any) { c["exp"] = now.Add(-2 * clockSkew).Unix() })},
+		{name: "expired within the clock skew", alg: "RS256", claims: claims(func(c map[string]any) { c["exp"] = now.Add(-clockSkew / 2).Unix() }), valid: true},
+		{name: "missing exp", alg: "RS256", claims: claims(func(c map[string]any) { delete(c, "exp") })},
+		{name: "exp as string", alg: "RS256", claims: claims(func(c map[string]any) { c["exp"] = "4102444800" })},
+		{name: "nbf in the future", alg: "RS256", claims: claims(func(c map[string]any) { c["nbf"] = now.Add(2 * clockSkew).Unix() })},
+		{name: "nbf within the clock skew", alg: "RS256", claims: claims(func(c map[string]any) { c["nbf"] = now.Add(clockSkew / 2).Unix() }), valid: true},
+		{name: "nbf in the past", alg: "RS256", claims: claims(func(c map[string]any) { c["nbf"] = now.Add(-time.Hour).Unix() }), valid: true},
+		{name: "aud as array", alg: "RS256", claims: claims(func(c map[string]any) { c["aud"] = []string{"other", audience} }), valid: true},
+		{name: "aud as array without the audience", alg: "RS256", claims: claims(func(c map[string]any) { c["aud"] = []string{"other"} })},
+		{name: "wrong aud", alg: "RS256", claims: claims(func(c map[string]any) { c["aud"] = "other" })},
+		{name: "missing aud", alg: "RS256", claims: claims(func(c map[string]any) { delete(c, "aud") })},
+		{name: "wrong iss", alg: "RS256", claims: claims(func(c map[string]any) { c["iss"] = "https://evil.example.com" })},
+		{name: "missing iss", alg: "RS256", claims: claims(func(c map[string]any) { delete(c, "iss") })},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			token := s.token(t, test.alg, test.kid, test.claims)
+			got, err := verifyJWT(token, s.keys, issuer, audience, now)
+			if test.valid {
+				if err != nil {
+					t.Fatalf("rejected: %v", err)
+				}
+				if got["sub"] != "operator" {
+					t.Errorf("claims: %v", got)
+				}
+			} else if err == nil {
+				t.Fatal("accepted")
+			}
+		})
+	}
+}
+
+func TestVerifyJWTRejectsTamperedTokens(t *testing.T) {
+	s := newSigner(t)
+	now := time.Unix(1700000000, 0)
+	valid := s.token(t, "ES256", "ec", map[string]any{"sub": "operator", "exp": now.Add(time.Hour).Unix()})
+	// the claims of another token with the signature of the valid one
+	forged := s.token(t, "ES256", "ec", map[string]any{"sub": "admin", "exp": now.Add(time.Hour).Unix()})
+	forgedParts, validParts := strings.Split(forged, "."), strings.Split(valid, ".")
+
+	for name, token := range map[string]string{
+		"swapped claims":  validParts[0] + "." + forgedParts[1] + "." + validParts[2],
+		"two segments":    validParts[0] + "." + validParts[1],
+		"empty signature": validParts[0] + "." + validParts[1] + ".",
+		"not base64":      validParts[0] + "." + validParts[1] + ".!!!",
+		"empty":           "",
+	} {
+		if _, err := verifyJWT(token, s.keys, "", "", now); err == nil {
+			t.Errorf("%s: accepted", name)
+		}
+	}
+	// without issuer and audience configured, only signature and validity period are checked
+	if _, err := verifyJWT(valid, s.keys, "", "", now); err != nil {
+		t.Errorf("valid token rejected: %v", err)
+	}
+}
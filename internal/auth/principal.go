@@ -0,0 +1,41 @@
+package auth
+
+// An authenticated API client
+type Principal struct {
+	Name   string  // The name of the API key or user, or the subject of the token
+	Method string  // The authentication method (apiKey, basic, jwt)
+	Grants []Grant // The roles granted to the principal
+}
+
+// The principal of requests when authentication is disabled, allowed to do everything
+var Unrestricted = &Principal{Name: "anonymous", Grants: []Grant{{Role: Admin}}}
+
+// Returns whether the principal has the given role for the given edge node.
+// An empty node ID requests the role for the whole group, an empty group ID for all groups.
+func (p *Principal) Allows(role Role, groupID, nodeID string) bool {
+	for _, grant := range p.Grants {
+		if grant.covers(role, groupID, nodeID) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns whether the principal has the given role for at least one group or edge node
+func (p *Principal) AllowsAny(role Role) bool {
+	for _, grant := range p.Grants {
+		if grant.Role >= role {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the grants of the principal in their string representation
+func (p *Principal) Roles() []string {
+	roles := make([]string, 0, len(p.Grants))
+	for _, grant := range p.Grants {
+		roles = append(roles, grant.String())
+	}
+	return roles
+}
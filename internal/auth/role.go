@@ -0,0 +1,102 @@
+package auth
+
+import (
+	"fmt"
+	"strings"
+)
+
+// The role of a principal. Every role includes the permissions of the lower roles.
+type Role int
+
+const (
+	Viewer   Role = iota + 1 // May read the state of groups, nodes and devices
+	Operator                 // May additionally send commands to edge nodes and devices
+	Admin                    // May additionally use the admin API
+)
+
+var roleNames = map[Role]string{
+	Viewer:   "viewer",
+	Operator: "operator",
+	Admin:    "admin",
+}
+
+func (r Role) String() string {
+	if name, ok := roleNames[r]; ok {
+		return name
+	}
+	return fmt.Sprintf("Role(%d)", int(r))
+}
+
+// Returns the role of the given name
+func ParseRole(name string) (Role, error) {
+	for role, roleName := range roleNames {
+		if roleName == name {
+			return role, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown role %q, must be viewer, operator or admin", name)
+}
+
+// A role granted to a principal, optionally scoped to a group or a single edge node
+type Grant struct {
+	Role    Role
+	GroupID string // The group the grant is scoped to, all groups if empty
+	NodeID  string // The node the grant is scoped to, all nodes of the group if empty
+}
+
+// Parses a grant of the form "<role>", "<role>:<group>" or "<role>:<group>/<node>"
+func ParseGrant(grant string) (Grant, error) {
+	roleName, scope, scoped := strings.Cut(grant, ":")
+	role, err := ParseRole(roleName)
+	if err != nil {
+		return Grant{}, err
+	}
+	if !scoped {
+		return Grant{Role: role}, nil
+	}
+
+	groupID, nodeID, _ := strings.Cut(scope, "/")
+	if groupID == "" || strings.Contains(nodeID, "/") || strings.ContainsAny(scope, "+#") {
+		return Grant{}, fmt.Errorf("invalid scope %q of grant %q, must be <group> or <group>/<node>", scope, grant)
+	}
+	return Grant{Role: role, GroupID: groupID, NodeID: nodeID}, nil
+}
+
+// Parses all given grants
+func ParseGrants(grants []string) ([]Grant, error) {
+	result := make([]Grant, 0, len(grants))
+	for _, grant := range grants {
+		g, err := ParseGrant(grant)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, g)
+	}
+	return result, nil
+}
+
+func (g Grant) String() string {
+	switch {
+	case g.GroupID == "":
+		return g.Role.String()
+	case g.NodeID == "":
+		return g.Role.String() + ":" + g.GroupID
+	default:
+		return g.Role.String() + ":" + g.GroupID + "/" + g.NodeID
+	}
+}
+
+// Returns whether the grant covers the given role within the given scope.
+// An empty node ID requests the whole group, an empty group ID all groups.
+func (g Grant) covers(role Role, groupID, nodeID string) bool {
+	if g.Role < role {
+		return false
+	}
+	if g.GroupID == "" {
+		return true
+	}
+	if g.GroupID != groupID {
+		return false
+	}
+	return g.NodeID == "" || g.NodeID == nodeID
+}
@@ -0,0 +1,204 @@
+package cluster
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A primary instance taking part in the cluster
+type Member struct {
+	ID       string    `json:"id"`             // The instance ID
+	APIURL   string    `json:"apiUrl"`         // The base URL of the instance's HTTP API
+	LastSeen time.Time `json:"lastSeen"`       // The time the last heartbeat of the instance was received
+	Left     bool      `json:"left,omitempty"` // Set in the heartbeat announcing that the instance leaves the cluster
+}
+
+// Coordinates multiple primary instances consuming a shared subscription,
+// so that every edge node is owned by exactly one instance.
+// Membership is tracked by heartbeats published on the MQTT broker and
+// nodes are assigned to members by rendezvous hashing of group and node ID.
+type Cluster struct {
+	ShareGroup        string        // The MQTT shared subscription group
+	TopicPrefix       string        // The topic prefix used for heartbeats and forwarded messages
+	HeartbeatInterval time.Duration // The interval in which heartbeats are published
+	ReorderTimeout    time.Duration // How long messages of a node received out of order wait for the missing ones
+
+	self    Member
+	mu      sync.RWMutex
+	members map[string]*Member
+}
+
+// Creates a new cluster with the given instance as its only member
+func New(instanceID, apiURL, shareGroup, topicPrefix string, heartbeatInterval time.Duration) *Cluster {
+	if heartbeatInterval <= 0 {
+		heartbeatInterval = 5 * time.Second
+	}
+	return &Cluster{
+		ShareGroup:        shareGroup,
+		TopicPrefix:       strings.TrimSuffix(topicPrefix, "/"),
+		HeartbeatInterval: heartbeatInterval,
+		ReorderTimeout:    time.Second,
+		self:              Member{ID: instanceID, APIURL: strings.TrimSuffix(apiURL, "/")},
+		members:           make(map[string]*Member),
+	}
+}
+
+// Returns the ID of this instance
+func (c *Cluster) ID() string {
+	return c.self.ID
+}
+
+// Returns the given MQTT topic filter as shared subscription
+func (c *Cluster) SharedTopic(filter string) string {
+	return fmt.Sprintf("$share/%s/%s", c.ShareGroup, filter)
+}
+
+// Returns the topic the heartbeats of this instance are published on
+func (c *Cluster) HeartbeatTopic() string {
+	return c.TopicPrefix + "/members/" + c.self.ID
+}
+
+// Returns the topic filter to subscribe to for the heartbeats of all members
+func (c *Cluster) HeartbeatFilter() string {
+	return c.TopicPrefix + "/members/+"
+}
+
+// Returns the topic a message of the given topic is forwarded to for the given member
+func (c *Cluster) ForwardTopic(memberID, topic string) string {
+	return c.TopicPrefix + "/forward/" + memberID + "/" + topic
+}
+
+// Returns the topic filter to subscribe to for messages forwarded to this instance
+func (c *Cluster) ForwardFilter() string {
+	return c.TopicPrefix + "/forward/" + c.self.ID + "/#"
+}
+
+// Returns the original topic of a forwarded message, or false if the topic is not a forward topic of this instance
+func (c *Cluster) ForwardedTopic(topic string) (string, bool) {
+	prefix := c.TopicPrefix + "/forward/" + c.self.ID + "/"
+	if !strings.HasPrefix(topic, prefix) {
+		return "", false
+	}
+	return strings.TrimPrefix(topic, prefix), true
+}
+
+// Returns the heartbeat payload of this instance
+func (c *Cluster) Heartbeat() []byte {
+	payload, _ := json.Marshal(c.self)
+	return payload
+}
+
+// Returns the heartbeat announcing that this instance leaves the cluster, published by the instance itself or by its will.
+// It is not empty, as some brokers reject wills without payload.
+func (c *Cluster) Farewell() []byte {
+	self := c.self
+	self.Left = true
+	payload, _ := json.Marshal(self)
+	return payload
+}
+
+// Registers the heartbeat of a member published on the given topic.
+// The farewell of a member, or an empty payload as published by older versions, removes it from the cluster.
+func (c *Cluster) HandleHeartbeat(topic string, payload []byte) error {
+	if len(payload) == 0 {
+		memberID := strings.TrimPrefix(topic, c.TopicPrefix+"/members/")
+		if memberID == topic || memberID == c.self.ID {
+			return nil
+		}
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		delete(c.members, memberID)
+		return nil
+	}
+
+	var member Member
+	if err := json.Unmarshal(payload, &member); err != nil {
+		return err
+	}
+	if member.ID == "" {
+		return fmt.Errorf("heartbeat without instance ID")
+	}
+	if member.ID == c.self.ID {
+		return nil
+	}
+	if member.Left {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		delete(c.members, member.ID)
+		return nil
+	}
+
+	member.LastSeen = time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.members[member.ID] = &member
+	return nil
+}
+
+// Returns all live members including this instance, sorted by ID.
+// Members whose last heartbeat is older than three heartbeat intervals are considered dead.
+func (c *Cluster) Members() []Member {
+	self := c.self
+	self.LastSeen = time.Now()
+	members := []Member{self}
+
+	deadline := time.Now().Add(-3 * c.HeartbeatInterval)
+	c.mu.RLock()
+	for _, member := range c.members {
+		if member.LastSeen.After(deadline) {
+			members = append(members, *member)
+		}
+	}
+	c.mu.RUnlock()
+
+	sort.Slice(members, func(i, j int) bool {
+		return members[i].ID < members[j].ID
+	})
+	return members
+}
+
+// Returns the live member with the lowest ID, which holds the STATE of the primary host
+func (c *Cluster) Leader() Member {
+	return c.Members()[0]
+}
+
+// Returns the member owning the given edge node
+func (c *Cluster) Owner(groupID, nodeID string) Member {
+	return OwnerOf(c.Members(), groupID, nodeID)
+}
+
+// Returns the member of the given ones owning the given edge node
+func OwnerOf(members []Member, groupID, nodeID string) Member {
+	var owner Member
+	var ownerScore uint64
+	for _, member := range members {
+		if score := score(member.ID, groupID, nodeID); owner.ID == "" || score > ownerScore {
+			owner, ownerScore = member, score
+		}
+	}
+	return owner
+}
+
+// Returns true iff this instance owns the given edge node
+func (c *Cluster) IsOwner(groupID, nodeID string) bool {
+	return c.Owner(groupID, nodeID).ID == c.self.ID
+}
+
+// Returns the rendezvous hashing score of a member for an edge node
+func score(memberID, groupID, nodeID string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(memberID + "/" + groupID + "/" + nodeID))
+	// fnv alone correlates strongly for IDs with a common suffix, so the hash is finalized as in murmur3
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
@@ -0,0 +1,230 @@
+package config
+
+import (
+	"runtime"
+	"time"
+)
+
+// The configuration of the primary application.
+// Every setting can be given in the YAML configuration file (yaml tag), as environment variable (env tag)
+// and as command-line flag named by its YAML path (e.g. -mqtt.clientId).
+// Settings marked as secret or named like credentials (e.g. password) and the passwords of URLs are masked when printing the configuration,
+// settings marked with reload:"live" are applied on a configuration reload without restarting.
+type Config struct {
+	Log             LogConfig        `yaml:"log"`
+	MQTT            MQTTConfig       `yaml:"mqtt"`
+	Sparkplug       SparkplugConfig  `yaml:"sparkplug"`
+	Cluster         ClusterConfig    `yaml:"cluster"`
+	Redundancy      RedundancyConfig `yaml:"redundancy"`
+	Store           StoreConfig      `yaml:"store"`
+	HTTP            HTTPConfig       `yaml:"http"`
+	Auth            AuthConfig       `yaml:"auth"`
+	Audit           AuditConfig      `yaml:"audit"`
+	Exporter        ExporterConfig   `yaml:"exporter"`
+	Watchdog        WatchdogConfig   `yaml:"watchdog"`
+	Alarms          AlarmsConfig     `yaml:"alarms"`
+	Webhooks        WebhooksConfig   `yaml:"webhooks"`
+	UNS             UNSConfig        `yaml:"uns"`
+	Sinks           SinksConfig      `yaml:"sinks"`
+	OPCUA           OPCUAConfig      `yaml:"opcua"`
+	GraphQL         GraphQLConfig    `yaml:"graphql"`
+	GRPC            GRPCConfig       `yaml:"grpc"`
+	ShutdownTimeout time.Duration    `yaml:"shutdownTimeout" env:"SHUTDOWN_TIMEOUT" usage:"Timeout of each graceful shutdown step"`
+}
+
+type LogConfig struct {
+	Format string `yaml:"format" env:"LOG_FORMAT" usage:"Log format (text, json)" reload:"live"`
+	File   string `yaml:"file" env:"LOG_FILE" usage:"Log file for the application (empty for stdout)" reload:"live"`
+	Level  string `yaml:"level" env:"LOG_LEVEL" usage:"Log level (panic, fatal, error, warn, info, debug, trace)" reload:"live"`
+}
+
+type MQTTConfig struct {
+	Endpoints []string `yaml:"endpoints" env:"MQTT_ENDPOINT" usage:"Endpoints of the MQTT brokers, tried in order"`
+	ClientID  string   `yaml:"clientId" env:"MQTT_CLIENT_ID" usage:"Client ID for the MQTT connection"`
+	Username  string   `yaml:"username" env:"MQTT_USERNAME" usage:"Username for the MQTT connection"`
+	Password  string   `yaml:"password" env:"MQTT_PASSWORD" usage:"Password for the MQTT connection" secret:"true"`
+}
+
+type SparkplugConfig struct {
+	HostID       string   `yaml:"hostId" env:"SPARKPLUG_HOST_ID" usage:"Host ID for STATE messages"`
+	Groups       []string `yaml:"groups" env:"SPARKPLUG_GROUPS" usage:"Group IDs to subscribe to (all groups if empty)" reload:"live"`
+	TopicFilters []string `yaml:"topicFilters" env:"SPARKPLUG_TOPIC_FILTERS" usage:"MQTT topic filters subscribed to instead of the group subscriptions" reload:"live"`
+	Exclude      []string `yaml:"exclude" env:"SPARKPLUG_EXCLUDE" usage:"Group IDs or MQTT topic filters whose messages are ignored" reload:"live"`
+}
+
+type ClusterConfig struct {
+	ShareGroup        string        `yaml:"shareGroup" env:"CLUSTER_SHARE_GROUP" usage:"Enables shared-subscription load balancing using this $share group"`
+	InstanceID        string        `yaml:"instanceId" env:"CLUSTER_INSTANCE_ID" usage:"Unique ID of this instance within the cluster (defaults to the MQTT client ID)"`
+	APIURL            string        `yaml:"apiUrl" env:"CLUSTER_API_URL" usage:"Base URL under which other instances reach the API of this instance"`
+	TopicPrefix       string        `yaml:"topicPrefix" env:"CLUSTER_TOPIC_PREFIX" usage:"Topic prefix for cluster heartbeats and forwarded messages"`
+	HeartbeatInterval time.Duration `yaml:"heartbeatInterval" env:"CLUSTER_HEARTBEAT_INTERVAL" usage:"Interval of cluster heartbeats"`
+	ReorderTimeout    time.Duration `yaml:"reorderTimeout" env:"CLUSTER_REORDER_TIMEOUT" usage:"Time messages of a node received out of order wait for the missing ones"`
+}
+
+type RedundancyConfig struct {
+	Standby       bool          `yaml:"standby" env:"REDUNDANCY_STANDBY" usage:"Starts the instance as standby of an active/standby pair"`
+	TakeoverDelay time.Duration `yaml:"takeoverDelay" env:"REDUNDANCY_TAKEOVER_DELAY" usage:"Delay before a standby takes over after the active instance went OFFLINE"`
+}
+
+type StoreConfig struct {
+	Workers          int `yaml:"workers" env:"STORE_WORKERS" usage:"Number of workers processing messages in parallel"`
+	MessageLogSize   int `yaml:"messageLogSize" env:"MESSAGE_LOG_SIZE" usage:"Number of messages kept for /api/messages, all if 0"`
+	EventHistorySize int `yaml:"eventHistorySize" env:"EVENT_HISTORY_SIZE" usage:"Number of lifecycle events kept per node and device"`
+	ValueHistorySize int `yaml:"valueHistorySize" env:"VALUE_HISTORY_SIZE" usage:"Number of values kept per metric for the GraphQL API if it is enabled, none if 0"`
+}
+
+type HTTPConfig struct {
+	Address      string        `yaml:"address" env:"HTTP_ADDRESS" usage:"Listen address of the API, host:port or unix:<socket path>"`
+	AdminAddress string        `yaml:"adminAddress" env:"HTTP_ADMIN_ADDRESS" usage:"Listen address of the admin API (served on the API address if empty)"`
+	TLSCertFile  string        `yaml:"tlsCertFile" env:"HTTP_TLS_CERT_FILE" usage:"Certificate file for HTTPS"`
+	TLSKeyFile   string        `yaml:"tlsKeyFile" env:"HTTP_TLS_KEY_FILE" usage:"Private key file for HTTPS"`
+	ReadTimeout  time.Duration `yaml:"readTimeout" env:"HTTP_READ_TIMEOUT" usage:"Maximum duration for reading a request (0 for none)"`
+	WriteTimeout time.Duration `yaml:"writeTimeout" env:"HTTP_WRITE_TIMEOUT" usage:"Maximum duration for writing a response (0 for none)"`
+	IdleTimeout  time.Duration `yaml:"idleTimeout" env:"HTTP_IDLE_TIMEOUT" usage:"Maximum duration to keep idle connections open (0 for none)"`
+	Mode         string        `yaml:"mode" env:"HTTP_MODE" usage:"Gin mode (debug, release, test)"`
+}
+
+type AuthConfig struct {
+	Enabled         bool   `yaml:"enabled" env:"AUTH_ENABLED" usage:"Requires authentication for the API"`
+	CredentialsFile string `yaml:"credentialsFile" env:"AUTH_CREDENTIALS_FILE" usage:"YAML file with the API keys and users"`
+	JWKSFile        string `yaml:"jwksFile" env:"AUTH_JWKS_FILE" usage:"JWKS file with the keys verifying JWT bearer tokens"`
+	JWTIssuer       string `yaml:"jwtIssuer" env:"AUTH_JWT_ISSUER" usage:"Required issuer of JWT bearer tokens (any if empty)"`
+	JWTAudience     string `yaml:"jwtAudience" env:"AUTH_JWT_AUDIENCE" usage:"Required audience of JWT bearer tokens (any if empty)"`
+	JWTRolesClaim   string `yaml:"jwtRolesClaim" env:"AUTH_JWT_ROLES_CLAIM" usage:"Claim of JWT bearer tokens holding the roles, nested claims separated by dots"`
+}
+
+type AuditConfig struct {
+	File    string `yaml:"file" env:"AUDIT_FILE" usage:"JSON lines file the audit log is appended to (memory only if empty)"`
+	LogSize int    `yaml:"logSize" env:"AUDIT_LOG_SIZE" usage:"Number of audit entries kept in memory if no file is given"`
+}
+
+type ExporterConfig struct {
+	Enabled bool     `yaml:"enabled" env:"EXPORTER_ENABLED" usage:"Exposes the values of the sparkplug metrics on /metrics/sparkplug"`
+	Include []string `yaml:"include" env:"EXPORTER_INCLUDE" usage:"Patterns of the exported metrics (all metrics if empty)" reload:"live"`
+	Exclude []string `yaml:"exclude" env:"EXPORTER_EXCLUDE" usage:"Patterns of the metrics which are not exported" reload:"live"`
+}
+
+type WatchdogConfig struct {
+	Timeout        time.Duration `yaml:"timeout" env:"WATCHDOG_TIMEOUT" usage:"Time without messages after which nodes and devices are stale (0 to disable)" reload:"live"`
+	Timeouts       []string      `yaml:"timeouts" env:"WATCHDOG_TIMEOUTS" usage:"Timeouts of matching nodes and devices as <pattern>=<duration>" reload:"live"`
+	MetricTimeouts []string      `yaml:"metricTimeouts" env:"WATCHDOG_METRIC_TIMEOUTS" usage:"Timeouts of matching metrics as <pattern>=<duration>" reload:"live"`
+	Rebirth        bool          `yaml:"rebirth" env:"WATCHDOG_REBIRTH" usage:"Requests a rebirth of a node when it or one of its devices turns stale" reload:"live"`
+}
+
+type AlarmsConfig struct {
+	RulesFile string `yaml:"rulesFile" env:"ALARMS_RULES_FILE" usage:"YAML file with the alarm rules, read on every reload (alarming disabled if empty)"`
+	StateFile string `yaml:"stateFile" env:"ALARMS_STATE_FILE" usage:"JSON file the alarms are persisted to (memory only if empty)"`
+}
+
+type WebhooksConfig struct {
+	File           string `yaml:"file" env:"WEBHOOKS_FILE" usage:"YAML file with the webhook subscriptions, read on every reload (disabled if empty)"`
+	DeadLetterSize int    `yaml:"deadLetterSize" env:"WEBHOOKS_DEAD_LETTER_SIZE" usage:"Number of undeliverable webhook notifications kept"`
+}
+
+type UNSConfig struct {
+	Enabled             bool   `yaml:"enabled" env:"UNS_ENABLED" usage:"Republishes the metric values as JSON to a unified namespace on the broker"`
+	TopicTemplate       string `yaml:"topicTemplate" env:"UNS_TOPIC_TEMPLATE" usage:"Topic of the metric values with {group}, {node}, {device} and {metric}" reload:"live"`
+	StatusTopicTemplate string `yaml:"statusTopicTemplate" env:"UNS_STATUS_TOPIC_TEMPLATE" usage:"Topic of the online status of nodes and devices (none if empty)" reload:"live"`
+	QoS                 int    `yaml:"qos" env:"UNS_QOS" usage:"QoS of the unified namespace messages" reload:"live"`
+	Retain              bool   `yaml:"retain" env:"UNS_RETAIN" usage:"Publishes the unified namespace messages retained" reload:"live"`
+}
+
+type SinksConfig struct {
+	File string `yaml:"file" env:"SINKS_FILE" usage:"YAML file with the data sinks, read on every reload (disabled if empty)"`
+}
+
+type OPCUAConfig struct {
+	Enabled     bool   `yaml:"enabled" env:"OPCUA_ENABLED" usage:"Serves the groups, edge nodes, devices and metrics with an OPC UA server"`
+	Address     string `yaml:"address" env:"OPCUA_ADDRESS" usage:"Listen address of the OPC UA server"`
+	EndpointURL string `yaml:"endpointUrl" env:"OPCUA_ENDPOINT_URL" usage:"Endpoint URL advertised to OPC UA clients (derived from the host name if empty)"`
+	Writable    bool   `yaml:"writable" env:"OPCUA_WRITABLE" usage:"Allows OPC UA clients to write metrics as NCMD and DCMD" reload:"live"`
+	MaxSessions int    `yaml:"maxSessions" env:"OPCUA_MAX_SESSIONS" usage:"Maximum number of OPC UA sessions"`
+	CertFile    string `yaml:"certFile" env:"OPCUA_CERT_FILE" usage:"Certificate file of the OPC UA server (self-signed on every start if empty)"`
+	KeyFile     string `yaml:"keyFile" env:"OPCUA_KEY_FILE" usage:"RSA private key file of the OPC UA server certificate"`
+	TrustedDir  string `yaml:"trustedDir" env:"OPCUA_TRUSTED_DIR" usage:"Directory of the trusted OPC UA client and CA certificates (any client if empty)"`
+}
+
+type GraphQLConfig struct {
+	Enabled bool `yaml:"enabled" env:"GRAPHQL_ENABLED" usage:"Serves the GraphQL API with subscriptions on /api/graphql"`
+}
+
+type GRPCConfig struct {
+	Enabled     bool   `yaml:"enabled" env:"GRPC_ENABLED" usage:"Serves the gRPC API for typed access, metric update and message streams, and commands"`
+	Address     string `yaml:"address" env:"GRPC_ADDRESS" usage:"Listen address of the gRPC server"`
+	TLSCertFile string `yaml:"tlsCertFile" env:"GRPC_TLS_CERT_FILE" usage:"Certificate file for gRPC over TLS"`
+	TLSKeyFile  string `yaml:"tlsKeyFile" env:"GRPC_TLS_KEY_FILE" usage:"Private key file for gRPC over TLS"`
+	MaxStreams  int    `yaml:"maxStreams" env:"GRPC_MAX_STREAMS" usage:"Maximum number of concurrent gRPC streams"`
+	Reflection  bool   `yaml:"reflection" env:"GRPC_REFLECTION" usage:"Serves gRPC reflection, so tools like grpcurl work without the proto files"`
+}
+
+// Returns the default configuration
+func Default() *Config {
+	return &Config{
+		Log: LogConfig{
+			Format: "text",
+			Level:  "info",
+		},
+		MQTT: MQTTConfig{
+			Endpoints: []string{"tcp://localhost:1883"},
+			ClientID:  "go-primary",
+		},
+		Sparkplug: SparkplugConfig{
+			HostID:       "go-primary",
+			Groups:       []string{},
+			TopicFilters: []string{},
+			Exclude:      []string{},
+		},
+		Cluster: ClusterConfig{
+			TopicPrefix:       "go-primary/cluster",
+			HeartbeatInterval: 5 * time.Second,
+			ReorderTimeout:    time.Second,
+		},
+		Redundancy: RedundancyConfig{
+			TakeoverDelay: 5 * time.Second,
+		},
+		Store: StoreConfig{
+			Workers:          runtime.NumCPU(),
+			MessageLogSize:   0,
+			EventHistorySize: 1000,
+			ValueHistorySize: 100,
+		},
+		HTTP: HTTPConfig{
+			Address:      ":8080",
+			ReadTimeout:  10 * time.Second,
+			WriteTimeout: 30 * time.Second,
+			IdleTimeout:  2 * time.Minute,
+			Mode:         "release",
+		},
+		Auth: AuthConfig{
+			JWTRolesClaim: "roles",
+		},
+		Audit: AuditConfig{
+			LogSize: 10000,
+		},
+		Exporter: ExporterConfig{
+			Include: []string{},
+			Exclude: []string{},
+		},
+		Watchdog: WatchdogConfig{
+			Timeouts:       []string{},
+			MetricTimeouts: []string{},
+		},
+		Webhooks: WebhooksConfig{
+			DeadLetterSize: 1000,
+		},
+		UNS: UNSConfig{
+			TopicTemplate:       "uns/{group}/{node}/{device}/{metric}",
+			StatusTopicTemplate: "uns/{group}/{node}/{device}/_status",
+			Retain:              true,
+		},
+		OPCUA: OPCUAConfig{
+			Address:     ":4840",
+			MaxSessions: 100,
+		},
+		GRPC: GRPCConfig{
+			Address:    ":9090",
+			MaxStreams: 100,
+		},
+		ShutdownTimeout: 10 * time.Second,
+	}
+}
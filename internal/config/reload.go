@@ -0,0 +1,56 @@
+package config
+
+import (
+	"reflect"
+	"strings"
+)
+
+// The result of a configuration reload
+type ReloadReport struct {
+	Applied         []string `json:"applied"`         // The settings applied live
+	RestartRequired []string `json:"restartRequired"` // The changed settings only applied after a restart
+}
+
+// Returns true iff any of the applied settings starts with the given path prefix (e.g. "log.")
+func (r *ReloadReport) AppliedAny(prefix string) bool {
+	for _, path := range r.Applied {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the running configuration after reloading the given configuration:
+// changed live settings are taken over, while all other settings keep their running value
+// until the next restart, so they are reported again on the next reload.
+func (cfg *Config) Reload(next *Config) (*Config, *ReloadReport) {
+	running := *cfg
+	report := &ReloadReport{
+		Applied:         make([]string, 0),
+		RestartRequired: make([]string, 0),
+	}
+
+	nextFields := fields(next)
+	for i, f := range fields(&running) {
+		nextValue := nextFields[i].Value
+		if equal(f.Value, nextValue) {
+			continue
+		}
+		if f.Live {
+			f.Value.Set(nextValue)
+			report.Applied = append(report.Applied, f.Path)
+		} else {
+			report.RestartRequired = append(report.RestartRequired, f.Path)
+		}
+	}
+	return &running, report
+}
+
+// Returns true iff both setting values are equal, treating nil and empty lists as equal
+func equal(a, b reflect.Value) bool {
+	if a.Kind() == reflect.Slice && a.Len() == 0 && b.Len() == 0 {
+		return true
+	}
+	return reflect.DeepEqual(a.Interface(), b.Interface())
+}
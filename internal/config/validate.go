@@ -0,0 +1,309 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/alarm"
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/auth"
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/exporter"
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/grpcapi"
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/opcua"
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/sink"
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/sparkplug"
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/store"
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/uns"
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/util"
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/webhook"
+	"github.com/sirupsen/logrus"
+)
+
+// Lists every problem found in the configuration
+type ValidationError struct {
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("invalid configuration:\n  - %s", strings.Join(e.Problems, "\n  - "))
+}
+
+// Reports whether the listen address is a Unix socket or a loopback address, which cannot be reached from the network.
+// An empty address is local, as the admin API is then served on http.address.
+func isLocal(address string) bool {
+	if address == "" || strings.HasPrefix(address, "unix:") {
+		return true
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// Returns an error listing every problem of the configuration, or nil if it is valid
+func (cfg *Config) Validate() error {
+	if problems := cfg.problems(); len(problems) > 0 {
+		return &ValidationError{Problems: problems}
+	}
+	return nil
+}
+
+func (cfg *Config) problems() []string {
+	problems := make([]string, 0)
+	add := func(format string, args ...any) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	if !util.Contains([]string{"text", "json"}, cfg.Log.Format) {
+		add("log.format: must be text or json, got %q", cfg.Log.Format)
+	}
+	if _, err := logrus.ParseLevel(cfg.Log.Level); err != nil {
+		add("log.level: %v", err)
+	}
+
+	if len(cfg.MQTT.Endpoints) == 0 {
+		add("mqtt.endpoints: at least one endpoint is required")
+	}
+	for _, endpoint := range cfg.MQTT.Endpoints {
+		u, err := url.Parse(endpoint)
+		if err != nil {
+			add("mqtt.endpoints: %v", err)
+			continue
+		}
+		if !util.Contains([]string{"tcp", "mqtt", "ssl", "tls", "mqtts", "ws", "wss"}, u.Scheme) || u.Host == "" {
+			add("mqtt.endpoints: %q must be of the form <tcp|ssl|ws|wss>://<host>:<port>", endpoint)
+		}
+	}
+	if cfg.MQTT.ClientID == "" {
+		add("mqtt.clientId: must not be empty")
+	}
+
+	if cfg.Sparkplug.HostID == "" || strings.ContainsAny(cfg.Sparkplug.HostID, "/+#") {
+		add("sparkplug.hostId: must be non-empty and must not contain '/', '+' or '#', got %q", cfg.Sparkplug.HostID)
+	}
+	if err := cfg.TopicFilter().Validate(); err != nil {
+		add("sparkplug: %v", err)
+	}
+
+	if cfg.Cluster.ShareGroup != "" {
+		if strings.ContainsAny(cfg.Cluster.ShareGroup, "/+#") {
+			add("cluster.shareGroup: must not contain '/', '+' or '#', got %q", cfg.Cluster.ShareGroup)
+		}
+		if cfg.Cluster.TopicPrefix == "" || strings.ContainsAny(cfg.Cluster.TopicPrefix, "+#") {
+			add("cluster.topicPrefix: must be non-empty and must not contain wildcards, got %q", cfg.Cluster.TopicPrefix)
+		}
+		if cfg.Cluster.HeartbeatInterval <= 0 {
+			add("cluster.heartbeatInterval: must be positive, got %v", cfg.Cluster.HeartbeatInterval)
+		}
+		if cfg.Cluster.ReorderTimeout <= 0 {
+			add("cluster.reorderTimeout: must be positive, got %v", cfg.Cluster.ReorderTimeout)
+		}
+		if cfg.Cluster.APIURL != "" {
+			if u, err := url.Parse(cfg.Cluster.APIURL); err != nil || u.Scheme == "" || u.Host == "" {
+				add("cluster.apiUrl: must be an absolute URL, got %q", cfg.Cluster.APIURL)
+			}
+		}
+	}
+
+	if cfg.Redundancy.Standby && (cfg.MQTT.ClientID == Default().MQTT.ClientID || cfg.MQTT.ClientID == cfg.Sparkplug.HostID) {
+		// the broker disconnects a client when another one connects with the same ID, so the instances would disconnect each other
+		add("mqtt.clientId: must be unique to each instance with redundancy.standby, got %q which is the default or the shared sparkplug.hostId", cfg.MQTT.ClientID)
+	}
+	if cfg.Redundancy.TakeoverDelay < 0 {
+		add("redundancy.takeoverDelay: must not be negative, got %v", cfg.Redundancy.TakeoverDelay)
+	}
+
+	if cfg.Store.Workers < 1 {
+		add("store.workers: must be at least 1, got %d", cfg.Store.Workers)
+	}
+	if cfg.Store.MessageLogSize < 0 {
+		add("store.messageLogSize: must not be negative, got %d", cfg.Store.MessageLogSize)
+	}
+	if cfg.Store.EventHistorySize < 0 {
+		add("store.eventHistorySize: must not be negative, got %d", cfg.Store.EventHistorySize)
+	}
+	if cfg.Store.ValueHistorySize < 0 {
+		add("store.valueHistorySize: must not be negative, got %d", cfg.Store.ValueHistorySize)
+	}
+	if cfg.HTTP.Address == "" {
+		add("http.address: must not be empty")
+	}
+	if cfg.HTTP.AdminAddress != "" && cfg.HTTP.AdminAddress == cfg.HTTP.Address {
+		add("http.adminAddress: must differ from http.address, leave empty to serve the admin API on http.address")
+	}
+	if (cfg.HTTP.TLSCertFile == "") != (cfg.HTTP.TLSKeyFile == "") {
+		add("http.tlsCertFile, http.tlsKeyFile: both or none must be given")
+	}
+	for _, file := range []string{cfg.HTTP.TLSCertFile, cfg.HTTP.TLSKeyFile} {
+		if file == "" {
+			continue
+		}
+		if _, err := os.Stat(file); err != nil {
+			add("http: TLS file: %v", err)
+		}
+	}
+	if cfg.Auth.Enabled && cfg.HTTP.TLSCertFile == "" && !isLocal(cfg.HTTP.AdminAddress) {
+		add("http.adminAddress: must be a loopback address or Unix socket unless http.tlsCertFile is given, credentials must not be sent over plain HTTP, got %q", cfg.HTTP.AdminAddress)
+	}
+	if cfg.HTTP.ReadTimeout < 0 || cfg.HTTP.WriteTimeout < 0 || cfg.HTTP.IdleTimeout < 0 {
+		add("http: timeouts must not be negative, got read %v, write %v, idle %v", cfg.HTTP.ReadTimeout, cfg.HTTP.WriteTimeout, cfg.HTTP.IdleTimeout)
+	}
+	if !util.Contains([]string{"debug", "release", "test"}, cfg.HTTP.Mode) {
+		add("http.mode: must be debug, release or test, got %q", cfg.HTTP.Mode)
+	}
+
+	if cfg.Auth.Enabled {
+		if cfg.Auth.JWKSFile != "" && cfg.Auth.JWTRolesClaim == "" {
+			add("auth.jwtRolesClaim: must not be empty")
+		}
+		if _, err := auth.New(cfg.AuthConfig()); err != nil {
+			add("auth: %v", err)
+		}
+	}
+
+	if cfg.Audit.LogSize < 0 {
+		add("audit.logSize: must not be negative, got %d", cfg.Audit.LogSize)
+	}
+
+	if err := cfg.ExporterFilter().Validate(); err != nil {
+		add("exporter: %v", err)
+	}
+
+	if watchdog, err := cfg.WatchdogConfig(); err != nil {
+		add("watchdog: %v", err)
+	} else if err := watchdog.Validate(); err != nil {
+		add("watchdog: %v", err)
+	}
+
+	if cfg.Alarms.RulesFile != "" {
+		if _, err := alarm.LoadRules(cfg.Alarms.RulesFile); err != nil {
+			add("alarms.rulesFile: %v", err)
+		}
+	}
+
+	if cfg.Webhooks.File != "" {
+		if _, err := webhook.LoadSubscriptions(cfg.Webhooks.File); err != nil {
+			add("webhooks.file: %v", err)
+		}
+	}
+	if cfg.Webhooks.DeadLetterSize < 0 {
+		add("webhooks.deadLetterSize: must not be negative, got %d", cfg.Webhooks.DeadLetterSize)
+	}
+
+	if cfg.Sinks.File != "" {
+		if _, err := sink.LoadDefinitions(cfg.Sinks.File); err != nil {
+			add("sinks.file: %v", err)
+		}
+	}
+
+	if cfg.UNS.QoS < 0 || cfg.UNS.QoS > 2 {
+		add("uns.qos: must be 0, 1 or 2, got %d", cfg.UNS.QoS)
+	} else if err := cfg.UNSConfig().Validate(); err != nil {
+		add("uns: %v", err)
+	}
+
+	if cfg.OPCUA.Enabled {
+		if err := cfg.OPCUAConfig().Validate(); err != nil {
+			add("opcua: %v", err)
+		}
+	}
+
+	if cfg.GRPC.Enabled {
+		if err := cfg.GRPCConfig().Validate(); err != nil {
+			add("grpc: %v", err)
+		}
+	}
+
+	if cfg.ShutdownTimeout <= 0 {
+		add("shutdownTimeout: must be positive, got %v", cfg.ShutdownTimeout)
+	}
+
+	return problems
+}
+
+// Returns the settings of the API authentication
+func (cfg *Config) AuthConfig() auth.Config {
+	return auth.Config{
+		CredentialsFile: cfg.Auth.CredentialsFile,
+		JWKSFile:        cfg.Auth.JWKSFile,
+		JWTIssuer:       cfg.Auth.JWTIssuer,
+		JWTAudience:     cfg.Auth.JWTAudience,
+		JWTRolesClaim:   cfg.Auth.JWTRolesClaim,
+	}
+}
+
+// Returns the sparkplug topic filter of the configuration
+func (cfg *Config) TopicFilter() sparkplug.TopicFilter {
+	return sparkplug.TopicFilter{
+		Groups:  cfg.Sparkplug.Groups,
+		Filters: cfg.Sparkplug.TopicFilters,
+		Exclude: cfg.Sparkplug.Exclude,
+	}
+}
+
+// Returns the filter of the exported sparkplug metrics
+func (cfg *Config) ExporterFilter() exporter.Filter {
+	return exporter.Filter{
+		Include: cfg.Exporter.Include,
+		Exclude: cfg.Exporter.Exclude,
+	}
+}
+
+// Returns the settings of the stale-data watchdog
+func (cfg *Config) WatchdogConfig() (store.WatchdogConfig, error) {
+	timeouts, err := store.ParseTimeouts(cfg.Watchdog.Timeouts)
+	if err != nil {
+		return store.WatchdogConfig{}, err
+	}
+	metricTimeouts, err := store.ParseTimeouts(cfg.Watchdog.MetricTimeouts)
+	if err != nil {
+		return store.WatchdogConfig{}, err
+	}
+	return store.WatchdogConfig{
+		Timeout:        cfg.Watchdog.Timeout,
+		Timeouts:       timeouts,
+		MetricTimeouts: metricTimeouts,
+		Rebirth:        cfg.Watchdog.Rebirth,
+	}, nil
+}
+
+// Returns the settings of the unified namespace
+func (cfg *Config) UNSConfig() uns.Config {
+	return uns.Config{
+		TopicTemplate:       cfg.UNS.TopicTemplate,
+		StatusTopicTemplate: cfg.UNS.StatusTopicTemplate,
+		QoS:                 byte(cfg.UNS.QoS),
+		Retain:              cfg.UNS.Retain,
+	}
+}
+
+// Returns the settings of the OPC UA server
+func (cfg *Config) OPCUAConfig() opcua.Config {
+	return opcua.Config{
+		Address:     cfg.OPCUA.Address,
+		EndpointURL: cfg.OPCUA.EndpointURL,
+		Writable:    cfg.OPCUA.Writable,
+		MaxSessions: cfg.OPCUA.MaxSessions,
+		CertFile:    cfg.OPCUA.CertFile,
+		KeyFile:     cfg.OPCUA.KeyFile,
+		TrustedDir:  cfg.OPCUA.TrustedDir,
+	}
+}
+
+// Returns the settings of the gRPC server
+func (cfg *Config) GRPCConfig() grpcapi.Config {
+	return grpcapi.Config{
+		Address:     cfg.GRPC.Address,
+		TLSCertFile: cfg.GRPC.TLSCertFile,
+		TLSKeyFile:  cfg.GRPC.TLSKeyFile,
+		MaxStreams:  cfg.GRPC.MaxStreams,
+		Reflection:  cfg.GRPC.Reflection,
+	}
+}
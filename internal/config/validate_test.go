@@ -0,0 +1,43 @@
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateRefusesPlainAdminListenerWithAuth(t *testing.T) {
+	tests := []struct {
+		address string
+		auth    bool
+		tls     bool
+		refused bool
+	}{
+		{address: "", auth: true},
+		{address: "127.0.0.1:8081", auth: true},
+		{address: "[::1]:8081", auth: true},
+		{address: "localhost:8081", auth: true},
+		{address: "unix:/run/sparkplug-primary/admin.sock", auth: true},
+		{address: ":8081", auth: true, refused: true},
+		{address: "0.0.0.0:8081", auth: true, refused: true},
+		{address: "10.0.0.5:8081", auth: true, refused: true},
+		{address: "admin.example.com:8081", auth: true, refused: true},
+		{address: ":8081", auth: true, tls: true},
+		{address: ":8081"},
+	}
+	for _, test := range tests {
+		cfg := Default()
+		cfg.HTTP.AdminAddress = test.address
+		cfg.Auth.Enabled = test.auth
+		if test.tls {
+			// the files need not exist, only the admin listener problem is checked
+			cfg.HTTP.TLSCertFile, cfg.HTTP.TLSKeyFile = "tls.crt", "tls.key"
+		}
+		refused := false
+		for _, problem := range cfg.problems() {
+			refused = refused || strings.HasPrefix(problem, "http.adminAddress:")
+		}
+		if refused != test.refused {
+			t.Errorf("admin address %q, auth %v, TLS %v: refused %v, want %v", test.address, test.auth, test.tls, refused, test.refused)
+		}
+	}
+}
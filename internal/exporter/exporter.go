@@ -0,0 +1,153 @@
+package exporter
+
+import (
+	"regexp"
+	"sync/atomic"
+
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/store"
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/util"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// The name of the metric family holding the values of all sparkplug metrics
+const MetricName = "sparkplug_metric_value"
+
+// The labels identifying a sparkplug metric, the device is empty for node metrics
+var labels = []string{"group", "node", "device", "metric"}
+
+var desc = prometheus.NewDesc(MetricName, "Current value of a numeric or boolean sparkplug metric, booleans as 0 or 1", labels, nil)
+
+// Restricts the exported sparkplug metrics by glob patterns ('*' matches any characters including '/', '?' a single character)
+// matched against "<group>/<node>/<metric>" for node metrics and "<group>/<node>/<device>/<metric>" for device metrics
+type Filter struct {
+	Include []string // The patterns of the exported metrics (all metrics if empty)
+	Exclude []string // The patterns of metrics which are not exported, even if included
+}
+
+// The compiled patterns of a filter
+type patterns struct {
+	include []*regexp.Regexp
+	exclude []*regexp.Regexp
+}
+
+// Returns an error if any of the patterns is invalid
+func (f Filter) Validate() error {
+	_, err := f.compile()
+	return err
+}
+
+func (f Filter) compile() (*patterns, error) {
+	p := &patterns{}
+	for _, list := range []struct {
+		patterns []string
+		compiled *[]*regexp.Regexp
+	}{{f.Include, &p.include}, {f.Exclude, &p.exclude}} {
+		for _, pattern := range list.patterns {
+			re, err := util.Glob(pattern)
+			if err != nil {
+				return nil, err
+			}
+			*list.compiled = append(*list.compiled, re)
+		}
+	}
+	return p, nil
+}
+
+// Returns true iff the metric of the given path is exported
+func (p *patterns) accepts(path string) bool {
+	included := len(p.include) == 0
+	for _, re := range p.include {
+		if re.MatchString(path) {
+			included = true
+			break
+		}
+	}
+	if !included {
+		return false
+	}
+	for _, re := range p.exclude {
+		if re.MatchString(path) {
+			return false
+		}
+	}
+	return true
+}
+
+// Exports the current values of the sparkplug metrics in the store in the Prometheus text exposition format
+type Exporter struct {
+	sm       *store.StoreManager
+	patterns atomic.Value // *patterns, replaced on configuration reload
+}
+
+// Creates an exporter of the metrics in the given store matching the filter
+func New(sm *store.StoreManager, filter Filter) (*Exporter, error) {
+	e := &Exporter{sm: sm}
+	if err := e.SetFilter(filter); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// Replaces the filter of the exported metrics
+func (e *Exporter) SetFilter(filter Filter) error {
+	p, err := filter.compile()
+	if err != nil {
+		return err
+	}
+	e.patterns.Store(p)
+	return nil
+}
+
+// Returns a collector of the numeric and boolean values of all metrics of the nodes allowed by the given function.
+// Metrics of offline nodes and devices and null values are omitted, so Prometheus treats them as stale.
+func (e *Exporter) Collector(allow func(groupID, nodeID string) bool) prometheus.Collector {
+	return &collector{e: e, allow: allow}
+}
+
+// Collects the values of the sparkplug metrics when scraped
+type collector struct {
+	e     *Exporter
+	allow func(groupID, nodeID string) bool
+}
+
+func (c *collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- desc
+}
+
+func (c *collector) Collect(ch chan<- prometheus.Metric) {
+	p := c.e.patterns.Load().(*patterns)
+	for _, group := range *c.e.sm.Fetch() {
+		for _, node := range group.Nodes {
+			if !node.Online || !c.allow(group.ID, node.ID) {
+				continue
+			}
+			prefix := group.ID + "/" + node.ID + "/"
+			collectMetrics(ch, p, prefix, []string{group.ID, node.ID, ""}, node.Metrics)
+			for _, device := range node.Devices {
+				if device.Online {
+					collectMetrics(ch, p, prefix+device.ID+"/", []string{group.ID, node.ID, device.ID}, device.Metrics)
+				}
+			}
+		}
+	}
+}
+
+// Sends a sample of every exported metric with a numeric value
+func collectMetrics(ch chan<- prometheus.Metric, p *patterns, prefix string, owner []string, fetched []store.FetchedMetric) {
+	for _, metric := range fetched {
+		if metric.Stale || metric.IsNull || !p.accepts(prefix+metric.Name) {
+			continue
+		}
+		value, ok := store.NumericValue(metric.Value)
+		if !ok {
+			continue
+		}
+		m, err := prometheus.NewConstMetric(desc, prometheus.GaugeValue, value, append(owner, metric.Name)...)
+		if err != nil {
+			// e.g. a name which is no valid UTF-8
+			ch <- prometheus.NewInvalidMetric(desc, err)
+			continue
+		}
+		ch <- m
+	}
+}
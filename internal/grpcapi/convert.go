@@ -0,0 +1,183 @@
+package grpcapi
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/sparkplug"
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/store"
+	"github.com/DATATRONiQ/go-sparkplug-primary/third_party/primaryapi"
+	"github.com/DATATRONiQ/go-sparkplug-primary/third_party/sparkplugb"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+var qualities = map[store.Quality]primaryapi.Quality{
+	store.QualityGood:      primaryapi.Quality_QUALITY_GOOD,
+	store.QualityBad:       primaryapi.Quality_QUALITY_BAD,
+	store.QualityStale:     primaryapi.Quality_QUALITY_STALE,
+	store.QualityUncertain: primaryapi.Quality_QUALITY_UNCERTAIN,
+}
+
+// Returns the timestamp of the time, nil if it is zero
+func timestamp(t time.Time) *timestamppb.Timestamp {
+	if t.IsZero() {
+		return nil
+	}
+	return timestamppb.New(t)
+}
+
+// Converts a metric value of the store, nil values have no kind
+func value(v any) *primaryapi.Value {
+	switch v := v.(type) {
+	case bool:
+		return &primaryapi.Value{Kind: &primaryapi.Value_BoolValue{BoolValue: v}}
+	case int8:
+		return &primaryapi.Value{Kind: &primaryapi.Value_IntValue{IntValue: int64(v)}}
+	case int16:
+		return &primaryapi.Value{Kind: &primaryapi.Value_IntValue{IntValue: int64(v)}}
+	case int32:
+		return &primaryapi.Value{Kind: &primaryapi.Value_IntValue{IntValue: int64(v)}}
+	case int64:
+		return &primaryapi.Value{Kind: &primaryapi.Value_IntValue{IntValue: v}}
+	case uint8:
+		return &primaryapi.Value{Kind: &primaryapi.Value_IntValue{IntValue: int64(v)}}
+	case uint16:
+		return &primaryapi.Value{Kind: &primaryapi.Value_IntValue{IntValue: int64(v)}}
+	case uint32:
+		return &primaryapi.Value{Kind: &primaryapi.Value_IntValue{IntValue: int64(v)}}
+	case uint64:
+		return &primaryapi.Value{Kind: &primaryapi.Value_UintValue{UintValue: v}}
+	case float32:
+		return &primaryapi.Value{Kind: &primaryapi.Value_DoubleValue{DoubleValue: float64(v)}}
+	case float64:
+		return &primaryapi.Value{Kind: &primaryapi.Value_DoubleValue{DoubleValue: v}}
+	case string:
+		return &primaryapi.Value{Kind: &primaryapi.Value_StringValue{StringValue: v}}
+	}
+	return &primaryapi.Value{}
+}
+
+// Converts the metric properties as they appear in the JSON of the REST API, e.g. DateTime values as RFC 3339 strings
+func properties(props map[string]any) *structpb.Struct {
+	if len(props) == 0 {
+		return nil
+	}
+	data, err := json.Marshal(props)
+	if err != nil {
+		// e.g. a NaN value
+		return nil
+	}
+	var decoded map[string]any
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return nil
+	}
+	s, err := structpb.NewStruct(decoded)
+	if err != nil {
+		return nil
+	}
+	return s
+}
+
+// Returns the path of a metric, "<group>/<node>[/<device>]/<metric>"
+func metricPath(groupID, nodeID, deviceID, name string) string {
+	if deviceID == "" {
+		return groupID + "/" + nodeID + "/" + name
+	}
+	return groupID + "/" + nodeID + "/" + deviceID + "/" + name
+}
+
+func metric(m store.FetchedMetric, groupID, nodeID, deviceID string) *primaryapi.Metric {
+	return &primaryapi.Metric{
+		Name:       m.Name,
+		Path:       metricPath(groupID, nodeID, deviceID, m.Name),
+		GroupId:    groupID,
+		NodeId:     nodeID,
+		DeviceId:   deviceID,
+		Alias:      m.Alias,
+		DataType:   m.DataType,
+		Value:      value(m.Value),
+		Timestamp:  timestamp(m.Timestamp),
+		Stale:      m.Stale,
+		Quality:    qualities[m.Quality],
+		Units:      m.Units,
+		Properties: properties(m.Properties),
+	}
+}
+
+func metricList(fetched []store.FetchedMetric, groupID, nodeID, deviceID string) []*primaryapi.Metric {
+	metrics := make([]*primaryapi.Metric, len(fetched))
+	for i, m := range fetched {
+		metrics[i] = metric(m, groupID, nodeID, deviceID)
+	}
+	return metrics
+}
+
+func device(d store.FetchedDevice, withMetrics bool) *primaryapi.Device {
+	result := &primaryapi.Device{
+		Id:            d.ID,
+		GroupId:       d.GroupID,
+		NodeId:        d.NodeID,
+		Online:        d.Online,
+		Stale:         d.Stale,
+		LastMessageAt: timestamp(d.LastMessageAt),
+	}
+	if withMetrics {
+		result.Metrics = metricList(d.Metrics, d.GroupID, d.NodeID, d.ID)
+	}
+	return result
+}
+
+func node(n store.FetchedNode, withMetrics bool) *primaryapi.Node {
+	result := &primaryapi.Node{
+		Id:            n.ID,
+		GroupId:       n.GroupID,
+		Online:        n.Online,
+		Stale:         n.Stale,
+		LastMessageAt: timestamp(n.LastMessageAt),
+		Devices:       make([]*primaryapi.Device, len(n.Devices)),
+	}
+	for i, d := range n.Devices {
+		result.Devices[i] = device(d, withMetrics)
+	}
+	if withMetrics {
+		result.Metrics = metricList(n.Metrics, n.GroupID, n.ID, "")
+	}
+	return result
+}
+
+func metricUpdate(u store.MetricUpdate) *primaryapi.MetricUpdate {
+	return &primaryapi.MetricUpdate{
+		Name:       u.Name,
+		Path:       u.Path(),
+		GroupId:    u.GroupID,
+		NodeId:     u.NodeID,
+		DeviceId:   u.DeviceID,
+		DataType:   u.DataType,
+		Value:      value(u.Value),
+		Timestamp:  timestamp(u.Timestamp),
+		Units:      u.Units,
+		Quality:    qualities[u.Quality],
+		Birth:      u.Birth,
+		ReceivedAt: timestamp(u.ReceivedAt),
+	}
+}
+
+// Converts a received message, decoding its payload if it is valid
+func message(m sparkplug.RawMessage) *primaryapi.SparkplugMessage {
+	result := &primaryapi.SparkplugMessage{
+		Topic:       m.Topic,
+		GroupId:     m.GroupID,
+		MessageType: string(m.Type),
+		NodeId:      m.NodeID,
+		DeviceId:    m.DeviceID,
+		ReceivedAt:  timestamp(m.ReceivedAt),
+		RawPayload:  m.Payload,
+	}
+	var payload sparkplugb.Payload
+	if err := proto.Unmarshal(m.Payload, &payload); err == nil {
+		result.Payload = &payload
+	}
+	return result
+}
@@ -0,0 +1,99 @@
+package grpcapi
+
+import (
+	"sync"
+
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/metrics"
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/sparkplug"
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/store"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// The number of events buffered per stream. A stream whose buffer is full ends, as its client would miss events.
+const streamBuffer = 1024
+
+var streamsOverflowed = promauto.NewCounterVec(prometheus.CounterOpts{Name: "sparkplug_primary_grpc_streams_overflowed_total", Help: "gRPC streams ended because the client did not keep up, by method"}, []string{"method"})
+
+// Fans out the metric updates of the store and the received messages to the streams
+type hub struct {
+	mu      sync.RWMutex
+	streams map[*stream]struct{}
+	done    chan struct{} // closed on shutdown
+}
+
+// A stream receiving the accepted events
+type stream struct {
+	method       string
+	accept       func(event any) bool
+	events       chan any
+	overflow     chan struct{} // closed once an event did not fit into the buffer
+	overflowOnce sync.Once
+}
+
+// Returns whether an event was not buffered, so the stream has to end
+func (s *stream) overflowed() bool {
+	select {
+	case <-s.overflow:
+		return true
+	default:
+		return false
+	}
+}
+
+func newHub(client Client) *hub {
+	h := &hub{streams: make(map[*stream]struct{}), done: make(chan struct{})}
+	metrics.NewGaugeFunc("sparkplug_primary_grpc_streams", "Active gRPC streams", nil, func(emit func(v float64, labelValues ...string)) {
+		h.mu.RLock()
+		defer h.mu.RUnlock()
+		emit(float64(len(h.streams)))
+	})
+	store.AddUpdateHandler(func(u store.MetricUpdate) { h.publish(u) })
+	client.AddMessageHandler(func(m sparkplug.RawMessage) { h.publish(m) })
+	return h
+}
+
+// Passes the event to the accepting streams without blocking, marking the streams whose buffer is full as overflowed.
+// Overflowed streams get no further events, so their clients never receive the events after a gap.
+func (h *hub) publish(event any) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for s := range h.streams {
+		if s.overflowed() || !s.accept(event) {
+			continue
+		}
+		select {
+		case s.events <- event:
+		default:
+			s.overflowOnce.Do(func() {
+				streamsOverflowed.WithLabelValues(s.method).Inc()
+				close(s.overflow)
+			})
+		}
+	}
+}
+
+// Adds a stream of the accepted events, unless the maximum number of streams is reached
+func (h *hub) subscribe(method string, max int, accept func(event any) bool) (*stream, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.streams) >= max {
+		return nil, status.Errorf(codes.ResourceExhausted, "too many streams, at most %d are allowed", max)
+	}
+	s := &stream{method: method, accept: accept, events: make(chan any, streamBuffer), overflow: make(chan struct{})}
+	h.streams[s] = struct{}{}
+	return s, nil
+}
+
+func (h *hub) unsubscribe(s *stream) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.streams, s)
+}
+
+// Ends all streams
+func (h *hub) close() {
+	close(h.done)
+}
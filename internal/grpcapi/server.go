@@ -0,0 +1,209 @@
+package grpcapi
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/audit"
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/auth"
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/sparkplug"
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/store"
+	"github.com/DATATRONiQ/go-sparkplug-primary/third_party/primaryapi"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
+)
+
+var requests = promauto.NewCounterVec(prometheus.CounterOpts{Name: "sparkplug_primary_grpc_requests_total", Help: "gRPC calls by method and status code"}, []string{"method", "code"})
+
+// The settings of the gRPC server
+type Config struct {
+	Address     string // The TCP listen address
+	TLSCertFile string // Serves via TLS if given
+	TLSKeyFile  string
+	MaxStreams  int  // The maximum number of concurrent streaming calls of all clients
+	Reflection  bool // Serves the reflection service describing the API
+}
+
+// Returns an error if the address or the TLS files are invalid
+func (c Config) Validate() error {
+	if _, _, err := net.SplitHostPort(c.Address); err != nil {
+		return fmt.Errorf("invalid address %q: %v", c.Address, err)
+	}
+	if (c.TLSCertFile == "") != (c.TLSKeyFile == "") {
+		return errors.New("TLS certificate and key file must be given together")
+	}
+	if c.MaxStreams < 1 {
+		return fmt.Errorf("max streams must be positive, got %d", c.MaxStreams)
+	}
+	return nil
+}
+
+// Publishes the commands and passes on the received messages, implemented by the sparkplug client
+type Client interface {
+	SendCommand(groupID, nodeID, deviceID string, metrics []sparkplug.CommandMetric) error
+	RequestRebirth(groupID, nodeID string) error
+	AddMessageHandler(handler func(sparkplug.RawMessage))
+}
+
+// Serves the store, metric updates, received messages and commands via gRPC.
+// Clients authenticate with the credentials of the API in the authorization or x-api-key metadata.
+type Server struct {
+	primaryapi.UnimplementedPrimaryServer
+
+	cfg      Config
+	sm       *store.StoreManager
+	client   Client
+	auditLog *audit.Log
+	auth     *auth.Authenticator // nil if authentication is disabled
+	hub      *hub
+	grpc     *grpc.Server
+}
+
+// Starts listening on the configured address
+func Start(cfg Config, sm *store.StoreManager, client Client, auditLog *audit.Log, authenticator *auth.Authenticator) (*Server, error) {
+	s, err := newServer(cfg, sm, client, auditLog, authenticator)
+	if err != nil {
+		return nil, err
+	}
+	listener, err := net.Listen("tcp", cfg.Address)
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		if err := s.grpc.Serve(listener); err != nil {
+			logrus.Fatalf("gRPC server on %s failed: %v", cfg.Address, err)
+		}
+	}()
+	logrus.Infof("Serving gRPC on %s", listener.Addr())
+	return s, nil
+}
+
+// Creates the server with the registered services, which serves once a listener is passed to its gRPC server
+func newServer(cfg Config, sm *store.StoreManager, client Client, auditLog *audit.Log, authenticator *auth.Authenticator) (*Server, error) {
+	s := &Server{
+		cfg:      cfg,
+		sm:       sm,
+		client:   client,
+		auditLog: auditLog,
+		auth:     authenticator,
+	}
+	opts := []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(s.interceptUnary),
+		grpc.ChainStreamInterceptor(s.interceptStream),
+	}
+	if cfg.TLSCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.TLSCertFile, cfg.TLSKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, grpc.Creds(credentials.NewTLS(&tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12})))
+	}
+
+	s.hub = newHub(client)
+	s.grpc = grpc.NewServer(opts...)
+	primaryapi.RegisterPrimaryServer(s.grpc, s)
+	if cfg.Reflection {
+		// lets tools like grpcurl discover the service without the proto files
+		reflection.Register(s.grpc)
+	}
+	return s, nil
+}
+
+// Ends the streams and waits for the running calls to finish until the context is done
+func (s *Server) Shutdown(ctx context.Context) {
+	s.hub.close()
+	done := make(chan struct{})
+	go func() {
+		s.grpc.GracefulStop()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		s.grpc.Stop()
+	}
+}
+
+// The context key of the authenticated principal
+type principalKey struct{}
+
+// Returns the principal set by the interceptors
+func principal(ctx context.Context) *auth.Principal {
+	return ctx.Value(principalKey{}).(*auth.Principal)
+}
+
+// Returns the IP address of the client
+func sourceIP(ctx context.Context) string {
+	if p, ok := peer.FromContext(ctx); ok {
+		if host, _, err := net.SplitHostPort(p.Addr.String()); err == nil {
+			return host
+		}
+	}
+	return ""
+}
+
+// Returns the context with the principal of the call, which must have the viewer role for at least one group or node
+func (s *Server) authenticate(ctx context.Context) (context.Context, error) {
+	p := auth.Unrestricted
+	if s.auth != nil {
+		// the metadata carries the same credentials as the HTTP headers of the API
+		md, _ := metadata.FromIncomingContext(ctx)
+		r := &http.Request{Header: make(http.Header)}
+		for _, key := range []string{"Authorization", auth.APIKeyHeader} {
+			if values := md.Get(strings.ToLower(key)); len(values) > 0 {
+				r.Header.Set(key, values[0])
+			}
+		}
+		var err error
+		if p, err = s.auth.Authenticate(r); err != nil {
+			return nil, status.Error(codes.Unauthenticated, err.Error())
+		}
+	}
+	if !p.AllowsAny(auth.Viewer) {
+		return nil, status.Error(codes.PermissionDenied, "forbidden")
+	}
+	return context.WithValue(ctx, principalKey{}, p), nil
+}
+
+func (s *Server) interceptUnary(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	ctx, err := s.authenticate(ctx)
+	var resp any
+	if err == nil {
+		resp, err = handler(ctx, req)
+	}
+	requests.WithLabelValues(path.Base(info.FullMethod), status.Code(err).String()).Inc()
+	return resp, err
+}
+
+func (s *Server) interceptStream(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, err := s.authenticate(ss.Context())
+	if err == nil {
+		err = handler(srv, &serverStream{ServerStream: ss, ctx: ctx})
+	}
+	requests.WithLabelValues(path.Base(info.FullMethod), status.Code(err).String()).Inc()
+	return err
+}
+
+// A server stream with the context of the authenticated principal
+type serverStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *serverStream) Context() context.Context {
+	return s.ctx
+}
@@ -0,0 +1,327 @@
+package grpcapi
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/audit"
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/auth"
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/sparkplug"
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/store"
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/store/storetest"
+	"github.com/DATATRONiQ/go-sparkplug-primary/third_party/primaryapi"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// The API keys of the test server
+const (
+	operatorKey    = "operator-key"
+	viewerKey      = "viewer-key"
+	otherViewerKey = "other-viewer-key"
+)
+
+const credentialsYAML = `apiKeys:
+  - name: operator
+    key: operator-key
+    roles: [operator]
+  - name: viewer
+    key: viewer-key
+    roles: [viewer]
+  - name: other-viewer
+    key: other-viewer-key
+    roles: ["viewer:g2"]
+`
+
+// Records the commands like storetest.Commander and lets the test pass on received messages
+type testClient struct {
+	storetest.Commander
+	mu       sync.Mutex
+	handlers []func(sparkplug.RawMessage)
+}
+
+func (c *testClient) AddMessageHandler(handler func(sparkplug.RawMessage)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.handlers = append(c.handlers, handler)
+}
+
+// Passes the message to the handlers as if it was received from the broker
+func (c *testClient) receive(m sparkplug.RawMessage) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, handler := range c.handlers {
+		handler(m)
+	}
+}
+
+// A server on an in-memory listener with the edge node g1/n1 and its metric temp
+type testServer struct {
+	*Server
+	t        *testing.T
+	store    *storetest.Store
+	client   *testClient
+	auditLog *audit.Log
+	listener *bufconn.Listener
+}
+
+func startServer(t *testing.T) *testServer {
+	t.Helper()
+	st := storetest.New(t)
+	auditLog, err := audit.Open("", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	credentialsFile := filepath.Join(t.TempDir(), "credentials.yaml")
+	if err := os.WriteFile(credentialsFile, []byte(credentialsYAML), 0600); err != nil {
+		t.Fatal(err)
+	}
+	authenticator, err := auth.New(auth.Config{CredentialsFile: credentialsFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := &testClient{}
+	s, err := newServer(Config{Address: "bufconn:0", MaxStreams: 10}, st.StoreManager, client, auditLog, authenticator)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener := bufconn.Listen(1 << 20)
+	go s.grpc.Serve(listener)
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		s.Shutdown(ctx)
+	})
+	ts := &testServer{Server: s, t: t, store: st, client: client, auditLog: auditLog, listener: listener}
+	ts.publish(store.NodeBirth, 0, 21)
+	return ts
+}
+
+// Passes a message with the value of temp to the store and waits until it is processed
+func (ts *testServer) publish(msgType store.Type, seq uint64, value int64) {
+	ts.t.Helper()
+	ts.store.PublishMetric(ts.t, "g1", "n1", msgType, seq, storetest.Int64Metric("temp", 1, value))
+}
+
+// Connects a client, which sends the credentials given by the context of each call.
+// The fixed window size keeps the transport from buffering more than 64 KiB of a stream the client does not read.
+func (ts *testServer) connect() primaryapi.PrimaryClient {
+	ts.t.Helper()
+	conn, err := grpc.Dial("bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return ts.listener.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithInitialWindowSize(1<<16),
+		grpc.WithInitialConnWindowSize(1<<16),
+	)
+	if err != nil {
+		ts.t.Fatal(err)
+	}
+	ts.t.Cleanup(func() { conn.Close() })
+	return primaryapi.NewPrimaryClient(conn)
+}
+
+// Returns a context sending the API key, cancelled at the end of the test
+func (ts *testServer) context(key string) context.Context {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	ts.t.Cleanup(cancel)
+	if key == "" {
+		return ctx
+	}
+	return metadata.AppendToOutgoingContext(ctx, "x-api-key", key)
+}
+
+// Waits until the given number of streams subscribed to the hub
+func (ts *testServer) waitForStreams(n int) {
+	ts.t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		ts.hub.mu.RLock()
+		count := len(ts.hub.streams)
+		ts.hub.mu.RUnlock()
+		if count == n {
+			return
+		}
+	}
+	ts.t.Fatalf("%d streams did not subscribe", n)
+}
+
+func TestAuthentication(t *testing.T) {
+	ts := startServer(t)
+	client := ts.connect()
+
+	tests := []struct {
+		name string
+		ctx  context.Context
+		code codes.Code
+	}{
+		{"no credentials", ts.context(""), codes.Unauthenticated},
+		{"invalid key", ts.context("invalid"), codes.Unauthenticated},
+		{"bearer token", metadata.AppendToOutgoingContext(ts.context(""), "authorization", "Bearer invalid"), codes.Unauthenticated},
+		{"viewer", ts.context(viewerKey), codes.OK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := client.ListGroups(tt.ctx, &primaryapi.ListGroupsRequest{}); status.Code(err) != tt.code {
+				t.Errorf("ListGroups: %v, want %s", err, tt.code)
+			}
+			stream, err := client.StreamMetricUpdates(tt.ctx, &primaryapi.StreamMetricUpdatesRequest{CurrentValues: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := stream.Recv(); status.Code(err) != tt.code {
+				t.Errorf("StreamMetricUpdates: %v, want %s", err, tt.code)
+			}
+		})
+	}
+}
+
+func TestScope(t *testing.T) {
+	ts := startServer(t)
+	client := ts.connect()
+	ctx := ts.context(otherViewerKey)
+
+	resp, err := client.ListGroups(ctx, &primaryapi.ListGroupsRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Groups) != 0 {
+		t.Errorf("groups: %v", resp.Groups)
+	}
+	if _, err := client.GetNode(ctx, &primaryapi.GetNodeRequest{GroupId: "g1", NodeId: "n1"}); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("GetNode: %v", err)
+	}
+	read, err := client.ReadMetrics(ctx, &primaryapi.ReadMetricsRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(read.Metrics) != 0 {
+		t.Errorf("metrics: %v", read.Metrics)
+	}
+
+	// the viewer of g1 sees the node
+	node, err := ts.connect().GetNode(ts.context(viewerKey), &primaryapi.GetNodeRequest{GroupId: "g1", NodeId: "n1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(node.Metrics) != 1 || node.Metrics[0].Value.GetIntValue() != 21 {
+		t.Errorf("metrics: %v", node.Metrics)
+	}
+}
+
+func TestWriteMetrics(t *testing.T) {
+	ts := startServer(t)
+	req := &primaryapi.WriteMetricsRequest{GroupId: "g1", NodeId: "n1", Metrics: []*primaryapi.MetricWrite{
+		{Name: "temp", Value: &primaryapi.Value{Kind: &primaryapi.Value_IntValue{IntValue: 42}}},
+	}}
+
+	if _, err := ts.connect().WriteMetrics(ts.context(viewerKey), req); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("viewer: %v", err)
+	}
+	if len(ts.client.Commands()) != 0 {
+		t.Fatalf("commands: %+v", ts.client.Commands())
+	}
+
+	if _, err := ts.connect().WriteMetrics(ts.context(operatorKey), req); err != nil {
+		t.Fatal(err)
+	}
+	commands := ts.client.Commands()
+	if len(commands) != 1 || commands[0].Name != "temp" || commands[0].DataType.String() != "Int64" || commands[0].Value != int64(42) {
+		t.Errorf("commands: %+v", commands)
+	}
+	entries, err := ts.auditLog.Query(audit.Filter{Action: audit.Command})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Principal != "operator" || entries[0].Source != audit.GRPC {
+		t.Errorf("audit: %+v", entries)
+	}
+}
+
+func TestStreamMetricUpdates(t *testing.T) {
+	ts := startServer(t)
+	stream, err := ts.connect().StreamMetricUpdates(ts.context(viewerKey), &primaryapi.StreamMetricUpdatesRequest{CurrentValues: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	current, err := stream.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if current.Path != "g1/n1/temp" || current.Value.GetIntValue() != 21 {
+		t.Errorf("current value: %v", current)
+	}
+
+	// the stream subscribed before sending the current values
+	ts.publish(store.NodeData, 1, 22)
+	update, err := stream.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if update.Path != "g1/n1/temp" || update.Value.GetIntValue() != 22 {
+		t.Errorf("update: %v", update)
+	}
+}
+
+func TestStreamMessagesScope(t *testing.T) {
+	ts := startServer(t)
+	other, err := ts.connect().StreamMessages(ts.context(otherViewerKey), &primaryapi.StreamMessagesRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts.waitForStreams(1)
+	ts.client.receive(sparkplug.RawMessage{Topic: "spBv1.0/g1/NDATA/n1", GroupID: "g1", Type: store.NodeData, NodeID: "n1", ReceivedAt: time.Now()})
+	ts.client.receive(sparkplug.RawMessage{Topic: "spBv1.0/g2/NDATA/n1", GroupID: "g2", Type: store.NodeData, NodeID: "n1", ReceivedAt: time.Now()})
+
+	// the message of g1 is not sent to the viewer of g2
+	m, err := other.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Topic != "spBv1.0/g2/NDATA/n1" || m.MessageType != "NDATA" {
+		t.Errorf("message: %v", m)
+	}
+}
+
+func TestStreamOverflow(t *testing.T) {
+	ts := startServer(t)
+	stream, err := ts.connect().StreamMessages(ts.context(viewerKey), &primaryapi.StreamMessagesRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts.waitForStreams(1)
+
+	// the flow control window holds only a few of the messages the client does not read yet
+	payload := make([]byte, 4096)
+	for i := 0; i < 2*streamBuffer; i++ {
+		ts.client.receive(sparkplug.RawMessage{Topic: "spBv1.0/g1/NDATA/n1", GroupID: "g1", Type: store.NodeData, NodeID: "n1", DeviceID: strconv.Itoa(i), Payload: payload})
+	}
+
+	// the messages before the overflow arrive without a gap
+	received := 0
+	for {
+		m, err := stream.Recv()
+		if err != nil {
+			if status.Code(err) != codes.ResourceExhausted {
+				t.Fatalf("after %d messages: %v", received, err)
+			}
+			break
+		}
+		if m.DeviceId != strconv.Itoa(received) {
+			t.Fatalf("message %d: got %s", received, m.DeviceId)
+		}
+		received++
+	}
+	if received < streamBuffer || received >= 2*streamBuffer {
+		t.Errorf("received %d messages", received)
+	}
+}
@@ -0,0 +1,357 @@
+package grpcapi
+
+import (
+	"context"
+	"errors"
+	"regexp"
+
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/audit"
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/auth"
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/sparkplug"
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/store"
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/util"
+	"github.com/DATATRONiQ/go-sparkplug-primary/third_party/primaryapi"
+	"github.com/DATATRONiQ/go-sparkplug-primary/third_party/sparkplugb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var messageTypes = []store.Type{
+	store.NodeBirth, store.NodeDeath, store.NodeData, store.NodeCommand,
+	store.DeviceBirth, store.DeviceDeath, store.DeviceData, store.DeviceCommand,
+}
+
+// Returns the glob patterns, or an InvalidArgument error naming the field
+func globs(field string, patterns []string) ([]*regexp.Regexp, error) {
+	result := make([]*regexp.Regexp, 0, len(patterns))
+	for _, pattern := range patterns {
+		glob, err := util.Glob(pattern)
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "%s: %v", field, err)
+		}
+		result = append(result, glob)
+	}
+	return result, nil
+}
+
+// Returns a matcher of the paths matching any include pattern, or all if there are none, and no exclude pattern
+func pathMatcher(include, exclude []string) (func(path string) bool, error) {
+	includeGlobs, err := globs("include", include)
+	if err != nil {
+		return nil, err
+	}
+	excludeGlobs, err := globs("exclude", exclude)
+	if err != nil {
+		return nil, err
+	}
+	matchesAny := func(globs []*regexp.Regexp, path string) bool {
+		for _, glob := range globs {
+			if glob.MatchString(path) {
+				return true
+			}
+		}
+		return false
+	}
+	return func(path string) bool {
+		return (len(includeGlobs) == 0 || matchesAny(includeGlobs, path)) && !matchesAny(excludeGlobs, path)
+	}, nil
+}
+
+// Returns the nodes of all groups the principal may view
+func (s *Server) visibleNodes(p *auth.Principal) []store.FetchedNode {
+	var nodes []store.FetchedNode
+	for _, group := range *s.sm.Fetch() {
+		for _, n := range group.Nodes {
+			if p.Allows(auth.Viewer, group.ID, n.ID) {
+				nodes = append(nodes, n)
+			}
+		}
+	}
+	return nodes
+}
+
+// Returns the node, or a PermissionDenied or NotFound error
+func (s *Server) fetchNode(ctx context.Context, groupID, nodeID string) (*store.FetchedNode, error) {
+	if !principal(ctx).Allows(auth.Viewer, groupID, nodeID) {
+		return nil, status.Error(codes.PermissionDenied, "forbidden")
+	}
+	n, ok := s.sm.FetchNode(groupID, nodeID)
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "node %s/%s not found", groupID, nodeID)
+	}
+	return n, nil
+}
+
+func (s *Server) ListGroups(ctx context.Context, req *primaryapi.ListGroupsRequest) (*primaryapi.ListGroupsResponse, error) {
+	p := principal(ctx)
+	resp := &primaryapi.ListGroupsResponse{Groups: make([]*primaryapi.Group, 0)}
+	for _, g := range *s.sm.Fetch() {
+		if len(req.GroupIds) > 0 && !util.Contains(req.GroupIds, g.ID) {
+			continue
+		}
+		group := &primaryapi.Group{Id: g.ID, LastMessageAt: timestamp(g.LastMessageAt)}
+		for _, n := range g.Nodes {
+			if p.Allows(auth.Viewer, g.ID, n.ID) {
+				group.Nodes = append(group.Nodes, node(n, req.IncludeMetrics))
+			}
+		}
+		// groups are visible with their nodes, or as a whole with a role for the group
+		if len(group.Nodes) > 0 || p.Allows(auth.Viewer, g.ID, "") {
+			resp.Groups = append(resp.Groups, group)
+		}
+	}
+	return resp, nil
+}
+
+func (s *Server) GetNode(ctx context.Context, req *primaryapi.GetNodeRequest) (*primaryapi.Node, error) {
+	n, err := s.fetchNode(ctx, req.GroupId, req.NodeId)
+	if err != nil {
+		return nil, err
+	}
+	return node(*n, true), nil
+}
+
+func (s *Server) GetDevice(ctx context.Context, req *primaryapi.GetDeviceRequest) (*primaryapi.Device, error) {
+	n, err := s.fetchNode(ctx, req.GroupId, req.NodeId)
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range n.Devices {
+		if d.ID == req.DeviceId {
+			return device(d, true), nil
+		}
+	}
+	return nil, status.Errorf(codes.NotFound, "device %s/%s/%s not found", req.GroupId, req.NodeId, req.DeviceId)
+}
+
+func (s *Server) ReadMetrics(ctx context.Context, req *primaryapi.ReadMetricsRequest) (*primaryapi.ReadMetricsResponse, error) {
+	matches, err := pathMatcher(req.Include, req.Exclude)
+	if err != nil {
+		return nil, err
+	}
+	return &primaryapi.ReadMetricsResponse{Metrics: s.currentMetrics(principal(ctx), matches, "", "", "")}, nil
+}
+
+// Returns the current values of the visible metrics of the given entity (any if empty) whose paths match
+func (s *Server) currentMetrics(p *auth.Principal, matches func(path string) bool, groupID, nodeID, deviceID string) []*primaryapi.Metric {
+	metrics := make([]*primaryapi.Metric, 0)
+	for _, n := range s.visibleNodes(p) {
+		if (groupID != "" && n.GroupID != groupID) || (nodeID != "" && n.ID != nodeID) {
+			continue
+		}
+		if deviceID == "" {
+			for _, m := range n.Metrics {
+				if matches(metricPath(n.GroupID, n.ID, "", m.Name)) {
+					metrics = append(metrics, metric(m, n.GroupID, n.ID, ""))
+				}
+			}
+		}
+		for _, d := range n.Devices {
+			if deviceID != "" && d.ID != deviceID {
+				continue
+			}
+			for _, m := range d.Metrics {
+				if matches(metricPath(n.GroupID, n.ID, d.ID, m.Name)) {
+					metrics = append(metrics, metric(m, n.GroupID, n.ID, d.ID))
+				}
+			}
+		}
+	}
+	return metrics
+}
+
+func (s *Server) StreamMetricUpdates(req *primaryapi.StreamMetricUpdatesRequest, srv primaryapi.Primary_StreamMetricUpdatesServer) error {
+	matches, err := pathMatcher(req.Include, req.Exclude)
+	if err != nil {
+		return err
+	}
+	p := principal(srv.Context())
+	sub, err := s.hub.subscribe("StreamMetricUpdates", s.cfg.MaxStreams, func(event any) bool {
+		u, ok := event.(store.MetricUpdate)
+		return ok &&
+			(req.GroupId == "" || u.GroupID == req.GroupId) &&
+			(req.NodeId == "" || u.NodeID == req.NodeId) &&
+			(req.DeviceId == "" || u.DeviceID == req.DeviceId) &&
+			p.Allows(auth.Viewer, u.GroupID, u.NodeID) &&
+			matches(u.Path())
+	})
+	if err != nil {
+		return err
+	}
+	defer s.hub.unsubscribe(sub)
+
+	// subscribed first, so no update is missed between the current values and the stream
+	if req.CurrentValues {
+		for _, m := range s.currentMetrics(p, matches, req.GroupId, req.NodeId, req.DeviceId) {
+			if err := srv.Send(&primaryapi.MetricUpdate{
+				Name: m.Name, Path: m.Path, GroupId: m.GroupId, NodeId: m.NodeId, DeviceId: m.DeviceId, DataType: m.DataType,
+				Value: m.Value, Timestamp: m.Timestamp, Units: m.Units, Quality: m.Quality,
+			}); err != nil {
+				return err
+			}
+		}
+	}
+	return s.forward(srv, sub, func(event any) error {
+		return srv.Send(metricUpdate(event.(store.MetricUpdate)))
+	})
+}
+
+func (s *Server) StreamMessages(req *primaryapi.StreamMessagesRequest, srv primaryapi.Primary_StreamMessagesServer) error {
+	types := make([]store.Type, 0, len(req.MessageTypes))
+	for _, name := range req.MessageTypes {
+		if !util.Contains(messageTypes, store.Type(name)) {
+			return status.Errorf(codes.InvalidArgument, "unknown message type %q", name)
+		}
+		types = append(types, store.Type(name))
+	}
+	p := principal(srv.Context())
+	sub, err := s.hub.subscribe("StreamMessages", s.cfg.MaxStreams, func(event any) bool {
+		m, ok := event.(sparkplug.RawMessage)
+		return ok &&
+			(req.GroupId == "" || m.GroupID == req.GroupId) &&
+			(req.NodeId == "" || m.NodeID == req.NodeId) &&
+			(len(types) == 0 || util.Contains(types, m.Type)) &&
+			p.Allows(auth.Viewer, m.GroupID, m.NodeID)
+	})
+	if err != nil {
+		return err
+	}
+	defer s.hub.unsubscribe(sub)
+
+	return s.forward(srv, sub, func(event any) error {
+		return srv.Send(message(event.(sparkplug.RawMessage)))
+	})
+}
+
+// Sends the events of the stream until the client cancels the call, the server shuts down or the client did not keep up
+func (s *Server) forward(srv grpc.ServerStream, sub *stream, send func(event any) error) error {
+	for {
+		select {
+		case <-srv.Context().Done():
+			return status.FromContextError(srv.Context().Err()).Err()
+		case <-s.hub.done:
+			return status.Error(codes.Unavailable, "server shutting down")
+		case <-sub.overflow:
+			// the buffered events precede the gap, so the client receives them before the stream ends
+			for len(sub.events) > 0 {
+				if err := send(<-sub.events); err != nil {
+					return err
+				}
+			}
+			return status.Errorf(codes.ResourceExhausted, "the client did not keep up with the stream, more than %d events were pending", streamBuffer)
+		case event := <-sub.events:
+			if err := send(event); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// Returns the value of a command metric as expected by the sparkplug client
+func commandValue(v *primaryapi.Value) (any, error) {
+	switch kind := v.GetKind().(type) {
+	case nil:
+		return nil, nil
+	case *primaryapi.Value_BoolValue:
+		return kind.BoolValue, nil
+	case *primaryapi.Value_IntValue:
+		return kind.IntValue, nil
+	case *primaryapi.Value_UintValue:
+		return kind.UintValue, nil
+	case *primaryapi.Value_DoubleValue:
+		return kind.DoubleValue, nil
+	case *primaryapi.Value_StringValue:
+		return kind.StringValue, nil
+	}
+	return nil, errors.New("unsupported value")
+}
+
+func (s *Server) WriteMetrics(ctx context.Context, req *primaryapi.WriteMetricsRequest) (*primaryapi.WriteMetricsResponse, error) {
+	if !principal(ctx).Allows(auth.Operator, req.GroupId, req.NodeId) {
+		return nil, status.Error(codes.PermissionDenied, "forbidden")
+	}
+	if len(req.Metrics) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "at least one metric is required")
+	}
+
+	known := make(map[string]store.FetchedMetric)
+	knownMetrics, _ := s.sm.FetchMetrics(req.GroupId, req.NodeId, req.DeviceId)
+	for _, m := range knownMetrics {
+		known[m.Name] = m
+	}
+
+	metrics := make([]sparkplug.CommandMetric, 0, len(req.Metrics))
+	auditMetrics := make([]audit.Metric, 0, len(req.Metrics))
+	for _, m := range req.Metrics {
+		if m.Name == "" {
+			return nil, status.Error(codes.InvalidArgument, "metric name is required")
+		}
+		dataTypeName := m.DataType
+		if dataTypeName == "" {
+			dataTypeName = known[m.Name].DataType
+		}
+		dataType, ok := sparkplugb.DataType_value[dataTypeName]
+		if !ok {
+			return nil, status.Errorf(codes.InvalidArgument, "metric %s: unknown data type %q, give the data type of metrics not in the birth certificate", m.Name, dataTypeName)
+		}
+		v, err := commandValue(m.Value)
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "metric %s: %v", m.Name, err)
+		}
+		metrics = append(metrics, sparkplug.CommandMetric{Name: m.Name, DataType: sparkplugb.DataType(dataType), Value: v})
+		auditMetrics = append(auditMetrics, audit.Metric{Name: m.Name, DataType: dataTypeName, OldValue: known[m.Name].Value, NewValue: v})
+	}
+
+	err := s.client.SendCommand(req.GroupId, req.NodeId, req.DeviceId, metrics)
+	entry := s.auditEntry(ctx, audit.Command, req.GroupId, req.NodeId, err)
+	entry.DeviceID = req.DeviceId
+	entry.Metrics = auditMetrics
+	s.auditLog.Record(entry)
+	if err != nil {
+		return nil, commandError(err)
+	}
+	return &primaryapi.WriteMetricsResponse{}, nil
+}
+
+func (s *Server) RequestRebirth(ctx context.Context, req *primaryapi.RequestRebirthRequest) (*primaryapi.RequestRebirthResponse, error) {
+	p := principal(ctx)
+	if !p.Allows(auth.Operator, req.GroupId, req.NodeId) {
+		return nil, status.Error(codes.PermissionDenied, "forbidden")
+	}
+	err := s.client.RequestRebirth(req.GroupId, req.NodeId)
+	s.auditLog.Record(s.auditEntry(ctx, audit.Rebirth, req.GroupId, req.NodeId, err))
+	if err != nil {
+		return nil, commandError(err)
+	}
+	s.sm.RecordRebirthRequest(req.GroupId, req.NodeId, "requested via gRPC by "+p.Name)
+	return &primaryapi.RequestRebirthResponse{}, nil
+}
+
+// Returns the audit entry of a command or rebirth request of the caller
+func (s *Server) auditEntry(ctx context.Context, action audit.Action, groupID, nodeID string, err error) audit.Entry {
+	entry := audit.Entry{
+		Action:    action,
+		Source:    audit.GRPC,
+		Principal: principal(ctx).Name,
+		SourceIP:  sourceIP(ctx),
+		GroupID:   groupID,
+		NodeID:    nodeID,
+		Success:   err == nil,
+	}
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	return entry
+}
+
+// Returns the status of an error publishing a command
+func commandError(err error) error {
+	switch {
+	case errors.Is(err, sparkplug.ErrInvalidCommand):
+		return status.Error(codes.InvalidArgument, err.Error())
+	case errors.Is(err, sparkplug.ErrStandby):
+		return status.Error(codes.Unavailable, err.Error())
+	}
+	return status.Error(codes.Internal, err.Error())
+}
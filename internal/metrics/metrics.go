@@ -0,0 +1,33 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// The default buckets of latency histograms in seconds
+var DefaultBuckets = []float64{0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5}
+
+// A gauge whose samples are computed when scraped
+type gaugeFunc struct {
+	desc    *prometheus.Desc
+	collect func(emit func(v float64, labelValues ...string))
+}
+
+// Registers a gauge computed by the given function when scraped in the default registry, replacing a gauge of the same name.
+// The function emits one sample per combination of label values. Gauges bound to an instance (e.g. of the store manager)
+// are thereby taken over by a newly created instance.
+func NewGaugeFunc(name, help string, labels []string, collect func(emit func(v float64, labelValues ...string))) {
+	g := &gaugeFunc{desc: prometheus.NewDesc(name, help, labels, nil), collect: collect}
+	prometheus.Unregister(g)
+	prometheus.MustRegister(g)
+}
+
+func (g *gaugeFunc) Describe(ch chan<- *prometheus.Desc) {
+	ch <- g.desc
+}
+
+func (g *gaugeFunc) Collect(ch chan<- prometheus.Metric) {
+	g.collect(func(v float64, labelValues ...string) {
+		ch <- prometheus.MustNewConstMetric(g.desc, prometheus.GaugeValue, v, labelValues...)
+	})
+}
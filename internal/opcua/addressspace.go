@@ -0,0 +1,486 @@
+package opcua
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/auth"
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/store"
+	"github.com/gopcua/opcua/id"
+	"github.com/gopcua/opcua/ua"
+)
+
+// The namespace of the Sparkplug hierarchy, its node IDs are the paths of the groups, edge nodes, devices and metrics
+const sparkplugNamespace = 1
+
+// The kinds of nodes
+type nodeKind int
+
+const (
+	standardNode nodeKind = iota // a node of namespace 0
+	groupNode
+	edgeNodeNode
+	deviceNode
+	metricNode
+)
+
+// A node of the address space, as seen by a single request
+type node struct {
+	kind        nodeKind
+	id          *ua.NodeID
+	class       ua.NodeClass
+	browseName  ua.QualifiedName
+	description string
+	typeDef     uint32 // the type definition of objects and variables
+
+	standard *standardDefinition // the definition of standard nodes
+
+	// the Sparkplug entity of the node, the device ID is empty for edge nodes and their metrics
+	groupID, nodeID, deviceID string
+	metric                    *store.FetchedMetric
+	offline                   bool // whether the edge node or device of the metric is offline
+}
+
+// A reference of a node to another node
+type reference struct {
+	typeID  uint32
+	forward bool
+	target  *node
+}
+
+// The definition of a node of namespace 0
+type standardDefinition struct {
+	class     ua.NodeClass
+	name      string
+	typeDef   uint32
+	refs      [][2]uint32 // the forward references as reference type and target
+	abstract  bool        // of types
+	inverse   string      // the inverse name of reference types
+	dataType  uint32      // of variables
+	valueRank int32       // of variables
+	value     func(s *Server, now time.Time) *ua.Variant
+}
+
+func folder(name string, organizes ...uint32) *standardDefinition {
+	refs := make([][2]uint32, 0, len(organizes))
+	for _, target := range organizes {
+		refs = append(refs, [2]uint32{id.Organizes, target})
+	}
+	return &standardDefinition{class: ua.NodeClassObject, name: name, typeDef: id.FolderType, refs: refs}
+}
+
+func typeDefinition(class ua.NodeClass, name string, abstract bool, subtypes ...uint32) *standardDefinition {
+	refs := make([][2]uint32, 0, len(subtypes))
+	for _, target := range subtypes {
+		refs = append(refs, [2]uint32{id.HasSubtype, target})
+	}
+	return &standardDefinition{class: class, name: name, abstract: abstract, refs: refs}
+}
+
+func referenceType(name, inverse string, abstract bool, subtypes ...uint32) *standardDefinition {
+	d := typeDefinition(ua.NodeClassReferenceType, name, abstract, subtypes...)
+	d.inverse = inverse
+	return d
+}
+
+func variable(name string, typeDef, dataType uint32, valueRank int32, value func(s *Server, now time.Time) *ua.Variant) *standardDefinition {
+	return &standardDefinition{class: ua.NodeClassVariable, name: name, typeDef: typeDef, dataType: dataType, valueRank: valueRank, value: value}
+}
+
+// The nodes of namespace 0: the folders, the server object and the types used by the address space
+var standardNodes = map[uint32]*standardDefinition{
+	id.RootFolder:           folder("Root", id.ObjectsFolder, id.TypesFolder, id.ViewsFolder),
+	id.ObjectsFolder:        folder("Objects", id.Server),
+	id.TypesFolder:          folder("Types", id.ObjectTypesFolder, id.VariableTypesFolder, id.DataTypesFolder, id.ReferenceTypesFolder),
+	id.ViewsFolder:          folder("Views"),
+	id.ObjectTypesFolder:    folder("ObjectTypes", id.BaseObjectType),
+	id.VariableTypesFolder:  folder("VariableTypes", id.BaseVariableType),
+	id.DataTypesFolder:      folder("DataTypes", id.BaseDataType),
+	id.ReferenceTypesFolder: folder("ReferenceTypes", id.References),
+
+	id.Server: {class: ua.NodeClassObject, name: "Server", typeDef: id.ServerType, refs: [][2]uint32{
+		{id.HasProperty, id.Server_ServerArray}, {id.HasProperty, id.Server_NamespaceArray}, {id.HasComponent, id.Server_ServerStatus},
+	}},
+	id.Server_ServerArray: variable("ServerArray", id.PropertyType, id.String, 1, func(s *Server, now time.Time) *ua.Variant {
+		return ua.MustVariant([]string{ApplicationURI})
+	}),
+	id.Server_NamespaceArray: variable("NamespaceArray", id.PropertyType, id.String, 1, func(s *Server, now time.Time) *ua.Variant {
+		return ua.MustVariant([]string{"http://opcfoundation.org/UA/", NamespaceURI})
+	}),
+	id.Server_ServerStatus: {class: ua.NodeClassVariable, name: "ServerStatus", typeDef: id.ServerStatusType, dataType: id.ServerStatusDataType, valueRank: -1,
+		refs: [][2]uint32{
+			{id.HasComponent, id.Server_ServerStatus_StartTime}, {id.HasComponent, id.Server_ServerStatus_CurrentTime}, {id.HasComponent, id.Server_ServerStatus_State},
+		},
+		value: func(s *Server, now time.Time) *ua.Variant {
+			return ua.MustVariant(ua.NewExtensionObject(s.serverStatus(now)))
+		},
+	},
+	id.Server_ServerStatus_StartTime: variable("StartTime", id.BaseDataVariableType, id.DateTime, -1, func(s *Server, now time.Time) *ua.Variant {
+		return ua.MustVariant(s.started)
+	}),
+	id.Server_ServerStatus_CurrentTime: variable("CurrentTime", id.BaseDataVariableType, id.DateTime, -1, func(s *Server, now time.Time) *ua.Variant {
+		return ua.MustVariant(now)
+	}),
+	id.Server_ServerStatus_State: variable("State", id.BaseDataVariableType, id.ServerState, -1, func(s *Server, now time.Time) *ua.Variant {
+		return ua.MustVariant(int32(ua.ServerStateRunning))
+	}),
+
+	id.BaseObjectType:       typeDefinition(ua.NodeClassObjectType, "BaseObjectType", false, id.FolderType, id.ServerType),
+	id.FolderType:           typeDefinition(ua.NodeClassObjectType, "FolderType", false),
+	id.ServerType:           typeDefinition(ua.NodeClassObjectType, "ServerType", false),
+	id.BaseVariableType:     typeDefinition(ua.NodeClassVariableType, "BaseVariableType", true, id.BaseDataVariableType, id.PropertyType),
+	id.BaseDataVariableType: typeDefinition(ua.NodeClassVariableType, "BaseDataVariableType", false, id.ServerStatusType),
+	id.PropertyType:         typeDefinition(ua.NodeClassVariableType, "PropertyType", false),
+	id.ServerStatusType:     typeDefinition(ua.NodeClassVariableType, "ServerStatusType", false),
+
+	id.BaseDataType: typeDefinition(ua.NodeClassDataType, "BaseDataType", true, id.Boolean, id.Number, id.String, id.DateTime,
+		id.ByteString, id.NodeID, id.StatusCode, id.QualifiedName, id.LocalizedText, id.Structure, id.Enumeration),
+	id.Number:               typeDefinition(ua.NodeClassDataType, "Number", true, id.Integer, id.UInteger, id.Float, id.Double),
+	id.Integer:              typeDefinition(ua.NodeClassDataType, "Integer", true, id.SByte, id.Int16, id.Int32, id.Int64),
+	id.UInteger:             typeDefinition(ua.NodeClassDataType, "UInteger", true, id.Byte, id.UInt16, id.UInt32, id.UInt64),
+	id.Boolean:              typeDefinition(ua.NodeClassDataType, "Boolean", false),
+	id.SByte:                typeDefinition(ua.NodeClassDataType, "SByte", false),
+	id.Byte:                 typeDefinition(ua.NodeClassDataType, "Byte", false),
+	id.Int16:                typeDefinition(ua.NodeClassDataType, "Int16", false),
+	id.UInt16:               typeDefinition(ua.NodeClassDataType, "UInt16", false),
+	id.Int32:                typeDefinition(ua.NodeClassDataType, "Int32", false),
+	id.UInt32:               typeDefinition(ua.NodeClassDataType, "UInt32", false),
+	id.Int64:                typeDefinition(ua.NodeClassDataType, "Int64", false),
+	id.UInt64:               typeDefinition(ua.NodeClassDataType, "UInt64", false),
+	id.Float:                typeDefinition(ua.NodeClassDataType, "Float", false),
+	id.Double:               typeDefinition(ua.NodeClassDataType, "Double", false),
+	id.String:               typeDefinition(ua.NodeClassDataType, "String", false),
+	id.DateTime:             typeDefinition(ua.NodeClassDataType, "DateTime", false),
+	id.ByteString:           typeDefinition(ua.NodeClassDataType, "ByteString", false),
+	id.NodeID:               typeDefinition(ua.NodeClassDataType, "NodeId", false),
+	id.StatusCode:           typeDefinition(ua.NodeClassDataType, "StatusCode", false),
+	id.QualifiedName:        typeDefinition(ua.NodeClassDataType, "QualifiedName", false),
+	id.LocalizedText:        typeDefinition(ua.NodeClassDataType, "LocalizedText", false),
+	id.Structure:            typeDefinition(ua.NodeClassDataType, "Structure", true, id.ServerStatusDataType),
+	id.Enumeration:          typeDefinition(ua.NodeClassDataType, "Enumeration", true, id.ServerState),
+	id.ServerStatusDataType: typeDefinition(ua.NodeClassDataType, "ServerStatusDataType", false),
+	id.ServerState:          typeDefinition(ua.NodeClassDataType, "ServerState", false),
+
+	id.References:                referenceType("References", "", true, id.NonHierarchicalReferences, id.HierarchicalReferences),
+	id.NonHierarchicalReferences: referenceType("NonHierarchicalReferences", "", true, id.HasTypeDefinition),
+	id.HierarchicalReferences:    referenceType("HierarchicalReferences", "InverseHierarchicalReferences", true, id.HasChild, id.Organizes),
+	id.HasChild:                  referenceType("HasChild", "ChildOf", true, id.Aggregates, id.HasSubtype),
+	id.Aggregates:                referenceType("Aggregates", "AggregatedBy", true, id.HasProperty, id.HasComponent),
+	id.Organizes:                 referenceType("Organizes", "OrganizedBy", false),
+	id.HasTypeDefinition:         referenceType("HasTypeDefinition", "TypeDefinitionOf", false),
+	id.HasSubtype:                referenceType("HasSubtype", "SubtypeOf", false),
+	id.HasProperty:               referenceType("HasProperty", "PropertyOf", false),
+	id.HasComponent:              referenceType("HasComponent", "ComponentOf", false),
+}
+
+// The inverse references of the standard nodes by target, derived from their forward references
+var inverseReferences = make(map[uint32][][2]uint32)
+
+// The supertypes of the reference types
+var referenceSupertypes = make(map[uint32]uint32)
+
+func init() {
+	for source, d := range standardNodes {
+		for _, ref := range d.refs {
+			inverseReferences[ref[1]] = append(inverseReferences[ref[1]], [2]uint32{ref[0], source})
+			if ref[0] == id.HasSubtype && d.class == ua.NodeClassReferenceType {
+				referenceSupertypes[ref[1]] = source
+			}
+		}
+	}
+	for _, refs := range inverseReferences {
+		sort.Slice(refs, func(i, j int) bool { return refs[i][1] < refs[j][1] })
+	}
+}
+
+// Returns whether the reference type is the given type or, if subtypes are included, one of its subtypes
+func isReferenceType(typeID, filter uint32, includeSubtypes bool) bool {
+	for {
+		if typeID == filter {
+			return true
+		}
+		supertype, ok := referenceSupertypes[typeID]
+		if !includeSubtypes || !ok {
+			return false
+		}
+		typeID = supertype
+	}
+}
+
+// Returns the node of namespace 0, or nil if it is not known
+func standard(n uint32) *node {
+	d, ok := standardNodes[n]
+	if !ok {
+		return nil
+	}
+	return &node{
+		kind:       standardNode,
+		id:         ua.NewNumericNodeID(0, n),
+		class:      d.class,
+		browseName: ua.QualifiedName{Name: d.name},
+		typeDef:    d.typeDef,
+		standard:   d,
+	}
+}
+
+func newGroupNode(groupID string) *node {
+	return &node{
+		kind:        groupNode,
+		id:          ua.NewStringNodeID(sparkplugNamespace, groupID),
+		class:       ua.NodeClassObject,
+		browseName:  ua.QualifiedName{NamespaceIndex: sparkplugNamespace, Name: groupID},
+		description: "Sparkplug group",
+		typeDef:     id.FolderType,
+		groupID:     groupID,
+	}
+}
+
+func newEdgeNode(groupID, nodeID string) *node {
+	return &node{
+		kind:        edgeNodeNode,
+		id:          ua.NewStringNodeID(sparkplugNamespace, groupID+"/"+nodeID),
+		class:       ua.NodeClassObject,
+		browseName:  ua.QualifiedName{NamespaceIndex: sparkplugNamespace, Name: nodeID},
+		description: "Sparkplug edge node",
+		typeDef:     id.BaseObjectType,
+		groupID:     groupID,
+		nodeID:      nodeID,
+	}
+}
+
+func newDeviceNode(groupID, nodeID, deviceID string) *node {
+	return &node{
+		kind:        deviceNode,
+		id:          ua.NewStringNodeID(sparkplugNamespace, groupID+"/"+nodeID+"/"+deviceID),
+		class:       ua.NodeClassObject,
+		browseName:  ua.QualifiedName{NamespaceIndex: sparkplugNamespace, Name: deviceID},
+		description: "Sparkplug device",
+		typeDef:     id.BaseObjectType,
+		groupID:     groupID,
+		nodeID:      nodeID,
+		deviceID:    deviceID,
+	}
+}
+
+func newMetricNode(groupID, nodeID, deviceID string, m *store.FetchedMetric, offline bool) *node {
+	path := groupID + "/" + nodeID + "/"
+	if deviceID != "" {
+		path += deviceID + "/"
+	}
+	return &node{
+		kind:        metricNode,
+		id:          ua.NewStringNodeID(sparkplugNamespace, path+m.Name),
+		class:       ua.NodeClassVariable,
+		browseName:  ua.QualifiedName{NamespaceIndex: sparkplugNamespace, Name: m.Name},
+		description: m.Units,
+		typeDef:     id.BaseDataVariableType,
+		groupID:     groupID,
+		nodeID:      nodeID,
+		deviceID:    deviceID,
+		metric:      m,
+		offline:     offline,
+	}
+}
+
+// A snapshot of the store shared by the operations of a request or publishing cycle,
+// each edge node is fetched at most once
+type view struct {
+	sm        *store.StoreManager
+	edgeNodes []store.EdgeNode // nil until loaded
+	nodes     map[store.EdgeNode]*store.FetchedNode
+	metrics   map[string]map[string]*store.FetchedMetric // by the path of the edge node or device and the metric name
+}
+
+func newView(sm *store.StoreManager) *view {
+	return &view{
+		sm:      sm,
+		nodes:   make(map[store.EdgeNode]*store.FetchedNode),
+		metrics: make(map[string]map[string]*store.FetchedMetric),
+	}
+}
+
+func (v *view) allEdgeNodes() []store.EdgeNode {
+	if v.edgeNodes == nil {
+		v.edgeNodes = v.sm.EdgeNodes()
+	}
+	return v.edgeNodes
+}
+
+// Returns the IDs of the groups with edge nodes visible to the principal, sorted
+func (v *view) groupIDs(p *auth.Principal) []string {
+	groupIDs := make([]string, 0)
+	for _, n := range v.allEdgeNodes() {
+		if (len(groupIDs) == 0 || groupIDs[len(groupIDs)-1] != n.GroupID) && p.Allows(auth.Viewer, n.GroupID, n.NodeID) {
+			groupIDs = append(groupIDs, n.GroupID)
+		}
+	}
+	return groupIDs
+}
+
+// Returns the IDs of the edge nodes of the group visible to the principal, sorted
+func (v *view) nodeIDs(p *auth.Principal, groupID string) []string {
+	nodeIDs := make([]string, 0)
+	for _, n := range v.allEdgeNodes() {
+		if n.GroupID == groupID && p.Allows(auth.Viewer, n.GroupID, n.NodeID) {
+			nodeIDs = append(nodeIDs, n.NodeID)
+		}
+	}
+	return nodeIDs
+}
+
+// Returns the edge node, or nil if it is not in the store
+func (v *view) node(groupID, nodeID string) *store.FetchedNode {
+	key := store.EdgeNode{GroupID: groupID, NodeID: nodeID}
+	n, ok := v.nodes[key]
+	if !ok {
+		n, _ = v.sm.FetchNode(groupID, nodeID)
+		v.nodes[key] = n
+	}
+	return n
+}
+
+// Returns the metric of the given metrics of an edge node or device by name, or nil if it has none of the name
+func (v *view) metric(path string, metrics []store.FetchedMetric, name string) *store.FetchedMetric {
+	byName, ok := v.metrics[path]
+	if !ok {
+		byName = make(map[string]*store.FetchedMetric, len(metrics))
+		for i := range metrics {
+			byName[metrics[i].Name] = &metrics[i]
+		}
+		v.metrics[path] = byName
+	}
+	return byName[name]
+}
+
+// Returns the node visible to the principal, or nil if it does not exist
+func (v *view) lookup(p *auth.Principal, nodeID *ua.NodeID) *node {
+	if n, ok := standardID(nodeID); ok {
+		return standard(n)
+	}
+	if nodeID != nil && nodeID.Namespace() == sparkplugNamespace && nodeID.Type() == ua.NodeIDTypeString {
+		return v.resolve(p, nodeID.StringID())
+	}
+	return nil
+}
+
+// Returns the numeric identifier of a node ID of namespace 0, whatever its encoding
+func standardID(nodeID *ua.NodeID) (uint32, bool) {
+	if nodeID == nil || nodeID.Namespace() != 0 {
+		return 0, false
+	}
+	switch nodeID.Type() {
+	case ua.NodeIDTypeTwoByte, ua.NodeIDTypeFourByte, ua.NodeIDTypeNumeric:
+		return nodeID.IntID(), true
+	}
+	return 0, false
+}
+
+// Returns the Sparkplug node of the path. Metric names may contain slashes, so the path of a device and its metric
+// may also be the path of a metric of its edge node; the device is preferred.
+func (v *view) resolve(p *auth.Principal, path string) *node {
+	parts := strings.Split(path, "/")
+	groupID := parts[0]
+	if len(parts) == 1 {
+		for _, g := range v.groupIDs(p) {
+			if g == groupID {
+				return newGroupNode(groupID)
+			}
+		}
+		return nil
+	}
+	nodeID := parts[1]
+	if !p.Allows(auth.Viewer, groupID, nodeID) {
+		return nil
+	}
+	n := v.node(groupID, nodeID)
+	if n == nil {
+		return nil
+	}
+	if len(parts) == 2 {
+		return newEdgeNode(groupID, nodeID)
+	}
+	for i := range n.Devices {
+		device := &n.Devices[i]
+		if device.ID != parts[2] {
+			continue
+		}
+		if len(parts) == 3 {
+			return newDeviceNode(groupID, nodeID, device.ID)
+		}
+		devicePath := groupID + "/" + nodeID + "/" + device.ID
+		if m := v.metric(devicePath, device.Metrics, strings.Join(parts[3:], "/")); m != nil {
+			return newMetricNode(groupID, nodeID, device.ID, m, !n.Online || !device.Online)
+		}
+	}
+	if m := v.metric(groupID+"/"+nodeID, n.Metrics, strings.Join(parts[2:], "/")); m != nil {
+		return newMetricNode(groupID, nodeID, "", m, !n.Online)
+	}
+	return nil
+}
+
+// Returns the forward and inverse references of the node visible to the principal
+func (v *view) references(p *auth.Principal, n *node) []reference {
+	refs := make([]reference, 0)
+	add := func(typeID uint32, forward bool, target *node) {
+		if target != nil {
+			refs = append(refs, reference{typeID, forward, target})
+		}
+	}
+	if n.typeDef != 0 {
+		add(id.HasTypeDefinition, true, standard(n.typeDef))
+	}
+
+	switch n.kind {
+	case standardNode:
+		for _, ref := range inverseReferences[n.id.IntID()] {
+			add(ref[0], false, standard(ref[1]))
+		}
+		for _, ref := range n.standard.refs {
+			add(ref[0], true, standard(ref[1]))
+		}
+		if n.id.IntID() == id.ObjectsFolder {
+			for _, groupID := range v.groupIDs(p) {
+				add(id.Organizes, true, newGroupNode(groupID))
+			}
+		}
+	case groupNode:
+		add(id.Organizes, false, standard(id.ObjectsFolder))
+		for _, nodeID := range v.nodeIDs(p, n.groupID) {
+			add(id.Organizes, true, newEdgeNode(n.groupID, nodeID))
+		}
+	case edgeNodeNode:
+		add(id.Organizes, false, newGroupNode(n.groupID))
+		fetched := v.node(n.groupID, n.nodeID)
+		if fetched == nil {
+			break
+		}
+		for _, device := range fetched.Devices {
+			add(id.HasComponent, true, newDeviceNode(n.groupID, n.nodeID, device.ID))
+		}
+		for i := range fetched.Metrics {
+			add(id.HasComponent, true, newMetricNode(n.groupID, n.nodeID, "", &fetched.Metrics[i], !fetched.Online))
+		}
+	case deviceNode:
+		add(id.HasComponent, false, newEdgeNode(n.groupID, n.nodeID))
+		fetched := v.node(n.groupID, n.nodeID)
+		if fetched == nil {
+			break
+		}
+		for _, device := range fetched.Devices {
+			if device.ID != n.deviceID {
+				continue
+			}
+			for i := range device.Metrics {
+				add(id.HasComponent, true, newMetricNode(n.groupID, n.nodeID, n.deviceID, &device.Metrics[i], !fetched.Online || !device.Online))
+			}
+		}
+	case metricNode:
+		if n.deviceID != "" {
+			add(id.HasComponent, false, newDeviceNode(n.groupID, n.nodeID, n.deviceID))
+		} else {
+			add(id.HasComponent, false, newEdgeNode(n.groupID, n.nodeID))
+		}
+	}
+	return refs
+}
@@ -0,0 +1,344 @@
+package opcua
+
+import (
+	"errors"
+	"math"
+	"net"
+	"runtime/debug"
+	"time"
+
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/audit"
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/auth"
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/sparkplug"
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/store"
+	"github.com/DATATRONiQ/go-sparkplug-primary/third_party/sparkplugb"
+	"github.com/gopcua/opcua/id"
+	"github.com/gopcua/opcua/ua"
+	"github.com/sirupsen/logrus"
+)
+
+// The bits of the access levels
+const (
+	accessRead  byte = 0x01
+	accessWrite byte = 0x02
+)
+
+// The maximum number of operations of a single request
+const maxOperations = 10000
+
+// The OPC UA data types of the Sparkplug data types
+var dataTypes = map[string]uint32{
+	"Boolean": id.Boolean,
+	"Int8":    id.SByte,
+	"UInt8":   id.Byte,
+	"Int16":   id.Int16,
+	"UInt16":  id.UInt16,
+	"Int32":   id.Int32,
+	"UInt32":  id.UInt32,
+	"Int64":   id.Int64,
+	"UInt64":  id.UInt64,
+	"Float":   id.Float,
+	"Double":  id.Double,
+	"String":  id.String,
+	"Text":    id.String,
+	"UUID":    id.String,
+}
+
+// Returns the data type of the metric, BaseDataType if it has no equivalent
+func metricDataType(m *store.FetchedMetric) *ua.NodeID {
+	if t, ok := dataTypes[m.DataType]; ok {
+		return ua.NewNumericNodeID(0, t)
+	}
+	return ua.NewNumericNodeID(0, id.BaseDataType)
+}
+
+// Returns the variant of a metric value, nil if it has no OPC UA equivalent
+func metricVariant(value any) *ua.Variant {
+	switch value.(type) {
+	case bool, int8, uint8, int16, uint16, int32, uint32, int64, uint64, float32, float64, string:
+		return ua.MustVariant(value)
+	}
+	return nil
+}
+
+// Returns the value of the metric with the status derived from the state of its edge node or device and its quality
+func metricValue(n *node) ua.DataValue {
+	m := n.metric
+	dv := ua.DataValue{SourceTimestamp: m.Timestamp}
+	if !m.IsNull {
+		dv.Value = metricVariant(m.Value)
+	}
+	switch {
+	case n.offline:
+		dv.Status = ua.StatusUncertainNoCommunicationLastUsableValue
+	case m.Stale || m.Quality == store.QualityStale:
+		dv.Status = ua.StatusUncertainLastUsableValue
+	case m.Quality == store.QualityBad:
+		dv.Status = ua.StatusBad
+	case m.Quality == store.QualityUncertain:
+		dv.Status = ua.StatusUncertain
+	}
+	return dv
+}
+
+// Returns the access level of the metric for the principal, or for any client if the principal is nil
+func (s *Server) accessLevel(n *node, p *auth.Principal) byte {
+	if n.kind != metricNode || !s.isWritable() {
+		return accessRead
+	}
+	if p != nil && !p.Allows(auth.Operator, n.groupID, n.nodeID) {
+		return accessRead
+	}
+	return accessRead | accessWrite
+}
+
+// Returns the value of an attribute of the node, with the server timestamp of the given time
+func (s *Server) readAttribute(n *node, attribute ua.AttributeID, p *auth.Principal, now time.Time) ua.DataValue {
+	dv := ua.DataValue{ServerTimestamp: now}
+	value := func(v any) ua.DataValue {
+		dv.Value = ua.MustVariant(v)
+		return dv
+	}
+	switch attribute {
+	case ua.AttributeIDNodeID:
+		return value(n.id)
+	case ua.AttributeIDNodeClass:
+		return value(int32(n.class))
+	case ua.AttributeIDBrowseName:
+		name := n.browseName
+		return value(&name)
+	case ua.AttributeIDDisplayName:
+		return value(ua.NewLocalizedText(n.browseName.Name))
+	case ua.AttributeIDDescription:
+		return value(ua.NewLocalizedText(n.description))
+	case ua.AttributeIDWriteMask, ua.AttributeIDUserWriteMask:
+		return value(uint32(0))
+	}
+
+	d := n.standard
+	switch n.class {
+	case ua.NodeClassObject:
+		if attribute == ua.AttributeIDEventNotifier {
+			return value(byte(0))
+		}
+	case ua.NodeClassObjectType, ua.NodeClassVariableType, ua.NodeClassDataType:
+		if attribute == ua.AttributeIDIsAbstract {
+			return value(d.abstract)
+		}
+	case ua.NodeClassReferenceType:
+		switch attribute {
+		case ua.AttributeIDIsAbstract:
+			return value(d.abstract)
+		case ua.AttributeIDSymmetric:
+			return value(false)
+		case ua.AttributeIDInverseName:
+			return value(ua.NewLocalizedText(d.inverse))
+		}
+	case ua.NodeClassVariable:
+		switch attribute {
+		case ua.AttributeIDValue:
+			if n.kind == metricNode {
+				v := metricValue(n)
+				v.ServerTimestamp = now
+				return v
+			}
+			dv.Value = d.value(s, now)
+			dv.SourceTimestamp = now
+			return dv
+		case ua.AttributeIDDataType:
+			if n.kind == metricNode {
+				return value(metricDataType(n.metric))
+			}
+			return value(ua.NewNumericNodeID(0, d.dataType))
+		case ua.AttributeIDValueRank:
+			if n.kind == metricNode {
+				return value(int32(-1))
+			}
+			return value(d.valueRank)
+		case ua.AttributeIDArrayDimensions:
+			if n.kind == standardNode && d.valueRank == 1 {
+				return value([]uint32{0})
+			}
+			return dv
+		case ua.AttributeIDAccessLevel:
+			return value(s.accessLevel(n, nil))
+		case ua.AttributeIDUserAccessLevel:
+			return value(s.accessLevel(n, p))
+		case ua.AttributeIDMinimumSamplingInterval:
+			return value(float64(minPublishingInterval / time.Millisecond))
+		case ua.AttributeIDHistorizing:
+			return value(false)
+		}
+	}
+	return ua.DataValue{Status: ua.StatusBadAttributeIDInvalid}
+}
+
+// Removes the timestamps the client did not request and sets the encoding mask
+func filterTimestamps(dv ua.DataValue, timestamps ua.TimestampsToReturn) *ua.DataValue {
+	if timestamps == ua.TimestampsToReturnServer || timestamps == ua.TimestampsToReturnNeither {
+		dv.SourceTimestamp = time.Time{}
+	}
+	if timestamps == ua.TimestampsToReturnSource || timestamps == ua.TimestampsToReturnNeither {
+		dv.ServerTimestamp = time.Time{}
+	}
+	dv.UpdateMask()
+	return &dv
+}
+
+// Returns the ServerStatusDataType of the server
+func (s *Server) serverStatus(now time.Time) *ua.ServerStatusDataType {
+	version := ""
+	if info, ok := debug.ReadBuildInfo(); ok {
+		version = info.Main.Version
+	}
+	return &ua.ServerStatusDataType{
+		StartTime:   s.started,
+		CurrentTime: now,
+		State:       ua.ServerStateRunning,
+		BuildInfo: &ua.BuildInfo{
+			ProductURI:       ProductURI,
+			ManufacturerName: "DATATRONiQ",
+			ProductName:      "go-sparkplug-primary",
+			SoftwareVersion:  version,
+		},
+		ShutdownReason: ua.NewLocalizedText(""),
+	}
+}
+
+// Returns the status of the index range and data encoding of a ReadValueId, which are not supported
+func checkReadValueID(rv *ua.ReadValueID) ua.StatusCode {
+	switch {
+	case rv.IndexRange != "":
+		return ua.StatusBadIndexRangeInvalid
+	case rv.DataEncoding.Name != "" && rv.AttributeID != ua.AttributeIDValue:
+		return ua.StatusBadDataEncodingInvalid
+	case rv.DataEncoding.Name != "" && rv.DataEncoding.Name != "Default Binary":
+		return ua.StatusBadDataEncodingUnsupported
+	}
+	return ua.StatusOK
+}
+
+// Handles Read, returning the attributes of the nodes. Values are always read from the store, whatever the maximum age.
+func (s *Server) read(r *request) []response {
+	req := r.req.(*ua.ReadRequest)
+	switch {
+	case req.TimestampsToReturn > ua.TimestampsToReturnNeither:
+		return r.fault(ua.StatusBadTimestampsToReturnInvalid)
+	case len(req.NodesToRead) == 0:
+		return r.fault(ua.StatusBadNothingToDo)
+	case len(req.NodesToRead) > maxOperations:
+		return r.fault(ua.StatusBadTooManyOperations)
+	}
+
+	v, now := newView(s.sm), time.Now()
+	results := make([]*ua.DataValue, 0, len(req.NodesToRead))
+	for _, item := range req.NodesToRead {
+		dv := ua.DataValue{Status: checkReadValueID(item)}
+		if dv.Status == ua.StatusOK {
+			if n := v.lookup(r.principal, item.NodeID); n != nil {
+				dv = s.readAttribute(n, item.AttributeID, r.principal, now)
+			} else {
+				dv.Status = ua.StatusBadNodeIDUnknown
+			}
+		}
+		results = append(results, filterTimestamps(dv, req.TimestampsToReturn))
+	}
+	return r.respond(&ua.ReadResponse{Results: results})
+}
+
+// Handles Write, publishing an NCMD or DCMD for every written metric value
+func (s *Server) write(r *request) []response {
+	req := r.req.(*ua.WriteRequest)
+	switch {
+	case len(req.NodesToWrite) == 0:
+		return r.fault(ua.StatusBadNothingToDo)
+	case len(req.NodesToWrite) > maxOperations:
+		return r.fault(ua.StatusBadTooManyOperations)
+	}
+
+	v := newView(s.sm)
+	results := make([]ua.StatusCode, len(req.NodesToWrite))
+	for i, item := range req.NodesToWrite {
+		n := v.lookup(r.principal, item.NodeID)
+		switch {
+		case n == nil:
+			results[i] = ua.StatusBadNodeIDUnknown
+		case item.AttributeID != ua.AttributeIDValue || n.kind != metricNode || !s.isWritable():
+			results[i] = ua.StatusBadNotWritable
+		case r.conn.securityMode() == ua.MessageSecurityModeNone:
+			// commands are only accepted over channels which are at least signed
+			results[i] = ua.StatusBadSecurityModeInsufficient
+		case !r.principal.Allows(auth.Operator, n.groupID, n.nodeID):
+			results[i] = ua.StatusBadUserAccessDenied
+		case item.IndexRange != "":
+			results[i] = ua.StatusBadWriteNotSupported
+		default:
+			results[i] = s.writeMetric(r, n, item.Value.Value)
+		}
+	}
+	return r.respond(&ua.WriteResponse{Results: results})
+}
+
+// Publishes the command writing the value of the metric and records it in the audit log
+func (s *Server) writeMetric(r *request, n *node, value *ua.Variant) ua.StatusCode {
+	newValue, ok := commandValue(value)
+	if !ok {
+		return ua.StatusBadTypeMismatch
+	}
+	m := n.metric
+	err := s.commander.SendCommand(n.groupID, n.nodeID, n.deviceID, []sparkplug.CommandMetric{{
+		Name:     m.Name,
+		DataType: sparkplugb.DataType(sparkplugb.DataType_value[m.DataType]),
+		Value:    newValue,
+	}})
+
+	entry := audit.Entry{
+		Action:    audit.Command,
+		Source:    audit.OPCUA,
+		Principal: r.principal.Name,
+		GroupID:   n.groupID,
+		NodeID:    n.nodeID,
+		DeviceID:  n.deviceID,
+		Metrics:   []audit.Metric{{Name: m.Name, DataType: m.DataType, OldValue: m.Value, NewValue: newValue}},
+		Success:   err == nil,
+	}
+	if host, _, splitErr := net.SplitHostPort(r.conn.nc.RemoteAddr().String()); splitErr == nil {
+		entry.SourceIP = host
+	}
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	s.auditLog.Record(entry)
+
+	switch {
+	case err == nil:
+		return ua.StatusOK
+	case errors.Is(err, sparkplug.ErrInvalidCommand):
+		return ua.StatusBadTypeMismatch
+	case errors.Is(err, sparkplug.ErrStandby):
+		return ua.StatusBadInvalidState
+	}
+	logrus.Warnf("OPC UA write of %s failed: %v", n.id, err)
+	return ua.StatusBadCommunicationError
+}
+
+// Converts a written value into the value of a command: bool, int64, uint64, float64, string or nil
+func commandValue(v *ua.Variant) (any, bool) {
+	if v == nil || v.Type() == ua.TypeIDNull {
+		return nil, true
+	}
+	if v.Has(ua.VariantArrayValues) {
+		return nil, false
+	}
+	switch value := v.Value().(type) {
+	case bool, string, int64, uint64:
+		return value, true
+	}
+	if f, ok := store.NumericValue(v.Value()); ok && v.Type() != ua.TypeIDBoolean {
+		if math.IsNaN(f) {
+			return nil, false
+		}
+		return f, true
+	}
+	return nil, false
+}
@@ -0,0 +1,198 @@
+package opcua
+
+import "github.com/gopcua/opcua/ua"
+
+// The maximum number of continuation points of a session
+const maxContinuationPoints = 16
+
+// The references remaining after a browse result was truncated to the maximum number of references
+type continuation struct {
+	refs []reference
+	max  int
+}
+
+// Handles Browse, returning the references of the nodes. Only the whole address space can be viewed,
+// and all fields of the references are always returned.
+func (s *Server) browse(r *request) []response {
+	req := r.req.(*ua.BrowseRequest)
+	switch {
+	case len(req.NodesToBrowse) == 0:
+		return r.fault(ua.StatusBadNothingToDo)
+	case len(req.NodesToBrowse) > maxOperations:
+		return r.fault(ua.StatusBadTooManyOperations)
+	}
+
+	v := newView(s.sm)
+	results := make([]*ua.BrowseResult, 0, len(req.NodesToBrowse))
+	for _, b := range req.NodesToBrowse {
+		refs, status := s.browseNode(v, r, b)
+		if status != ua.StatusOK {
+			results = append(results, &ua.BrowseResult{StatusCode: status})
+			continue
+		}
+		results = append(results, s.truncate(r.sess, refs, int(req.RequestedMaxReferencesPerNode)))
+	}
+	return r.respond(&ua.BrowseResponse{Results: results})
+}
+
+// Returns the references of the node matching the browse description
+func (s *Server) browseNode(v *view, r *request, b *ua.BrowseDescription) ([]reference, ua.StatusCode) {
+	n := v.lookup(r.principal, b.NodeID)
+	if n == nil {
+		return nil, ua.StatusBadNodeIDUnknown
+	}
+	if b.BrowseDirection > ua.BrowseDirectionBoth {
+		return nil, ua.StatusBadBrowseDirectionInvalid
+	}
+	// the null reference type matches all references
+	filter, ok := standardID(b.ReferenceTypeID)
+	if !ok || (filter != 0 && (standardNodes[filter] == nil || standardNodes[filter].class != ua.NodeClassReferenceType)) {
+		return nil, ua.StatusBadReferenceTypeIDInvalid
+	}
+
+	refs := make([]reference, 0)
+	for _, ref := range v.references(r.principal, n) {
+		if (ref.forward && b.BrowseDirection == ua.BrowseDirectionInverse) || (!ref.forward && b.BrowseDirection == ua.BrowseDirectionForward) {
+			continue
+		}
+		if filter != 0 && !isReferenceType(ref.typeID, filter, b.IncludeSubtypes) {
+			continue
+		}
+		if b.NodeClassMask != 0 && b.NodeClassMask&uint32(ref.target.class) == 0 {
+			continue
+		}
+		refs = append(refs, ref)
+	}
+	return refs, ua.StatusOK
+}
+
+// Returns the first maxRefs references, remembering the others with a continuation point of the session
+func (s *Server) truncate(sess *session, refs []reference, maxRefs int) *ua.BrowseResult {
+	if maxRefs <= 0 || len(refs) <= maxRefs {
+		return &ua.BrowseResult{References: referenceDescriptions(refs)}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(sess.continuations) >= maxContinuationPoints {
+		return &ua.BrowseResult{StatusCode: ua.StatusBadNoContinuationPoints}
+	}
+	point := randomBytes(16)
+	sess.continuations[string(point)] = &continuation{refs: refs[maxRefs:], max: maxRefs}
+	return &ua.BrowseResult{ContinuationPoint: point, References: referenceDescriptions(refs[:maxRefs])}
+}
+
+// Handles BrowseNext, returning the remaining references of continuation points or releasing them
+func (s *Server) browseNext(r *request) []response {
+	req := r.req.(*ua.BrowseNextRequest)
+	if len(req.ContinuationPoints) == 0 {
+		return r.fault(ua.StatusBadNothingToDo)
+	}
+
+	results := make([]*ua.BrowseResult, 0, len(req.ContinuationPoints))
+	for _, point := range req.ContinuationPoints {
+		s.mu.Lock()
+		c, ok := r.sess.continuations[string(point)]
+		delete(r.sess.continuations, string(point))
+		s.mu.Unlock()
+		switch {
+		case !ok:
+			results = append(results, &ua.BrowseResult{StatusCode: ua.StatusBadContinuationPointInvalid})
+		case req.ReleaseContinuationPoints:
+			results = append(results, &ua.BrowseResult{})
+		default:
+			results = append(results, s.truncate(r.sess, c.refs, c.max))
+		}
+	}
+	return r.respond(&ua.BrowseNextResponse{Results: results})
+}
+
+// Returns the descriptions of the references with all fields
+func referenceDescriptions(refs []reference) []*ua.ReferenceDescription {
+	descriptions := make([]*ua.ReferenceDescription, 0, len(refs))
+	for _, ref := range refs {
+		t := ref.target
+		name := t.browseName
+		descriptions = append(descriptions, &ua.ReferenceDescription{
+			ReferenceTypeID: ua.NewNumericNodeID(0, ref.typeID),
+			IsForward:       ref.forward,
+			NodeID:          ua.NewExpandedNodeID(t.id, "", 0),
+			BrowseName:      &name,
+			DisplayName:     ua.NewLocalizedText(name.Name),
+			NodeClass:       t.class,
+			TypeDefinition:  ua.NewExpandedNodeID(ua.NewNumericNodeID(0, t.typeDef), "", 0), // null without type definition
+		})
+	}
+	return descriptions
+}
+
+// Handles TranslateBrowsePathsToNodeIds, following the browse names of relative paths from their starting nodes
+func (s *Server) translateBrowsePaths(r *request) []response {
+	req := r.req.(*ua.TranslateBrowsePathsToNodeIDsRequest)
+	switch {
+	case len(req.BrowsePaths) == 0:
+		return r.fault(ua.StatusBadNothingToDo)
+	case len(req.BrowsePaths) > maxOperations:
+		return r.fault(ua.StatusBadTooManyOperations)
+	}
+
+	v := newView(s.sm)
+	results := make([]*ua.BrowsePathResult, 0, len(req.BrowsePaths))
+	for _, p := range req.BrowsePaths {
+		start := v.lookup(r.principal, p.StartingNode)
+		switch {
+		case start == nil:
+			results = append(results, &ua.BrowsePathResult{StatusCode: ua.StatusBadNodeIDUnknown})
+			continue
+		case len(p.RelativePath.Elements) == 0:
+			results = append(results, &ua.BrowsePathResult{StatusCode: ua.StatusBadNothingToDo})
+			continue
+		}
+		current := []*node{start}
+		for _, el := range p.RelativePath.Elements {
+			next := make([]*node, 0)
+			direction := ua.BrowseDirectionForward
+			if el.IsInverse {
+				direction = ua.BrowseDirectionInverse
+			}
+			for _, n := range current {
+				refs, _ := s.browseNode(v, r, &ua.BrowseDescription{
+					NodeID: n.id, BrowseDirection: direction, ReferenceTypeID: el.ReferenceTypeID, IncludeSubtypes: el.IncludeSubtypes,
+				})
+				for _, ref := range refs {
+					if ref.target.browseName == *el.TargetName {
+						next = append(next, ref.target)
+					}
+				}
+			}
+			current = next
+		}
+		if len(current) == 0 {
+			results = append(results, &ua.BrowsePathResult{StatusCode: ua.StatusBadNoMatch})
+			continue
+		}
+		targets := make([]*ua.BrowsePathTarget, 0, len(current))
+		for _, n := range current {
+			// the whole path was followed
+			targets = append(targets, &ua.BrowsePathTarget{TargetID: ua.NewExpandedNodeID(n.id, "", 0), RemainingPathIndex: 0xffffffff})
+		}
+		results = append(results, &ua.BrowsePathResult{Targets: targets})
+	}
+	return r.respond(&ua.TranslateBrowsePathsToNodeIDsResponse{Results: results})
+}
+
+// Handles RegisterNodes. The node IDs are used as they are, so they are returned unchanged.
+func (s *Server) registerNodes(r *request) []response {
+	req := r.req.(*ua.RegisterNodesRequest)
+	if len(req.NodesToRegister) == 0 {
+		return r.fault(ua.StatusBadNothingToDo)
+	}
+	return r.respond(&ua.RegisterNodesResponse{RegisteredNodeIDs: req.NodesToRegister})
+}
+
+// Handles UnregisterNodes, which has nothing to release
+func (s *Server) unregisterNodes(r *request) []response {
+	if len(r.req.(*ua.UnregisterNodesRequest).NodesToUnregister) == 0 {
+		return r.fault(ua.StatusBadNothingToDo)
+	}
+	return r.respond(&ua.UnregisterNodesResponse{})
+}
@@ -0,0 +1,512 @@
+package opcua
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/gopcua/opcua/id"
+	"github.com/gopcua/opcua/ua"
+	"github.com/gopcua/opcua/uacp"
+	"github.com/gopcua/opcua/uapolicy"
+	"github.com/gopcua/opcua/uasc"
+	"github.com/sirupsen/logrus"
+)
+
+// The limits of the transport. Chunks are at most bufferSize bytes, messages at most maxMessageSize bytes.
+const (
+	bufferSize     = 65535
+	minBufferSize  = 8192
+	maxMessageSize = 16 << 20
+	maxPartial     = 16 // The maximum number of messages received in chunks at the same time
+)
+
+// The bounds of the lifetime of the security tokens of secure channels
+const (
+	minChannelLifetime = 10 * time.Second
+	maxChannelLifetime = time.Hour
+)
+
+// The length of the message header, of the headers of symmetric chunks (channel and token ID)
+// and of the sequence header (sequence number and request ID), which starts the secured part of a chunk
+const (
+	headerLength          = 8
+	symmetricHeaderLength = 8
+	sequenceHeaderLength  = 8
+	sequenceHeaderOffset  = headerLength + symmetricHeaderLength
+)
+
+// The sequence numbers of chunks may wrap around to a number below 1024 once they exceed maxSequenceNumber
+const maxSequenceNumber = math.MaxUint32 - 1024
+
+// A TCP connection of a client carrying a single secure channel
+type conn struct {
+	s  *Server
+	nc net.Conn
+
+	// used by the connection goroutine only
+	receiveBuffer uint32 // the maximum size of received chunks
+	lifetime      time.Duration
+	partial       map[uint32][]byte // the chunks of incomplete messages by request ID
+	policy        string
+	clientCert    []byte                        // the certificate of the client, nil with the security policy None
+	asymmetric    *uapolicy.EncryptionAlgorithm // the algorithm of the server and client certificates, nil with the security policy None
+	tokens        map[uint32]*securityToken     // the tokens the client may still use, by ID
+	lastTokenID   uint32
+	receivedAny   bool   // whether a chunk with a sequence number was received
+	receivedSeq   uint32 // the sequence number of the last received chunk
+
+	// changed by the connection goroutine while holding wmu, read by the goroutines sending responses
+	wmu            sync.Mutex
+	channelID      uint32
+	mode           ua.MessageSecurityMode // None until the secure channel is opened
+	sendToken      *securityToken         // the token securing the sent messages, switched once the client uses a renewed one
+	sendBuffer     uint32                 // the maximum size of sent chunks
+	maxMessageSize uint32                 // of the client, 0 if unlimited
+	maxChunkCount  uint32                 // of the client, 0 if unlimited
+	seq            uint32                 // the sequence number of the last sent chunk
+
+	closeOnce sync.Once
+}
+
+func newConn(s *Server, nc net.Conn) *conn {
+	return &conn{
+		s:             s,
+		nc:            nc,
+		receiveBuffer: bufferSize,
+		sendBuffer:    minBufferSize,
+		lifetime:      minChannelLifetime,
+		partial:       make(map[uint32][]byte),
+		tokens:        make(map[uint32]*securityToken),
+		mode:          ua.MessageSecurityModeNone,
+	}
+}
+
+// Returns the message security mode of the secure channel
+func (c *conn) securityMode() ua.MessageSecurityMode {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	return c.mode
+}
+
+func (c *conn) close() {
+	c.closeOnce.Do(func() {
+		c.nc.Close()
+	})
+}
+
+// Reads and handles the messages until the connection is closed
+func (c *conn) serve() {
+	defer c.close()
+	remote := c.nc.RemoteAddr()
+	if err := c.hello(); err != nil {
+		logrus.Debugf("OPC UA connection from %s rejected: %v", remote, err)
+		return
+	}
+	for {
+		// the security token must be renewed before it expires
+		c.nc.SetReadDeadline(time.Now().Add(c.lifetime + c.lifetime/4))
+		msgType, chunkType, chunk, err := c.readChunk()
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				logrus.Debugf("OPC UA connection from %s closed: %v", remote, err)
+			}
+			return
+		}
+		switch msgType {
+		case "OPN":
+			err = c.open(chunk)
+		case "MSG":
+			err = c.message(chunkType, chunk)
+		case "CLO":
+			logrus.Debugf("OPC UA secure channel %d from %s closed by the client", c.channelID, remote)
+			return
+		default:
+			err = ua.StatusBadTCPMessageTypeInvalid
+		}
+		if err != nil {
+			logrus.Debugf("OPC UA connection from %s failed: %v", remote, err)
+			c.sendError(err)
+			return
+		}
+	}
+}
+
+// Reads a chunk, returning its message type, chunk type and the whole chunk including the message header
+func (c *conn) readChunk() (string, byte, []byte, error) {
+	header := make([]byte, headerLength)
+	if _, err := io.ReadFull(c.nc, header); err != nil {
+		return "", 0, nil, err
+	}
+	var h uacp.Header
+	if _, err := h.Decode(header); err != nil {
+		return "", 0, nil, err
+	}
+	if h.MessageSize < headerLength || h.MessageSize > c.receiveBuffer {
+		return "", 0, nil, fmt.Errorf("%w: chunk of %d bytes", ua.StatusBadTCPMessageTooLarge, h.MessageSize)
+	}
+	chunk := make([]byte, h.MessageSize)
+	copy(chunk, header)
+	if _, err := io.ReadFull(c.nc, chunk[headerLength:]); err != nil {
+		return "", 0, nil, err
+	}
+	return h.MessageType, h.ChunkType, chunk, nil
+}
+
+// Handles the HEL message, which negotiates the buffer sizes
+func (c *conn) hello() error {
+	c.nc.SetReadDeadline(time.Now().Add(10 * time.Second))
+	msgType, _, chunk, err := c.readChunk()
+	if err != nil {
+		return err
+	}
+	if msgType != "HEL" {
+		c.sendError(ua.StatusBadTCPMessageTypeInvalid)
+		return fmt.Errorf("expected HEL, got %q", msgType)
+	}
+	// all protocol versions are compatible to version 0
+	var hello uacp.Hello
+	_, err = hello.Decode(chunk[headerLength:])
+	if err != nil || hello.ReceiveBufSize < minBufferSize || hello.SendBufSize < minBufferSize || len(hello.EndpointURL) > 4096 {
+		c.sendError(ua.StatusBadTCPEndpointURLInvalid)
+		return fmt.Errorf("invalid HEL message")
+	}
+
+	c.receiveBuffer = minUint32(hello.SendBufSize, bufferSize)
+	c.wmu.Lock()
+	c.sendBuffer = minUint32(hello.ReceiveBufSize, bufferSize)
+	c.maxMessageSize = hello.MaxMessageSize
+	c.maxChunkCount = hello.MaxChunkCount
+	c.wmu.Unlock()
+
+	ack, err := (&uacp.Acknowledge{ReceiveBufSize: c.receiveBuffer, SendBufSize: c.sendBuffer, MaxMessageSize: maxMessageSize}).Encode()
+	if err != nil {
+		return err
+	}
+	return c.write("ACKF", ack)
+}
+
+// Handles an OPN message issuing or renewing the security token of the secure channel.
+// With Basic256Sha256 the message is signed and encrypted with the keys of the certificates, whatever the security mode.
+func (c *conn) open(chunk []byte) error {
+	var h uasc.Header
+	var security uasc.AsymmetricSecurityHeader
+	n, err := h.Decode(chunk)
+	if err != nil {
+		return ua.StatusBadDecodingError
+	}
+	m, err := security.Decode(chunk[n:])
+	if err != nil {
+		return ua.StatusBadDecodingError
+	}
+	offset := n + m
+	data := chunk[offset:]
+	var asymmetric *uapolicy.EncryptionAlgorithm
+	switch security.SecurityPolicyURI {
+	case ua.SecurityPolicyURINone:
+	case ua.SecurityPolicyURIBasic256Sha256:
+		clientKey, status := c.s.clientPublicKey(security.SenderCertificate)
+		if status != ua.StatusOK {
+			return status
+		}
+		if !bytes.Equal(security.ReceiverCertificateThumbprint, c.s.cert.thumbprint) {
+			return fmt.Errorf("%w: the message is encrypted for another certificate", ua.StatusBadSecurityChecksFailed)
+		}
+		if asymmetric, err = uapolicy.Asymmetric(ua.SecurityPolicyURIBasic256Sha256, c.s.cert.key, clientKey); err != nil {
+			return fmt.Errorf("%w: %v", ua.StatusBadSecurityChecksFailed, err)
+		}
+		if data, status = c.s.cert.openAsymmetric(asymmetric, chunk, offset); status != ua.StatusOK {
+			return status
+		}
+	default:
+		return fmt.Errorf("%w: %s", ua.StatusBadSecurityPolicyRejected, security.SecurityPolicyURI)
+	}
+
+	var seq uasc.SequenceHeader
+	n, err = seq.Decode(data)
+	if err != nil {
+		return ua.StatusBadDecodingError
+	}
+	typeID := new(ua.ExpandedNodeID)
+	m, err = typeID.Decode(data[n:])
+	if err != nil || typeID.NodeID.IntID() != id.OpenSecureChannelRequest_Encoding_DefaultBinary || typeID.NodeID.Namespace() != 0 {
+		return ua.StatusBadDecodingError
+	}
+	req := new(ua.OpenSecureChannelRequest)
+	if err := decode(data[n+m:], req); err != nil {
+		return ua.StatusBadDecodingError
+	}
+	if err := c.checkSequenceNumber(seq.SequenceNumber); err != nil {
+		return err
+	}
+	secured := asymmetric != nil
+	mode := req.SecurityMode
+	switch {
+	case !secured && mode != ua.MessageSecurityModeNone,
+		secured && mode != ua.MessageSecurityModeSign && mode != ua.MessageSecurityModeSignAndEncrypt:
+		return fmt.Errorf("%w: mode %d", ua.StatusBadSecurityModeRejected, mode)
+	case secured && len(req.ClientNonce) != nonceLength:
+		return ua.StatusBadNonceInvalid
+	}
+
+	switch {
+	case req.RequestType == ua.SecurityTokenRequestTypeIssue && c.channelID == 0:
+		c.s.mu.Lock()
+		c.s.nextChannelID++
+		newChannelID := c.s.nextChannelID
+		c.s.mu.Unlock()
+		c.policy, c.clientCert, c.asymmetric = security.SecurityPolicyURI, security.SenderCertificate, asymmetric
+		// the IDs are also read by the goroutines sending publish responses
+		c.wmu.Lock()
+		c.channelID, c.mode = newChannelID, mode
+		c.wmu.Unlock()
+	case req.RequestType == ua.SecurityTokenRequestTypeRenew && h.SecureChannelID == c.channelID && c.channelID != 0:
+		// a renewal keeps the security of the channel
+		if security.SecurityPolicyURI != c.policy || mode != c.mode || !bytes.Equal(security.SenderCertificate, c.clientCert) {
+			return ua.StatusBadSecurityChecksFailed
+		}
+	default:
+		return ua.StatusBadRequestTypeInvalid
+	}
+	var serverNonce []byte
+	if secured {
+		serverNonce = randomBytes(nonceLength)
+	}
+	token, err := newSecurityToken(c.lastTokenID+1, req.ClientNonce, serverNonce)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ua.StatusBadSecurityChecksFailed, err)
+	}
+	c.lastTokenID = token.id
+	c.tokens[token.id] = token
+	c.wmu.Lock()
+	if c.sendToken == nil {
+		c.sendToken = token
+	}
+	c.wmu.Unlock()
+	c.lifetime = time.Duration(req.RequestedLifetime) * time.Millisecond
+	if c.lifetime < minChannelLifetime {
+		c.lifetime = minChannelLifetime
+	}
+	if c.lifetime > maxChannelLifetime {
+		c.lifetime = maxChannelLifetime
+	}
+
+	body, err := encodeResponse(&ua.OpenSecureChannelResponse{
+		ResponseHeader: responseHeader(req.RequestHeader.RequestHandle, ua.StatusOK),
+		SecurityToken: &ua.ChannelSecurityToken{
+			ChannelID:       c.channelID,
+			TokenID:         token.id,
+			CreatedAt:       time.Now(),
+			RevisedLifetime: uint32(c.lifetime / time.Millisecond),
+		},
+		ServerNonce: serverNonce,
+	})
+	if err != nil {
+		return err
+	}
+	header := uasc.NewAsymmetricSecurityHeader(c.policy, nil, nil)
+	if secured {
+		header = uasc.NewAsymmetricSecurityHeader(c.policy, c.s.cert.der, uapolicy.Thumbprint(c.clientCert))
+	}
+	chunk, err = (&uasc.Header{MessageType: "OPN", ChunkType: uasc.ChunkTypeFinal, SecureChannelID: c.channelID}).Encode()
+	if err != nil {
+		return err
+	}
+	securityHeader, err := header.Encode()
+	if err != nil {
+		return err
+	}
+	chunk = append(chunk, securityHeader...)
+	offset = len(chunk)
+	c.wmu.Lock()
+	c.seq++
+	sequenceHeader, err := uasc.NewSequenceHeader(c.seq, seq.RequestID).Encode()
+	c.wmu.Unlock()
+	if err != nil {
+		return err
+	}
+	chunk = append(append(chunk, sequenceHeader...), body...)
+	if !secured {
+		return c.writeChunk(chunk)
+	}
+	return c.writeChunk(sealAsymmetric(asymmetric, chunk, offset))
+}
+
+// Handles a chunk of a MSG message, dispatching the request once it is complete
+func (c *conn) message(chunkType byte, chunk []byte) error {
+	var h uasc.Header
+	var security uasc.SymmetricSecurityHeader
+	n, err := h.Decode(chunk)
+	if err == nil {
+		_, err = security.Decode(chunk[n:])
+	}
+	if err != nil {
+		return ua.StatusBadDecodingError
+	}
+	if h.SecureChannelID != c.channelID || c.channelID == 0 {
+		return ua.StatusBadTCPSecureChannelUnknown
+	}
+	token, ok := c.tokens[security.TokenID]
+	if !ok {
+		return ua.StatusBadSecureChannelTokenUnknown
+	}
+	data, status := token.open(chunk, c.mode)
+	if status != ua.StatusOK {
+		return status
+	}
+	c.use(token)
+	var seq uasc.SequenceHeader
+	n, err = seq.Decode(data)
+	if err != nil {
+		return ua.StatusBadDecodingError
+	}
+	if err := c.checkSequenceNumber(seq.SequenceNumber); err != nil {
+		return err
+	}
+	requestID, body := seq.RequestID, data[n:]
+
+	switch chunkType {
+	case 'A':
+		delete(c.partial, requestID)
+		return nil
+	case 'C':
+		if _, ok := c.partial[requestID]; !ok && len(c.partial) >= maxPartial {
+			return ua.StatusBadTCPMessageTooLarge
+		}
+		c.partial[requestID] = append(c.partial[requestID], body...)
+		if len(c.partial[requestID]) > maxMessageSize {
+			return ua.StatusBadTCPMessageTooLarge
+		}
+		return nil
+	case 'F':
+		message := append(c.partial[requestID], body...)
+		delete(c.partial, requestID)
+		c.s.handle(c, requestID, message)
+		return nil
+	}
+	return ua.StatusBadTCPMessageTypeInvalid
+}
+
+// Checks that the sequence number of a received chunk is above the one of the previous chunk, so replayed or
+// reordered chunks are rejected. The first chunk after a wrap-around must have a number below 1024.
+func (c *conn) checkSequenceNumber(seq uint32) error {
+	wrapped := c.receivedSeq > maxSequenceNumber && seq < 1024
+	if c.receivedAny && seq <= c.receivedSeq && !wrapped {
+		return fmt.Errorf("%w: %d after %d", ua.StatusBadSequenceNumberInvalid, seq, c.receivedSeq)
+	}
+	c.receivedAny, c.receivedSeq = true, seq
+	return nil
+}
+
+// Secures the sent messages with the token once the client uses it after a renewal and forgets the previous tokens
+func (c *conn) use(token *securityToken) {
+	c.wmu.Lock()
+	if token.id > c.sendToken.id {
+		c.sendToken = token
+	}
+	c.wmu.Unlock()
+	for id := range c.tokens {
+		if id < token.id {
+			delete(c.tokens, id)
+		}
+	}
+}
+
+// Sends a service response, split into chunks of the send buffer size
+func (c *conn) send(requestID uint32, body []byte) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	maxBody := c.maxBody()
+	for first := true; first || len(body) > 0; first = false {
+		n := len(body)
+		chunkType := "MSGF"
+		if n > maxBody {
+			n = maxBody
+			chunkType = "MSGC"
+		}
+		buf := ua.NewBuffer(make([]byte, 0, int(c.sendBuffer)))
+		buf.Write([]byte(chunkType))
+		buf.WriteUint32(0) // the size, set once the chunk is sealed
+		buf.WriteUint32(c.channelID)
+		buf.WriteUint32(c.sendToken.id)
+		c.seq++
+		buf.WriteUint32(c.seq)
+		buf.WriteUint32(requestID)
+		buf.Write(body[:n])
+		body = body[n:]
+		c.nc.SetWriteDeadline(time.Now().Add(10 * time.Second))
+		if _, err := c.nc.Write(c.sendToken.seal(buf.Bytes(), c.mode)); err != nil {
+			logrus.Debugf("OPC UA connection to %s failed: %v", c.nc.RemoteAddr(), err)
+			c.close()
+			return
+		}
+	}
+}
+
+// Returns the maximum size of the body of a sent chunk, after the headers and before the padding and signature.
+// Must be called with wmu held.
+func (c *conn) maxBody() int {
+	secured := int(c.sendBuffer) - sequenceHeaderOffset
+	switch c.mode {
+	case ua.MessageSecurityModeSign:
+		return secured - sequenceHeaderLength - c.sendToken.alg.SignatureLength()
+	case ua.MessageSecurityModeSignAndEncrypt:
+		// at least the padding size is appended, and the encrypted part fills whole blocks
+		return secured - secured%c.sendToken.alg.BlockSize() - sequenceHeaderLength - 1 - c.sendToken.alg.SignatureLength()
+	}
+	return secured - sequenceHeaderLength
+}
+
+// Returns whether a response body of the given size exceeds the limits of the client
+func (c *conn) tooLarge(size int) bool {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if c.maxMessageSize > 0 && size > int(c.maxMessageSize) {
+		return true
+	}
+	maxBody := c.maxBody()
+	return c.maxChunkCount > 0 && (size+maxBody-1)/maxBody > int(c.maxChunkCount)
+}
+
+// Writes a single chunk of the given type, e.g. "ACKF"
+func (c *conn) write(chunkType string, body []byte) error {
+	header, err := (&uacp.Header{MessageType: chunkType[:3], ChunkType: chunkType[3]}).Encode()
+	if err != nil {
+		return err
+	}
+	return c.writeChunk(append(header, body...))
+}
+
+// Writes a complete chunk, setting its size in the message header
+func (c *conn) writeChunk(chunk []byte) error {
+	binary.LittleEndian.PutUint32(chunk[4:], uint32(len(chunk)))
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	c.nc.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	_, err := c.nc.Write(chunk)
+	return err
+}
+
+// Sends an ERR message with the status of the error before the connection is closed
+func (c *conn) sendError(err error) {
+	status := ua.StatusBadCommunicationError
+	errors.As(err, &status)
+	body, err := (&uacp.Error{ErrorCode: uint32(status), Reason: err.Error()}).Encode()
+	if err != nil {
+		return
+	}
+	c.write("ERRF", body)
+}
+
+func minUint32(a, b uint32) uint32 {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,42 @@
+package opcua
+
+import (
+	"errors"
+	"math"
+	"testing"
+
+	"github.com/gopcua/opcua/ua"
+)
+
+func TestCheckSequenceNumber(t *testing.T) {
+	tests := []struct {
+		name  string
+		seqs  []uint32
+		valid bool
+	}{
+		{name: "increasing by one", seqs: []uint32{1, 2, 3}, valid: true},
+		{name: "increasing with gaps", seqs: []uint32{5, 7, 100}, valid: true},
+		{name: "starting at zero", seqs: []uint32{0, 1}, valid: true},
+		{name: "replayed", seqs: []uint32{1, 2, 2}},
+		{name: "decreasing", seqs: []uint32{1, 3, 2}},
+		{name: "wrapping around", seqs: []uint32{math.MaxUint32 - 10, 1}, valid: true},
+		{name: "wrapping around to 1023", seqs: []uint32{maxSequenceNumber + 1, 1023}, valid: true},
+		{name: "wrapping around to 1024", seqs: []uint32{maxSequenceNumber + 1, 1024}},
+		{name: "wrapping around too early", seqs: []uint32{maxSequenceNumber, 1}},
+	}
+	for _, test := range tests {
+		c := &conn{}
+		var err error
+		for _, seq := range test.seqs {
+			if err = c.checkSequenceNumber(seq); err != nil {
+				break
+			}
+		}
+		if test.valid && err != nil {
+			t.Errorf("%s: rejected: %v", test.name, err)
+		}
+		if !test.valid && !errors.Is(err, ua.StatusBadSequenceNumberInvalid) {
+			t.Errorf("%s: got %v, want ua.StatusBadSequenceNumberInvalid", test.name, err)
+		}
+	}
+}
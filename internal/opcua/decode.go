@@ -0,0 +1,192 @@
+package opcua
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/gopcua/opcua/id"
+	"github.com/gopcua/opcua/ua"
+)
+
+// The maximum number of elements of an array in a request
+const maxArrayLength = 0xffff
+
+// The structures decoded from the bodies of extension objects in requests, by the numeric ID of their binary encoding.
+// The bodies of other extension objects are skipped.
+var extensionObjects = map[uint32]reflect.Type{
+	id.AnonymousIdentityToken_Encoding_DefaultBinary: reflect.TypeOf(ua.AnonymousIdentityToken{}),
+	id.UserNameIdentityToken_Encoding_DefaultBinary:  reflect.TypeOf(ua.UserNameIdentityToken{}),
+	id.X509IdentityToken_Encoding_DefaultBinary:      reflect.TypeOf(ua.X509IdentityToken{}),
+	id.IssuedIdentityToken_Encoding_DefaultBinary:    reflect.TypeOf(ua.IssuedIdentityToken{}),
+	id.DataChangeFilter_Encoding_DefaultBinary:       reflect.TypeOf(ua.DataChangeFilter{}),
+}
+
+var (
+	extensionObjectType = reflect.TypeOf(ua.ExtensionObject{})
+	variantType         = reflect.TypeOf(ua.Variant{})
+	dataValueType       = reflect.TypeOf(ua.DataValue{})
+	diagnosticInfoType  = reflect.TypeOf(ua.DiagnosticInfo{})
+	binaryDecoder       = reflect.TypeOf((*ua.BinaryDecoder)(nil)).Elem()
+	timeType            = reflect.TypeOf(time.Time{})
+)
+
+// Returned if a message cannot be decoded
+var errDecoding = errors.New("opcua: invalid message encoding")
+
+// Decodes a request into the structure v points to. Unlike ua.Decode, it checks the lengths of arrays against the
+// remaining bytes before allocating them and refuses the nested values of variants, so a client cannot make the server
+// allocate more memory than the size of the message or exhaust the stack.
+func decode(b []byte, v interface{}) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%w: %v", errDecoding, r)
+		}
+	}()
+	val := reflect.ValueOf(v)
+	if val.Kind() != reflect.Ptr || val.IsNil() {
+		return fmt.Errorf("%w: cannot decode into %T", errDecoding, v)
+	}
+	_, err = decodeValue(b, val.Elem())
+	return err
+}
+
+// Decodes the value from the start of b, returning the number of bytes read
+func decodeValue(b []byte, val reflect.Value) (int, error) {
+	switch val.Type() {
+	case extensionObjectType:
+		return decodeExtensionObject(b, val.Addr().Interface().(*ua.ExtensionObject))
+	case variantType:
+		if err := checkVariant(b); err != nil {
+			return 0, err
+		}
+	case dataValueType:
+		if len(b) > 0 && b[0]&ua.DataValueValue != 0 {
+			if err := checkVariant(b[1:]); err != nil {
+				return 0, err
+			}
+		}
+	case diagnosticInfoType:
+		return 0, fmt.Errorf("%w: diagnostic info in a request", errDecoding)
+	}
+
+	switch {
+	case val.Addr().Type().Implements(binaryDecoder):
+		return val.Addr().Interface().(ua.BinaryDecoder).Decode(b)
+	case val.Type() == timeType:
+		return ua.Decode(b, val.Addr().Interface())
+	}
+	switch val.Kind() {
+	case reflect.Ptr:
+		if val.IsNil() {
+			val.Set(reflect.New(val.Type().Elem()))
+		}
+		return decodeValue(b, val.Elem())
+	case reflect.Slice:
+		return decodeSlice(b, val)
+	case reflect.Struct:
+		pos := 0
+		for i := 0; i < val.NumField(); i++ {
+			if !val.Field(i).CanSet() {
+				return pos, fmt.Errorf("%w: unexported field of %s", errDecoding, val.Type())
+			}
+			n, err := decodeValue(b[pos:], val.Field(i))
+			if err != nil {
+				return pos, err
+			}
+			pos += n
+		}
+		return pos, nil
+	case reflect.Array, reflect.Map, reflect.Interface, reflect.Chan, reflect.Func:
+		return 0, fmt.Errorf("%w: unsupported type %s", errDecoding, val.Type())
+	}
+	return ua.Decode(b, val.Addr().Interface())
+}
+
+// Decodes an array, which is refused if it has more elements than bytes remaining
+func decodeSlice(b []byte, val reflect.Value) (int, error) {
+	buf := ua.NewBuffer(b)
+	n := buf.ReadInt32()
+	if buf.Error() != nil {
+		return 0, errDecoding
+	}
+	if n == -1 {
+		val.Set(reflect.Zero(val.Type()))
+		return buf.Pos(), nil
+	}
+	if n < 0 || int(n) > len(b)-buf.Pos() {
+		return buf.Pos(), fmt.Errorf("%w: array of %d elements", errDecoding, n)
+	}
+	if val.Type().Elem().Kind() == reflect.Uint8 {
+		val.SetBytes(append([]byte{}, buf.ReadN(int(n))...))
+		return buf.Pos(), buf.Error()
+	}
+	if n > maxArrayLength {
+		return buf.Pos(), ua.StatusBadEncodingLimitsExceeded
+	}
+	a := reflect.MakeSlice(val.Type(), int(n), int(n))
+	pos := buf.Pos()
+	for i := 0; i < int(n); i++ {
+		m, err := decodeValue(b[pos:], a.Index(i))
+		if err != nil {
+			return pos, err
+		}
+		pos += m
+	}
+	val.Set(a)
+	return pos, nil
+}
+
+// Decodes an extension object. Only the bodies of the known structures are decoded, the value of others is nil.
+func decodeExtensionObject(b []byte, o *ua.ExtensionObject) (int, error) {
+	buf := ua.NewBuffer(b)
+	o.TypeID = new(ua.ExpandedNodeID)
+	buf.ReadStruct(o.TypeID)
+	o.EncodingMask = buf.ReadByte()
+	if buf.Error() != nil {
+		return buf.Pos(), errDecoding
+	}
+	if o.EncodingMask == ua.ExtensionObjectEmpty {
+		return buf.Pos(), nil
+	}
+	body := buf.ReadBytes()
+	if buf.Error() != nil {
+		return buf.Pos(), errDecoding
+	}
+	typeID, ok := standardID(o.TypeID.NodeID)
+	t, known := extensionObjects[typeID]
+	if !ok || !known || o.EncodingMask != ua.ExtensionObjectBinary {
+		return buf.Pos(), nil
+	}
+	value := reflect.New(t)
+	if _, err := decodeValue(body, value.Elem()); err != nil {
+		return buf.Pos(), err
+	}
+	o.Value = value.Interface()
+	return buf.Pos(), nil
+}
+
+// Checks the encoding of a variant before it is decoded by ua.Variant. Variants of structures, data values,
+// variants and diagnostic infos could nest without limit, and the dimensions of multi-dimensional arrays
+// are allocated without checking their number.
+func checkVariant(b []byte) error {
+	if len(b) == 0 {
+		return errDecoding
+	}
+	mask := b[0]
+	switch ua.TypeID(mask & 0x3f) {
+	case ua.TypeIDExtensionObject, ua.TypeIDDataValue, ua.TypeIDVariant, ua.TypeIDDiagnosticInfo:
+		return fmt.Errorf("%w: variant of type %d", errDecoding, mask&0x3f)
+	}
+	if mask&ua.VariantArrayDimensions != 0 {
+		return fmt.Errorf("%w: multi-dimensional array", errDecoding)
+	}
+	if mask&ua.VariantArrayValues != 0 {
+		buf := ua.NewBuffer(b[1:])
+		if n := buf.ReadInt32(); buf.Error() != nil || n < 0 || int(n) > len(b)-5 {
+			return fmt.Errorf("%w: variant array", errDecoding)
+		}
+	}
+	return nil
+}
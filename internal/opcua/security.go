@@ -0,0 +1,347 @@
+package opcua
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/util"
+	"github.com/gopcua/opcua/ua"
+	"github.com/gopcua/opcua/uapolicy"
+)
+
+// The limits of Basic256Sha256
+const (
+	nonceLength   = 32
+	minRSAKeySize = 256 // bytes, 2048 bits
+	maxRSAKeySize = 512 // bytes, 4096 bits
+)
+
+// The certificate and private key of the server
+type certificate struct {
+	der        []byte
+	key        *rsa.PrivateKey
+	thumbprint []byte // the SHA-1 hash identifying the certificate in the headers of clients
+}
+
+// Reads the certificate and the RSA private key of the server from PEM files
+func loadCertificate(certFile, keyFile string) (*certificate, error) {
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := pair.PrivateKey.(*rsa.PrivateKey)
+	if !ok || key.Size() < minRSAKeySize || key.Size() > maxRSAKeySize {
+		return nil, errors.New("the private key must be an RSA key of 2048 to 4096 bits")
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	for _, uri := range cert.URIs {
+		if uri.String() == ApplicationURI {
+			return newCertificate(pair.Certificate[0], key), nil
+		}
+	}
+	return nil, fmt.Errorf("the certificate must contain the application URI %s as subject alternative name", ApplicationURI)
+}
+
+// Generates a self-signed certificate for the host of the endpoint URL
+func generateCertificate(endpointURL string) (*certificate, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	applicationURI, _ := url.Parse(ApplicationURI)
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "Sparkplug Primary Host"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageContentCommitment | x509.KeyUsageKeyEncipherment | x509.KeyUsageDataEncipherment | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		URIs:                  []*url.URL{applicationURI},
+	}
+	if u, err := url.Parse(endpointURL); err == nil && u.Hostname() != "" {
+		template.DNSNames = []string{u.Hostname()}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	return newCertificate(der, key), nil
+}
+
+func newCertificate(der []byte, key *rsa.PrivateKey) *certificate {
+	thumbprint := sha1.Sum(der)
+	return &certificate{der: der, key: key, thumbprint: thumbprint[:]}
+}
+
+// The extensions of the files read from the directory of the trusted certificates
+var certificateExtensions = []string{".der", ".cer", ".crt", ".pem"}
+
+// The client certificates trusted by the server, directly or by one of the trusted CA certificates issuing them
+type trustList struct {
+	thumbprints map[[sha1.Size]byte]bool
+	roots       *x509.CertPool
+}
+
+// Reads the DER or PEM certificates of the directory, ignoring files of other extensions, e.g. revocation lists
+func loadTrustList(dir string) (*trustList, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	t := &trustList{thumbprints: make(map[[sha1.Size]byte]bool), roots: x509.NewCertPool()}
+	for _, entry := range entries {
+		if entry.IsDir() || !util.Contains(certificateExtensions, strings.ToLower(filepath.Ext(entry.Name()))) {
+			continue
+		}
+		content, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		ders := [][]byte{content}
+		if bytes.HasPrefix(bytes.TrimSpace(content), []byte("-----BEGIN")) {
+			ders = nil
+			for block, rest := pem.Decode(content); block != nil; block, rest = pem.Decode(rest) {
+				if block.Type == "CERTIFICATE" {
+					ders = append(ders, block.Bytes)
+				}
+			}
+		}
+		for _, der := range ders {
+			cert, err := x509.ParseCertificate(der)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", entry.Name(), err)
+			}
+			t.thumbprints[sha1.Sum(der)] = true
+			t.roots.AddCert(cert)
+		}
+	}
+	return t, nil
+}
+
+// Returns whether the certificate is trusted or issued by a trusted CA
+func (t *trustList) trusts(cert *x509.Certificate) bool {
+	if t.thumbprints[sha1.Sum(cert.Raw)] {
+		return true
+	}
+	_, err := cert.Verify(x509.VerifyOptions{Roots: t.roots, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny}})
+	return err == nil
+}
+
+// Returns the public key of a client certificate, which must be trusted if the server has a trust list.
+// Clients are authenticated by their user identity tokens in addition.
+func (s *Server) clientPublicKey(der []byte) (*rsa.PublicKey, ua.StatusCode) {
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, ua.StatusBadCertificateInvalid
+	}
+	key, ok := cert.PublicKey.(*rsa.PublicKey)
+	if !ok || key.Size() < minRSAKeySize || key.Size() > maxRSAKeySize {
+		return nil, ua.StatusBadCertificateInvalid
+	}
+	if now := time.Now(); now.Before(cert.NotBefore) || now.After(cert.NotAfter) {
+		return nil, ua.StatusBadCertificateTimeInvalid
+	}
+	if s.trusted != nil && !s.trusted.trusts(cert) {
+		return nil, ua.StatusBadCertificateUntrusted
+	}
+	return key, ua.StatusOK
+}
+
+// Decrypts data encrypted with the server certificate, which must fill whole blocks of its key size
+func (c *certificate) decrypt(alg *uapolicy.EncryptionAlgorithm, data []byte) ([]byte, bool) {
+	if len(data) == 0 || len(data)%c.key.Size() != 0 {
+		return nil, false
+	}
+	plaintext, err := alg.Decrypt(data)
+	return plaintext, err == nil
+}
+
+// Decrypts and verifies an OPN chunk of a client, returning its sequence header and body.
+// The chunk is encrypted from the given offset, after the security header.
+func (c *certificate) openAsymmetric(alg *uapolicy.EncryptionAlgorithm, chunk []byte, offset int) ([]byte, ua.StatusCode) {
+	decrypted, ok := c.decrypt(alg, chunk[offset:])
+	if !ok {
+		return nil, ua.StatusBadSecurityChecksFailed
+	}
+	plaintext := append(chunk[:offset:offset], decrypted...)
+	n := len(plaintext) - alg.RemoteSignatureLength()
+	if n < offset || alg.VerifySignature(plaintext[:n], plaintext[n:]) != nil {
+		return nil, ua.StatusBadSecurityChecksFailed
+	}
+	data, ok := unpad(plaintext[offset:n], c.key.Size() > minRSAKeySize)
+	if !ok {
+		return nil, ua.StatusBadSecurityChecksFailed
+	}
+	return data, ua.StatusOK
+}
+
+// Signs and encrypts an OPN chunk for the client, from the given offset after the security header
+func sealAsymmetric(alg *uapolicy.EncryptionAlgorithm, chunk []byte, offset int) []byte {
+	blockSize, plaintextBlockSize := alg.BlockSize(), alg.PlaintextBlockSize()
+	chunk = pad(chunk, offset, plaintextBlockSize, alg.SignatureLength(), blockSize > minRSAKeySize)
+	size := offset + (len(chunk)-offset+alg.SignatureLength())/plaintextBlockSize*blockSize
+	binary.LittleEndian.PutUint32(chunk[4:], uint32(size))
+	signature, err := alg.Signature(chunk)
+	if err != nil {
+		panic(err)
+	}
+	encrypted, err := alg.Encrypt(append(chunk[offset:len(chunk):len(chunk)], signature...))
+	if err != nil {
+		panic(err)
+	}
+	return append(chunk[:offset:offset], encrypted...)
+}
+
+// Appends the padding, so the chunk from the offset on and the signature fill whole blocks.
+// The padding size is repeated in every padding byte, keys above 2048 bits add the high byte of the size.
+func pad(chunk []byte, offset, blockSize, signatureLength int, extra bool) []byte {
+	sizeLength := 1
+	if extra {
+		sizeLength = 2
+	}
+	size := (blockSize - (len(chunk)-offset+sizeLength+signatureLength)%blockSize) % blockSize
+	for i := 0; i <= size; i++ {
+		chunk = append(chunk, byte(size))
+	}
+	if extra {
+		chunk = append(chunk, byte(size>>8))
+	}
+	return chunk
+}
+
+// Removes the padding appended by pad, returning false if it is malformed
+func unpad(data []byte, extra bool) ([]byte, bool) {
+	n := len(data)
+	if n < 1 || (extra && n < 2) {
+		return nil, false
+	}
+	size, count := int(data[n-1]), int(data[n-1])+1
+	if extra {
+		size = int(data[n-1])<<8 | int(data[n-2])
+		count = size + 2
+	}
+	if count > n {
+		return nil, false
+	}
+	for _, b := range data[n-count : n-count+size+1] {
+		if b != byte(size) {
+			return nil, false
+		}
+	}
+	return data[:n-count], true
+}
+
+// A security token of a secure channel. Its algorithm verifies and decrypts the messages of the client
+// and signs and encrypts the messages of the server, it is nil with the security policy None.
+type securityToken struct {
+	id  uint32
+	alg *uapolicy.EncryptionAlgorithm
+}
+
+// Creates a token, deriving its keys from the nonces if the channel is secured
+func newSecurityToken(id uint32, clientNonce, serverNonce []byte) (*securityToken, error) {
+	t := &securityToken{id: id}
+	if len(serverNonce) == 0 {
+		return t, nil
+	}
+	var err error
+	t.alg, err = uapolicy.Symmetric(ua.SecurityPolicyURIBasic256Sha256, serverNonce, clientNonce)
+	return t, err
+}
+
+// Verifies and decrypts a symmetric chunk of the client according to the security mode, returning its sequence header and body
+func (t *securityToken) open(chunk []byte, mode ua.MessageSecurityMode) ([]byte, ua.StatusCode) {
+	if mode == ua.MessageSecurityModeNone {
+		return chunk[sequenceHeaderOffset:], ua.StatusOK
+	}
+	if mode == ua.MessageSecurityModeSignAndEncrypt {
+		decrypted, err := t.alg.Decrypt(chunk[sequenceHeaderOffset:])
+		if err != nil {
+			return nil, ua.StatusBadSecurityChecksFailed
+		}
+		chunk = append(chunk[:sequenceHeaderOffset:sequenceHeaderOffset], decrypted...)
+	}
+	n := len(chunk) - t.alg.RemoteSignatureLength()
+	if n < sequenceHeaderOffset || t.alg.VerifySignature(chunk[:n], chunk[n:]) != nil {
+		return nil, ua.StatusBadSecurityChecksFailed
+	}
+	data := chunk[sequenceHeaderOffset:n]
+	if mode == ua.MessageSecurityModeSignAndEncrypt {
+		var ok bool
+		if data, ok = unpad(data, false); !ok {
+			return nil, ua.StatusBadSecurityChecksFailed
+		}
+	}
+	return data, ua.StatusOK
+}
+
+// Signs and encrypts a symmetric chunk of the server according to the security mode and sets its size
+func (t *securityToken) seal(chunk []byte, mode ua.MessageSecurityMode) []byte {
+	if mode == ua.MessageSecurityModeNone {
+		binary.LittleEndian.PutUint32(chunk[4:], uint32(len(chunk)))
+		return chunk
+	}
+	if mode == ua.MessageSecurityModeSignAndEncrypt {
+		chunk = pad(chunk, sequenceHeaderOffset, t.alg.BlockSize(), t.alg.SignatureLength(), false)
+	}
+	binary.LittleEndian.PutUint32(chunk[4:], uint32(len(chunk)+t.alg.SignatureLength()))
+	signature, err := t.alg.Signature(chunk)
+	if err != nil {
+		panic(err)
+	}
+	chunk = append(chunk, signature...)
+	if mode == ua.MessageSecurityModeSignAndEncrypt {
+		encrypted, err := t.alg.Encrypt(chunk[sequenceHeaderOffset:])
+		if err != nil {
+			panic(err)
+		}
+		chunk = append(chunk[:sequenceHeaderOffset:sequenceHeaderOffset], encrypted...)
+	}
+	return chunk
+}
+
+// Returns whether the signature of the client over the server certificate and nonce is valid
+func (c *conn) verifyClientSignature(der, nonce []byte, signature *ua.SignatureData) bool {
+	data := append(der[:len(der):len(der)], nonce...)
+	return signature.Algorithm == c.asymmetric.SignatureURI() && c.asymmetric.VerifySignature(data, signature.Signature) == nil
+}
+
+// Decrypts the password of a UserNameIdentityToken, which is followed by the nonce of the session
+func (c *conn) decryptPassword(token *ua.UserNameIdentityToken, nonce []byte) (string, bool) {
+	if token.EncryptionAlgorithm != c.asymmetric.EncryptionURI() {
+		return "", false
+	}
+	plaintext, ok := c.s.cert.decrypt(c.asymmetric, token.Password)
+	if !ok || len(plaintext) < 4 {
+		return "", false
+	}
+	length := int(binary.LittleEndian.Uint32(plaintext))
+	plaintext = plaintext[4:]
+	if length != len(plaintext) || length < len(nonce) || !bytes.Equal(plaintext[length-len(nonce):], nonce) {
+		return "", false
+	}
+	return string(plaintext[:length-len(nonce)]), true
+}
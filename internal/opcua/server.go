@@ -0,0 +1,284 @@
+package opcua
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/audit"
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/auth"
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/metrics"
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/sparkplug"
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/store"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sirupsen/logrus"
+)
+
+// The URIs identifying the server and its namespace of the Sparkplug hierarchy
+const (
+	ApplicationURI = "urn:go-sparkplug-primary"
+	ProductURI     = "https://github.com/DATATRONiQ/go-sparkplug-primary"
+	NamespaceURI   = "urn:go-sparkplug-primary:sparkplug"
+)
+
+// How often the subscriptions, publish requests and session timeouts are checked
+const tickInterval = 50 * time.Millisecond
+
+var requests = promauto.NewCounterVec(prometheus.CounterOpts{Name: "sparkplug_primary_opcua_requests_total", Help: "OPC UA service requests by service"}, []string{"service"})
+
+// The settings of the OPC UA server
+type Config struct {
+	Address     string // The TCP listen address
+	EndpointURL string // The endpoint URL advertised to clients, derived from the host name and port if empty
+	Writable    bool   // Whether clients with the operator role may write metrics as NCMD and DCMD
+	MaxSessions int
+	CertFile    string // The PEM certificate of the server securing the channels, a self-signed one is generated if empty
+	KeyFile     string // The PEM RSA private key of the certificate
+	TrustedDir  string // The directory of the trusted client and CA certificates, any client certificate is accepted if empty
+}
+
+// Returns an error if the address, the endpoint URL or the certificate files are invalid
+func (c Config) Validate() error {
+	if _, _, err := net.SplitHostPort(c.Address); err != nil {
+		return fmt.Errorf("invalid address %q: %v", c.Address, err)
+	}
+	if c.EndpointURL != "" {
+		u, err := url.Parse(c.EndpointURL)
+		if err != nil || u.Scheme != "opc.tcp" || u.Host == "" {
+			return fmt.Errorf("endpoint URL must be opc.tcp://<host>:<port>, got %q", c.EndpointURL)
+		}
+	}
+	if c.MaxSessions < 1 {
+		return fmt.Errorf("max sessions must be positive, got %d", c.MaxSessions)
+	}
+	if (c.CertFile == "") != (c.KeyFile == "") {
+		return errors.New("certificate and key file must be given together")
+	}
+	return nil
+}
+
+// Publishes the commands of OPC UA writes, implemented by the sparkplug client
+type Commander interface {
+	SendCommand(groupID, nodeID, deviceID string, metrics []sparkplug.CommandMetric) error
+}
+
+// Serves the groups, edge nodes, devices and metrics of the store as the address space of an OPC UA server.
+// Channels are secured with Basic256Sha256, clients authenticate with the users of the API if authentication is enabled.
+// Channels without security serve anonymous clients read-only if authentication is disabled, and discovery otherwise.
+type Server struct {
+	cfg         Config
+	endpointURL string
+	cert        *certificate
+	trusted     *trustList // nil if any client certificate is accepted
+	sm          *store.StoreManager
+	commander   Commander
+	auditLog    *audit.Log
+	auth        *auth.Authenticator // nil if authentication is disabled
+	listener    net.Listener
+	writable    int32 // 1 if writes are allowed, changed by reloads
+	started     time.Time
+
+	mu            sync.Mutex
+	conns         map[*conn]struct{}
+	sessions      map[string]*session // by the string of the authentication token
+	nextChannelID uint32
+	nextSessionID uint32
+	nextID        uint32 // of subscriptions and monitored items
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// Starts listening on the configured address
+func Start(cfg Config, sm *store.StoreManager, commander Commander, auditLog *audit.Log, authenticator *auth.Authenticator) (*Server, error) {
+	var cert *certificate
+	if cfg.CertFile != "" {
+		var err error
+		if cert, err = loadCertificate(cfg.CertFile, cfg.KeyFile); err != nil {
+			return nil, fmt.Errorf("certificate: %v", err)
+		}
+	}
+	var trusted *trustList
+	if cfg.TrustedDir != "" {
+		var err error
+		if trusted, err = loadTrustList(cfg.TrustedDir); err != nil {
+			return nil, fmt.Errorf("trusted certificates: %v", err)
+		}
+	}
+	listener, err := net.Listen("tcp", cfg.Address)
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{
+		cfg:         cfg,
+		endpointURL: cfg.EndpointURL,
+		cert:        cert,
+		trusted:     trusted,
+		sm:          sm,
+		commander:   commander,
+		auditLog:    auditLog,
+		auth:        authenticator,
+		listener:    listener,
+		started:     time.Now(),
+		conns:       make(map[*conn]struct{}),
+		sessions:    make(map[string]*session),
+		done:        make(chan struct{}),
+	}
+	if s.endpointURL == "" {
+		s.endpointURL = defaultEndpointURL(listener.Addr())
+	}
+	if s.cert == nil {
+		if s.cert, err = generateCertificate(s.endpointURL); err != nil {
+			listener.Close()
+			return nil, err
+		}
+		logrus.Infof("OPC UA server uses a self-signed certificate with the SHA-1 thumbprint %X, set opcua.certFile to keep it across restarts", s.cert.thumbprint)
+	}
+	if s.trusted == nil {
+		logrus.Warn("OPC UA server accepts any client certificate, set opcua.trustedDir to restrict the clients")
+	}
+	s.SetWritable(cfg.Writable)
+	metrics.NewGaugeFunc("sparkplug_primary_opcua_sessions", "Open OPC UA sessions", nil, func(emit func(v float64, labelValues ...string)) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		emit(float64(len(s.sessions)))
+	})
+
+	s.wg.Add(2)
+	go s.accept()
+	go s.run()
+	logrus.Infof("OPC UA server listening on %s (%s)", listener.Addr(), s.endpointURL)
+	return s, nil
+}
+
+// Returns opc.tcp://<hostname>:<port> of the listen address
+func defaultEndpointURL(addr net.Addr) string {
+	host, _ := os.Hostname()
+	if host == "" {
+		host = "localhost"
+	}
+	_, port, _ := net.SplitHostPort(addr.String())
+	return "opc.tcp://" + net.JoinHostPort(host, port)
+}
+
+// Allows or forbids writes of metrics
+func (s *Server) SetWritable(writable bool) {
+	var v int32
+	if writable {
+		v = 1
+	}
+	atomic.StoreInt32(&s.writable, v)
+}
+
+func (s *Server) isWritable() bool {
+	return atomic.LoadInt32(&s.writable) == 1
+}
+
+// Stops listening and closes all connections and sessions
+func (s *Server) Close() {
+	close(s.done)
+	s.listener.Close()
+	s.mu.Lock()
+	for c := range s.conns {
+		c.close()
+	}
+	s.sessions = make(map[string]*session)
+	s.mu.Unlock()
+	s.wg.Wait()
+}
+
+func (s *Server) accept() {
+	defer s.wg.Done()
+	for {
+		nc, err := s.listener.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				logrus.Errorf("OPC UA server stopped accepting connections: %v", err)
+			}
+			return
+		}
+		c := newConn(s, nc)
+		s.mu.Lock()
+		s.conns[c] = struct{}{}
+		s.mu.Unlock()
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			c.serve()
+			s.mu.Lock()
+			delete(s.conns, c)
+			s.detach(c)
+			s.mu.Unlock()
+		}()
+	}
+}
+
+// Returns a new ID of a subscription or monitored item, unique in the server
+func (s *Server) newID() uint32 {
+	s.nextID++
+	return s.nextID
+}
+
+// Processes the subscriptions, the timeouts of publish requests and sessions every tick
+func (s *Server) run() {
+	defer s.wg.Done()
+	ticker := time.NewTicker(tickInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case now := <-ticker.C:
+			s.tick(now)
+		}
+	}
+}
+
+func (s *Server) tick(now time.Time) {
+	var out []response
+	var v *view // built once the first subscription is due
+	s.mu.Lock()
+	for token, sess := range s.sessions {
+		if now.Sub(sess.lastActivity) > sess.timeout {
+			logrus.Infof("OPC UA session %s of %s timed out", sess.name, sess.principalName())
+			out = append(out, sess.close()...)
+			delete(s.sessions, token)
+			continue
+		}
+		out = append(out, sess.expirePublishRequests(now)...)
+		for _, sub := range sess.subscriptionsByID() {
+			if now.Before(sub.next) {
+				continue
+			}
+			sub.next = sub.next.Add(sub.interval)
+			if sub.next.Before(now) {
+				// skips the missed cycles
+				sub.next = now.Add(sub.interval)
+			}
+			if v == nil {
+				v = newView(s.sm)
+			}
+			out = append(out, s.publishCycle(sess, sub, v, now)...)
+		}
+	}
+	s.mu.Unlock()
+	for _, r := range out {
+		r.send()
+	}
+}
+
+// Returns random bytes for nonces and authentication tokens
+func randomBytes(n int) []byte {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return b
+}
@@ -0,0 +1,386 @@
+package opcua
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/audit"
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/auth"
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/store"
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/store/storetest"
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/util"
+	gopcua "github.com/gopcua/opcua"
+	"github.com/gopcua/opcua/id"
+	"github.com/gopcua/opcua/ua"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var temperature = ua.NewStringNodeID(sparkplugNamespace, "g1/n1/temp")
+
+// A server serving the edge node g1/n1 with the metric temp
+type testServer struct {
+	*Server
+	t        *testing.T
+	url      string
+	store    *storetest.Store
+	commands *storetest.Commander
+}
+
+// Starts a writable server, authenticating the user operator with the password secret if auth is set.
+// The configure functions change the configuration of the server.
+func startServer(t *testing.T, withAuth bool, configure ...func(*Config)) *testServer {
+	t.Helper()
+	st := storetest.New(t)
+	auditLog, err := audit.Open("", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var authenticator *auth.Authenticator
+	if withAuth {
+		hash, _ := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+		credentialsFile := filepath.Join(t.TempDir(), "credentials.yaml")
+		credentials := fmt.Sprintf("users:\n  - name: operator\n    passwordHash: %q\n    roles: [operator]\n", hash)
+		if err := os.WriteFile(credentialsFile, []byte(credentials), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if authenticator, err = auth.New(auth.Config{CredentialsFile: credentialsFile}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cmds := &storetest.Commander{}
+	cfg := Config{Address: "127.0.0.1:0", Writable: true, MaxSessions: 10}
+	for _, f := range configure {
+		f(&cfg)
+	}
+	s, err := Start(cfg, st.StoreManager, cmds, auditLog, authenticator)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Close)
+	ts := &testServer{Server: s, t: t, url: "opc.tcp://" + s.listener.Addr().String(), store: st, commands: cmds}
+	ts.publish(store.NodeBirth, 0, 21.5)
+	return ts
+}
+
+// Passes a message with the value of temp to the store and waits until it is processed
+func (ts *testServer) publish(msgType store.Type, seq uint64, value float64) {
+	ts.t.Helper()
+	ts.store.PublishMetric(ts.t, "g1", "n1", msgType, seq, storetest.DoubleMetric("temp", 1, value))
+}
+
+// Connects a client to the endpoint of the given security mode, with the given options for the user identity token
+func (ts *testServer) connect(t *testing.T, mode ua.MessageSecurityMode, tokenType ua.UserTokenType, opts ...gopcua.Option) (*gopcua.Client, error) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	endpoints, err := gopcua.GetEndpoints(ctx, ts.url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy := ua.SecurityPolicyURIBasic256Sha256
+	if mode == ua.MessageSecurityModeNone {
+		policy = ua.SecurityPolicyURINone
+	}
+	endpoint := gopcua.SelectEndpoint(endpoints, policy, mode)
+	if endpoint == nil {
+		return nil, fmt.Errorf("no endpoint with mode %s", mode)
+	}
+	clientCert, err := generateCertificate("opc.tcp://localhost:4841")
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts = append([]gopcua.Option{
+		gopcua.SecurityFromEndpoint(endpoint, tokenType),
+		gopcua.Certificate(clientCert.der),
+		gopcua.PrivateKey(clientCert.key),
+		gopcua.AutoReconnect(false),
+	}, opts...)
+	client, err := gopcua.NewClient(ts.url, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Connect(ctx); err != nil {
+		return nil, err
+	}
+	t.Cleanup(func() { client.Close(context.Background()) })
+	return client, nil
+}
+
+func TestBrowseAndRead(t *testing.T) {
+	ts := startServer(t, false)
+	client, err := ts.connect(t, ua.MessageSecurityModeSignAndEncrypt, ua.UserTokenTypeAnonymous)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	browse := func(nodeID *ua.NodeID) []string {
+		t.Helper()
+		res, err := client.Browse(ctx, &ua.BrowseRequest{NodesToBrowse: []*ua.BrowseDescription{{
+			NodeID:          nodeID,
+			BrowseDirection: ua.BrowseDirectionForward,
+			ReferenceTypeID: ua.NewNumericNodeID(0, id.HierarchicalReferences),
+			IncludeSubtypes: true,
+			ResultMask:      uint32(ua.BrowseResultMaskAll),
+		}}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status := res.Results[0].StatusCode; status != ua.StatusOK {
+			t.Fatalf("browsing %s: %v", nodeID, status)
+		}
+		var names []string
+		for _, ref := range res.Results[0].References {
+			names = append(names, ref.BrowseName.Name)
+		}
+		return names
+	}
+	if names := browse(ua.NewNumericNodeID(0, id.ObjectsFolder)); !util.Contains(names, "g1") {
+		t.Errorf("got %v in the Objects folder, want g1", names)
+	}
+	if names := browse(ua.NewStringNodeID(sparkplugNamespace, "g1/n1")); !util.Contains(names, "temp") {
+		t.Errorf("got %v below g1/n1, want temp", names)
+	}
+
+	res, err := client.Read(ctx, &ua.ReadRequest{
+		NodesToRead:        []*ua.ReadValueID{{NodeID: temperature, AttributeID: ua.AttributeIDValue}},
+		TimestampsToReturn: ua.TimestampsToReturnBoth,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := res.Results[0]; v.Status != ua.StatusOK || v.Value.Value() != 21.5 {
+		t.Errorf("got %v with status %v, want 21.5", v.Value.Value(), v.Status)
+	}
+}
+
+func TestSubscription(t *testing.T) {
+	ts := startServer(t, false)
+	client, err := ts.connect(t, ua.MessageSecurityModeSign, ua.UserTokenTypeAnonymous)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	notifications := make(chan *gopcua.PublishNotificationData, 10)
+	sub, err := client.Subscribe(ctx, &gopcua.SubscriptionParameters{Interval: 100 * time.Millisecond}, notifications)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := sub.Monitor(ctx, ua.TimestampsToReturnBoth, gopcua.NewMonitoredItemCreateRequestWithDefaults(temperature, ua.AttributeIDValue, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status := res.Results[0].StatusCode; status != ua.StatusOK {
+		t.Fatalf("creating the monitored item: %v", status)
+	}
+
+	next := func() any {
+		t.Helper()
+		for {
+			select {
+			case n := <-notifications:
+				if n.Error != nil {
+					t.Fatal(n.Error)
+				}
+				if change, ok := n.Value.(*ua.DataChangeNotification); ok && len(change.MonitoredItems) > 0 {
+					return change.MonitoredItems[len(change.MonitoredItems)-1].Value.Value.Value()
+				}
+			case <-ctx.Done():
+				t.Fatal("no data change notification received")
+			}
+		}
+	}
+	if v := next(); v != 21.5 {
+		t.Errorf("got %v as initial value, want 21.5", v)
+	}
+	ts.publish(store.NodeData, 1, 22.5)
+	if v := next(); v != 22.5 {
+		t.Errorf("got %v after the update, want 22.5", v)
+	}
+}
+
+// Writes 23.5 to temp, returning the status of the write
+func write(t *testing.T, client *gopcua.Client) ua.StatusCode {
+	t.Helper()
+	res, err := client.Write(context.Background(), &ua.WriteRequest{NodesToWrite: []*ua.WriteValue{{
+		NodeID:      temperature,
+		AttributeID: ua.AttributeIDValue,
+		Value:       &ua.DataValue{EncodingMask: ua.DataValueValue, Value: ua.MustVariant(23.5)},
+	}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res.Results[0]
+}
+
+func TestWriteRequiresSecureChannel(t *testing.T) {
+	ts := startServer(t, false)
+	insecure, err := ts.connect(t, ua.MessageSecurityModeNone, ua.UserTokenTypeAnonymous)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status := write(t, insecure); status != ua.StatusBadSecurityModeInsufficient {
+		t.Errorf("got %v writing over a channel without security, want BadSecurityModeInsufficient", status)
+	}
+	if sent := ts.commands.Commands(); len(sent) != 0 {
+		t.Fatalf("got commands %v of a refused write", sent)
+	}
+
+	secure, err := ts.connect(t, ua.MessageSecurityModeSignAndEncrypt, ua.UserTokenTypeAnonymous)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status := write(t, secure); status != ua.StatusOK {
+		t.Fatalf("got %v writing over a secure channel, want Good", status)
+	}
+	if sent := ts.commands.Commands(); len(sent) != 1 || sent[0].Name != "temp" || sent[0].Value != 23.5 {
+		t.Errorf("got commands %v, want temp = 23.5", sent)
+	}
+}
+
+func TestUserNameLogin(t *testing.T) {
+	ts := startServer(t, true)
+	if _, err := ts.connect(t, ua.MessageSecurityModeNone, ua.UserTokenTypeUserName, gopcua.AuthUsername("operator", "secret")); err == nil {
+		t.Error("an endpoint without security is offered with authentication enabled")
+	}
+	if _, err := ts.connect(t, ua.MessageSecurityModeSignAndEncrypt, ua.UserTokenTypeUserName, gopcua.AuthUsername("operator", "wrong")); err == nil {
+		t.Error("logged in with a wrong password")
+	}
+	client, err := ts.connect(t, ua.MessageSecurityModeSign, ua.UserTokenTypeUserName, gopcua.AuthUsername("operator", "secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status := write(t, client); status != ua.StatusOK {
+		t.Errorf("got %v writing as operator, want Good", status)
+	}
+}
+
+func TestUserNameRefusedWithoutSecurity(t *testing.T) {
+	ts := startServer(t, true)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	// the endpoint is not offered, but a client may still try to send the password over a channel without security
+	client, err := gopcua.NewClient(ts.url,
+		gopcua.SecurityPolicy(ua.SecurityPolicyURINone),
+		gopcua.SecurityMode(ua.MessageSecurityModeNone),
+		gopcua.AuthUsername("operator", "secret"),
+		gopcua.AuthPolicyID(userNamePolicy),
+		gopcua.AutoReconnect(false),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Connect(ctx); err == nil {
+		client.Close(ctx)
+		t.Fatal("a password was accepted over a channel without security")
+	}
+}
+
+// Writes the certificate as PEM file to the directory
+func writeCertificate(t *testing.T, dir, name string, der []byte) {
+	t.Helper()
+	if err := os.WriteFile(filepath.Join(dir, name), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Returns a CA certificate and a client certificate issued by it
+func issueCertificate(t *testing.T) (ca []byte, client *certificate) {
+	t.Helper()
+	caKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	if ca, err = x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey); err != nil {
+		t.Fatal(err)
+	}
+	clientKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "Test Client"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment | x509.KeyUsageDataEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	caCert, err := x509.ParseCertificate(ca)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, caCert, &clientKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ca, newCertificate(der, clientKey)
+}
+
+func TestTrustedCertificates(t *testing.T) {
+	dir := t.TempDir()
+	trusted, err := generateCertificate("opc.tcp://localhost:4841")
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeCertificate(t, dir, "client.pem", trusted.der)
+	ca, issued := issueCertificate(t)
+	if err := os.WriteFile(filepath.Join(dir, "ca.der"), ca, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	// files of other extensions are ignored
+	if err := os.WriteFile(filepath.Join(dir, "ca.crl"), []byte("revocation list"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	ts := startServer(t, false, func(cfg *Config) { cfg.TrustedDir = dir })
+
+	withCertificate := func(c *certificate) []gopcua.Option {
+		return []gopcua.Option{gopcua.Certificate(c.der), gopcua.PrivateKey(c.key)}
+	}
+	if _, err := ts.connect(t, ua.MessageSecurityModeSignAndEncrypt, ua.UserTokenTypeAnonymous, withCertificate(trusted)...); err != nil {
+		t.Errorf("trusted certificate rejected: %v", err)
+	}
+	if _, err := ts.connect(t, ua.MessageSecurityModeSign, ua.UserTokenTypeAnonymous, withCertificate(issued)...); err != nil {
+		t.Errorf("certificate issued by a trusted CA rejected: %v", err)
+	}
+	untrusted, err := generateCertificate("opc.tcp://localhost:4841")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ts.connect(t, ua.MessageSecurityModeSignAndEncrypt, ua.UserTokenTypeAnonymous, withCertificate(untrusted)...); err == nil {
+		t.Error("untrusted certificate accepted")
+	}
+	if _, status := ts.clientPublicKey(untrusted.der); status != ua.StatusBadCertificateUntrusted {
+		t.Errorf("got %v for the untrusted certificate, want ua.StatusBadCertificateUntrusted", status)
+	}
+}
+
+func TestTrustedDirWithInvalidCertificate(t *testing.T) {
+	dir := t.TempDir()
+	writeCertificate(t, dir, "broken.pem", []byte("not a certificate"))
+	if _, err := loadTrustList(dir); err == nil {
+		t.Error("invalid certificate accepted")
+	}
+}
@@ -0,0 +1,417 @@
+package opcua
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/auth"
+	"github.com/gopcua/opcua/id"
+	"github.com/gopcua/opcua/ua"
+	"github.com/sirupsen/logrus"
+)
+
+// The transport profile of the binary encoding over TCP
+const transportProfile = "http://opcfoundation.org/UA-Profile/Transport/uatcp-uasc-uabinary"
+
+// The policies of the user identity tokens
+const (
+	anonymousPolicy = "anonymous"
+	userNamePolicy  = "username"
+)
+
+// The bounds of the session timeout requested by clients
+const (
+	minSessionTimeout = 10 * time.Second
+	maxSessionTimeout = time.Hour
+)
+
+// The session a service requires
+type sessionRequirement int
+
+const (
+	noSession        sessionRequirement = iota
+	createdSession                      // a created session, which may not be activated yet
+	activatedSession                    // an activated session
+)
+
+// A service of the server
+type service struct {
+	name    string
+	session sessionRequirement
+	handle  func(s *Server, r *request) []response
+	request ua.Request // the type of the request, decoded before the handler is called
+}
+
+var services map[uint32]service
+
+func init() {
+	// assigned in init, as the handlers refer to the services in turn
+	services = map[uint32]service{
+		id.FindServersRequest_Encoding_DefaultBinary:                   {"FindServers", noSession, (*Server).findServers, &ua.FindServersRequest{}},
+		id.GetEndpointsRequest_Encoding_DefaultBinary:                  {"GetEndpoints", noSession, (*Server).getEndpoints, &ua.GetEndpointsRequest{}},
+		id.CreateSessionRequest_Encoding_DefaultBinary:                 {"CreateSession", noSession, (*Server).createSession, &ua.CreateSessionRequest{}},
+		id.ActivateSessionRequest_Encoding_DefaultBinary:               {"ActivateSession", createdSession, (*Server).activateSession, &ua.ActivateSessionRequest{}},
+		id.CloseSessionRequest_Encoding_DefaultBinary:                  {"CloseSession", createdSession, (*Server).closeSession, &ua.CloseSessionRequest{}},
+		id.BrowseRequest_Encoding_DefaultBinary:                        {"Browse", activatedSession, (*Server).browse, &ua.BrowseRequest{}},
+		id.BrowseNextRequest_Encoding_DefaultBinary:                    {"BrowseNext", activatedSession, (*Server).browseNext, &ua.BrowseNextRequest{}},
+		id.TranslateBrowsePathsToNodeIDsRequest_Encoding_DefaultBinary: {"TranslateBrowsePathsToNodeIds", activatedSession, (*Server).translateBrowsePaths, &ua.TranslateBrowsePathsToNodeIDsRequest{}},
+		id.RegisterNodesRequest_Encoding_DefaultBinary:                 {"RegisterNodes", activatedSession, (*Server).registerNodes, &ua.RegisterNodesRequest{}},
+		id.UnregisterNodesRequest_Encoding_DefaultBinary:               {"UnregisterNodes", activatedSession, (*Server).unregisterNodes, &ua.UnregisterNodesRequest{}},
+		id.ReadRequest_Encoding_DefaultBinary:                          {"Read", activatedSession, (*Server).read, &ua.ReadRequest{}},
+		id.WriteRequest_Encoding_DefaultBinary:                         {"Write", activatedSession, (*Server).write, &ua.WriteRequest{}},
+		id.CreateSubscriptionRequest_Encoding_DefaultBinary:            {"CreateSubscription", activatedSession, (*Server).createSubscription, &ua.CreateSubscriptionRequest{}},
+		id.ModifySubscriptionRequest_Encoding_DefaultBinary:            {"ModifySubscription", activatedSession, (*Server).modifySubscription, &ua.ModifySubscriptionRequest{}},
+		id.SetPublishingModeRequest_Encoding_DefaultBinary:             {"SetPublishingMode", activatedSession, (*Server).setPublishingMode, &ua.SetPublishingModeRequest{}},
+		id.DeleteSubscriptionsRequest_Encoding_DefaultBinary:           {"DeleteSubscriptions", activatedSession, (*Server).deleteSubscriptions, &ua.DeleteSubscriptionsRequest{}},
+		id.CreateMonitoredItemsRequest_Encoding_DefaultBinary:          {"CreateMonitoredItems", activatedSession, (*Server).createMonitoredItems, &ua.CreateMonitoredItemsRequest{}},
+		id.ModifyMonitoredItemsRequest_Encoding_DefaultBinary:          {"ModifyMonitoredItems", activatedSession, (*Server).modifyMonitoredItems, &ua.ModifyMonitoredItemsRequest{}},
+		id.SetMonitoringModeRequest_Encoding_DefaultBinary:             {"SetMonitoringMode", activatedSession, (*Server).setMonitoringMode, &ua.SetMonitoringModeRequest{}},
+		id.DeleteMonitoredItemsRequest_Encoding_DefaultBinary:          {"DeleteMonitoredItems", activatedSession, (*Server).deleteMonitoredItems, &ua.DeleteMonitoredItemsRequest{}},
+		id.PublishRequest_Encoding_DefaultBinary:                       {"Publish", activatedSession, (*Server).publish, &ua.PublishRequest{}},
+		id.RepublishRequest_Encoding_DefaultBinary:                     {"Republish", activatedSession, (*Server).republish, &ua.RepublishRequest{}},
+	}
+}
+
+// A decoded service request
+type request struct {
+	conn        *conn
+	id          uint32 // the request ID of the secure channel
+	handle      uint32 // the request handle of the client
+	token       *ua.NodeID
+	timeoutHint time.Duration
+	received    time.Time
+	req         ua.Request // of the type of the service
+
+	sess      *session        // the session of the request, nil for services without session
+	principal *auth.Principal // the user of the activated session
+	acks      []ua.StatusCode // the results of the acknowledgements of a queued publish request
+}
+
+// An encoded response to be sent to a client
+type response struct {
+	conn      *conn
+	requestID uint32
+	body      []byte
+}
+
+func (r response) send() {
+	r.conn.send(r.requestID, r.body)
+}
+
+// Returns the response header of a service response
+func responseHeader(handle uint32, status ua.StatusCode) *ua.ResponseHeader {
+	return &ua.ResponseHeader{
+		Timestamp:          time.Now(),
+		RequestHandle:      handle,
+		ServiceResult:      status,
+		ServiceDiagnostics: &ua.DiagnosticInfo{},
+	}
+}
+
+// Encodes a service response, preceded by the node ID of its binary encoding
+func encodeResponse(resp ua.Response) (b []byte, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("opcua: cannot encode %T: %v", resp, r)
+		}
+	}()
+	typeID, err := ua.NewFourByteExpandedNodeID(0, ua.ServiceTypeID(resp)).Encode()
+	if err != nil {
+		return nil, err
+	}
+	body, err := ua.Encode(resp)
+	if err != nil {
+		return nil, err
+	}
+	return append(typeID, body...), nil
+}
+
+// Returns the encoded response with the header of the request
+func (r *request) respond(resp ua.Response) []response {
+	resp.SetHeader(responseHeader(r.handle, ua.StatusOK))
+	body, err := encodeResponse(resp)
+	if err != nil {
+		logrus.Errorf("OPC UA response failed: %v", err)
+		return r.fault(ua.StatusBadInternalError)
+	}
+	if r.conn.tooLarge(len(body)) {
+		return r.fault(ua.StatusBadResponseTooLarge)
+	}
+	return []response{{r.conn, r.id, body}}
+}
+
+// Returns a service fault with the given status
+func (r *request) fault(status ua.StatusCode) []response {
+	body, err := encodeResponse(&ua.ServiceFault{ResponseHeader: responseHeader(r.handle, status)})
+	if err != nil {
+		panic(err)
+	}
+	return []response{{r.conn, r.id, body}}
+}
+
+// Decodes the request and dispatches it to its service
+func (s *Server) handle(c *conn, requestID uint32, message []byte) {
+	r := &request{conn: c, id: requestID, received: time.Now()}
+	typeID := new(ua.ExpandedNodeID)
+	n, err := typeID.Decode(message)
+	header := new(ua.RequestHeader)
+	if err == nil {
+		err = decode(message[n:], header)
+	}
+	r.token = header.AuthenticationToken
+	r.handle = header.RequestHandle
+	r.timeoutHint = time.Duration(header.TimeoutHint) * time.Millisecond
+
+	numeric, ok := standardID(typeID.NodeID)
+	svc, known := services[numeric]
+	var out []response
+	switch {
+	case err != nil:
+		out = r.fault(ua.StatusBadDecodingError)
+	case !ok || !known:
+		logrus.Debugf("OPC UA service %s is not supported", typeID.NodeID)
+		requests.WithLabelValues("unsupported").Inc()
+		out = r.fault(ua.StatusBadServiceUnsupported)
+	default:
+		requests.WithLabelValues(svc.name).Inc()
+		r.req = reflect.New(reflect.TypeOf(svc.request).Elem()).Interface().(ua.Request)
+		if err := decode(message[n:], r.req); err != nil {
+			out = r.fault(ua.StatusBadDecodingError)
+			break
+		}
+		if status := s.attach(r, svc.session); status != ua.StatusOK {
+			out = r.fault(status)
+			break
+		}
+		out = svc.handle(s, r)
+	}
+	for _, response := range out {
+		response.send()
+	}
+}
+
+// Looks up the session of the request, checking that it belongs to the secure channel and is activated if required
+func (s *Server) attach(r *request, requirement sessionRequirement) ua.StatusCode {
+	if requirement == noSession {
+		return ua.StatusOK
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sess, ok := s.sessions[r.token.String()]
+	if !ok {
+		return ua.StatusBadSessionIDInvalid
+	}
+	if requirement == activatedSession {
+		if sess.principal == nil {
+			return ua.StatusBadSessionNotActivated
+		}
+		if sess.conn != r.conn {
+			return ua.StatusBadSecureChannelIDInvalid
+		}
+	}
+	sess.lastActivity = time.Now()
+	r.sess = sess
+	r.principal = sess.principal
+	return ua.StatusOK
+}
+
+// Handles FindServers, returning the description of this server
+func (s *Server) findServers(r *request) []response {
+	return r.respond(&ua.FindServersResponse{Servers: []*ua.ApplicationDescription{s.applicationDescription()}})
+}
+
+// Handles GetEndpoints, returning the endpoints of the security modes
+func (s *Server) getEndpoints(r *request) []response {
+	req := r.req.(*ua.GetEndpointsRequest)
+	offered := len(req.ProfileURIs) == 0
+	for _, profile := range req.ProfileURIs {
+		offered = offered || profile == transportProfile
+	}
+	endpoints := []*ua.EndpointDescription{}
+	if offered {
+		endpoints = s.endpointDescriptions()
+	}
+	return r.respond(&ua.GetEndpointsResponse{Endpoints: endpoints})
+}
+
+func (s *Server) applicationDescription() *ua.ApplicationDescription {
+	return &ua.ApplicationDescription{
+		ApplicationURI:  ApplicationURI,
+		ProductURI:      ProductURI,
+		ApplicationName: ua.NewLocalizedText("Sparkplug Primary Host"),
+		ApplicationType: ua.ApplicationTypeServer,
+		DiscoveryURLs:   []string{s.endpointURL},
+	}
+}
+
+// Returns the endpoints: Basic256Sha256 signed and encrypted or only signed, and without security if authentication is disabled,
+// as the passwords of the users must not be sent in plain text
+func (s *Server) endpointDescriptions() []*ua.EndpointDescription {
+	modes := []ua.MessageSecurityMode{ua.MessageSecurityModeSignAndEncrypt, ua.MessageSecurityModeSign}
+	if s.auth == nil {
+		modes = append(modes, ua.MessageSecurityModeNone)
+	}
+	endpoints := make([]*ua.EndpointDescription, 0, len(modes))
+	for _, mode := range modes {
+		policy := ua.SecurityPolicyURIBasic256Sha256
+		if mode == ua.MessageSecurityModeNone {
+			policy = ua.SecurityPolicyURINone
+		}
+		// passwords are encrypted with the certificate of the server
+		token := &ua.UserTokenPolicy{PolicyID: anonymousPolicy, TokenType: ua.UserTokenTypeAnonymous}
+		if s.auth != nil {
+			token = &ua.UserTokenPolicy{PolicyID: userNamePolicy, TokenType: ua.UserTokenTypeUserName, SecurityPolicyURI: ua.SecurityPolicyURIBasic256Sha256}
+		}
+		endpoints = append(endpoints, &ua.EndpointDescription{
+			EndpointURL:         s.endpointURL,
+			Server:              s.applicationDescription(),
+			ServerCertificate:   s.cert.der,
+			SecurityMode:        mode,
+			SecurityPolicyURI:   policy,
+			UserIdentityTokens:  []*ua.UserTokenPolicy{token},
+			TransportProfileURI: transportProfile,
+			SecurityLevel:       uint8(mode - 1), // higher is more secure
+		})
+	}
+	return endpoints
+}
+
+// Handles CreateSession, the session has to be activated before it can be used
+func (s *Server) createSession(r *request) []response {
+	req := r.req.(*ua.CreateSessionRequest)
+	secured := r.conn.securityMode() != ua.MessageSecurityModeNone
+	if secured && (!bytes.Equal(req.ClientCertificate, r.conn.clientCert) || len(req.ClientNonce) < nonceLength) {
+		// the client proves the possession of the key of the channel by signing the nonce of the server
+		return r.fault(ua.StatusBadSecurityChecksFailed)
+	}
+	timeout := time.Duration(req.RequestedSessionTimeout * float64(time.Millisecond))
+	switch {
+	case timeout <= 0:
+		timeout = time.Minute
+	case timeout < minSessionTimeout:
+		timeout = minSessionTimeout
+	case timeout > maxSessionTimeout:
+		timeout = maxSessionTimeout
+	}
+
+	s.mu.Lock()
+	if len(s.sessions) >= s.cfg.MaxSessions {
+		s.mu.Unlock()
+		logrus.Warnf("OPC UA session %q rejected, the maximum of %d sessions is reached", req.SessionName, s.cfg.MaxSessions)
+		return r.fault(ua.StatusBadTooManySessions)
+	}
+	s.nextSessionID++
+	sess := newSession(ua.NewNumericNodeID(1, s.nextSessionID), req.SessionName, r.conn, timeout)
+	s.sessions[sess.token.String()] = sess
+	nonce := sess.nonce
+	s.mu.Unlock()
+
+	// the signature of the client certificate and nonce, proving the possession of the key of the server certificate
+	signature := &ua.SignatureData{}
+	if secured {
+		var err error
+		signature.Algorithm = r.conn.asymmetric.SignatureURI()
+		signature.Signature, err = r.conn.asymmetric.Signature(append(req.ClientCertificate[:len(req.ClientCertificate):len(req.ClientCertificate)], req.ClientNonce...))
+		if err != nil {
+			return r.fault(ua.StatusBadSecurityChecksFailed)
+		}
+	}
+	return r.respond(&ua.CreateSessionResponse{
+		SessionID:             sess.id,
+		AuthenticationToken:   sess.token,
+		RevisedSessionTimeout: float64(timeout / time.Millisecond),
+		ServerNonce:           nonce,
+		ServerCertificate:     s.cert.der,
+		ServerEndpoints:       s.endpointDescriptions(),
+		ServerSignature:       signature,
+		MaxRequestMessageSize: maxMessageSize,
+	})
+}
+
+// Handles ActivateSession, authenticating the user of the session. It also moves the session to the secure channel
+// of the request, e.g. after the client reconnected.
+func (s *Server) activateSession(r *request) []response {
+	req := r.req.(*ua.ActivateSessionRequest)
+	s.mu.Lock()
+	nonce := r.sess.nonce
+	s.mu.Unlock()
+	status := ua.StatusOK
+	if r.conn.securityMode() != ua.MessageSecurityModeNone && !r.conn.verifyClientSignature(s.cert.der, nonce, req.ClientSignature) {
+		status = ua.StatusBadApplicationSignatureInvalid
+	}
+	var principal *auth.Principal
+	if status == ua.StatusOK {
+		principal, status = s.authenticate(r, req.UserIdentityToken, nonce)
+	}
+	if status != ua.StatusOK {
+		logrus.Infof("OPC UA session %s from %s rejected: 0x%08X", r.sess.name, r.conn.nc.RemoteAddr(), uint32(status))
+		return r.fault(status)
+	}
+
+	s.mu.Lock()
+	r.sess.principal = principal
+	r.sess.conn = r.conn
+	r.sess.nonce = randomBytes(nonceLength)
+	nonce = r.sess.nonce
+	s.mu.Unlock()
+	logrus.Infof("OPC UA session %s activated by %s from %s", r.sess.name, principal.Name, r.conn.nc.RemoteAddr())
+
+	return r.respond(&ua.ActivateSessionResponse{ServerNonce: nonce, Results: []ua.StatusCode{}})
+}
+
+// Returns the principal of the user identity token. Clients are anonymous if authentication is disabled,
+// and authenticate with the user names and passwords of the API otherwise, which are encrypted with the server certificate
+// and the nonce of the session. Passwords are refused on channels without security.
+func (s *Server) authenticate(r *request, token *ua.ExtensionObject, nonce []byte) (*auth.Principal, ua.StatusCode) {
+	typeID, ok := standardID(token.TypeID.NodeID)
+	if !ok {
+		return nil, ua.StatusBadIdentityTokenInvalid
+	}
+	switch {
+	case typeID == 0 || typeID == id.AnonymousIdentityToken_Encoding_DefaultBinary:
+		if s.auth != nil {
+			return nil, ua.StatusBadIdentityTokenRejected
+		}
+		return auth.Unrestricted, ua.StatusOK
+	case typeID == id.UserNameIdentityToken_Encoding_DefaultBinary:
+		if s.auth == nil || r.conn.securityMode() == ua.MessageSecurityModeNone {
+			return nil, ua.StatusBadIdentityTokenRejected
+		}
+		userName, ok := token.Value.(*ua.UserNameIdentityToken)
+		if !ok {
+			return nil, ua.StatusBadIdentityTokenInvalid
+		}
+		password, ok := r.conn.decryptPassword(userName, nonce)
+		if !ok {
+			return nil, ua.StatusBadIdentityTokenInvalid
+		}
+		principal, err := s.auth.Password(userName.UserName, password)
+		if err != nil {
+			return nil, ua.StatusBadUserAccessDenied
+		}
+		return principal, ua.StatusOK
+	}
+	return nil, ua.StatusBadIdentityTokenInvalid
+}
+
+// Handles CloseSession, deleting the session and its subscriptions, which are never transferred to other sessions
+func (s *Server) closeSession(r *request) []response {
+	s.mu.Lock()
+	delete(s.sessions, r.sess.token.String())
+	out := r.sess.close()
+	s.mu.Unlock()
+	logrus.Debugf("OPC UA session %s of %s closed", r.sess.name, r.sess.principalName())
+	return append(out, r.respond(&ua.CloseSessionResponse{})...)
+}
+
+// Detaches the sessions from the closed connection, they may be activated again on another connection until they time out
+func (s *Server) detach(c *conn) {
+	for _, sess := range s.sessions {
+		if sess.conn == c {
+			sess.conn = nil
+			sess.publishQueue = nil
+		}
+	}
+}
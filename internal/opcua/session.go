@@ -0,0 +1,95 @@
+package opcua
+
+import (
+	"sort"
+	"time"
+
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/auth"
+	"github.com/gopcua/opcua/ua"
+)
+
+// The maximum number of publish requests queued by a session, the oldest is answered if another one is received
+const maxPublishRequests = 10
+
+// A session of a client. The fields are guarded by the mutex of the server.
+type session struct {
+	id, token     *ua.NodeID
+	name          string
+	conn          *conn           // the connection of the secure channel, nil while the client is disconnected
+	principal     *auth.Principal // nil until the session is activated
+	timeout       time.Duration
+	lastActivity  time.Time
+	nonce         []byte
+	continuations map[string]*continuation // by continuation point
+	subscriptions map[uint32]*subscription
+	publishQueue  []*request
+}
+
+func newSession(id *ua.NodeID, name string, c *conn, timeout time.Duration) *session {
+	return &session{
+		id:            id,
+		token:         ua.NewByteStringNodeID(0, randomBytes(32)),
+		name:          name,
+		conn:          c,
+		timeout:       timeout,
+		lastActivity:  time.Now(),
+		nonce:         randomBytes(nonceLength),
+		continuations: make(map[string]*continuation),
+		subscriptions: make(map[uint32]*subscription),
+	}
+}
+
+// Returns the name of the user of the session for log messages
+func (sess *session) principalName() string {
+	if sess.principal == nil {
+		return "an unauthenticated client"
+	}
+	return sess.principal.Name
+}
+
+// Deletes the subscriptions and answers the queued publish requests of the closed session
+func (sess *session) close() []response {
+	out := make([]response, 0, len(sess.publishQueue))
+	for _, r := range sess.publishQueue {
+		out = append(out, r.fault(ua.StatusBadSessionClosed)...)
+	}
+	sess.publishQueue = nil
+	sess.subscriptions = make(map[uint32]*subscription)
+	sess.continuations = make(map[string]*continuation)
+	return out
+}
+
+// Returns the subscriptions sorted by ID
+func (sess *session) subscriptionsByID() []*subscription {
+	subs := make([]*subscription, 0, len(sess.subscriptions))
+	for _, sub := range sess.subscriptions {
+		subs = append(subs, sub)
+	}
+	sort.Slice(subs, func(i, j int) bool { return subs[i].id < subs[j].id })
+	return subs
+}
+
+// Removes and returns the oldest queued publish request, or nil if there is none
+func (sess *session) popPublishRequest() *request {
+	if len(sess.publishQueue) == 0 {
+		return nil
+	}
+	r := sess.publishQueue[0]
+	sess.publishQueue = sess.publishQueue[1:]
+	return r
+}
+
+// Answers the queued publish requests whose timeout hint expired
+func (sess *session) expirePublishRequests(now time.Time) []response {
+	var out []response
+	queue := sess.publishQueue[:0]
+	for _, r := range sess.publishQueue {
+		if r.timeoutHint > 0 && now.Sub(r.received) > r.timeoutHint {
+			out = append(out, r.fault(ua.StatusBadTimeout)...)
+			continue
+		}
+		queue = append(queue, r)
+	}
+	sess.publishQueue = queue
+	return out
+}
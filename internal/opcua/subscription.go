@@ -0,0 +1,594 @@
+package opcua
+
+import (
+	"math"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/store"
+	"github.com/gopcua/opcua/ua"
+	"github.com/sirupsen/logrus"
+)
+
+// The limits of subscriptions and monitored items
+const (
+	minPublishingInterval = 100 * time.Millisecond
+	maxPublishingInterval = time.Hour
+	defaultKeepAliveCount = 10
+	maxSubscriptions      = 100   // per session
+	maxMonitoredItems     = 10000 // per subscription
+	maxQueueSize          = 100
+	maxRetransmissions    = 100 // the notification messages kept for republishing per subscription
+)
+
+// A subscription of a session. The monitored items are sampled once per publishing interval.
+type subscription struct {
+	id               uint32
+	interval         time.Duration
+	lifetimeCount    uint32
+	keepAliveCount   uint32
+	maxNotifications uint32 // 0 if unlimited
+	enabled          bool
+	next             time.Time // the start of the next publishing cycle
+	keepAliveCounter uint32    // the publishing cycles since the last message
+	lifetimeCounter  uint32    // the publishing cycles without a publish request of the client
+	sentAny          bool      // whether any message was sent, the first one is sent without waiting for the keep-alive count
+	seq              uint32    // the sequence number of the next notification message
+	items            map[uint32]*monitoredItem
+	retransmission   map[uint32]*ua.NotificationMessage // the notification messages not acknowledged yet by sequence number
+}
+
+// An attribute of a node monitored by a subscription
+type monitoredItem struct {
+	id            uint32
+	clientHandle  uint32
+	node          *ua.NodeID
+	attribute     ua.AttributeID
+	mode          ua.MonitoringMode
+	timestamps    ua.TimestampsToReturn
+	trigger       ua.DataChangeTrigger
+	deadband      float64 // the absolute deadband of numeric values, 0 if none
+	queueSize     int
+	discardOldest bool
+	last          *ua.DataValue // the last sampled value, nil before the first sample
+	queue         []ua.DataValue
+}
+
+// Revises the requested publishing interval and counts
+func (sub *subscription) revise(interval float64, lifetimeCount, keepAliveCount, maxNotifications uint32) {
+	sub.interval = minPublishingInterval
+	if interval*float64(time.Millisecond) > float64(minPublishingInterval) { // false for NaN
+		sub.interval = time.Duration(interval * float64(time.Millisecond))
+	}
+	if sub.interval > maxPublishingInterval {
+		sub.interval = maxPublishingInterval
+	}
+	if keepAliveCount == 0 {
+		keepAliveCount = defaultKeepAliveCount
+	}
+	// keep-alive messages are sent at least once per maximum publishing interval
+	if limit := uint32(maxPublishingInterval / sub.interval); keepAliveCount > limit {
+		keepAliveCount = limit
+	}
+	if lifetimeCount < 3*keepAliveCount {
+		lifetimeCount = 3 * keepAliveCount
+	}
+	sub.lifetimeCount = lifetimeCount
+	sub.keepAliveCount = keepAliveCount
+	sub.maxNotifications = maxNotifications
+}
+
+// Returns the monitored items sorted by ID
+func (sub *subscription) itemsByID() []*monitoredItem {
+	items := make([]*monitoredItem, 0, len(sub.items))
+	for _, item := range sub.items {
+		items = append(items, item)
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].id < items[j].id })
+	return items
+}
+
+// Returns whether a reporting item has queued notifications
+func (sub *subscription) hasNotifications() bool {
+	for _, item := range sub.items {
+		if item.mode == ua.MonitoringModeReporting && len(item.queue) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Samples the monitored items and answers queued publish requests with notifications, a keep-alive message or the
+// expiration of the subscription
+func (s *Server) publishCycle(sess *session, sub *subscription, v *view, now time.Time) []response {
+	for _, item := range sub.itemsByID() {
+		if item.mode == ua.MonitoringModeDisabled {
+			continue
+		}
+		dv := ua.DataValue{Status: ua.StatusBadNodeIDUnknown, ServerTimestamp: now}
+		if n := v.lookup(sess.principal, item.node); n != nil {
+			dv = s.readAttribute(n, item.attribute, sess.principal, now)
+		}
+		item.sample(dv)
+	}
+
+	var out []response
+	sent := false
+	for sub.enabled && sub.hasNotifications() {
+		r := sess.popPublishRequest()
+		if r == nil {
+			break
+		}
+		out = append(out, sub.notify(r, now)...)
+		sent = true
+	}
+	if !sent {
+		sub.keepAliveCounter++
+		if !sub.sentAny || sub.keepAliveCounter >= sub.keepAliveCount {
+			if r := sess.popPublishRequest(); r != nil {
+				out = append(out, sub.message(r, sub.notificationMessage(now, nil), false, false)...)
+				sent = true
+			}
+		}
+	}
+	if sent || len(sess.publishQueue) > 0 {
+		sub.lifetimeCounter = 0
+	}
+	if sent {
+		sub.keepAliveCounter = 0
+		sub.sentAny = true
+		return out
+	}
+
+	sub.lifetimeCounter++
+	if sub.lifetimeCounter >= sub.lifetimeCount {
+		logrus.Infof("OPC UA subscription %d of session %s expired without publish requests", sub.id, sess.name)
+		delete(sess.subscriptions, sub.id)
+	}
+	return out
+}
+
+// Returns the publish response with the queued notifications of the reporting items
+func (sub *subscription) notify(r *request, now time.Time) []response {
+	notifications := make([]*ua.MonitoredItemNotification, 0)
+	for _, item := range sub.itemsByID() {
+		if item.mode != ua.MonitoringModeReporting {
+			continue
+		}
+		for len(item.queue) > 0 && (sub.maxNotifications == 0 || len(notifications) < int(sub.maxNotifications)) {
+			notifications = append(notifications, &ua.MonitoredItemNotification{
+				ClientHandle: item.clientHandle,
+				Value:        filterTimestamps(item.queue[0], item.timestamps),
+			})
+			item.queue = item.queue[1:]
+		}
+	}
+	data := ua.NewExtensionObject(&ua.DataChangeNotification{MonitoredItems: notifications})
+	return sub.message(r, sub.notificationMessage(now, data), sub.hasNotifications(), true)
+}
+
+// Returns a notification message with a data change notification, or a keep-alive message if data is nil
+func (sub *subscription) notificationMessage(now time.Time, data *ua.ExtensionObject) *ua.NotificationMessage {
+	msg := &ua.NotificationMessage{SequenceNumber: sub.seq, PublishTime: now, NotificationData: []*ua.ExtensionObject{}}
+	if data != nil {
+		msg.NotificationData = append(msg.NotificationData, data)
+	}
+	return msg
+}
+
+// Returns the publish response with the notification message. Messages with notifications use up their sequence
+// number and are kept for republishing until they are acknowledged.
+func (sub *subscription) message(r *request, msg *ua.NotificationMessage, more, notification bool) []response {
+	if notification {
+		sub.retransmission[sub.seq] = msg
+		sub.seq++
+		if sub.seq == 0 {
+			sub.seq = 1
+		}
+		if len(sub.retransmission) > maxRetransmissions {
+			delete(sub.retransmission, sub.availableSequenceNumbers()[0])
+		}
+	}
+	return r.respond(&ua.PublishResponse{
+		SubscriptionID:           sub.id,
+		AvailableSequenceNumbers: sub.availableSequenceNumbers(),
+		MoreNotifications:        more,
+		NotificationMessage:      msg,
+		Results:                  r.acks,
+	})
+}
+
+// Returns the sequence numbers of the messages available for republishing, sorted
+func (sub *subscription) availableSequenceNumbers() []uint32 {
+	available := make([]uint32, 0, len(sub.retransmission))
+	for seq := range sub.retransmission {
+		available = append(available, seq)
+	}
+	sort.Slice(available, func(i, j int) bool { return available[i] < available[j] })
+	return available
+}
+
+// Queues the sampled value if it changed according to the filter of the item
+func (item *monitoredItem) sample(dv ua.DataValue) {
+	if item.last != nil && !item.changed(*item.last, dv) {
+		return
+	}
+	item.last = &dv
+	if len(item.queue) >= item.queueSize {
+		if !item.discardOldest {
+			item.queue[len(item.queue)-1] = dv
+			return
+		}
+		item.queue = item.queue[1:]
+	}
+	item.queue = append(item.queue, dv)
+}
+
+func (item *monitoredItem) changed(old, new ua.DataValue) bool {
+	switch {
+	case old.Status != new.Status:
+		return true
+	case item.trigger == ua.DataChangeTriggerStatus:
+		return false
+	case item.trigger == ua.DataChangeTriggerStatusValueTimestamp && !old.SourceTimestamp.Equal(new.SourceTimestamp):
+		return true
+	}
+	if old.Value == nil || new.Value == nil {
+		return old.Value != new.Value
+	}
+	array := old.Value.Has(ua.VariantArrayValues)
+	if old.Value.Type() != new.Value.Type() || array != new.Value.Has(ua.VariantArrayValues) {
+		return true
+	}
+	if item.deadband > 0 && !array && old.Value.Type() != ua.TypeIDBoolean {
+		a, okOld := store.NumericValue(old.Value.Value())
+		b, okNew := store.NumericValue(new.Value.Value())
+		if okOld && okNew {
+			return math.Abs(a-b) > item.deadband
+		}
+	}
+	return !reflect.DeepEqual(old.Value.Value(), new.Value.Value())
+}
+
+// Applies the requested parameters to the item
+func (item *monitoredItem) apply(p *ua.MonitoringParameters) ua.StatusCode {
+	trigger, deadband, status := dataChangeFilter(p.Filter, item.attribute)
+	if status != ua.StatusOK {
+		return status
+	}
+	item.clientHandle = p.ClientHandle
+	item.trigger = trigger
+	item.deadband = deadband
+	item.queueSize = int(p.QueueSize)
+	if item.queueSize < 1 {
+		item.queueSize = 1
+	}
+	if item.queueSize > maxQueueSize {
+		item.queueSize = maxQueueSize
+	}
+	item.discardOldest = p.DiscardOldest
+	if len(item.queue) > item.queueSize {
+		item.queue = item.queue[len(item.queue)-item.queueSize:]
+	}
+	return ua.StatusOK
+}
+
+// Returns the trigger and absolute deadband of the filter of a monitored item
+func dataChangeFilter(filter *ua.ExtensionObject, attribute ua.AttributeID) (ua.DataChangeTrigger, float64, ua.StatusCode) {
+	if filter == nil || filter.TypeID == nil || filter.TypeID.NodeID == nil {
+		return ua.DataChangeTriggerStatusValue, 0, ua.StatusOK
+	}
+	if typeID, ok := standardID(filter.TypeID.NodeID); ok && typeID == 0 {
+		return ua.DataChangeTriggerStatusValue, 0, ua.StatusOK
+	}
+	f, ok := filter.Value.(*ua.DataChangeFilter)
+	if !ok {
+		return 0, 0, ua.StatusBadMonitoredItemFilterUnsupported
+	}
+	if attribute != ua.AttributeIDValue {
+		return 0, 0, ua.StatusBadFilterNotAllowed
+	}
+	switch {
+	case f.Trigger > ua.DataChangeTriggerStatusValueTimestamp:
+		return 0, 0, ua.StatusBadMonitoredItemFilterInvalid
+	case f.DeadbandType == uint32(ua.DeadbandTypeNone):
+		return f.Trigger, 0, ua.StatusOK
+	case f.DeadbandType == uint32(ua.DeadbandTypeAbsolute) && f.DeadbandValue >= 0:
+		return f.Trigger, f.DeadbandValue, ua.StatusOK
+	case f.DeadbandType == uint32(ua.DeadbandTypePercent):
+		// requires the engineering unit range of the metrics, which Sparkplug does not define
+		return 0, 0, ua.StatusBadMonitoredItemFilterUnsupported
+	}
+	return 0, 0, ua.StatusBadDeadbandFilterInvalid
+}
+
+// Handles CreateSubscription
+func (s *Server) createSubscription(r *request) []response {
+	req := r.req.(*ua.CreateSubscriptionRequest)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(r.sess.subscriptions) >= maxSubscriptions {
+		return r.fault(ua.StatusBadTooManySubscriptions)
+	}
+	sub := &subscription{
+		id:             s.newID(),
+		enabled:        req.PublishingEnabled,
+		seq:            1,
+		items:          make(map[uint32]*monitoredItem),
+		retransmission: make(map[uint32]*ua.NotificationMessage),
+	}
+	sub.revise(req.RequestedPublishingInterval, req.RequestedLifetimeCount, req.RequestedMaxKeepAliveCount, req.MaxNotificationsPerPublish)
+	sub.next = time.Now().Add(sub.interval)
+	r.sess.subscriptions[sub.id] = sub
+	logrus.Debugf("OPC UA session %s created subscription %d with publishing interval %s", r.sess.name, sub.id, sub.interval)
+	return r.respond(&ua.CreateSubscriptionResponse{
+		SubscriptionID:            sub.id,
+		RevisedPublishingInterval: float64(sub.interval) / float64(time.Millisecond),
+		RevisedLifetimeCount:      sub.lifetimeCount,
+		RevisedMaxKeepAliveCount:  sub.keepAliveCount,
+	})
+}
+
+// Handles ModifySubscription
+func (s *Server) modifySubscription(r *request) []response {
+	req := r.req.(*ua.ModifySubscriptionRequest)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sub, ok := r.sess.subscriptions[req.SubscriptionID]
+	if !ok {
+		return r.fault(ua.StatusBadSubscriptionIDInvalid)
+	}
+	sub.revise(req.RequestedPublishingInterval, req.RequestedLifetimeCount, req.RequestedMaxKeepAliveCount, req.MaxNotificationsPerPublish)
+	return r.respond(&ua.ModifySubscriptionResponse{
+		RevisedPublishingInterval: float64(sub.interval) / float64(time.Millisecond),
+		RevisedLifetimeCount:      sub.lifetimeCount,
+		RevisedMaxKeepAliveCount:  sub.keepAliveCount,
+	})
+}
+
+// Handles SetPublishingMode
+func (s *Server) setPublishingMode(r *request) []response {
+	req := r.req.(*ua.SetPublishingModeRequest)
+	if len(req.SubscriptionIDs) == 0 {
+		return r.fault(ua.StatusBadNothingToDo)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	results := make([]ua.StatusCode, 0, len(req.SubscriptionIDs))
+	for _, id := range req.SubscriptionIDs {
+		sub, ok := r.sess.subscriptions[id]
+		if !ok {
+			results = append(results, ua.StatusBadSubscriptionIDInvalid)
+			continue
+		}
+		sub.enabled = req.PublishingEnabled
+		results = append(results, ua.StatusOK)
+	}
+	return r.respond(&ua.SetPublishingModeResponse{Results: results})
+}
+
+// Handles DeleteSubscriptions, answering the queued publish requests if no subscription is left
+func (s *Server) deleteSubscriptions(r *request) []response {
+	req := r.req.(*ua.DeleteSubscriptionsRequest)
+	if len(req.SubscriptionIDs) == 0 {
+		return r.fault(ua.StatusBadNothingToDo)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	results := make([]ua.StatusCode, 0, len(req.SubscriptionIDs))
+	for _, id := range req.SubscriptionIDs {
+		if _, ok := r.sess.subscriptions[id]; !ok {
+			results = append(results, ua.StatusBadSubscriptionIDInvalid)
+			continue
+		}
+		delete(r.sess.subscriptions, id)
+		results = append(results, ua.StatusOK)
+	}
+	var out []response
+	if len(r.sess.subscriptions) == 0 {
+		for _, queued := range r.sess.publishQueue {
+			out = append(out, queued.fault(ua.StatusBadNoSubscription)...)
+		}
+		r.sess.publishQueue = nil
+	}
+	return append(out, r.respond(&ua.DeleteSubscriptionsResponse{Results: results})...)
+}
+
+// Handles CreateMonitoredItems
+func (s *Server) createMonitoredItems(r *request) []response {
+	req := r.req.(*ua.CreateMonitoredItemsRequest)
+	switch {
+	case req.TimestampsToReturn > ua.TimestampsToReturnNeither:
+		return r.fault(ua.StatusBadTimestampsToReturnInvalid)
+	case len(req.ItemsToCreate) == 0:
+		return r.fault(ua.StatusBadNothingToDo)
+	}
+
+	// checks that the nodes and attributes exist before the subscriptions are locked
+	v, now := newView(s.sm), time.Now()
+	items := make([]*monitoredItem, 0, len(req.ItemsToCreate))
+	results := make([]*ua.MonitoredItemCreateResult, 0, len(req.ItemsToCreate))
+	for _, c := range req.ItemsToCreate {
+		rv := c.ItemToMonitor
+		item := &monitoredItem{node: rv.NodeID, attribute: rv.AttributeID, mode: c.MonitoringMode, timestamps: req.TimestampsToReturn}
+		status := checkReadValueID(rv)
+		if status == ua.StatusOK {
+			node := v.lookup(r.principal, item.node)
+			switch {
+			case node == nil:
+				status = ua.StatusBadNodeIDUnknown
+			case s.readAttribute(node, item.attribute, r.principal, now).Status == ua.StatusBadAttributeIDInvalid:
+				status = ua.StatusBadAttributeIDInvalid
+			case item.mode > ua.MonitoringModeReporting:
+				status = ua.StatusBadMonitoringModeInvalid
+			default:
+				status = item.apply(c.RequestedParameters)
+			}
+		}
+		items = append(items, item)
+		results = append(results, &ua.MonitoredItemCreateResult{StatusCode: status})
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sub, ok := r.sess.subscriptions[req.SubscriptionID]
+	if !ok {
+		return r.fault(ua.StatusBadSubscriptionIDInvalid)
+	}
+	for i, item := range items {
+		result := results[i]
+		if result.StatusCode != ua.StatusOK {
+			continue
+		}
+		if len(sub.items) >= maxMonitoredItems {
+			result.StatusCode = ua.StatusBadTooManyMonitoredItems
+			continue
+		}
+		item.id = s.newID()
+		sub.items[item.id] = item
+		result.MonitoredItemID = item.id
+		result.RevisedSamplingInterval = float64(sub.interval) / float64(time.Millisecond)
+		result.RevisedQueueSize = uint32(item.queueSize)
+	}
+	return r.respond(&ua.CreateMonitoredItemsResponse{Results: results})
+}
+
+// Handles ModifyMonitoredItems
+func (s *Server) modifyMonitoredItems(r *request) []response {
+	req := r.req.(*ua.ModifyMonitoredItemsRequest)
+	switch {
+	case req.TimestampsToReturn > ua.TimestampsToReturnNeither:
+		return r.fault(ua.StatusBadTimestampsToReturnInvalid)
+	case len(req.ItemsToModify) == 0:
+		return r.fault(ua.StatusBadNothingToDo)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sub, ok := r.sess.subscriptions[req.SubscriptionID]
+	if !ok {
+		return r.fault(ua.StatusBadSubscriptionIDInvalid)
+	}
+	results := make([]*ua.MonitoredItemModifyResult, 0, len(req.ItemsToModify))
+	for _, m := range req.ItemsToModify {
+		item, ok := sub.items[m.MonitoredItemID]
+		status := ua.StatusBadMonitoredItemIDInvalid
+		if ok {
+			status = item.apply(m.RequestedParameters)
+		}
+		result := &ua.MonitoredItemModifyResult{StatusCode: status}
+		if status == ua.StatusOK {
+			item.timestamps = req.TimestampsToReturn
+			result.RevisedSamplingInterval = float64(sub.interval) / float64(time.Millisecond)
+			result.RevisedQueueSize = uint32(item.queueSize)
+		}
+		results = append(results, result)
+	}
+	return r.respond(&ua.ModifyMonitoredItemsResponse{Results: results})
+}
+
+// Handles SetMonitoringMode. Disabled items forget their last value, so they report the current value when enabled again.
+func (s *Server) setMonitoringMode(r *request) []response {
+	req := r.req.(*ua.SetMonitoringModeRequest)
+	switch {
+	case req.MonitoringMode > ua.MonitoringModeReporting:
+		return r.fault(ua.StatusBadMonitoringModeInvalid)
+	case len(req.MonitoredItemIDs) == 0:
+		return r.fault(ua.StatusBadNothingToDo)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sub, ok := r.sess.subscriptions[req.SubscriptionID]
+	if !ok {
+		return r.fault(ua.StatusBadSubscriptionIDInvalid)
+	}
+	results := make([]ua.StatusCode, 0, len(req.MonitoredItemIDs))
+	for _, id := range req.MonitoredItemIDs {
+		item, ok := sub.items[id]
+		if !ok {
+			results = append(results, ua.StatusBadMonitoredItemIDInvalid)
+			continue
+		}
+		item.mode = req.MonitoringMode
+		if item.mode == ua.MonitoringModeDisabled {
+			item.last = nil
+			item.queue = nil
+		}
+		results = append(results, ua.StatusOK)
+	}
+	return r.respond(&ua.SetMonitoringModeResponse{Results: results})
+}
+
+// Handles DeleteMonitoredItems
+func (s *Server) deleteMonitoredItems(r *request) []response {
+	req := r.req.(*ua.DeleteMonitoredItemsRequest)
+	if len(req.MonitoredItemIDs) == 0 {
+		return r.fault(ua.StatusBadNothingToDo)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sub, ok := r.sess.subscriptions[req.SubscriptionID]
+	if !ok {
+		return r.fault(ua.StatusBadSubscriptionIDInvalid)
+	}
+	results := make([]ua.StatusCode, 0, len(req.MonitoredItemIDs))
+	for _, id := range req.MonitoredItemIDs {
+		if _, ok := sub.items[id]; !ok {
+			results = append(results, ua.StatusBadMonitoredItemIDInvalid)
+			continue
+		}
+		delete(sub.items, id)
+		results = append(results, ua.StatusOK)
+	}
+	return r.respond(&ua.DeleteMonitoredItemsResponse{Results: results})
+}
+
+// Handles Publish, acknowledging the given notification messages. The request is queued and answered by the next
+// publishing cycle of a subscription with notifications or a keep-alive message.
+func (s *Server) publish(r *request) []response {
+	req := r.req.(*ua.PublishRequest)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r.acks = make([]ua.StatusCode, 0, len(req.SubscriptionAcknowledgements))
+	for _, a := range req.SubscriptionAcknowledgements {
+		sub, ok := r.sess.subscriptions[a.SubscriptionID]
+		switch {
+		case !ok:
+			r.acks = append(r.acks, ua.StatusBadSubscriptionIDInvalid)
+		case sub.retransmission[a.SequenceNumber] == nil:
+			r.acks = append(r.acks, ua.StatusBadSequenceNumberUnknown)
+		default:
+			delete(sub.retransmission, a.SequenceNumber)
+			r.acks = append(r.acks, ua.StatusOK)
+		}
+	}
+	if len(r.sess.subscriptions) == 0 {
+		return r.fault(ua.StatusBadNoSubscription)
+	}
+	r.sess.publishQueue = append(r.sess.publishQueue, r)
+	if len(r.sess.publishQueue) > maxPublishRequests {
+		return r.sess.popPublishRequest().fault(ua.StatusBadTooManyPublishRequests)
+	}
+	return nil
+}
+
+// Handles Republish, returning a notification message not acknowledged yet
+func (s *Server) republish(r *request) []response {
+	req := r.req.(*ua.RepublishRequest)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sub, ok := r.sess.subscriptions[req.SubscriptionID]
+	if !ok {
+		return r.fault(ua.StatusBadSubscriptionIDInvalid)
+	}
+	msg, ok := sub.retransmission[req.RetransmitSequenceNumber]
+	if !ok {
+		return r.fault(ua.StatusBadMessageNotAvailable)
+	}
+	return r.respond(&ua.RepublishResponse{NotificationMessage: msg})
+}
@@ -0,0 +1,57 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/audit"
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/auth"
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/config"
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/store"
+	"github.com/gin-gonic/gin"
+)
+
+// Reloads the configuration and reports which settings were applied
+type Reloader func() (*config.ReloadReport, error)
+
+// Creates the router of the admin port, which also serves the liveness and readiness probes and the metrics
+func setAdminRouter(sm *store.StoreManager, reload Reloader, cfg Config) *gin.Engine {
+	router := gin.Default()
+	router.Use(instrument())
+	setProbeRoutes(router, sm, cfg)
+	setMetricsRoutes(router, cfg)
+	setAdminRoutes(router.Group("/api/admin"), reload, cfg.Auth, cfg.Audit)
+	router.NoRoute(func(ctx *gin.Context) { ctx.JSON(http.StatusNotFound, gin.H{}) })
+	return router
+}
+
+// Adds the administrative routes to the given route group, requiring the admin role for all groups
+func setAdminRoutes(admin *gin.RouterGroup, reload Reloader, a *auth.Authenticator, auditLog *audit.Log) {
+	admin.Use(authenticate(a), requireRole(auth.Admin))
+	admin.POST("/reload", func(ctx *gin.Context) {
+		report, err := reload()
+		entry := apiEntry(ctx, audit.Reload, err)
+		if report != nil {
+			entry.Settings = report.Applied
+		}
+		auditLog.Record(entry)
+
+		var validationErr *config.ValidationError
+		if errors.As(err, &validationErr) {
+			ctx.JSON(http.StatusUnprocessableEntity, gin.H{
+				"error":    "invalid configuration",
+				"problems": validationErr.Problems,
+			})
+			return
+		}
+		if err != nil {
+			ctx.JSON(http.StatusInternalServerError, gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+		ctx.JSON(http.StatusOK, gin.H{
+			"data": report,
+		})
+	})
+}
@@ -0,0 +1,112 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/alarm"
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/audit"
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/auth"
+	"github.com/gin-gonic/gin"
+)
+
+// The request body of an acknowledgement or shelve of an alarm
+type alarmRequest struct {
+	Comment  string `json:"comment"`
+	Duration string `json:"duration"` // The shelve duration, e.g. "1h"
+}
+
+// Returns the alarms within the scope of the principal, newest first,
+// filtered by the state, priority, rule, groupId and nodeId query parameters
+func indexAlarms(engine *alarm.Engine) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		p := principal(ctx)
+		state, priority, rule := alarm.AlarmState(ctx.Query("state")), ctx.Query("priority"), ctx.Query("rule")
+		groupID, nodeID := ctx.Query("groupId"), ctx.Query("nodeId")
+
+		alarms := make([]alarm.Alarm, 0)
+		for _, a := range engine.Alarms() {
+			if (state != "" && a.State != state) || (priority != "" && a.Priority != priority) || (rule != "" && a.Rule != rule) ||
+				(groupID != "" && a.GroupID != groupID) || (nodeID != "" && a.NodeID != nodeID) ||
+				!p.Allows(auth.Viewer, a.GroupID, a.NodeID) {
+				continue
+			}
+			alarms = append(alarms, a)
+		}
+		ctx.JSON(http.StatusOK, gin.H{
+			"data": alarms,
+		})
+	}
+}
+
+// Returns the alarm of the alarmId parameter, if it is within the scope of the principal
+func showAlarm(engine *alarm.Engine) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		a, ok := engine.Alarm(ctx.Param("alarmId"))
+		if !ok || !principal(ctx).Allows(auth.Viewer, a.GroupID, a.NodeID) {
+			ctx.JSON(http.StatusNotFound, gin.H{"error": alarm.ErrNotFound.Error()})
+			return
+		}
+		ctx.JSON(http.StatusOK, gin.H{
+			"data": a,
+		})
+	}
+}
+
+// Applies an operator action to the alarm of the alarmId parameter, requiring the operator role for its node
+func changeAlarm(engine *alarm.Engine, auditLog *audit.Log, action audit.Action) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		id := ctx.Param("alarmId")
+		a, ok := engine.Alarm(id)
+		if !ok || !principal(ctx).Allows(auth.Viewer, a.GroupID, a.NodeID) {
+			ctx.JSON(http.StatusNotFound, gin.H{"error": alarm.ErrNotFound.Error()})
+			return
+		}
+		if !principal(ctx).Allows(auth.Operator, a.GroupID, a.NodeID) {
+			forbidden(ctx)
+			return
+		}
+
+		var req alarmRequest
+		if ctx.Request.ContentLength != 0 {
+			if err := ctx.ShouldBindJSON(&req); err != nil {
+				ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+		}
+
+		var err error
+		switch action {
+		case audit.AcknowledgeAlarm:
+			a, err = engine.Acknowledge(id, principal(ctx).Name, req.Comment)
+		case audit.ShelveAlarm:
+			var duration time.Duration
+			if duration, err = time.ParseDuration(req.Duration); err != nil {
+				ctx.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("duration: must be a duration like 30m, got %q", req.Duration)})
+				return
+			}
+			a, err = engine.Shelve(id, principal(ctx).Name, req.Comment, duration)
+		case audit.UnshelveAlarm:
+			a, err = engine.Unshelve(id)
+		}
+
+		entry := apiEntry(ctx, action, err)
+		entry.GroupID, entry.NodeID, entry.DeviceID = a.GroupID, a.NodeID, a.DeviceID
+		entry.Details = fmt.Sprintf("alarm %s (%s %s of %s)", id, a.Rule, a.Condition, a.Metric)
+		if req.Comment != "" {
+			entry.Details += ": " + req.Comment
+		}
+		auditLog.Record(entry)
+
+		switch {
+		case errors.Is(err, alarm.ErrNotFound):
+			ctx.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		case err != nil:
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		default:
+			ctx.JSON(http.StatusOK, gin.H{"data": a})
+		}
+	}
+}
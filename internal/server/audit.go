@@ -0,0 +1,109 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/audit"
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/auth"
+	"github.com/gin-gonic/gin"
+)
+
+// The default amount of entries returned by the audit log query
+const defaultAuditLimit = 1000
+
+// Returns an audit entry of an action requested via the API by the principal of the request
+func apiEntry(ctx *gin.Context, action audit.Action, err error) audit.Entry {
+	entry := audit.Entry{
+		Action:    action,
+		Source:    audit.API,
+		Principal: principal(ctx).Name,
+		SourceIP:  ctx.ClientIP(),
+		GroupID:   ctx.Param("groupId"),
+		NodeID:    ctx.Param("nodeId"),
+		Success:   err == nil,
+	}
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	return entry
+}
+
+// Returns the audit log filter given by the query parameters, restricted to the scope of the principal
+func auditFilter(ctx *gin.Context) (audit.Filter, error) {
+	f := audit.Filter{
+		Action:    audit.Action(ctx.Query("action")),
+		Source:    audit.Source(ctx.Query("source")),
+		Principal: ctx.Query("principal"),
+		GroupID:   ctx.Query("groupId"),
+		NodeID:    ctx.Query("nodeId"),
+		Limit:     defaultAuditLimit,
+	}
+	for param, t := range map[string]*time.Time{"since": &f.Since, "until": &f.Until} {
+		if value := ctx.Query(param); value != "" {
+			parsed, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				return f, fmt.Errorf("%s: must be an RFC 3339 timestamp, got %q", param, value)
+			}
+			*t = parsed
+		}
+	}
+	if value := ctx.Query("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 1 {
+			return f, fmt.Errorf("limit: must be a positive number, got %q", value)
+		}
+		f.Limit = limit
+	}
+
+	// entries of actions without edge node (e.g. reloads) are only visible to principals without scope
+	p := principal(ctx)
+	if !p.Allows(auth.Operator, "", "") {
+		f.Allow = func(e audit.Entry) bool {
+			return e.GroupID != "" && p.Allows(auth.Operator, e.GroupID, e.NodeID)
+		}
+	}
+	return f, nil
+}
+
+// Returns the matching entries of the audit log, oldest first
+func indexAudit(auditLog *audit.Log) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		f, err := auditFilter(ctx)
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		entries, err := auditLog.Query(f)
+		if err != nil {
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		ctx.JSON(http.StatusOK, gin.H{
+			"data": entries,
+		})
+	}
+}
+
+// Streams all matching entries of the audit log as JSON lines, oldest first
+func exportAudit(auditLog *audit.Log) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		f, err := auditFilter(ctx)
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		// the export contains all matching entries
+		f.Limit = 0
+
+		ctx.Header("Content-Type", "application/x-ndjson")
+		ctx.Header("Content-Disposition", `attachment; filename="audit.jsonl"`)
+		ctx.Status(http.StatusOK)
+		if err := auditLog.Export(ctx.Writer, f); err != nil {
+			// the status is already sent, so the client only sees a truncated export
+			ctx.Error(err)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package server
+
+import (
+	"net/http"
+
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/auth"
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/store"
+	"github.com/gin-gonic/gin"
+)
+
+// The context key of the authenticated principal
+const principalKey = "principal"
+
+// Authenticates every request, or grants unrestricted access if no authenticator is given
+func authenticate(a *auth.Authenticator) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		if a == nil {
+			ctx.Set(principalKey, auth.Unrestricted)
+			return
+		}
+		p, err := a.Authenticate(ctx.Request)
+		if err != nil {
+			if a.Basic() {
+				ctx.Header("WWW-Authenticate", `Basic realm="sparkplug-primary"`)
+			} else {
+				ctx.Header("WWW-Authenticate", "Bearer")
+			}
+			ctx.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+			return
+		}
+		ctx.Set(principalKey, p)
+	}
+}
+
+// Returns the principal set by the authenticate middleware
+func principal(ctx *gin.Context) *auth.Principal {
+	return ctx.MustGet(principalKey).(*auth.Principal)
+}
+
+// Allows only principals having the given role for all groups
+func requireRole(role auth.Role) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		if !principal(ctx).Allows(role, "", "") {
+			forbidden(ctx)
+		}
+	}
+}
+
+// Allows only principals having the given role for at least one group or node.
+// The handler is responsible for restricting the response to the scope of the principal.
+func requireAnyRole(role auth.Role) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		if !principal(ctx).AllowsAny(role) {
+			forbidden(ctx)
+		}
+	}
+}
+
+// Allows only principals having the given role for the node of the groupId and nodeId parameters
+func requireNodeRole(role auth.Role) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		if !principal(ctx).Allows(role, ctx.Param("groupId"), ctx.Param("nodeId")) {
+			forbidden(ctx)
+		}
+	}
+}
+
+func forbidden(ctx *gin.Context) {
+	ctx.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "forbidden"})
+}
+
+// Returns the groups restricted to the nodes the principal may view, omitting empty groups
+func visibleGroups(p *auth.Principal, groups []store.FetchedGroup) []store.FetchedGroup {
+	if p.Allows(auth.Viewer, "", "") {
+		return groups
+	}
+	result := make([]store.FetchedGroup, 0)
+	for _, group := range groups {
+		if p.Allows(auth.Viewer, group.ID, "") {
+			result = append(result, group)
+			continue
+		}
+		nodes := make([]store.FetchedNode, 0)
+		for _, node := range group.Nodes {
+			if p.Allows(auth.Viewer, group.ID, node.ID) {
+				nodes = append(nodes, node)
+			}
+		}
+		if len(nodes) > 0 {
+			group.Nodes = nodes
+			result = append(result, group)
+		}
+	}
+	return result
+}
+
+// Returns the information on the authenticated principal
+func showPrincipal(ctx *gin.Context) {
+	p := principal(ctx)
+	ctx.JSON(http.StatusOK, gin.H{
+		"data": gin.H{
+			"name":   p.Name,
+			"method": p.Method,
+			"roles":  p.Roles(),
+		},
+	})
+}
@@ -0,0 +1,125 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/auth"
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/cluster"
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/store"
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+var peerClient = &http.Client{Timeout: 5 * time.Second}
+
+func indexClusterMembers(cl *cluster.Cluster) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		ctx.JSON(http.StatusOK, gin.H{
+			"data": gin.H{
+				"id":      cl.ID(),
+				"members": cl.Members(),
+			},
+		})
+	}
+}
+
+// Redirects to the instance owning the requested node if it is owned by another cluster member
+func redirectToOwner(cl *cluster.Cluster) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		owner := cl.Owner(ctx.Param("groupId"), ctx.Param("nodeId"))
+		if owner.ID == cl.ID() {
+			ctx.Next()
+			return
+		}
+		if owner.APIURL == "" {
+			ctx.AbortWithStatusJSON(http.StatusMisdirectedRequest, gin.H{
+				"error": fmt.Sprintf("node is owned by instance %s without API URL", owner.ID),
+			})
+			return
+		}
+		ctx.Redirect(http.StatusTemporaryRedirect, owner.APIURL+ctx.Request.URL.RequestURI())
+		ctx.Abort()
+	}
+}
+
+// Fetches the groups of all other cluster members and merges them with the given local groups.
+// The credentials of the given request are passed on to the other members.
+func mergeClusterGroups(cl *cluster.Cluster, groups []store.FetchedGroup, r *http.Request) []store.FetchedGroup {
+	merged := make(map[string]*store.FetchedGroup)
+	add := func(group store.FetchedGroup) {
+		existing, ok := merged[group.ID]
+		if !ok {
+			merged[group.ID] = &group
+			return
+		}
+		existing.Nodes = append(existing.Nodes, group.Nodes...)
+		if group.LastMessageAt.After(existing.LastMessageAt) {
+			existing.LastMessageAt = group.LastMessageAt
+		}
+	}
+
+	for _, group := range groups {
+		add(group)
+	}
+	for _, member := range cl.Members() {
+		if member.ID == cl.ID() {
+			continue
+		}
+		memberGroups, err := fetchMemberGroups(member, r)
+		if err != nil {
+			logrus.Warnf("Failed to fetch groups of cluster member %s: %v", member.ID, err)
+			continue
+		}
+		for _, group := range memberGroups {
+			add(group)
+		}
+	}
+
+	result := make([]store.FetchedGroup, 0, len(merged))
+	for _, group := range merged {
+		sort.Slice(group.Nodes, func(i, j int) bool {
+			return group.Nodes[i].ID < group.Nodes[j].ID
+		})
+		result = append(result, *group)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].ID < result[j].ID
+	})
+	return result
+}
+
+// Fetches the local groups of a cluster member with the credentials of the given request
+func fetchMemberGroups(member cluster.Member, r *http.Request) ([]store.FetchedGroup, error) {
+	if member.APIURL == "" {
+		return nil, fmt.Errorf("member has no API URL")
+	}
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, member.APIURL+"/api/groups", nil)
+	if err != nil {
+		return nil, err
+	}
+	for _, header := range []string{"Authorization", auth.APIKeyHeader} {
+		if value := r.Header.Get(header); value != "" {
+			req.Header.Set(header, value)
+		}
+	}
+	res, err := peerClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", res.Status)
+	}
+
+	var body struct {
+		Data []store.FetchedGroup `json:"data"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+		return nil, err
+	}
+	return body.Data, nil
+}
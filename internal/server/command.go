@@ -0,0 +1,127 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/audit"
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/sparkplug"
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/store"
+	"github.com/DATATRONiQ/go-sparkplug-primary/third_party/sparkplugb"
+	"github.com/gin-gonic/gin"
+)
+
+// Publishes commands to edge nodes and devices
+type Commander interface {
+	SendCommand(groupID, nodeID, deviceID string, metrics []sparkplug.CommandMetric) error
+	RequestRebirth(groupID, nodeID string) error
+}
+
+// A metric to write with a command
+type commandMetric struct {
+	Name     string `json:"name"`
+	DataType string `json:"dataType"` // The sparkplug data type, taken from the birth certificate if empty
+	Value    any    `json:"value"`
+}
+
+// The request body of a command
+type commandRequest struct {
+	Metrics []commandMetric `json:"metrics"`
+}
+
+// Returns the metrics to publish with their data types, and the metrics to record in the audit log with the last known values
+func commandMetrics(sm *store.StoreManager, groupID, nodeID, deviceID string, requested []commandMetric) ([]sparkplug.CommandMetric, []audit.Metric, error) {
+	if len(requested) == 0 {
+		return nil, nil, errors.New("at least one metric is required")
+	}
+
+	known := make(map[string]store.FetchedMetric)
+	knownMetrics, _ := sm.FetchMetrics(groupID, nodeID, deviceID)
+	for _, metric := range knownMetrics {
+		known[metric.Name] = metric
+	}
+
+	metrics := make([]sparkplug.CommandMetric, 0, len(requested))
+	auditMetrics := make([]audit.Metric, 0, len(requested))
+	for _, m := range requested {
+		if m.Name == "" {
+			return nil, nil, errors.New("metric name is required")
+		}
+		dataTypeName := m.DataType
+		if dataTypeName == "" {
+			dataTypeName = known[m.Name].DataType
+		}
+		dataType, ok := sparkplugb.DataType_value[dataTypeName]
+		if !ok {
+			return nil, nil, fmt.Errorf("metric %s: unknown data type %q, give the dataType of metrics not in the birth certificate", m.Name, dataTypeName)
+		}
+		metrics = append(metrics, sparkplug.CommandMetric{
+			Name:     m.Name,
+			DataType: sparkplugb.DataType(dataType),
+			Value:    m.Value,
+		})
+		auditMetrics = append(auditMetrics, audit.Metric{
+			Name:     m.Name,
+			DataType: dataTypeName,
+			OldValue: known[m.Name].Value,
+			NewValue: m.Value,
+		})
+	}
+	return metrics, auditMetrics, nil
+}
+
+// Writes metrics of the node or device given by the route parameters by publishing an NCMD or DCMD
+func sendCommand(sm *store.StoreManager, commander Commander, auditLog *audit.Log) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		groupID, nodeID, deviceID := ctx.Param("groupId"), ctx.Param("nodeId"), ctx.Param("deviceId")
+
+		var req commandRequest
+		dec := json.NewDecoder(ctx.Request.Body)
+		// keeps the numbers exact, so 64 bit integers are not rounded to float64
+		dec.UseNumber()
+		if err := dec.Decode(&req); err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		metrics, auditMetrics, err := commandMetrics(sm, groupID, nodeID, deviceID, req.Metrics)
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		err = commander.SendCommand(groupID, nodeID, deviceID, metrics)
+		entry := apiEntry(ctx, audit.Command, err)
+		entry.DeviceID = deviceID
+		entry.Metrics = auditMetrics
+		auditLog.Record(entry)
+		commandResponse(ctx, err)
+	}
+}
+
+// Requests the node given by the route parameters to republish its birth certificates
+func requestRebirth(sm *store.StoreManager, commander Commander, auditLog *audit.Log) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		err := commander.RequestRebirth(ctx.Param("groupId"), ctx.Param("nodeId"))
+		auditLog.Record(apiEntry(ctx, audit.Rebirth, err))
+		if err == nil {
+			sm.RecordRebirthRequest(ctx.Param("groupId"), ctx.Param("nodeId"), "requested via API by "+principal(ctx).Name)
+		}
+		commandResponse(ctx, err)
+	}
+}
+
+// Responds to a published command, or with the error publishing it
+func commandResponse(ctx *gin.Context, err error) {
+	switch {
+	case err == nil:
+		ctx.JSON(http.StatusAccepted, gin.H{})
+	case errors.Is(err, sparkplug.ErrInvalidCommand):
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, sparkplug.ErrStandby):
+		ctx.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+	default:
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
@@ -0,0 +1,97 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/store"
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/util"
+	"github.com/gin-gonic/gin"
+)
+
+// The default window of the availability, ending now
+const defaultAvailabilityWindow = 24 * time.Hour
+
+// Returns the time of the given RFC 3339 query parameter, or the default if it is not given
+func timeQuery(ctx *gin.Context, param string, def time.Time) (time.Time, error) {
+	value := ctx.Query(param)
+	if value == "" {
+		return def, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return t, fmt.Errorf("%s: must be an RFC 3339 timestamp, got %q", param, value)
+	}
+	return t, nil
+}
+
+// Returns the lifecycle events of the node or device given by the route parameters, oldest first,
+// filtered by the type, since and until query parameters and limited to the last limit events
+func indexEvents(ctx *gin.Context) {
+	since, err := timeQuery(ctx, "since", time.Time{})
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	until, err := timeQuery(ctx, "until", time.Time{})
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	limit := 0
+	if value := ctx.Query("limit"); value != "" {
+		if limit, err = strconv.Atoi(value); err != nil || limit < 1 {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("limit: must be a positive number, got %q", value)})
+			return
+		}
+	}
+	var types []store.EventType
+	if eventType := ctx.Query("type"); eventType != "" {
+		types = append(types, store.EventType(eventType))
+	}
+
+	events := filterEvents(store.FetchEvents(ctx.Param("groupId"), ctx.Param("nodeId"), ctx.Param("deviceId")), types, since, until, limit)
+	ctx.JSON(http.StatusOK, gin.H{
+		"data": events,
+	})
+}
+
+// Returns the events of the given types, all if none are given, between since and until if not zero,
+// limited to the last limit events if positive
+func filterEvents(all []store.Event, types []store.EventType, since, until time.Time, limit int) []store.Event {
+	events := make([]store.Event, 0)
+	for _, e := range all {
+		if (len(types) > 0 && !util.Contains(types, e.Type)) || (!since.IsZero() && e.Time.Before(since)) || (!until.IsZero() && e.Time.After(until)) {
+			continue
+		}
+		events = append(events, e)
+	}
+	if limit > 0 && len(events) > limit {
+		events = events[len(events)-limit:]
+	}
+	return events
+}
+
+// Returns the availability of the node or device given by the route parameters within the window
+// of the from and to query parameters, by default the last 24 hours
+func showAvailability(ctx *gin.Context) {
+	to, err := timeQuery(ctx, "to", time.Now())
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	from, err := timeQuery(ctx, "from", to.Add(-defaultAvailabilityWindow))
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !to.After(from) {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "from: must be before to"})
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{
+		"data": store.ComputeAvailability(ctx.Param("groupId"), ctx.Param("nodeId"), ctx.Param("deviceId"), from, to),
+	})
+}
@@ -0,0 +1,1173 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/audit"
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/auth"
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/metrics"
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/store"
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/util"
+	"github.com/graph-gophers/graphql-go"
+	gqllog "github.com/graph-gophers/graphql-go/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	graphqlSubscriptionBuffer = 1024 // the amount of events buffered per subscription, further events are dropped while it is full
+	graphqlMaxDepth           = 25   // the maximum nesting of fields in an operation
+)
+
+var graphqlDropped = promauto.NewCounterVec(prometheus.CounterOpts{Name: "sparkplug_primary_graphql_events_dropped_total", Help: "Events dropped because a GraphQL subscription did not keep up, by subscription field"}, []string{"field"})
+
+// The context key of the caller of a GraphQL operation
+type graphqlCallerKey struct{}
+
+// The authenticated client of a GraphQL operation
+type graphqlCaller struct {
+	principal *auth.Principal
+	sourceIP  string
+}
+
+func callerOf(ctx context.Context) graphqlCaller {
+	return ctx.Value(graphqlCallerKey{}).(graphqlCaller)
+}
+
+// Fans out the metric updates and lifecycle events of the store to the GraphQL subscriptions
+type graphqlHub struct {
+	mu            sync.RWMutex
+	subscriptions map[*graphqlSubscription]struct{}
+}
+
+type graphqlSubscription struct {
+	field  string
+	accept func(event any) bool
+	events chan any
+}
+
+func newGraphQLHub() *graphqlHub {
+	h := &graphqlHub{subscriptions: make(map[*graphqlSubscription]struct{})}
+	metrics.NewGaugeFunc("sparkplug_primary_graphql_subscriptions", "Active GraphQL subscriptions", nil, func(emit func(v float64, labelValues ...string)) {
+		h.mu.RLock()
+		defer h.mu.RUnlock()
+		emit(float64(len(h.subscriptions)))
+	})
+	store.AddUpdateHandler(func(u store.MetricUpdate) { h.publish(u) })
+	store.AddEventHandler(func(e store.Event) { h.publish(e) })
+	return h
+}
+
+// Passes the event to the accepting subscriptions without blocking the store
+func (h *graphqlHub) publish(event any) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for sub := range h.subscriptions {
+		if !sub.accept(event) {
+			continue
+		}
+		select {
+		case sub.events <- event:
+		default:
+			graphqlDropped.WithLabelValues(sub.field).Inc()
+		}
+	}
+}
+
+// Returns the accepted events until the context is done
+func (h *graphqlHub) subscribe(ctx context.Context, field string, accept func(event any) bool) <-chan any {
+	sub := &graphqlSubscription{field: field, accept: accept, events: make(chan any, graphqlSubscriptionBuffer)}
+	h.mu.Lock()
+	h.subscriptions[sub] = struct{}{}
+	h.mu.Unlock()
+	go func() {
+		<-ctx.Done()
+		h.mu.Lock()
+		delete(h.subscriptions, sub)
+		h.mu.Unlock()
+		close(sub.events)
+	}()
+	return sub.events
+}
+
+// Passes the events of a subscription of the hub to the executor as resolvers until the context is done
+func resolveEvents[E any, R any](ctx context.Context, events <-chan any, resolve func(E) R) <-chan R {
+	resolvers := make(chan R)
+	go func() {
+		defer close(resolvers)
+		for event := range events {
+			select {
+			case resolvers <- resolve(event.(E)):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return resolvers
+}
+
+// The schema of the GraphQL API
+const graphqlSchema = `
+schema {
+	query: Query
+	mutation: Mutation
+	subscription: Subscription
+}
+
+"An RFC 3339 timestamp"
+scalar DateTime @specifiedBy(url: "https://scalars.graphql.org/andimarek/date-time")
+
+"Any JSON value"
+scalar JSON
+
+"The quality of a metric value, from the Sparkplug Quality property"
+enum Quality {
+	GOOD
+	BAD
+	STALE
+	"Any other quality code"
+	UNCERTAIN
+}
+
+"The kind of a lifecycle event"
+enum EventType {
+	"The entity came online for the first time or rebirthed while online"
+	BIRTH
+	"The entity came online again after it was offline"
+	RECONNECT
+	"The entity went offline, the cause tells why"
+	DEATH
+	"A rebirth of the node was requested"
+	REBIRTH_REQUEST
+	"The entity has not sent messages for its inactivity timeout and is stale"
+	TIMEOUT
+	"The stale entity sent a message again"
+	RECOVERED
+}
+
+"The Sparkplug message type"
+enum MessageType {
+	NBIRTH
+	NDEATH
+	NDATA
+	NCMD
+	DBIRTH
+	DDEATH
+	DDATA
+	DCMD
+}
+
+"A property of a metric"
+type Property {
+	key: String!
+	value: JSON
+}
+
+"The current value of a metric of a node or device"
+type Metric {
+	name: String!
+	"<group>/<node>[/<device>]/<metric>"
+	path: String!
+	groupId: String!
+	nodeId: String!
+	"Null for metrics of the node"
+	deviceId: String
+	"The alias as a decimal string, as it may exceed the range of Int"
+	alias: String
+	"The Sparkplug data type"
+	dataType: String!
+	value: JSON
+	isNull: Boolean!
+	"The timestamp of the value sent by the edge node, the receive time if it sent none"
+	timestamp: DateTime
+	"Whether the node or device is offline or stale"
+	stale: Boolean!
+	quality: Quality!
+	"The engineering units of the birth certificate"
+	units: String
+	"The properties of the birth certificate, updated by data messages, sorted by key"
+	properties("Returns only the properties with the given keys" keys: [String!]): [Property!]!
+	"The last values of the metric, oldest first"
+	history(since: DateTime, until: DateTime, "Returns only the last values" limit: Int): [MetricUpdate!]!
+}
+
+"A lifecycle event of a node or device"
+type Event {
+	time: DateTime!
+	type: EventType!
+	groupId: String!
+	nodeId: String!
+	"Null for events of the node"
+	deviceId: String
+	cause: String!
+	"Whether the entity is online after the event"
+	online: Boolean!
+	"Whether the online entity is silent beyond its inactivity timeout after the event"
+	stale: Boolean!
+}
+
+"The time a node or device spent in each state within a window"
+type Availability {
+	from: DateTime!
+	to: DateTime!
+	onlineSeconds: Float!
+	"Online, but silent beyond the inactivity timeout"
+	staleSeconds: Float!
+	offlineSeconds: Float!
+	"Before the first known event, e.g. before the first birth"
+	unknownSeconds: Float!
+	"The online and not stale percentage of the known time, null if nothing is known"
+	availability: Float
+}
+
+"A device of an edge node"
+type Device {
+	id: String!
+	groupId: String!
+	nodeId: String!
+	online: Boolean!
+	"Whether the online device has not sent messages for its inactivity timeout"
+	stale: Boolean!
+	lastMessageAt: DateTime
+	metrics(
+		"Returns only the metrics with the given names"
+		names: [String!]
+		"Returns only the metrics whose name matches the glob pattern, * matches any characters including /"
+		pattern: String
+		"Returns only the stale or only the fresh metrics"
+		stale: Boolean
+	): [Metric!]!
+	metric(name: String!): Metric
+	"The lifecycle events, oldest first"
+	events("Returns only events of the given types" types: [EventType!], since: DateTime, until: DateTime, "Returns only the last events" limit: Int): [Event!]!
+	availability(
+		"The start of the window, by default 24 hours before its end"
+		from: DateTime
+		"The end of the window, by default now"
+		to: DateTime
+	): Availability!
+}
+
+"An edge node"
+type Node {
+	id: String!
+	groupId: String!
+	online: Boolean!
+	"Whether the online node has not sent messages for its inactivity timeout"
+	stale: Boolean!
+	lastMessageAt: DateTime
+	devices(
+		"Returns only the devices with the given IDs"
+		ids: [String!]
+		"Returns only the online or only the offline entities"
+		online: Boolean
+	): [Device!]!
+	device(id: String!): Device
+	metrics(
+		"Returns only the metrics with the given names"
+		names: [String!]
+		"Returns only the metrics whose name matches the glob pattern, * matches any characters including /"
+		pattern: String
+		"Returns only the stale or only the fresh metrics"
+		stale: Boolean
+	): [Metric!]!
+	metric(name: String!): Metric
+	"The lifecycle events of the node, oldest first"
+	events("Returns only events of the given types" types: [EventType!], since: DateTime, until: DateTime, "Returns only the last events" limit: Int): [Event!]!
+	availability(
+		"The start of the window, by default 24 hours before its end"
+		from: DateTime
+		"The end of the window, by default now"
+		to: DateTime
+	): Availability!
+}
+
+"A Sparkplug group"
+type Group {
+	id: String!
+	lastMessageAt: DateTime
+	nodes(
+		"Returns only the nodes with the given IDs"
+		ids: [String!]
+		"Returns only the online or only the offline entities"
+		online: Boolean
+	): [Node!]!
+	node(id: String!): Node
+}
+
+"A received Sparkplug message"
+type Message {
+	groupId: String!
+	nodeId: String!
+	"Null for messages of the node"
+	deviceId: String
+	type: MessageType!
+	"The amount of metrics in the message"
+	metricAmount: Int!
+	receivedAt: DateTime!
+}
+
+"A metric value applied to the store by a birth or data message"
+type MetricUpdate {
+	groupId: String!
+	nodeId: String!
+	"Null for metrics of the node"
+	deviceId: String
+	name: String!
+	"<group>/<node>[/<device>]/<metric>"
+	path: String!
+	dataType: String!
+	value: JSON
+	isNull: Boolean!
+	"The timestamp of the value sent by the edge node, the receive time if it sent none"
+	timestamp: DateTime
+	units: String
+	quality: Quality!
+	"Whether the value is of a birth certificate"
+	birth: Boolean!
+	receivedAt: DateTime!
+}
+
+type Query {
+	"The groups with the nodes the caller may view"
+	groups("Returns only the groups with the given IDs" ids: [String!]): [Group!]!
+	"The group with the nodes the caller may view"
+	group(id: String!): Group
+	node(groupId: String!, nodeId: String!): Node
+	device(groupId: String!, nodeId: String!, deviceId: String!): Device
+	"The metrics of all nodes and devices the caller may view whose path matches a pattern"
+	metrics(
+		"Glob patterns of the paths <group>/<node>[/<device>]/<metric>, * matches any characters including /"
+		include: [String!]!
+		"Glob patterns of paths to leave out"
+		exclude: [String!]
+	): [Metric!]!
+	"The last values of a metric, oldest first, at most store.valueHistorySize of them"
+	metricHistory(
+		groupId: String!
+		nodeId: String!
+		"Null for metrics of the node"
+		deviceId: String
+		name: String!
+		since: DateTime
+		until: DateTime
+		"Returns only the last values"
+		limit: Int
+	): [MetricUpdate!]!
+	"The last received messages of the nodes the caller may view, oldest first"
+	messages(
+		groupId: String
+		nodeId: String
+		"Returns only messages of the given types"
+		types: [MessageType!]
+		"Returns only the last messages"
+		limit: Int
+	): [Message!]!
+}
+
+"A metric to write"
+input CommandMetric {
+	name: String!
+	"The Sparkplug data type, taken from the birth certificate if not given"
+	dataType: String
+	value: JSON
+}
+
+type Mutation {
+	"Writes metrics of a node or device by publishing an NCMD or DCMD, requires the operator role for the node"
+	sendCommand(groupId: String!, nodeId: String!, deviceId: String, metrics: [CommandMetric!]!): Boolean!
+	"Requests a node to republish its birth certificates, requires the operator role for the node"
+	requestRebirth(groupId: String!, nodeId: String!): Boolean!
+}
+
+type Subscription {
+	"The metric values applied to the store for the nodes the caller may view"
+	metricUpdates(
+		groupId: String
+		nodeId: String
+		"Use the empty string for the node itself"
+		deviceId: String
+		"Glob patterns of the paths, all paths if not given"
+		include: [String!]
+		"Glob patterns of paths to leave out"
+		exclude: [String!]
+	): MetricUpdate!
+	"The lifecycle events of the nodes and devices the caller may view"
+	events(
+		groupId: String
+		nodeId: String
+		"Use the empty string for the node itself"
+		deviceId: String
+		"Returns only events of the given types"
+		types: [EventType!]
+	): Event!
+}
+`
+
+// The DateTime scalar, an RFC 3339 timestamp
+type dateTime struct {
+	time.Time
+}
+
+func (dateTime) ImplementsGraphQLType(name string) bool {
+	return name == "DateTime"
+}
+
+func (t *dateTime) UnmarshalGraphQL(input any) error {
+	s, ok := input.(string)
+	if !ok {
+		return errors.New("DateTime must be an RFC 3339 timestamp string")
+	}
+	parsed, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return fmt.Errorf("DateTime must be an RFC 3339 timestamp, got %q", s)
+	}
+	t.Time = parsed
+	return nil
+}
+
+func (t dateTime) MarshalJSON() ([]byte, error) {
+	return json.Marshal(t.Format(time.RFC3339Nano))
+}
+
+// Returns the timestamp, nil if it is zero
+func optionalTime(t time.Time) *dateTime {
+	if t.IsZero() {
+		return nil
+	}
+	return &dateTime{t}
+}
+
+// The JSON scalar, any JSON value
+type jsonValue struct {
+	value any
+}
+
+func (jsonValue) ImplementsGraphQLType(name string) bool {
+	return name == "JSON"
+}
+
+// Keeps the input as decoded by encoding/json, with numbers as json.Number so 64 bit integers stay exact
+func (v *jsonValue) UnmarshalGraphQL(input any) error {
+	v.value = parseJSONInput(input)
+	return nil
+}
+
+// Replaces floats which JSON cannot represent by null
+func (v jsonValue) MarshalJSON() ([]byte, error) {
+	switch f := v.value.(type) {
+	case float64:
+		if math.IsNaN(f) || math.IsInf(f, 0) {
+			return []byte("null"), nil
+		}
+	case float32:
+		if math.IsNaN(float64(f)) || math.IsInf(float64(f), 0) {
+			return []byte("null"), nil
+		}
+	}
+	return json.Marshal(v.value)
+}
+
+func parseJSONInput(input any) any {
+	switch v := input.(type) {
+	case int32:
+		return json.Number(strconv.FormatInt(int64(v), 10))
+	case int:
+		return json.Number(strconv.Itoa(v))
+	case float64:
+		return json.Number(strconv.FormatFloat(v, 'g', -1, 64))
+	case []any:
+		out := make([]any, len(v))
+		for i, item := range v {
+			out[i] = parseJSONInput(item)
+		}
+		return out
+	case map[string]any:
+		out := make(map[string]any, len(v))
+		for key, item := range v {
+			out[key] = parseJSONInput(item)
+		}
+		return out
+	}
+	return input
+}
+
+// Returns the value, nil if it is nil
+func optionalJSON(value any) *jsonValue {
+	if value == nil {
+		return nil
+	}
+	return &jsonValue{value}
+}
+
+// Returns the string, nil if it is empty
+func optionalString(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
+}
+
+// Returns the name of the enum value of a store constant, e.g. REBIRTH_REQUEST for rebirth_request
+func enumName[T ~string](value T) string {
+	return strings.ToUpper(string(value))
+}
+
+// Returns the compiled glob patterns of a list argument
+func globsArg(name string, patterns *[]string) ([]*regexp.Regexp, error) {
+	if patterns == nil {
+		return nil, nil
+	}
+	var globs []*regexp.Regexp
+	for _, pattern := range *patterns {
+		glob, err := util.Glob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+		globs = append(globs, glob)
+	}
+	return globs, nil
+}
+
+func matchesAny(globs []*regexp.Regexp, s string) bool {
+	for _, glob := range globs {
+		if glob.MatchString(s) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns whether the ID matches the list argument, which matches all IDs if it is not given
+func idArg(ids *[]string, id string) bool {
+	return ids == nil || util.Contains(*ids, id)
+}
+
+// Returns whether the optional boolean argument is not given or equals the value
+func boolArg(b *bool, value bool) bool {
+	return b == nil || *b == value
+}
+
+// Returns whether the optional string argument is not given or equals the value
+func stringArg(s *string, value string) bool {
+	return s == nil || *s == value
+}
+
+// Returns the time argument, or the default if it is not given
+func timeArg(t *dateTime, def time.Time) time.Time {
+	if t == nil {
+		return def
+	}
+	return t.Time
+}
+
+// Returns the limit argument, 0 if it is not given
+func limitArg(limit *int32) (int, error) {
+	if limit == nil {
+		return 0, nil
+	}
+	if *limit < 1 {
+		return 0, errors.New("limit: must be a positive number")
+	}
+	return int(*limit), nil
+}
+
+// Builds the GraphQL schema over the store
+func newGraphQLSchema(sm *store.StoreManager, commander Commander, auditLog *audit.Log, hub *graphqlHub) (*graphql.Schema, error) {
+	return graphql.ParseSchema(graphqlSchema, &graphqlResolver{sm: sm, commander: commander, auditLog: auditLog, hub: hub},
+		graphql.UseStringDescriptions(),
+		graphql.MaxDepth(graphqlMaxDepth),
+		// panics are answered with an error, e.g. for integer literals beyond the range of Int in JSON values
+		graphql.Logger(gqllog.LoggerFunc(func(ctx context.Context, value any) {
+			logrus.Warnf("GraphQL operation of %s failed: %v", callerOf(ctx).sourceIP, value)
+		})),
+		// the responses of subscriptions wait this long for the connection, so slow clients drop events in the hub
+		graphql.SubscribeResolverTimeout(graphqlWriteTimeout),
+	)
+}
+
+// Resolves the fields of Query, Mutation and Subscription
+type graphqlResolver struct {
+	sm        *store.StoreManager
+	commander Commander
+	auditLog  *audit.Log
+	hub       *graphqlHub
+}
+
+func (r *graphqlResolver) Groups(ctx context.Context, args struct{ IDs *[]string }) []*groupResolver {
+	groups := make([]*groupResolver, 0)
+	for _, g := range visibleGroups(callerOf(ctx).principal, *r.sm.Fetch()) {
+		if idArg(args.IDs, g.ID) {
+			groups = append(groups, &groupResolver{g})
+		}
+	}
+	return groups
+}
+
+func (r *graphqlResolver) Group(ctx context.Context, args struct{ ID string }) *groupResolver {
+	for _, g := range visibleGroups(callerOf(ctx).principal, *r.sm.Fetch()) {
+		if g.ID == args.ID {
+			return &groupResolver{g}
+		}
+	}
+	return nil
+}
+
+type nodeArgs struct {
+	GroupID string
+	NodeID  string
+}
+
+// Returns the node if the caller may view it, nil if it does not exist
+func (r *graphqlResolver) Node(ctx context.Context, args nodeArgs) (*nodeResolver, error) {
+	if !callerOf(ctx).principal.Allows(auth.Viewer, args.GroupID, args.NodeID) {
+		return nil, errors.New("forbidden")
+	}
+	node, ok := r.sm.FetchNode(args.GroupID, args.NodeID)
+	if !ok {
+		return nil, nil
+	}
+	return &nodeResolver{*node}, nil
+}
+
+func (r *graphqlResolver) Device(ctx context.Context, args struct {
+	GroupID  string
+	NodeID   string
+	DeviceID string
+}) (*deviceResolver, error) {
+	node, err := r.Node(ctx, nodeArgs{GroupID: args.GroupID, NodeID: args.NodeID})
+	if node == nil || err != nil {
+		return nil, err
+	}
+	return node.Device(struct{ ID string }{args.DeviceID}), nil
+}
+
+func (r *graphqlResolver) Metrics(ctx context.Context, args struct {
+	Include []string
+	Exclude *[]string
+}) ([]*metricResolver, error) {
+	include, err := globsArg("include", &args.Include)
+	if err != nil {
+		return nil, err
+	}
+	exclude, err := globsArg("exclude", args.Exclude)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]*metricResolver, 0)
+	add := func(metrics []*metricResolver) {
+		for _, m := range metrics {
+			if path := m.Path(); matchesAny(include, path) && !matchesAny(exclude, path) {
+				result = append(result, m)
+			}
+		}
+	}
+	for _, g := range visibleGroups(callerOf(ctx).principal, *r.sm.Fetch()) {
+		for _, n := range g.Nodes {
+			add(metricResolvers(g.ID, n.ID, "", n.Metrics))
+			for _, d := range n.Devices {
+				add(metricResolvers(g.ID, n.ID, d.ID, d.Metrics))
+			}
+		}
+	}
+	return result, nil
+}
+
+type historyArgs struct {
+	Since *dateTime
+	Until *dateTime
+	Limit *int32
+}
+
+func (r *graphqlResolver) MetricHistory(ctx context.Context, args struct {
+	GroupID  string
+	NodeID   string
+	DeviceID *string
+	Name     string
+	historyArgs
+}) ([]*metricUpdateResolver, error) {
+	if !callerOf(ctx).principal.Allows(auth.Viewer, args.GroupID, args.NodeID) {
+		return nil, errors.New("forbidden")
+	}
+	var deviceID string
+	if args.DeviceID != nil {
+		deviceID = *args.DeviceID
+	}
+	return resolveHistory(args.historyArgs, args.GroupID, args.NodeID, deviceID, args.Name)
+}
+
+// Resolves the values of a metric filtered by the history arguments
+func resolveHistory(args historyArgs, groupID, nodeID, deviceID, name string) ([]*metricUpdateResolver, error) {
+	limit, err := limitArg(args.Limit)
+	if err != nil {
+		return nil, err
+	}
+	since, until := timeArg(args.Since, time.Time{}), timeArg(args.Until, time.Time{})
+	values := make([]*metricUpdateResolver, 0)
+	for _, u := range store.FetchHistory(groupID, nodeID, deviceID, name) {
+		if (!since.IsZero() && u.Timestamp.Before(since)) || (!until.IsZero() && u.Timestamp.After(until)) {
+			continue
+		}
+		values = append(values, &metricUpdateResolver{u})
+	}
+	if limit > 0 && len(values) > limit {
+		values = values[len(values)-limit:]
+	}
+	return values, nil
+}
+
+func (r *graphqlResolver) Messages(ctx context.Context, args struct {
+	GroupID *string
+	NodeID  *string
+	Types   *[]string
+	Limit   *int32
+}) ([]*messageResolver, error) {
+	limit, err := limitArg(args.Limit)
+	if err != nil {
+		return nil, err
+	}
+	principal := callerOf(ctx).principal
+	messages := make([]*messageResolver, 0)
+	for _, msg := range *store.Fetch() {
+		if !principal.Allows(auth.Viewer, msg.GroupID, msg.NodeID) || !stringArg(args.GroupID, msg.GroupID) || !stringArg(args.NodeID, msg.NodeID) ||
+			!idArg(args.Types, string(msg.Type)) {
+			continue
+		}
+		messages = append(messages, &messageResolver{msg})
+	}
+	if limit > 0 && len(messages) > limit {
+		messages = messages[len(messages)-limit:]
+	}
+	return messages, nil
+}
+
+// The input of a metric to write
+type commandMetricInput struct {
+	Name     string
+	DataType *string
+	Value    *jsonValue
+}
+
+// Records a command or rebirth request of a GraphQL client in the audit log
+func (r *graphqlResolver) record(ctx context.Context, action audit.Action, groupID, nodeID string, err error) audit.Entry {
+	caller := callerOf(ctx)
+	entry := audit.Entry{
+		Action:    action,
+		Source:    audit.API,
+		Principal: caller.principal.Name,
+		SourceIP:  caller.sourceIP,
+		GroupID:   groupID,
+		NodeID:    nodeID,
+		Details:   "GraphQL",
+		Success:   err == nil,
+	}
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	return entry
+}
+
+func (r *graphqlResolver) SendCommand(ctx context.Context, args struct {
+	GroupID  string
+	NodeID   string
+	DeviceID *string
+	Metrics  []commandMetricInput
+}) (bool, error) {
+	if !callerOf(ctx).principal.Allows(auth.Operator, args.GroupID, args.NodeID) {
+		return false, errors.New("forbidden")
+	}
+	var deviceID string
+	if args.DeviceID != nil {
+		deviceID = *args.DeviceID
+	}
+	requested := make([]commandMetric, 0, len(args.Metrics))
+	for _, m := range args.Metrics {
+		c := commandMetric{Name: m.Name}
+		if m.DataType != nil {
+			c.DataType = *m.DataType
+		}
+		if m.Value != nil {
+			c.Value = m.Value.value
+		}
+		requested = append(requested, c)
+	}
+	metrics, auditMetrics, err := commandMetrics(r.sm, args.GroupID, args.NodeID, deviceID, requested)
+	if err != nil {
+		return false, err
+	}
+	err = r.commander.SendCommand(args.GroupID, args.NodeID, deviceID, metrics)
+	entry := r.record(ctx, audit.Command, args.GroupID, args.NodeID, err)
+	entry.DeviceID = deviceID
+	entry.Metrics = auditMetrics
+	r.auditLog.Record(entry)
+	return err == nil, err
+}
+
+func (r *graphqlResolver) RequestRebirth(ctx context.Context, args nodeArgs) (bool, error) {
+	principal := callerOf(ctx).principal
+	if !principal.Allows(auth.Operator, args.GroupID, args.NodeID) {
+		return false, errors.New("forbidden")
+	}
+	err := r.commander.RequestRebirth(args.GroupID, args.NodeID)
+	r.auditLog.Record(r.record(ctx, audit.Rebirth, args.GroupID, args.NodeID, err))
+	if err == nil {
+		r.sm.RecordRebirthRequest(args.GroupID, args.NodeID, "requested via API by "+principal.Name)
+	}
+	return err == nil, err
+}
+
+// The arguments selecting the nodes and devices of a subscription
+type entityArgs struct {
+	GroupID  *string
+	NodeID   *string
+	DeviceID *string
+}
+
+// Returns whether an event of a node or device matches the caller and the arguments
+func (args entityArgs) matcher(ctx context.Context) func(groupID, nodeID, deviceID string) bool {
+	principal := callerOf(ctx).principal
+	return func(groupID, nodeID, deviceID string) bool {
+		return principal.Allows(auth.Viewer, groupID, nodeID) &&
+			stringArg(args.GroupID, groupID) && stringArg(args.NodeID, nodeID) && stringArg(args.DeviceID, deviceID)
+	}
+}
+
+func (r *graphqlResolver) MetricUpdates(ctx context.Context, args struct {
+	entityArgs
+	Include *[]string
+	Exclude *[]string
+}) (<-chan *metricUpdateResolver, error) {
+	include, err := globsArg("include", args.Include)
+	if err != nil {
+		return nil, err
+	}
+	exclude, err := globsArg("exclude", args.Exclude)
+	if err != nil {
+		return nil, err
+	}
+	matches := args.matcher(ctx)
+	events := r.hub.subscribe(ctx, "metricUpdates", func(event any) bool {
+		u, ok := event.(store.MetricUpdate)
+		if !ok || !matches(u.GroupID, u.NodeID, u.DeviceID) {
+			return false
+		}
+		if len(include) == 0 && len(exclude) == 0 {
+			return true
+		}
+		path := u.Path()
+		return (len(include) == 0 || matchesAny(include, path)) && !matchesAny(exclude, path)
+	})
+	return resolveEvents(ctx, events, func(u store.MetricUpdate) *metricUpdateResolver { return &metricUpdateResolver{u} }), nil
+}
+
+func (r *graphqlResolver) Events(ctx context.Context, args struct {
+	entityArgs
+	Types *[]string
+}) (<-chan *eventResolver, error) {
+	matches := args.matcher(ctx)
+	events := r.hub.subscribe(ctx, "events", func(event any) bool {
+		e, ok := event.(store.Event)
+		return ok && matches(e.GroupID, e.NodeID, e.DeviceID) && idArg(args.Types, enumName(e.Type))
+	})
+	return resolveEvents(ctx, events, func(e store.Event) *eventResolver { return &eventResolver{e} }), nil
+}
+
+type groupResolver struct {
+	g store.FetchedGroup
+}
+
+func (r *groupResolver) ID() string               { return r.g.ID }
+func (r *groupResolver) LastMessageAt() *dateTime { return optionalTime(r.g.LastMessageAt) }
+
+type entityFilterArgs struct {
+	IDs    *[]string
+	Online *bool
+}
+
+func (r *groupResolver) Nodes(args entityFilterArgs) []*nodeResolver {
+	nodes := make([]*nodeResolver, 0)
+	for _, n := range r.g.Nodes {
+		if idArg(args.IDs, n.ID) && boolArg(args.Online, n.Online) {
+			nodes = append(nodes, &nodeResolver{n})
+		}
+	}
+	return nodes
+}
+
+func (r *groupResolver) Node(args struct{ ID string }) *nodeResolver {
+	for _, n := range r.g.Nodes {
+		if n.ID == args.ID {
+			return &nodeResolver{n}
+		}
+	}
+	return nil
+}
+
+type nodeResolver struct {
+	n store.FetchedNode
+}
+
+func (r *nodeResolver) ID() string               { return r.n.ID }
+func (r *nodeResolver) GroupID() string          { return r.n.GroupID }
+func (r *nodeResolver) Online() bool             { return r.n.Online }
+func (r *nodeResolver) Stale() bool              { return r.n.Stale }
+func (r *nodeResolver) LastMessageAt() *dateTime { return optionalTime(r.n.LastMessageAt) }
+
+func (r *nodeResolver) Devices(args entityFilterArgs) []*deviceResolver {
+	devices := make([]*deviceResolver, 0)
+	for _, d := range r.n.Devices {
+		if idArg(args.IDs, d.ID) && boolArg(args.Online, d.Online) {
+			devices = append(devices, &deviceResolver{d})
+		}
+	}
+	return devices
+}
+
+func (r *nodeResolver) Device(args struct{ ID string }) *deviceResolver {
+	for _, d := range r.n.Devices {
+		if d.ID == args.ID {
+			return &deviceResolver{d}
+		}
+	}
+	return nil
+}
+
+func (r *nodeResolver) Metrics(args metricsArgs) ([]*metricResolver, error) {
+	return filterMetrics(args, metricResolvers(r.n.GroupID, r.n.ID, "", r.n.Metrics))
+}
+
+func (r *nodeResolver) Metric(args struct{ Name string }) *metricResolver {
+	return findMetric(args.Name, metricResolvers(r.n.GroupID, r.n.ID, "", r.n.Metrics))
+}
+
+func (r *nodeResolver) Events(args eventsArgs) ([]*eventResolver, error) {
+	return resolveEntityEvents(args, r.n.GroupID, r.n.ID, "")
+}
+
+func (r *nodeResolver) Availability(args availabilityArgs) (*availabilityResolver, error) {
+	return resolveAvailability(args, r.n.GroupID, r.n.ID, "")
+}
+
+type deviceResolver struct {
+	d store.FetchedDevice
+}
+
+func (r *deviceResolver) ID() string               { return r.d.ID }
+func (r *deviceResolver) GroupID() string          { return r.d.GroupID }
+func (r *deviceResolver) NodeID() string           { return r.d.NodeID }
+func (r *deviceResolver) Online() bool             { return r.d.Online }
+func (r *deviceResolver) Stale() bool              { return r.d.Stale }
+func (r *deviceResolver) LastMessageAt() *dateTime { return optionalTime(r.d.LastMessageAt) }
+
+func (r *deviceResolver) Metrics(args metricsArgs) ([]*metricResolver, error) {
+	return filterMetrics(args, metricResolvers(r.d.GroupID, r.d.NodeID, r.d.ID, r.d.Metrics))
+}
+
+func (r *deviceResolver) Metric(args struct{ Name string }) *metricResolver {
+	return findMetric(args.Name, metricResolvers(r.d.GroupID, r.d.NodeID, r.d.ID, r.d.Metrics))
+}
+
+func (r *deviceResolver) Events(args eventsArgs) ([]*eventResolver, error) {
+	return resolveEntityEvents(args, r.d.GroupID, r.d.NodeID, r.d.ID)
+}
+
+func (r *deviceResolver) Availability(args availabilityArgs) (*availabilityResolver, error) {
+	return resolveAvailability(args, r.d.GroupID, r.d.NodeID, r.d.ID)
+}
+
+// A metric of a node or device in GraphQL results
+type metricResolver struct {
+	m                         store.FetchedMetric
+	groupID, nodeID, deviceID string
+}
+
+func metricResolvers(groupID, nodeID, deviceID string, fetched []store.FetchedMetric) []*metricResolver {
+	metrics := make([]*metricResolver, len(fetched))
+	for i, m := range fetched {
+		metrics[i] = &metricResolver{m: m, groupID: groupID, nodeID: nodeID, deviceID: deviceID}
+	}
+	return metrics
+}
+
+type metricsArgs struct {
+	Names   *[]string
+	Pattern *string
+	Stale   *bool
+}
+
+// Returns the metrics of a node or device filtered by the metric arguments
+func filterMetrics(args metricsArgs, metrics []*metricResolver) ([]*metricResolver, error) {
+	var glob *regexp.Regexp
+	if args.Pattern != nil {
+		var err error
+		if glob, err = util.Glob(*args.Pattern); err != nil {
+			return nil, fmt.Errorf("pattern: %v", err)
+		}
+	}
+	filtered := make([]*metricResolver, 0, len(metrics))
+	for _, m := range metrics {
+		if idArg(args.Names, m.m.Name) && (glob == nil || glob.MatchString(m.m.Name)) && boolArg(args.Stale, m.m.Stale) {
+			filtered = append(filtered, m)
+		}
+	}
+	return filtered, nil
+}
+
+func findMetric(name string, metrics []*metricResolver) *metricResolver {
+	for _, m := range metrics {
+		if m.m.Name == name {
+			return m
+		}
+	}
+	return nil
+}
+
+func (r *metricResolver) Name() string { return r.m.Name }
+
+// Returns the path of the metric, "<group>/<node>[/<device>]/<metric>"
+func (r *metricResolver) Path() string {
+	return store.MetricUpdate{GroupID: r.groupID, NodeID: r.nodeID, DeviceID: r.deviceID, Name: r.m.Name}.Path()
+}
+
+func (r *metricResolver) GroupID() string      { return r.groupID }
+func (r *metricResolver) NodeID() string       { return r.nodeID }
+func (r *metricResolver) DeviceID() *string    { return optionalString(r.deviceID) }
+func (r *metricResolver) DataType() string     { return r.m.DataType }
+func (r *metricResolver) Value() *jsonValue    { return optionalJSON(r.m.Value) }
+func (r *metricResolver) IsNull() bool         { return r.m.IsNull }
+func (r *metricResolver) Timestamp() *dateTime { return optionalTime(r.m.Timestamp) }
+func (r *metricResolver) Stale() bool          { return r.m.Stale }
+func (r *metricResolver) Quality() string      { return enumName(r.m.Quality) }
+func (r *metricResolver) Units() *string       { return optionalString(r.m.Units) }
+
+func (r *metricResolver) Alias() *string {
+	alias := strconv.FormatUint(r.m.Alias, 10)
+	return &alias
+}
+
+func (r *metricResolver) Properties(args struct{ Keys *[]string }) []*propertyResolver {
+	properties := make([]*propertyResolver, 0, len(r.m.Properties))
+	for _, key := range util.SortedKeys(r.m.Properties) {
+		if idArg(args.Keys, key) {
+			properties = append(properties, &propertyResolver{key: key, value: r.m.Properties[key]})
+		}
+	}
+	return properties
+}
+
+func (r *metricResolver) History(args historyArgs) ([]*metricUpdateResolver, error) {
+	return resolveHistory(args, r.groupID, r.nodeID, r.deviceID, r.m.Name)
+}
+
+type propertyResolver struct {
+	key   string
+	value any
+}
+
+func (r *propertyResolver) Key() string       { return r.key }
+func (r *propertyResolver) Value() *jsonValue { return optionalJSON(r.value) }
+
+type eventsArgs struct {
+	Types *[]string
+	Since *dateTime
+	Until *dateTime
+	Limit *int32
+}
+
+// Resolves the events of a node or device filtered by the event arguments
+func resolveEntityEvents(args eventsArgs, groupID, nodeID, deviceID string) ([]*eventResolver, error) {
+	var types []store.EventType
+	if args.Types != nil {
+		for _, t := range *args.Types {
+			types = append(types, store.EventType(strings.ToLower(t)))
+		}
+	}
+	limit, err := limitArg(args.Limit)
+	if err != nil {
+		return nil, err
+	}
+	filtered := filterEvents(store.FetchEvents(groupID, nodeID, deviceID), types, timeArg(args.Since, time.Time{}), timeArg(args.Until, time.Time{}), limit)
+	events := make([]*eventResolver, len(filtered))
+	for i, e := range filtered {
+		events[i] = &eventResolver{e}
+	}
+	return events, nil
+}
+
+type eventResolver struct {
+	e store.Event
+}
+
+func (r *eventResolver) Time() dateTime    { return dateTime{r.e.Time} }
+func (r *eventResolver) Type() string      { return enumName(r.e.Type) }
+func (r *eventResolver) GroupID() string   { return r.e.GroupID }
+func (r *eventResolver) NodeID() string    { return r.e.NodeID }
+func (r *eventResolver) DeviceID() *string { return optionalString(r.e.DeviceID) }
+func (r *eventResolver) Cause() string     { return r.e.Cause }
+func (r *eventResolver) Online() bool      { return r.e.Online }
+func (r *eventResolver) Stale() bool       { return r.e.Stale }
+
+type availabilityArgs struct {
+	From *dateTime
+	To   *dateTime
+}
+
+func resolveAvailability(args availabilityArgs, groupID, nodeID, deviceID string) (*availabilityResolver, error) {
+	to := timeArg(args.To, time.Now())
+	from := timeArg(args.From, to.Add(-defaultAvailabilityWindow))
+	if !to.After(from) {
+		return nil, errors.New("from: must be before to")
+	}
+	return &availabilityResolver{store.ComputeAvailability(groupID, nodeID, deviceID, from, to)}, nil
+}
+
+type availabilityResolver struct {
+	a store.Availability
+}
+
+func (r *availabilityResolver) From() dateTime          { return dateTime{r.a.From} }
+func (r *availabilityResolver) To() dateTime            { return dateTime{r.a.To} }
+func (r *availabilityResolver) OnlineSeconds() float64  { return r.a.OnlineSeconds }
+func (r *availabilityResolver) StaleSeconds() float64   { return r.a.StaleSeconds }
+func (r *availabilityResolver) OfflineSeconds() float64 { return r.a.OfflineSeconds }
+func (r *availabilityResolver) UnknownSeconds() float64 { return r.a.UnknownSeconds }
+func (r *availabilityResolver) Availability() *float64  { return r.a.Availability }
+
+type messageResolver struct {
+	m store.FetchedMessage
+}
+
+func (r *messageResolver) GroupID() string      { return r.m.GroupID }
+func (r *messageResolver) NodeID() string       { return r.m.NodeID }
+func (r *messageResolver) DeviceID() *string    { return optionalString(r.m.DeviceID) }
+func (r *messageResolver) Type() string         { return string(r.m.Type) }
+func (r *messageResolver) MetricAmount() int32  { return int32(r.m.MetricAmount) }
+func (r *messageResolver) ReceivedAt() dateTime { return dateTime{r.m.ReceivedAt} }
+
+type metricUpdateResolver struct {
+	u store.MetricUpdate
+}
+
+func (r *metricUpdateResolver) GroupID() string      { return r.u.GroupID }
+func (r *metricUpdateResolver) NodeID() string       { return r.u.NodeID }
+func (r *metricUpdateResolver) DeviceID() *string    { return optionalString(r.u.DeviceID) }
+func (r *metricUpdateResolver) Name() string         { return r.u.Name }
+func (r *metricUpdateResolver) Path() string         { return r.u.Path() }
+func (r *metricUpdateResolver) DataType() string     { return r.u.DataType }
+func (r *metricUpdateResolver) Value() *jsonValue    { return optionalJSON(r.u.Value) }
+func (r *metricUpdateResolver) IsNull() bool         { return r.u.IsNull }
+func (r *metricUpdateResolver) Timestamp() *dateTime { return optionalTime(r.u.Timestamp) }
+func (r *metricUpdateResolver) Units() *string       { return optionalString(r.u.Units) }
+func (r *metricUpdateResolver) Quality() string      { return enumName(r.u.Quality) }
+func (r *metricUpdateResolver) Birth() bool          { return r.u.Birth }
+func (r *metricUpdateResolver) ReceivedAt() dateTime { return dateTime{r.u.ReceivedAt} }
@@ -0,0 +1,316 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/audit"
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/auth"
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/store"
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/store/storetest"
+	"github.com/DATATRONiQ/go-sparkplug-primary/third_party/sparkplugb"
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+// A GraphQL API over a store with the edge node g1/n1 and its metric temp
+type testGraphQL struct {
+	*graphqlAPI
+	t         *testing.T
+	store     *storetest.Store
+	commander *storetest.Commander
+	auditLog  *audit.Log
+}
+
+func newTestGraphQL(t *testing.T) *testGraphQL {
+	t.Helper()
+	s := storetest.New(t)
+	auditLog, err := audit.Open("", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	commander := &storetest.Commander{}
+	api, err := newGraphQLAPI(s.StoreManager, commander, auditLog, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := &testGraphQL{graphqlAPI: api, t: t, store: s, commander: commander, auditLog: auditLog}
+	g.publish(store.NodeBirth, 0, 21)
+	return g
+}
+
+// Passes a message with the value of temp to the store and waits until it is processed
+func (g *testGraphQL) publish(msgType store.Type, seq uint64, value int64) {
+	g.t.Helper()
+	g.store.PublishMetric(g.t, "g1", "n1", msgType, seq, storetest.Int64Metric("temp", 1, value))
+}
+
+// Executes an operation as the given principal, failing on errors, and decodes its data into result
+func (g *testGraphQL) exec(t *testing.T, p *auth.Principal, query string, variables map[string]any, result any) {
+	t.Helper()
+	resp := g.schema.Exec(graphqlContext(context.Background(), p, "127.0.0.1"), query, "", variables)
+	if len(resp.Errors) > 0 {
+		t.Fatalf("%s: %v", query, resp.Errors)
+	}
+	if err := json.Unmarshal(resp.Data, result); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Executes an operation as the given principal and returns the message of its first error
+func (g *testGraphQL) execError(t *testing.T, p *auth.Principal, query string) string {
+	t.Helper()
+	resp := g.schema.Exec(graphqlContext(context.Background(), p, "127.0.0.1"), query, "", nil)
+	if len(resp.Errors) == 0 {
+		t.Fatalf("%s: no error, data %s", query, resp.Data)
+	}
+	return resp.Errors[0].Message
+}
+
+func TestGraphQLQuery(t *testing.T) {
+	g := newTestGraphQL(t)
+	g.publish(store.NodeData, 1, 22)
+
+	var tree struct {
+		Group struct {
+			Nodes []struct {
+				ID     string
+				Metric struct {
+					Path     string
+					Alias    string
+					DataType string
+					Value    int
+					Quality  string
+				}
+				Events []struct{ Type string }
+			}
+		}
+		Metrics  []struct{ Path string }
+		Messages []struct {
+			Type         string
+			MetricAmount int
+		}
+	}
+	g.exec(t, auth.Unrestricted, `{
+		group(id: "g1") {
+			nodes(online: true) {
+				id
+				metric(name: "temp") { path alias dataType value quality }
+				events(types: [BIRTH]) { type }
+			}
+		}
+		metrics(include: ["g1/*/temp"], exclude: ["other/*"]) { path }
+		messages(groupId: "g1", types: [NDATA]) { type metricAmount }
+	}`, nil, &tree)
+	if len(tree.Group.Nodes) != 1 || tree.Group.Nodes[0].ID != "n1" {
+		t.Fatalf("nodes: %+v", tree.Group.Nodes)
+	}
+	metric := tree.Group.Nodes[0].Metric
+	if metric.Path != "g1/n1/temp" || metric.Alias != "1" || metric.DataType != "Int64" || metric.Value != 22 || metric.Quality != "GOOD" {
+		t.Errorf("metric: %+v", metric)
+	}
+	if events := tree.Group.Nodes[0].Events; len(events) != 1 || events[0].Type != "BIRTH" {
+		t.Errorf("events: %+v", events)
+	}
+	if len(tree.Metrics) != 1 || tree.Metrics[0].Path != "g1/n1/temp" {
+		t.Errorf("metrics: %+v", tree.Metrics)
+	}
+	if len(tree.Messages) != 1 || tree.Messages[0].Type != "NDATA" || tree.Messages[0].MetricAmount != 1 {
+		t.Errorf("messages: %+v", tree.Messages)
+	}
+
+	// a viewer of another group sees nothing of this one
+	viewer := &auth.Principal{Name: "viewer", Grants: []auth.Grant{{Role: auth.Viewer, GroupID: "other"}}}
+	var visible struct{ Groups []struct{ ID string } }
+	g.exec(t, viewer, `{ groups { id } }`, nil, &visible)
+	for _, group := range visible.Groups {
+		if group.ID == "g1" {
+			t.Errorf("viewer of other sees group g1")
+		}
+	}
+	if msg := g.execError(t, viewer, `{ node(groupId: "g1", nodeId: "n1") { id } }`); msg != "forbidden" {
+		t.Errorf("node for viewer of other: %s", msg)
+	}
+	if msg := g.execError(t, auth.Unrestricted, `{ messages(limit: 0) { type } }`); msg != "limit: must be a positive number" {
+		t.Errorf("limit 0: %s", msg)
+	}
+}
+
+func TestGraphQLMetricHistory(t *testing.T) {
+	store.ValueHistorySize = 100
+	t.Cleanup(func() { store.ValueHistorySize = 0 })
+	g := newTestGraphQL(t)
+	g.publish(store.NodeData, 1, 22)
+	g.publish(store.NodeData, 2, 23)
+
+	var history struct {
+		MetricHistory []struct {
+			Value int
+			Birth bool
+		}
+		Node struct {
+			Metric struct {
+				History []struct{ Value int }
+			}
+		}
+	}
+	g.exec(t, auth.Unrestricted, `query($limit: Int) {
+		metricHistory(groupId: "g1", nodeId: "n1", name: "temp") { value birth }
+		node(groupId: "g1", nodeId: "n1") { metric(name: "temp") { history(limit: $limit) { value } } }
+	}`, map[string]any{"limit": 1}, &history)
+	values := history.MetricHistory
+	if len(values) != 3 || values[0].Value != 21 || !values[0].Birth || values[1].Value != 22 || values[2].Value != 23 || values[2].Birth {
+		t.Errorf("metricHistory: %+v", values)
+	}
+	if last := history.Node.Metric.History; len(last) != 1 || last[0].Value != 23 {
+		t.Errorf("history(limit: 1): %+v", last)
+	}
+
+	var future struct{ MetricHistory []struct{ Value int } }
+	g.exec(t, auth.Unrestricted, `query($since: DateTime) {
+		metricHistory(groupId: "g1", nodeId: "n1", name: "temp", since: $since) { value }
+	}`, map[string]any{"since": time.Now().Add(time.Hour).Format(time.RFC3339)}, &future)
+	if len(future.MetricHistory) != 0 {
+		t.Errorf("metricHistory since an hour ahead: %+v", future.MetricHistory)
+	}
+
+	// a rebirth drops the history of the node's metrics
+	g.publish(store.NodeBirth, 0, 30)
+	var reborn struct{ MetricHistory []struct{ Value int } }
+	g.exec(t, auth.Unrestricted, `{ metricHistory(groupId: "g1", nodeId: "n1", name: "temp") { value } }`, nil, &reborn)
+	if values := reborn.MetricHistory; len(values) != 1 || values[0].Value != 30 {
+		t.Errorf("metricHistory after rebirth: %+v", values)
+	}
+}
+
+func TestGraphQLMutations(t *testing.T) {
+	g := newTestGraphQL(t)
+
+	// decoded like a POST request, so the integer beyond the range of float64 stays exact
+	req, err := decodeGraphQLRequest([]byte(`{
+		"query": "mutation($value: JSON) { sendCommand(groupId: \"g1\", nodeId: \"n1\", metrics: [{name: \"temp\", value: $value}]) }",
+		"variables": {"value": 9007199254740993}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sent struct{ SendCommand bool }
+	g.exec(t, auth.Unrestricted, req.Query, req.Variables, &sent)
+	if !sent.SendCommand {
+		t.Fatal("sendCommand returned false")
+	}
+	var rebirth struct{ RequestRebirth bool }
+	g.exec(t, auth.Unrestricted, `mutation { requestRebirth(groupId: "g1", nodeId: "n1") }`, nil, &rebirth)
+
+	commands, rebirths := g.commander.Commands(), g.commander.Rebirths()
+	if len(commands) != 1 || commands[0].Name != "temp" || commands[0].DataType != sparkplugb.DataType_Int64 || commands[0].Value != json.Number("9007199254740993") {
+		t.Errorf("commands: %+v", commands)
+	}
+	if len(rebirths) != 1 || rebirths[0] != "g1/n1" {
+		t.Errorf("rebirths: %v", rebirths)
+	}
+	if entries, _ := g.auditLog.Query(audit.Filter{}); len(entries) != 2 || entries[0].Action != audit.Command || entries[0].Details != "GraphQL" || entries[1].Action != audit.Rebirth {
+		t.Errorf("audit log: %+v", entries)
+	}
+
+	viewer := &auth.Principal{Name: "viewer", Grants: []auth.Grant{{Role: auth.Viewer}}}
+	if msg := g.execError(t, viewer, `mutation { requestRebirth(groupId: "g1", nodeId: "n1") }`); msg != "forbidden" {
+		t.Errorf("requestRebirth of viewer: %s", msg)
+	}
+}
+
+func TestGraphQLSubscription(t *testing.T) {
+	g := newTestGraphQL(t)
+	router := gin.New()
+	router.GET("/api/graphql", g.serveWebSocket)
+	server := httptest.NewServer(router)
+	defer server.Close()
+	defer g.close()
+
+	dialer := websocket.Dialer{Subprotocols: []string{graphqlTransportWS}}
+	ws, _, err := dialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/api/graphql", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	ws.SetReadDeadline(time.Now().Add(10 * time.Second))
+	read := func() graphqlMessage {
+		t.Helper()
+		var msg graphqlMessage
+		if err := ws.ReadJSON(&msg); err != nil {
+			t.Fatal(err)
+		}
+		return msg
+	}
+
+	ws.WriteJSON(graphqlMessage{Type: "connection_init"})
+	if msg := read(); msg.Type != "connection_ack" {
+		t.Fatalf("expected connection_ack, got %+v", msg)
+	}
+
+	// invalid operations are answered with an error message
+	ws.WriteJSON(graphqlMessage{ID: "invalid", Type: "subscribe", Payload: json.RawMessage(`{"query": "subscription { unknown }"}`)})
+	if msg := read(); msg.ID != "invalid" || msg.Type != "error" {
+		t.Fatalf("expected error, got %+v", msg)
+	}
+
+	ws.WriteJSON(graphqlMessage{ID: "1", Type: "subscribe", Payload: json.RawMessage(`{"query": "subscription { metricUpdates(groupId: \"g1\", include: [\"*/temp\"]) { path value birth } }"}`)})
+	// the subscription is registered asynchronously, so values are published until one arrives
+	received := make(chan graphqlMessage)
+	go func() {
+		var msg graphqlMessage
+		if ws.ReadJSON(&msg) == nil {
+			received <- msg
+		}
+		close(received)
+	}()
+	var msg graphqlMessage
+	for seq := uint64(1); msg.Type == ""; seq++ {
+		g.publish(store.NodeData, seq, 42)
+		select {
+		case msg = <-received:
+			if msg.Type == "" {
+				t.Fatal("connection closed")
+			}
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	var next struct {
+		Data struct {
+			MetricUpdates struct {
+				Path  string
+				Value int
+				Birth bool
+			}
+		}
+	}
+	if err := json.Unmarshal(msg.Payload, &next); err != nil || msg.ID != "1" || msg.Type != "next" {
+		t.Fatalf("expected next, got %+v", msg)
+	}
+	if u := next.Data.MetricUpdates; u.Path != "g1/n1/temp" || u.Value != 42 || u.Birth {
+		t.Errorf("metricUpdates: %+v", u)
+	}
+
+	// queries run on the connection too, completed after their result
+	ws.WriteJSON(graphqlMessage{ID: "2", Type: "complete"})
+	ws.WriteJSON(graphqlMessage{ID: "1", Type: "complete"})
+	ws.WriteJSON(graphqlMessage{ID: "3", Type: "subscribe", Payload: json.RawMessage(`{"query": "{ node(groupId: \"g1\", nodeId: \"n1\") { id } }"}`)})
+	for {
+		msg := read()
+		if msg.ID != "3" {
+			// pending updates of the completed subscription
+			continue
+		}
+		if msg.Type != "next" || !strings.Contains(string(msg.Payload), `"id":"n1"`) {
+			t.Fatalf("expected the result of the query, got %+v", msg)
+		}
+		break
+	}
+	if msg := read(); msg.ID != "3" || msg.Type != "complete" {
+		t.Fatalf("expected complete, got %+v", msg)
+	}
+}
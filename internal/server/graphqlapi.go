@@ -0,0 +1,443 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/audit"
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/auth"
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/store"
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/graph-gophers/graphql-go"
+	gqlerrors "github.com/graph-gophers/graphql-go/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// The WebSocket subprotocol of GraphQL subscriptions, see https://github.com/enisdenjo/graphql-ws/blob/master/PROTOCOL.md
+const graphqlTransportWS = "graphql-transport-ws"
+
+const (
+	graphqlInitTimeout      = 10 * time.Second // the time clients have to send connection_init
+	graphqlPingInterval     = 30 * time.Second // the interval of WebSocket pings, connections are closed if two are unanswered
+	graphqlWriteTimeout     = 10 * time.Second
+	graphqlMaxSubscriptions = 100     // the maximum of operations running on a connection
+	graphqlMaxMessageSize   = 1 << 20 // the maximum size of received messages in bytes
+)
+
+// Close codes of the graphql-transport-ws protocol
+const (
+	closeBadRequest             = 4400
+	closeUnauthorized           = 4401
+	closeForbidden              = 4403
+	closeSubprotocolUnsupported = 4406
+	closeInitTimeout            = 4408
+	closeSubscriberExists       = 4409
+	closeTooManyInitRequests    = 4429
+)
+
+// Serves the GraphQL API, queries and mutations via POST and all operations via WebSocket
+type graphqlAPI struct {
+	schema   *graphql.Schema
+	auth     *auth.Authenticator
+	upgrader websocket.Upgrader
+
+	mu     sync.Mutex
+	conns  map[*graphqlConn]struct{}
+	closed bool
+}
+
+func newGraphQLAPI(sm *store.StoreManager, commander Commander, auditLog *audit.Log, a *auth.Authenticator) (*graphqlAPI, error) {
+	schema, err := newGraphQLSchema(sm, commander, auditLog, newGraphQLHub())
+	if err != nil {
+		return nil, err
+	}
+	return &graphqlAPI{
+		schema: schema,
+		auth:   a,
+		// the origin must match the host, as browsers send cached basic credentials with cross-site WebSocket requests
+		upgrader: websocket.Upgrader{Subprotocols: []string{graphqlTransportWS}},
+		conns:    make(map[*graphqlConn]struct{}),
+	}, nil
+}
+
+// Returns the context of an operation of the authenticated client
+func graphqlContext(parent context.Context, p *auth.Principal, sourceIP string) context.Context {
+	return context.WithValue(parent, graphqlCallerKey{}, graphqlCaller{principal: p, sourceIP: sourceIP})
+}
+
+// A GraphQL request, sent via POST or in a subscribe message
+type graphqlRequest struct {
+	Query         string         `json:"query"`
+	OperationName string         `json:"operationName"`
+	Variables     map[string]any `json:"variables"`
+}
+
+// Decodes a GraphQL request, keeping the integers of the variables exact
+func decodeGraphQLRequest(data []byte) (graphqlRequest, error) {
+	var req graphqlRequest
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&req); err != nil {
+		return req, err
+	}
+	if req.Query == "" {
+		return req, errors.New("query is required")
+	}
+	for name, value := range req.Variables {
+		req.Variables[name] = graphqlVariable(value)
+	}
+	return req, nil
+}
+
+// Converts the numbers of a variable to the types the executor expects, integers to int and other numbers to float64.
+// Integers beyond the range of int stay a json.Number, which only the JSON scalar accepts.
+func graphqlVariable(value any) any {
+	switch v := value.(type) {
+	case json.Number:
+		if i, err := strconv.ParseInt(string(v), 10, 0); err == nil {
+			return int(i)
+		}
+		if f, err := v.Float64(); err == nil && strings.ContainsAny(string(v), ".eE") {
+			return f
+		}
+		return v
+	case []any:
+		for i, item := range v {
+			v[i] = graphqlVariable(item)
+		}
+	case map[string]any:
+		for key, item := range v {
+			v[key] = graphqlVariable(item)
+		}
+	}
+	return value
+}
+
+// Returns a response of an error of the request
+func graphqlError(message string) *graphql.Response {
+	return &graphql.Response{Errors: []*gqlerrors.QueryError{{Message: message}}}
+}
+
+// Executes a query or mutation sent as JSON via POST
+func (api *graphqlAPI) serveHTTP(ctx *gin.Context) {
+	data, err := ctx.GetRawData()
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, graphqlError(err.Error()))
+		return
+	}
+	req, err := decodeGraphQLRequest(data)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, graphqlError("invalid request: "+err.Error()))
+		return
+	}
+	ctx.JSON(http.StatusOK, api.schema.Exec(graphqlContext(ctx.Request.Context(), principal(ctx), ctx.ClientIP()), req.Query, req.OperationName, req.Variables))
+}
+
+// Upgrades to a WebSocket speaking the graphql-transport-ws protocol. Clients authenticate with the headers of the
+// upgrade request, or with the Authorization or X-API-Key fields of the connection_init payload as browsers cannot
+// set headers.
+func (api *graphqlAPI) serveWebSocket(ctx *gin.Context) {
+	if !websocket.IsWebSocketUpgrade(ctx.Request) {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "send queries and mutations via POST, subscriptions via WebSocket with the " + graphqlTransportWS + " subprotocol"})
+		return
+	}
+	var p *auth.Principal
+	if api.auth == nil {
+		p = auth.Unrestricted
+	} else if ctx.GetHeader("Authorization") != "" || ctx.GetHeader(auth.APIKeyHeader) != "" {
+		var err error
+		if p, err = api.auth.Authenticate(ctx.Request); err != nil {
+			ctx.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	ws, err := api.upgrader.Upgrade(ctx.Writer, ctx.Request, nil)
+	if err != nil {
+		// the upgrader responded already
+		return
+	}
+	c := &graphqlConn{api: api, ws: ws, principal: p, sourceIP: ctx.ClientIP(), operations: make(map[string]*graphqlOperation)}
+	if ws.Subprotocol() != graphqlTransportWS {
+		c.closeWith(closeSubprotocolUnsupported, "Subprotocol not acceptable")
+		return
+	}
+	api.mu.Lock()
+	if api.closed {
+		api.mu.Unlock()
+		c.closeWith(websocket.CloseGoingAway, "Server shutting down")
+		return
+	}
+	api.conns[c] = struct{}{}
+	api.mu.Unlock()
+
+	c.serve()
+
+	api.mu.Lock()
+	delete(api.conns, c)
+	api.mu.Unlock()
+}
+
+// Closes the WebSocket connections, which the HTTP server does not track after the upgrade
+func (api *graphqlAPI) close() {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	api.closed = true
+	for c := range api.conns {
+		c.closeWith(websocket.CloseGoingAway, "Server shutting down")
+	}
+}
+
+// A message of the graphql-transport-ws protocol
+type graphqlMessage struct {
+	ID      string          `json:"id,omitempty"`
+	Type    string          `json:"type"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// A WebSocket connection of a GraphQL client
+type graphqlConn struct {
+	api      *graphqlAPI
+	ws       *websocket.Conn
+	sourceIP string
+	writeMu  sync.Mutex
+
+	mu           sync.Mutex
+	principal    *auth.Principal // nil until the client authenticated in connection_init
+	initReceived bool
+	acknowledged bool
+	operations   map[string]*graphqlOperation // by ID
+}
+
+// A running operation of a connection
+type graphqlOperation struct {
+	cancel context.CancelFunc
+}
+
+// Reads the messages of the client until the connection is closed
+func (c *graphqlConn) serve() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer func() {
+		// ends all operations of the connection
+		cancel()
+		c.ws.Close()
+	}()
+
+	initTimer := time.AfterFunc(graphqlInitTimeout, func() {
+		c.mu.Lock()
+		acknowledged := c.acknowledged
+		c.mu.Unlock()
+		if !acknowledged {
+			c.closeWith(closeInitTimeout, "Connection initialisation timeout")
+		}
+	})
+	defer initTimer.Stop()
+
+	c.ws.SetReadLimit(graphqlMaxMessageSize)
+	c.ws.SetReadDeadline(time.Now().Add(2 * graphqlPingInterval))
+	c.ws.SetPongHandler(func(string) error {
+		return c.ws.SetReadDeadline(time.Now().Add(2 * graphqlPingInterval))
+	})
+	go c.ping(ctx)
+
+	for {
+		_, data, err := c.ws.ReadMessage()
+		if err != nil {
+			return
+		}
+		c.ws.SetReadDeadline(time.Now().Add(2 * graphqlPingInterval))
+		var msg graphqlMessage
+		if err := json.Unmarshal(data, &msg); err != nil || msg.Type == "" {
+			c.closeWith(closeBadRequest, "Invalid message received")
+			return
+		}
+		if !c.handle(ctx, msg) {
+			return
+		}
+	}
+}
+
+// Sends WebSocket pings until the context is done, so dead connections are detected
+func (c *graphqlConn) ping(ctx context.Context) {
+	ticker := time.NewTicker(graphqlPingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := c.ws.WriteControl(websocket.PingMessage, nil, time.Now().Add(graphqlWriteTimeout)); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// Handles a message of the client, returns false if the connection was closed
+func (c *graphqlConn) handle(ctx context.Context, msg graphqlMessage) bool {
+	switch msg.Type {
+	case "connection_init":
+		c.mu.Lock()
+		initReceived := c.initReceived
+		c.initReceived = true
+		c.mu.Unlock()
+		if initReceived {
+			c.closeWith(closeTooManyInitRequests, "Too many initialisation requests")
+			return false
+		}
+		p, err := c.authenticate(msg.Payload)
+		if err != nil {
+			logrus.Debugf("GraphQL WebSocket client %s not authenticated: %v", c.sourceIP, err)
+			c.closeWith(closeForbidden, "Forbidden")
+			return false
+		}
+		c.mu.Lock()
+		c.principal = p
+		c.acknowledged = true
+		c.mu.Unlock()
+		return c.send(graphqlMessage{Type: "connection_ack"})
+	case "ping":
+		return c.send(graphqlMessage{Type: "pong"})
+	case "pong":
+		return true
+	case "subscribe":
+		return c.subscribe(ctx, msg)
+	case "complete":
+		c.mu.Lock()
+		if op := c.operations[msg.ID]; op != nil {
+			delete(c.operations, msg.ID)
+			op.cancel()
+		}
+		c.mu.Unlock()
+		return true
+	}
+	c.closeWith(closeBadRequest, "Invalid message received")
+	return false
+}
+
+// Returns the principal of the upgrade request headers, or else of the connection_init payload
+func (c *graphqlConn) authenticate(payload json.RawMessage) (*auth.Principal, error) {
+	p := c.principal
+	if p == nil {
+		var fields map[string]any
+		if len(payload) > 0 && string(payload) != "null" {
+			if err := json.Unmarshal(payload, &fields); err != nil {
+				return nil, err
+			}
+		}
+		r := &http.Request{Header: make(http.Header)}
+		for key, value := range fields {
+			canonical := http.CanonicalHeaderKey(key)
+			if s, ok := value.(string); ok && (canonical == "Authorization" || canonical == http.CanonicalHeaderKey(auth.APIKeyHeader)) {
+				r.Header.Set(canonical, s)
+			}
+		}
+		var err error
+		if p, err = c.api.auth.Authenticate(r); err != nil {
+			return nil, err
+		}
+	}
+	if !p.AllowsAny(auth.Viewer) {
+		return nil, errors.New("forbidden")
+	}
+	return p, nil
+}
+
+// Starts an operation, returns false if the connection was closed
+func (c *graphqlConn) subscribe(ctx context.Context, msg graphqlMessage) bool {
+	req, err := decodeGraphQLRequest(msg.Payload)
+	if err != nil || msg.ID == "" {
+		c.closeWith(closeBadRequest, "Invalid message received")
+		return false
+	}
+
+	c.mu.Lock()
+	if !c.acknowledged {
+		c.mu.Unlock()
+		c.closeWith(closeUnauthorized, "Unauthorized")
+		return false
+	}
+	if c.operations[msg.ID] != nil {
+		c.mu.Unlock()
+		c.closeWith(closeSubscriberExists, "Subscriber for "+msg.ID+" already exists")
+		return false
+	}
+	if len(c.operations) >= graphqlMaxSubscriptions {
+		c.mu.Unlock()
+		return c.sendErrors(msg.ID, graphqlError("too many operations on this connection").Errors)
+	}
+	opCtx, cancel := context.WithCancel(graphqlContext(ctx, c.principal, c.sourceIP))
+	op := &graphqlOperation{cancel: cancel}
+	c.operations[msg.ID] = op
+	c.mu.Unlock()
+
+	go func() {
+		defer func() {
+			c.mu.Lock()
+			if c.operations[msg.ID] == op {
+				delete(c.operations, msg.ID)
+			}
+			c.mu.Unlock()
+			cancel()
+		}()
+		// invalid operations are answered with an error message instead of a result
+		if errs := c.api.schema.ValidateWithVariables(req.Query, req.Variables); len(errs) > 0 {
+			c.sendErrors(msg.ID, errs)
+			return
+		}
+		responses, err := c.api.schema.Subscribe(opCtx, req.Query, req.OperationName, req.Variables)
+		if err != nil {
+			c.sendErrors(msg.ID, graphqlError(err.Error()).Errors)
+			return
+		}
+		for resp := range responses {
+			payload, err := json.Marshal(resp)
+			if err != nil {
+				payload, _ = json.Marshal(graphqlError(err.Error()))
+			}
+			if !c.send(graphqlMessage{ID: msg.ID, Type: "next", Payload: payload}) {
+				return
+			}
+		}
+		// the client does not expect a complete message for an operation it completed
+		if opCtx.Err() == nil {
+			c.send(graphqlMessage{ID: msg.ID, Type: "complete"})
+		}
+	}()
+	return true
+}
+
+// Sends the errors of an operation which could not be executed
+func (c *graphqlConn) sendErrors(id string, errs []*gqlerrors.QueryError) bool {
+	payload, err := json.Marshal(errs)
+	if err != nil {
+		return false
+	}
+	return c.send(graphqlMessage{ID: id, Type: "error", Payload: payload})
+}
+
+// Sends a message, closing the connection if it fails. Returns false if it failed.
+func (c *graphqlConn) send(msg graphqlMessage) bool {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.ws.SetWriteDeadline(time.Now().Add(graphqlWriteTimeout))
+	if err := c.ws.WriteJSON(msg); err != nil {
+		c.ws.Close()
+		return false
+	}
+	return true
+}
+
+// Closes the connection with the given close code and reason
+func (c *graphqlConn) closeWith(code int, reason string) {
+	c.ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(graphqlWriteTimeout))
+	c.ws.Close()
+}
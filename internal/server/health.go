@@ -0,0 +1,129 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/sparkplug"
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/store"
+	"github.com/gin-gonic/gin"
+)
+
+// The start of the process, reported as uptime
+var startedAt = time.Now()
+
+// The maximum time the store workers may take to respond to the health check
+const pingTimeout = 5 * time.Second
+
+// Reports the state of the connection to the MQTT broker
+type Connection interface {
+	Status() sparkplug.Status
+}
+
+// The result of a single readiness check
+type check struct {
+	Name  string `json:"name"`
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+// The detailed status report of the instance
+type status struct {
+	StartedAt         time.Time        `json:"startedAt"`
+	UptimeSeconds     float64          `json:"uptimeSeconds"`
+	SpecVersion       string           `json:"specVersion"` // The implemented version of the Sparkplug B Specification
+	Ready             bool             `json:"ready"`
+	Checks            []check          `json:"checks"`
+	MQTT              sparkplug.Status `json:"mqtt"`
+	Groups            int              `json:"groups"`
+	NodesOnline       int              `json:"nodesOnline"`
+	NodesOffline      int              `json:"nodesOffline"`
+	DevicesOnline     int              `json:"devicesOnline"`
+	DevicesOffline    int              `json:"devicesOffline"`
+	MessagesProcessed uint64           `json:"messagesProcessed"`
+}
+
+// Adds the liveness and readiness probes to the router, they do not require authentication
+func setProbeRoutes(router *gin.Engine, sm *store.StoreManager, cfg Config) {
+	// alive as long as the store workers process messages
+	router.GET("/healthz", func(ctx *gin.Context) {
+		pingCtx, cancel := context.WithTimeout(ctx.Request.Context(), pingTimeout)
+		defer cancel()
+		if err := sm.Ping(pingCtx); err != nil {
+			ctx.JSON(http.StatusServiceUnavailable, gin.H{"status": "unhealthy", "error": err.Error()})
+			return
+		}
+		ctx.JSON(http.StatusOK, gin.H{"status": "ok"})
+	})
+
+	// ready to consume messages and serve the API
+	router.GET("/readyz", func(ctx *gin.Context) {
+		ready, checks := readiness(ctx.Request.Context(), sm, cfg)
+		if !ready {
+			ctx.JSON(http.StatusServiceUnavailable, gin.H{"status": "not ready", "checks": checks})
+			return
+		}
+		ctx.JSON(http.StatusOK, gin.H{"status": "ready", "checks": checks})
+	})
+}
+
+// Returns whether all readiness checks passed and the result of each check
+func readiness(ctx context.Context, sm *store.StoreManager, cfg Config) (bool, []check) {
+	pingCtx, cancel := context.WithTimeout(ctx, pingTimeout)
+	defer cancel()
+	mqttStatus := cfg.Connection.Status()
+
+	checks := []check{
+		newCheck("store", sm.Ping(pingCtx)),
+		{Name: "mqtt", OK: mqttStatus.Connected},
+		{Name: "subscriptions", OK: mqttStatus.Subscribed},
+		// a standby does not publish STATE until it takes over
+		{Name: "state", OK: !mqttStatus.StateOwner || mqttStatus.StatePublished},
+		newCheck("audit", cfg.Audit.Check()),
+	}
+	if cfg.Alarms != nil {
+		checks = append(checks, newCheck("alarms", cfg.Alarms.Check()))
+	}
+	if cfg.Sinks != nil {
+		checks = append(checks, newCheck("sinks", cfg.Sinks.Check()))
+	}
+	ready := true
+	for _, c := range checks {
+		ready = ready && c.OK
+	}
+	return ready, checks
+}
+
+func newCheck(name string, err error) check {
+	if err != nil {
+		return check{Name: name, Error: err.Error()}
+	}
+	return check{Name: name, OK: true}
+}
+
+// Returns the detailed status report of the instance
+func showStatus(sm *store.StoreManager, cfg Config) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		ready, checks := readiness(ctx.Request.Context(), sm, cfg)
+		s := status{
+			StartedAt:         startedAt,
+			UptimeSeconds:     time.Since(startedAt).Seconds(),
+			SpecVersion:       sparkplug.SpecVersion,
+			Ready:             ready,
+			Checks:            checks,
+			MQTT:              cfg.Connection.Status(),
+			MessagesProcessed: sm.Processed(),
+		}
+		for _, groupStats := range sm.Stats() {
+			s.Groups++
+			s.NodesOnline += groupStats.NodesOnline
+			s.NodesOffline += groupStats.NodesOffline
+			s.DevicesOnline += groupStats.DevicesOnline
+			s.DevicesOffline += groupStats.DevicesOffline
+		}
+		ctx.JSON(http.StatusOK, gin.H{
+			"data": s,
+		})
+	}
+}
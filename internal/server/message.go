@@ -3,12 +3,25 @@ package server
 import (
 	"net/http"
 
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/auth"
 	"github.com/DATATRONiQ/go-sparkplug-primary/internal/store"
 	"github.com/gin-gonic/gin"
 )
 
 func indexMessages(ctx *gin.Context) {
-	messages := store.Fetch()
+	messages := *store.Fetch()
+
+	p := principal(ctx)
+	if !p.Allows(auth.Viewer, "", "") {
+		visible := make([]store.FetchedMessage, 0)
+		for _, msg := range messages {
+			if p.Allows(auth.Viewer, msg.GroupID, msg.NodeID) {
+				visible = append(visible, msg)
+			}
+		}
+		messages = visible
+	}
+
 	ctx.JSON(http.StatusOK, gin.H{
 		"data": messages,
 	})
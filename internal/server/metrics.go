@@ -0,0 +1,65 @@
+package server
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/auth"
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/exporter"
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/metrics"
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	httpRequests        = promauto.NewCounterVec(prometheus.CounterOpts{Name: "sparkplug_primary_http_requests_total", Help: "HTTP requests by method, route and status code"}, []string{"method", "route", "code"})
+	httpRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{Name: "sparkplug_primary_http_request_duration_seconds", Help: "Duration of HTTP requests by method and route", Buckets: metrics.DefaultBuckets}, []string{"method", "route"})
+)
+
+// Counts every request and observes its duration. Requests are labeled by route pattern
+// instead of path, so the node and device IDs do not create a series per node.
+func instrument() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		start := time.Now()
+		ctx.Next()
+
+		route := ctx.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		method := ctx.Request.Method
+		httpRequests.WithLabelValues(method, route, strconv.Itoa(ctx.Writer.Status())).Inc()
+		httpRequestDuration.WithLabelValues(method, route).Observe(time.Since(start).Seconds())
+	}
+}
+
+// Adds the routes for Prometheus, which are served on the admin listener if there is one, otherwise on the public listener
+func setMetricsRoutes(router *gin.Engine, cfg Config) {
+	// Metrics of this instance, require the viewer role for all groups if authentication is enabled
+	router.GET("/metrics", authenticate(cfg.Auth), requireRole(auth.Viewer), serveMetrics)
+	if cfg.Exporter != nil {
+		// Values of the sparkplug metrics within the scope of the principal
+		router.GET("/metrics/sparkplug", authenticate(cfg.Auth), requireAnyRole(auth.Viewer), serveSparkplugMetrics(cfg.Exporter))
+	}
+}
+
+// Serves the metrics of the primary in the Prometheus text exposition format
+func serveMetrics(ctx *gin.Context) {
+	promhttp.Handler().ServeHTTP(ctx.Writer, ctx.Request)
+}
+
+// Serves the values of the sparkplug metrics of the nodes the principal may view in the Prometheus text exposition format
+func serveSparkplugMetrics(exp *exporter.Exporter) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		p := principal(ctx)
+		// a registry per request, as the collected metrics depend on the principal
+		registry := prometheus.NewRegistry()
+		registry.MustRegister(exp.Collector(func(groupID, nodeID string) bool {
+			return p.Allows(auth.Viewer, groupID, nodeID)
+		}))
+		// invalid samples are skipped instead of failing the whole scrape
+		promhttp.HandlerFor(registry, promhttp.HandlerOpts{ErrorHandling: promhttp.ContinueOnError}).ServeHTTP(ctx.Writer, ctx.Request)
+	}
+}
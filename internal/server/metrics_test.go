@@ -0,0 +1,39 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/config"
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/store/storetest"
+	"github.com/gin-gonic/gin"
+)
+
+// Returns the status code of a GET request of the path
+func get(router *gin.Engine, path string) int {
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+	return w.Code
+}
+
+func TestMetricsServedOnAdminListenerOnly(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	s := storetest.New(t)
+	reload := func() (*config.ReloadReport, error) { return &config.ReloadReport{}, nil }
+
+	public := setRouter(s.StoreManager, nil, &storetest.Commander{}, Config{}, nil)
+	if code := get(public, "/metrics"); code != http.StatusOK {
+		t.Errorf("/metrics without admin listener: got %d, want %d", code, http.StatusOK)
+	}
+
+	cfg := Config{AdminAddress: "127.0.0.1:8081"}
+	public = setRouter(s.StoreManager, nil, &storetest.Commander{}, cfg, nil)
+	if code := get(public, "/metrics"); code != http.StatusNotFound {
+		t.Errorf("/metrics on the public listener: got %d, want %d", code, http.StatusNotFound)
+	}
+	admin := setAdminRouter(s.StoreManager, reload, cfg)
+	if code := get(admin, "/metrics"); code != http.StatusOK {
+		t.Errorf("/metrics on the admin listener: got %d, want %d", code, http.StatusOK)
+	}
+}
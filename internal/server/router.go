@@ -3,13 +3,25 @@ package server
 import (
 	"net/http"
 
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/audit"
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/auth"
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/cluster"
 	"github.com/DATATRONiQ/go-sparkplug-primary/internal/store"
 	"github.com/gin-gonic/gin"
 )
 
-func setRouter(sm *store.StoreManager) *gin.Engine {
+func setRouter(sm *store.StoreManager, cl *cluster.Cluster, commander Commander, cfg Config, gql *graphqlAPI) *gin.Engine {
+	a, auditLog := cfg.Auth, cfg.Audit
+
 	// Creates default gin router with Logger and Recovery middleware already attached
 	router := gin.Default()
+	router.Use(instrument())
+	setProbeRoutes(router, sm, cfg)
+
+	// with an admin listener, the metrics are served there only, like the admin API
+	if cfg.AdminAddress == "" {
+		setMetricsRoutes(router, cfg)
+	}
 
 	// Create API route group
 	api := router.Group("/api")
@@ -20,14 +32,71 @@ func setRouter(sm *store.StoreManager) *gin.Engine {
 		})
 	}
 
-	api.GET("/messages", indexMessages)
-	api.GET("/groups", func(ctx *gin.Context) {
-		groups := sm.Fetch()
+	// all other routes require authentication if enabled
+	secured := api.Group("", authenticate(a))
+	secured.GET("/me", showPrincipal)
+	secured.GET("/status", requireRole(auth.Viewer), showStatus(sm, cfg))
+	secured.GET("/messages", requireAnyRole(auth.Viewer), indexMessages)
+	secured.GET("/groups", requireAnyRole(auth.Viewer), func(ctx *gin.Context) {
+		groups := *sm.Fetch()
+		if cl != nil && ctx.Query("merge") == "true" {
+			groups = mergeClusterGroups(cl, groups, ctx.Request)
+		}
 		ctx.JSON(http.StatusOK, gin.H{
-			"data": groups,
+			"data": visibleGroups(principal(ctx), groups),
 		})
 	})
 
+	// routes of a single node are handled by the owning instance in a cluster
+	nodeRoute := func(role auth.Role, handler gin.HandlerFunc) []gin.HandlerFunc {
+		handlers := []gin.HandlerFunc{requireNodeRole(role)}
+		if cl != nil {
+			handlers = append(handlers, redirectToOwner(cl))
+		}
+		return append(handlers, handler)
+	}
+	if cl != nil {
+		secured.GET("/cluster", requireAnyRole(auth.Viewer), indexClusterMembers(cl))
+	}
+	secured.GET("/groups/:groupId/nodes/:nodeId", nodeRoute(auth.Viewer, func(ctx *gin.Context) {
+		node, ok := sm.FetchNode(ctx.Param("groupId"), ctx.Param("nodeId"))
+		if !ok {
+			ctx.JSON(http.StatusNotFound, gin.H{})
+			return
+		}
+		ctx.JSON(http.StatusOK, gin.H{
+			"data": node,
+		})
+	})...)
+	secured.POST("/groups/:groupId/nodes/:nodeId/commands", nodeRoute(auth.Operator, sendCommand(sm, commander, auditLog))...)
+	secured.POST("/groups/:groupId/nodes/:nodeId/devices/:deviceId/commands", nodeRoute(auth.Operator, sendCommand(sm, commander, auditLog))...)
+	secured.POST("/groups/:groupId/nodes/:nodeId/rebirth", nodeRoute(auth.Operator, requestRebirth(sm, commander, auditLog))...)
+	secured.GET("/groups/:groupId/nodes/:nodeId/events", nodeRoute(auth.Viewer, indexEvents)...)
+	secured.GET("/groups/:groupId/nodes/:nodeId/devices/:deviceId/events", nodeRoute(auth.Viewer, indexEvents)...)
+	secured.GET("/groups/:groupId/nodes/:nodeId/availability", nodeRoute(auth.Viewer, showAvailability)...)
+	secured.GET("/groups/:groupId/nodes/:nodeId/devices/:deviceId/availability", nodeRoute(auth.Viewer, showAvailability)...)
+	if engine := cfg.Alarms; engine != nil {
+		// alarms are filtered by the scope of the principal, changing them requires the operator role for their node
+		secured.GET("/alarms", requireAnyRole(auth.Viewer), indexAlarms(engine))
+		secured.GET("/alarms/:alarmId", requireAnyRole(auth.Viewer), showAlarm(engine))
+		secured.POST("/alarms/:alarmId/acknowledge", requireAnyRole(auth.Operator), changeAlarm(engine, auditLog, audit.AcknowledgeAlarm))
+		secured.POST("/alarms/:alarmId/shelve", requireAnyRole(auth.Operator), changeAlarm(engine, auditLog, audit.ShelveAlarm))
+		secured.POST("/alarms/:alarmId/unshelve", requireAnyRole(auth.Operator), changeAlarm(engine, auditLog, audit.UnshelveAlarm))
+	}
+	if webhooks := cfg.Webhooks; webhooks != nil {
+		// dead letters are filtered by the scope of the principal like the alarms
+		secured.GET("/webhooks/dead-letters", requireAnyRole(auth.Operator), indexDeadLetters(webhooks))
+		secured.POST("/webhooks/dead-letters/:letterId/redeliver", requireAnyRole(auth.Operator), changeDeadLetter(webhooks, webhooks.Redeliver))
+		secured.DELETE("/webhooks/dead-letters/:letterId", requireAnyRole(auth.Operator), changeDeadLetter(webhooks, webhooks.Discard))
+	}
+	if gql != nil {
+		// the results are restricted to the scope of the principal, subscriptions authenticate in the WebSocket handshake
+		secured.POST("/graphql", requireAnyRole(auth.Viewer), gql.serveHTTP)
+		api.GET("/graphql", gql.serveWebSocket)
+	}
+	secured.GET("/audit", requireAnyRole(auth.Operator), indexAudit(auditLog))
+	secured.GET("/audit/export", requireAnyRole(auth.Operator), exportAudit(auditLog))
+
 	router.NoRoute(func(ctx *gin.Context) { ctx.JSON(http.StatusNotFound, gin.H{}) })
 
 	return router
@@ -1,10 +1,141 @@
 package server
 
-import "github.com/DATATRONiQ/go-sparkplug-primary/internal/store"
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
 
-func Start(sm *store.StoreManager) {
-	router := setRouter(sm)
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/alarm"
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/audit"
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/auth"
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/cluster"
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/exporter"
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/sink"
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/store"
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/webhook"
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
 
-	// Start listening and serving requests
-	router.Run(":8080")
+// The prefix of listen addresses denoting a Unix socket path
+const unixPrefix = "unix:"
+
+// The settings of the HTTP servers
+type Config struct {
+	Address      string // The listen address of the API, "host:port" or "unix:<path>"
+	AdminAddress string // The listen address of the admin API, served on Address if empty
+	TLSCertFile  string // Serves the API via HTTPS if given, and the admin API unless it listens on a Unix socket
+	TLSKeyFile   string
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	IdleTimeout  time.Duration
+	Mode         string              // The gin mode (debug, release, test)
+	Auth         *auth.Authenticator // Authenticates the API requests, all requests are allowed if nil
+	Audit        *audit.Log          // Records the commands, rebirth requests and reloads requested via the API
+	Exporter     *exporter.Exporter  // Serves the sparkplug metric values on /metrics/sparkplug, disabled if nil
+	Connection   Connection          // Reports the state of the MQTT connection for /readyz and /api/status
+	Alarms       *alarm.Engine       // Serves the alarms on /api/alarms and checks their state file for /readyz, disabled if nil
+	Webhooks     *webhook.Dispatcher // Serves the webhook dead letters on /api/webhooks, disabled if nil
+	Sinks        *sink.Manager       // Checked by /readyz, nil if no sinks are configured
+	GraphQL      bool                // Serves the GraphQL API on /api/graphql
+}
+
+// The running HTTP servers of the API and admin API
+type Server struct {
+	servers []*http.Server
+	graphql *graphqlAPI // nil if the GraphQL API is disabled
+}
+
+// Starts the HTTP API in the background and returns the server, so it can be shut down.
+// The cluster is nil if the primary is not running in a cluster.
+func Start(cfg Config, sm *store.StoreManager, cl *cluster.Cluster, commander Commander, reload Reloader) (*Server, error) {
+	gin.SetMode(cfg.Mode)
+
+	var gql *graphqlAPI
+	if cfg.GraphQL {
+		var err error
+		if gql, err = newGraphQLAPI(sm, commander, cfg.Audit, cfg.Auth); err != nil {
+			return nil, err
+		}
+	}
+
+	router := setRouter(sm, cl, commander, cfg, gql)
+	handlers := map[string]http.Handler{cfg.Address: router}
+	if cfg.AdminAddress == "" {
+		setAdminRoutes(router.Group("/api/admin"), reload, cfg.Auth, cfg.Audit)
+	} else {
+		handlers[cfg.AdminAddress] = setAdminRouter(sm, reload, cfg)
+	}
+
+	s := &Server{graphql: gql}
+	for address, handler := range handlers {
+		listener, err := listen(address)
+		if err != nil {
+			s.Shutdown(context.Background())
+			return nil, err
+		}
+
+		srv := &http.Server{
+			Handler:      handler,
+			ReadTimeout:  cfg.ReadTimeout,
+			WriteTimeout: cfg.WriteTimeout,
+			IdleTimeout:  cfg.IdleTimeout,
+		}
+		s.servers = append(s.servers, srv)
+
+		// the admin API on a Unix socket is only reachable by the local processes its file permissions allow
+		useTLS := cfg.TLSCertFile != "" && (address == cfg.Address || !strings.HasPrefix(address, unixPrefix))
+
+		// Start listening and serving requests
+		go func(address string) {
+			var err error
+			if useTLS {
+				srv.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+				logrus.Infof("Serving HTTPS on %s", address)
+				err = srv.ServeTLS(listener, cfg.TLSCertFile, cfg.TLSKeyFile)
+			} else {
+				logrus.Infof("Serving HTTP on %s", address)
+				err = srv.Serve(listener)
+			}
+			if err != nil && !errors.Is(err, http.ErrServerClosed) {
+				logrus.Fatalf("HTTP server on %s failed: %v", address, err)
+			}
+		}(address)
+	}
+	return s, nil
+}
+
+// Listens on the given TCP address or Unix socket, removing a stale socket file
+func listen(address string) (net.Listener, error) {
+	if !strings.HasPrefix(address, unixPrefix) {
+		return net.Listen("tcp", address)
+	}
+
+	path := strings.TrimPrefix(address, unixPrefix)
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	return net.Listen("unix", path)
+}
+
+// Gracefully shuts down all HTTP servers
+func (s *Server) Shutdown(ctx context.Context) error {
+	if s.graphql != nil {
+		s.graphql.close()
+	}
+	var errs []string
+	for _, srv := range s.servers {
+		if err := srv.Shutdown(ctx); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
 }
@@ -0,0 +1,59 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/auth"
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/webhook"
+	"github.com/gin-gonic/gin"
+)
+
+// Returns the webhook notifications which could not be delivered within the scope of the principal, oldest first,
+// filtered by the subscription query parameter
+func indexDeadLetters(webhooks *webhook.Dispatcher) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		p := principal(ctx)
+		subscription := ctx.Query("subscription")
+
+		letters := make([]webhook.DeadLetter, 0)
+		for _, letter := range webhooks.DeadLetters() {
+			n := letter.Notification
+			if (subscription != "" && letter.Subscription != subscription) || !p.Allows(auth.Operator, n.GroupID, n.NodeID) {
+				continue
+			}
+			letters = append(letters, letter)
+		}
+		ctx.JSON(http.StatusOK, gin.H{
+			"data": letters,
+		})
+	}
+}
+
+// Redelivers or discards the dead letter of the letterId parameter, requiring the operator role for its node
+func changeDeadLetter(webhooks *webhook.Dispatcher, change func(id string) (webhook.DeadLetter, error)) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		id := ctx.Param("letterId")
+		var letter *webhook.DeadLetter
+		for _, l := range webhooks.DeadLetters() {
+			if l.ID == id {
+				letter = &l
+				break
+			}
+		}
+		if letter == nil || !principal(ctx).Allows(auth.Operator, letter.Notification.GroupID, letter.Notification.NodeID) {
+			ctx.JSON(http.StatusNotFound, gin.H{"error": webhook.ErrNotFound.Error()})
+			return
+		}
+
+		changed, err := change(id)
+		switch {
+		case errors.Is(err, webhook.ErrNotFound):
+			ctx.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		case err != nil:
+			ctx.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		default:
+			ctx.JSON(http.StatusOK, gin.H{"data": changed})
+		}
+	}
+}
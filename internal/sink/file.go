@@ -0,0 +1,98 @@
+package sink
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/sirupsen/logrus"
+)
+
+func init() {
+	Register("file", openFile)
+	Register("stdout", openStdout)
+}
+
+// The options of the file sink
+type FileOptions struct {
+	Path      string `yaml:"path"`
+	MaxSizeMB int    `yaml:"maxSizeMB"` // Rotates the file when it would exceed the size, never if 0
+	MaxFiles  int    `yaml:"maxFiles"`  // The rotated files kept as <path>.1 (newest) to <path>.<maxFiles>, 5 if 0
+}
+
+func (o FileOptions) Validate() error {
+	if o.Path == "" {
+		return fmt.Errorf("path is required")
+	}
+	if o.MaxSizeMB < 0 || o.MaxFiles < 0 {
+		return fmt.Errorf("maxSizeMB and maxFiles must not be negative")
+	}
+	return nil
+}
+
+// Appends the records as JSON lines to a file
+type fileSink struct {
+	name string
+	file *rotatingFile
+}
+
+func openFile(name string, o FileOptions) (Sink, error) {
+	f, err := openRotatingFile(o.Path, int64(o.MaxSizeMB)*1024*1024, o.MaxFiles)
+	if err != nil {
+		return nil, err
+	}
+	return &fileSink{name: name, file: f}, nil
+}
+
+func (s *fileSink) Write(_ context.Context, records []Record) error {
+	return s.file.Write(jsonLines(s.name, records))
+}
+
+func (s *fileSink) Close() error {
+	return s.file.Close()
+}
+
+// The stdout sink has no options
+type StdoutOptions struct{}
+
+func (o StdoutOptions) Validate() error {
+	return nil
+}
+
+// Writes the records as JSON lines to the standard output
+type stdoutSink struct {
+	name string
+	out  io.Writer
+}
+
+func openStdout(name string, _ StdoutOptions) (Sink, error) {
+	return &stdoutSink{name: name, out: os.Stdout}, nil
+}
+
+func (s *stdoutSink) Write(_ context.Context, records []Record) error {
+	_, err := s.out.Write(jsonLines(s.name, records))
+	return err
+}
+
+func (s *stdoutSink) Close() error {
+	return nil
+}
+
+// Encodes the records as JSON lines. Records which cannot be encoded, e.g. a NaN value, are skipped.
+func jsonLines(name string, records []Record) []byte {
+	var buf bytes.Buffer
+	for _, r := range records {
+		line, err := json.Marshal(r)
+		if err != nil {
+			logrus.Warnf("Sink %s: skipping record of %s: %v", name, r.Path(), err)
+			forwarded.WithLabelValues(name, "invalid").Inc()
+			continue
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes()
+}
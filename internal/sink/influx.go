@@ -0,0 +1,237 @@
+package sink
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/store"
+)
+
+func init() {
+	Register("influxdb", openInflux)
+}
+
+// How the metrics are mapped to InfluxDB measurements
+const (
+	MeasurementPerMetric = "metric" // A measurement per metric name with a "value" field
+	MeasurementPerDevice = "device" // A measurement per device, or node for its own metrics, with a field per metric
+)
+
+// The options of the InfluxDB sink, which writes either to the HTTP API or to local files
+type InfluxOptions struct {
+	URL         string        `yaml:"url"` // The base URL of an InfluxDB v2 compatible server, e.g. http://localhost:8086
+	Org         string        `yaml:"org"`
+	Bucket      string        `yaml:"bucket"`
+	Token       string        `yaml:"token"`
+	Timeout     time.Duration `yaml:"timeout"`     // Of each write request, 10s if 0
+	Gzip        bool          `yaml:"gzip"`        // Compresses the request bodies
+	Path        string        `yaml:"path"`        // Writes the lines to this file instead of the HTTP API
+	MaxSizeMB   int           `yaml:"maxSizeMB"`   // Rotates the file when it would exceed the size, never if 0
+	MaxFiles    int           `yaml:"maxFiles"`    // The rotated files kept, 5 if 0
+	Measurement string        `yaml:"measurement"` // metric (default) or device
+}
+
+func (o InfluxOptions) Validate() error {
+	if (o.URL == "") == (o.Path == "") {
+		return fmt.Errorf("either url or path is required")
+	}
+	if o.URL != "" {
+		if u, err := url.Parse(o.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("url must be an http or https URL, got %q", o.URL)
+		}
+		if o.Bucket == "" {
+			return fmt.Errorf("bucket is required with url")
+		}
+	}
+	if o.Measurement != "" && o.Measurement != MeasurementPerMetric && o.Measurement != MeasurementPerDevice {
+		return fmt.Errorf("measurement must be %s or %s, got %q", MeasurementPerMetric, MeasurementPerDevice, o.Measurement)
+	}
+	if o.Timeout < 0 || o.MaxSizeMB < 0 || o.MaxFiles < 0 {
+		return fmt.Errorf("timeout, maxSizeMB and maxFiles must not be negative")
+	}
+	return nil
+}
+
+// Writes the metric records in InfluxDB line protocol, lifecycle events are skipped
+type influxSink struct {
+	name     string
+	options  InfluxOptions
+	writeURL string
+	client   *http.Client
+	file     *rotatingFile // nil if writing to the HTTP API
+}
+
+func openInflux(name string, o InfluxOptions) (Sink, error) {
+	s := &influxSink{name: name, options: o}
+	if o.Path != "" {
+		f, err := openRotatingFile(o.Path, int64(o.MaxSizeMB)*1024*1024, o.MaxFiles)
+		if err != nil {
+			return nil, err
+		}
+		s.file = f
+		return s, nil
+	}
+
+	timeout := o.Timeout
+	if timeout == 0 {
+		timeout = 10 * time.Second
+	}
+	query := url.Values{"bucket": {o.Bucket}, "precision": {"ns"}}
+	if o.Org != "" {
+		query.Set("org", o.Org)
+	}
+	s.writeURL = strings.TrimSuffix(o.URL, "/") + "/api/v2/write?" + query.Encode()
+	s.client = &http.Client{Timeout: timeout}
+	return s, nil
+}
+
+func (s *influxSink) Write(ctx context.Context, records []Record) error {
+	var lines bytes.Buffer
+	for _, r := range records {
+		if r.Metric == nil {
+			continue
+		}
+		if line, ok := s.line(r.Metric); ok {
+			lines.WriteString(line)
+			lines.WriteByte('\n')
+		}
+	}
+	if lines.Len() == 0 {
+		return nil
+	}
+	if s.file != nil {
+		return s.file.Write(lines.Bytes())
+	}
+	return s.post(ctx, lines.Bytes())
+}
+
+// Posts the lines to the write endpoint. Rejected requests are permanent errors, server errors and 429 are retried.
+func (s *influxSink) post(ctx context.Context, lines []byte) error {
+	body := lines
+	if s.options.Gzip {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		zw.Write(lines)
+		if err := zw.Close(); err != nil {
+			return err
+		}
+		body = buf.Bytes()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.writeURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	req.Header.Set("User-Agent", "go-sparkplug-primary")
+	if s.options.Gzip {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	if s.options.Token != "" {
+		req.Header.Set("Authorization", "Token "+s.options.Token)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	err = fmt.Errorf("%s responded %s: %s", s.options.URL, resp.Status, strings.TrimSpace(string(message)))
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500 {
+		return err
+	}
+	return Permanent(err)
+}
+
+func (s *influxSink) Close() error {
+	if s.file != nil {
+		return s.file.Close()
+	}
+	s.client.CloseIdleConnections()
+	return nil
+}
+
+// Returns the line of the metric value, or false if it has no value InfluxDB can store (null, NaN or infinite)
+func (s *influxSink) line(u *store.MetricUpdate) (string, bool) {
+	if u.IsNull {
+		return "", false
+	}
+	value, ok := fieldValue(u.Value)
+	if !ok {
+		return "", false
+	}
+
+	var b strings.Builder
+	measurement, field := u.Name, "value"
+	if s.options.Measurement == MeasurementPerDevice {
+		measurement, field = u.NodeID, u.Name
+		if u.DeviceID != "" {
+			measurement = u.DeviceID
+		}
+	}
+	b.WriteString(escape(measurement, ", "))
+	b.WriteString(",group=" + escape(u.GroupID, ",= "))
+	b.WriteString(",node=" + escape(u.NodeID, ",= "))
+	if u.DeviceID != "" {
+		b.WriteString(",device=" + escape(u.DeviceID, ",= "))
+	}
+	b.WriteString(" " + escape(field, ",= ") + "=" + value)
+	b.WriteString(" " + strconv.FormatInt(u.Timestamp.UnixNano(), 10))
+	return b.String(), true
+}
+
+// Returns the value as typed line protocol field value
+func fieldValue(value any) (string, bool) {
+	switch v := value.(type) {
+	case bool:
+		return strconv.FormatBool(v), true
+	case int8, int16, int32, int64:
+		return fmt.Sprintf("%di", v), true
+	case uint8, uint16, uint32, uint64:
+		return fmt.Sprintf("%du", v), true
+	case float32:
+		return floatValue(float64(v), 32)
+	case float64:
+		return floatValue(v, 64)
+	case string:
+		return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v) + `"`, true
+	}
+	return "", false
+}
+
+// Returns the shortest representation of the float of the given bit size, or false if it is NaN or infinite
+func floatValue(v float64, bitSize int) (string, bool) {
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return "", false
+	}
+	return strconv.FormatFloat(v, 'g', -1, bitSize), true
+}
+
+// Escapes the given special characters of a measurement, tag or field key with a backslash.
+// Line breaks cannot be escaped in line protocol, so they are replaced by spaces.
+func escape(s, special string) string {
+	s = strings.NewReplacer("\r", " ", "\n", " ").Replace(s)
+	if !strings.ContainsAny(s, special) {
+		return s
+	}
+	var b strings.Builder
+	for _, r := range s {
+		if strings.ContainsRune(special, r) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
@@ -0,0 +1,325 @@
+package sink
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/store"
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/util"
+	"github.com/DATATRONiQ/go-sparkplug-primary/third_party/sparkplugb"
+	"github.com/sirupsen/logrus"
+	"github.com/twmb/franz-go/pkg/kerr"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"github.com/twmb/franz-go/pkg/sasl/plain"
+	"google.golang.org/protobuf/proto"
+)
+
+func init() {
+	Register("kafka", openKafka)
+}
+
+// The settings of the Kafka sink
+type KafkaOptions struct {
+	Brokers     []string      `yaml:"brokers"`     // The bootstrap brokers as host:port
+	Topic       string        `yaml:"topic"`       // The topic of the metric values
+	BirthTopic  string        `yaml:"birthTopic"`  // The compacted topic of the metrics of the birth certificates keyed by their path, none if empty
+	EventTopic  string        `yaml:"eventTopic"`  // The topic of the lifecycle events, none if empty
+	Key         string        `yaml:"key"`         // The key template with {group}, {node}, {device} and {metric}, "{group}/{node}/{device}" if empty
+	Mode        string        `yaml:"mode"`        // A record per metric (default) or per message
+	Format      string        `yaml:"format"`      // The value format, json (default) or protobuf
+	Acks        string        `yaml:"acks"`        // all (default), leader or none
+	Compression string        `yaml:"compression"` // none (default) or gzip
+	ClientID    string        `yaml:"clientId"`    // "go-sparkplug-primary" if empty
+	Timeout     time.Duration `yaml:"timeout"`     // Of connecting, of each request and of delivering a record, 10s if 0
+	TLS         bool          `yaml:"tls"`
+	CAFile      string        `yaml:"caFile"` // The CA certificates of the brokers, the system roots if empty
+	Username    string        `yaml:"username"`
+	Password    string        `yaml:"password"` // Authenticates with SASL/PLAIN if the username is not empty
+}
+
+// The modes and formats of the Kafka sink
+const (
+	ModeMetric     = "metric"
+	ModeMessage    = "message"
+	FormatJSON     = "json"
+	FormatProtobuf = "protobuf"
+)
+
+var kafkaAcks = map[string]kgo.Acks{"": kgo.AllISRAcks(), "all": kgo.AllISRAcks(), "leader": kgo.LeaderAck(), "none": kgo.NoAck()}
+
+var kafkaCompressions = map[string]kgo.CompressionCodec{"": kgo.NoCompression(), "none": kgo.NoCompression(), "gzip": kgo.GzipCompression()}
+
+func (o KafkaOptions) Validate() error {
+	if len(o.Brokers) == 0 || o.Topic == "" {
+		return fmt.Errorf("brokers and topic are required")
+	}
+	if o.Mode != "" && o.Mode != ModeMetric && o.Mode != ModeMessage {
+		return fmt.Errorf("mode must be %s or %s, got %q", ModeMetric, ModeMessage, o.Mode)
+	}
+	if o.Format != "" && o.Format != FormatJSON && o.Format != FormatProtobuf {
+		return fmt.Errorf("format must be %s or %s, got %q", FormatJSON, FormatProtobuf, o.Format)
+	}
+	if _, ok := kafkaAcks[o.Acks]; !ok {
+		return fmt.Errorf("acks must be all, leader or none, got %q", o.Acks)
+	}
+	if _, ok := kafkaCompressions[o.Compression]; !ok {
+		return fmt.Errorf("compression must be none or gzip, got %q", o.Compression)
+	}
+	if o.Timeout < 0 {
+		return fmt.Errorf("timeout must not be negative")
+	}
+	if o.CAFile != "" {
+		if _, err := os.ReadFile(o.CAFile); err != nil {
+			return fmt.Errorf("caFile: %v", err)
+		}
+	}
+	return nil
+}
+
+// Produces the records to Kafka topics
+type kafkaSink struct {
+	name    string
+	options KafkaOptions
+	client  *kgo.Client
+}
+
+func openKafka(name string, o KafkaOptions) (Sink, error) {
+	if o.ClientID == "" {
+		o.ClientID = "go-sparkplug-primary"
+	}
+	if o.Key == "" {
+		o.Key = "{group}/{node}/{device}"
+	}
+	if o.Timeout == 0 {
+		o.Timeout = 10 * time.Second
+	}
+	opts := []kgo.Opt{
+		kgo.SeedBrokers(o.Brokers...),
+		kgo.ClientID(o.ClientID),
+		kgo.RequiredAcks(kafkaAcks[o.Acks]),
+		kgo.ProducerBatchCompression(kafkaCompressions[o.Compression]),
+		kgo.DialTimeout(o.Timeout),
+		kgo.ProduceRequestTimeout(o.Timeout),
+		// the pipeline retries failed batches with its backoff, so a record is not retried for longer by the client
+	}
+	if o.Acks != "" && o.Acks != "all" {
+		// idempotent writes require the acknowledgement of all in-sync replicas
+		opts = append(opts, kgo.DisableIdempotentWrite())
+	}
+	if o.Username != "" {
+		opts = append(opts, kgo.SASL(plain.Auth{User: o.Username, Pass: o.Password}.AsMechanism()))
+	}
+	if o.TLS {
+		tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+		if o.CAFile != "" {
+			pem, err := os.ReadFile(o.CAFile)
+			if err != nil {
+				return nil, err
+			}
+			tlsConfig.RootCAs = x509.NewCertPool()
+			if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("caFile: no certificates found in %s", o.CAFile)
+			}
+		}
+		opts = append(opts, kgo.DialTLSConfig(tlsConfig))
+	}
+	// connects to the brokers when the first records are produced
+	client, err := kgo.NewClient(opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &kafkaSink{name: name, options: o, client: client}, nil
+}
+
+func (s *kafkaSink) Write(ctx context.Context, records []Record) error {
+	messages := make([]*kgo.Record, 0, len(records))
+	var metrics []*store.MetricUpdate
+	for _, r := range records {
+		if r.Event != nil {
+			if s.options.EventTopic != "" {
+				messages = s.appendJSON(messages, s.options.EventTopic, s.key(r.Event.GroupID, r.Event.NodeID, r.Event.DeviceID, ""), r.Event, r.Event.Time)
+			}
+			continue
+		}
+		u := r.Metric
+		if u.Birth && s.options.BirthTopic != "" {
+			// keyed by the path, so the compacted topic keeps the latest definition of every metric
+			messages = s.appendMetrics(messages, s.options.BirthTopic, []byte(u.Path()), []*store.MetricUpdate{u}, false)
+		}
+		if s.options.Mode == ModeMessage {
+			metrics = append(metrics, u)
+			continue
+		}
+		messages = s.appendMetrics(messages, s.options.Topic, s.key(u.GroupID, u.NodeID, u.DeviceID, u.Name), []*store.MetricUpdate{u}, false)
+	}
+	for _, group := range groupByMessage(metrics) {
+		u := group[0]
+		messages = s.appendMetrics(messages, s.options.Topic, s.key(u.GroupID, u.NodeID, u.DeviceID, ""), group, true)
+	}
+	if len(messages) == 0 {
+		return nil
+	}
+
+	// bounded here rather than by the delivery timeout of the client, which counts from the timestamps of the records
+	ctx, cancel := context.WithTimeout(ctx, s.options.Timeout)
+	defer cancel()
+	// some of the records may have been written if an error is returned
+	err := s.client.ProduceSync(ctx, messages...).FirstErr()
+	var kafkaErr *kerr.Error
+	if errors.As(err, &kafkaErr) && !kafkaErr.Retriable {
+		return Permanent(err)
+	}
+	return err
+}
+
+func (s *kafkaSink) Close() error {
+	s.client.Close()
+	return nil
+}
+
+// Returns the key of the record from the key template
+func (s *kafkaSink) key(groupID, nodeID, deviceID, metric string) []byte {
+	return []byte(util.ExpandPath(s.options.Key, groupID, nodeID, deviceID, metric))
+}
+
+// The JSON value of the metrics of a Sparkplug message in message mode
+type kafkaMessage struct {
+	GroupID    string                `json:"groupId"`
+	NodeID     string                `json:"nodeId"`
+	DeviceID   string                `json:"deviceId,omitempty"`
+	Birth      bool                  `json:"birth,omitempty"`
+	ReceivedAt time.Time             `json:"receivedAt"`
+	Metrics    []*store.MetricUpdate `json:"metrics"`
+}
+
+// Appends a record of a single metric, or of all metrics of a message, in the configured format
+func (s *kafkaSink) appendMetrics(messages []*kgo.Record, topic string, key []byte, metrics []*store.MetricUpdate, message bool) []*kgo.Record {
+	u := metrics[0]
+	if s.options.Format == FormatProtobuf {
+		payload := &sparkplugb.Payload{Timestamp: proto.Uint64(uint64(u.ReceivedAt.UnixMilli()))}
+		for _, m := range metrics {
+			payload.Metrics = append(payload.Metrics, payloadMetric(m))
+		}
+		value, err := proto.Marshal(payload)
+		if err != nil {
+			logrus.Warnf("Sink %s: skipping record of %s: %v", s.name, u.Path(), err)
+			forwarded.WithLabelValues(s.name, "invalid").Inc()
+			return messages
+		}
+		return append(messages, &kgo.Record{Topic: topic, Key: key, Value: value, Timestamp: u.ReceivedAt,
+			Headers: []kgo.RecordHeader{{Key: "content-type", Value: []byte("application/x-protobuf")}}})
+	}
+
+	if !message {
+		return s.appendJSON(messages, topic, key, u, u.ReceivedAt)
+	}
+	return s.appendJSON(messages, topic, key, kafkaMessage{
+		GroupID:    u.GroupID,
+		NodeID:     u.NodeID,
+		DeviceID:   u.DeviceID,
+		Birth:      u.Birth,
+		ReceivedAt: u.ReceivedAt,
+		Metrics:    metrics,
+	}, u.ReceivedAt)
+}
+
+// Appends a record with the JSON encoded value, skipping values which cannot be encoded, e.g. NaN
+func (s *kafkaSink) appendJSON(messages []*kgo.Record, topic string, key []byte, value any, t time.Time) []*kgo.Record {
+	b, err := json.Marshal(value)
+	if err != nil {
+		logrus.Warnf("Sink %s: skipping record of %s: %v", s.name, key, err)
+		forwarded.WithLabelValues(s.name, "invalid").Inc()
+		return messages
+	}
+	return append(messages, &kgo.Record{Topic: topic, Key: key, Value: b, Timestamp: t,
+		Headers: []kgo.RecordHeader{{Key: "content-type", Value: []byte("application/json")}}})
+}
+
+// Groups the metric updates by the Sparkplug message they were received in, keeping the order.
+// The updates of a message share the node and receive time, but a message may span two batches.
+func groupByMessage(metrics []*store.MetricUpdate) [][]*store.MetricUpdate {
+	type message struct {
+		groupID, nodeID, deviceID string
+		receivedAt                time.Time
+	}
+	groups := make([][]*store.MetricUpdate, 0)
+	index := make(map[message]int)
+	for _, u := range metrics {
+		key := message{u.GroupID, u.NodeID, u.DeviceID, u.ReceivedAt}
+		i, ok := index[key]
+		if !ok {
+			i = len(groups)
+			index[key] = i
+			groups = append(groups, nil)
+		}
+		groups[i] = append(groups[i], u)
+	}
+	return groups
+}
+
+// The Sparkplug quality codes of the Quality property
+var qualityCodes = map[store.Quality]int32{store.QualityBad: 0, store.QualityStale: 500}
+
+// Converts a metric update into a Sparkplug payload metric with its name instead of its alias,
+// and its units and quality as properties
+func payloadMetric(u *store.MetricUpdate) *sparkplugb.Payload_Metric {
+	metric := &sparkplugb.Payload_Metric{
+		Name:      proto.String(u.Name),
+		Timestamp: proto.Uint64(uint64(u.Timestamp.UnixMilli())),
+		Datatype:  proto.Uint32(uint32(sparkplugb.DataType_value[u.DataType])),
+	}
+	properties := &sparkplugb.Payload_PropertySet{}
+	if u.Units != "" {
+		properties.Keys = append(properties.Keys, "engUnit")
+		properties.Values = append(properties.Values, &sparkplugb.Payload_PropertyValue{
+			Type:  proto.Uint32(uint32(sparkplugb.DataType_String)),
+			Value: &sparkplugb.Payload_PropertyValue_StringValue{StringValue: u.Units},
+		})
+	}
+	if code, ok := qualityCodes[u.Quality]; ok {
+		properties.Keys = append(properties.Keys, "Quality")
+		properties.Values = append(properties.Values, &sparkplugb.Payload_PropertyValue{
+			Type:  proto.Uint32(uint32(sparkplugb.DataType_Int32)),
+			Value: &sparkplugb.Payload_PropertyValue_IntValue{IntValue: uint32(code)},
+		})
+	}
+	if len(properties.Keys) > 0 {
+		metric.Properties = properties
+	}
+
+	switch v := u.Value.(type) {
+	case bool:
+		metric.Value = &sparkplugb.Payload_Metric_BooleanValue{BooleanValue: v}
+	case int8:
+		metric.Value = &sparkplugb.Payload_Metric_IntValue{IntValue: uint32(int32(v))}
+	case int16:
+		metric.Value = &sparkplugb.Payload_Metric_IntValue{IntValue: uint32(int32(v))}
+	case int32:
+		metric.Value = &sparkplugb.Payload_Metric_IntValue{IntValue: uint32(v)}
+	case int64:
+		metric.Value = &sparkplugb.Payload_Metric_LongValue{LongValue: uint64(v)}
+	case uint8:
+		metric.Value = &sparkplugb.Payload_Metric_IntValue{IntValue: uint32(v)}
+	case uint16:
+		metric.Value = &sparkplugb.Payload_Metric_IntValue{IntValue: uint32(v)}
+	case uint32:
+		metric.Value = &sparkplugb.Payload_Metric_IntValue{IntValue: v}
+	case uint64:
+		metric.Value = &sparkplugb.Payload_Metric_LongValue{LongValue: v}
+	case float32:
+		metric.Value = &sparkplugb.Payload_Metric_FloatValue{FloatValue: v}
+	case float64:
+		metric.Value = &sparkplugb.Payload_Metric_DoubleValue{DoubleValue: v}
+	case string:
+		metric.Value = &sparkplugb.Payload_Metric_StringValue{StringValue: v}
+	default:
+		metric.IsNull = proto.Bool(true)
+	}
+	return metric
+}
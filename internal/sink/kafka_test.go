@@ -0,0 +1,145 @@
+package sink
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/store"
+	"github.com/DATATRONiQ/go-sparkplug-primary/third_party/sparkplugb"
+	"github.com/twmb/franz-go/pkg/kfake"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"google.golang.org/protobuf/proto"
+)
+
+// Starts an in-process Kafka broker with the given topics
+func startKafka(t *testing.T, topics ...string) []string {
+	t.Helper()
+	cluster, err := kfake.NewCluster(kfake.NumBrokers(1), kfake.SeedTopics(1, topics...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(cluster.Close)
+	return cluster.ListenAddrs()
+}
+
+// Writes the records with a Kafka sink of the given options
+func produce(t *testing.T, o KafkaOptions, records ...Record) {
+	t.Helper()
+	if err := o.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	s, err := openKafka("kafka", o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := s.Write(ctx, records); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Returns the given number of records of the topic
+func consume(t *testing.T, brokers []string, topic string, n int) []*kgo.Record {
+	t.Helper()
+	client, err := kgo.NewClient(kgo.SeedBrokers(brokers...), kgo.ConsumeTopics(topic), kgo.ConsumeResetOffset(kgo.NewOffset().AtStart()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	records := make([]*kgo.Record, 0, n)
+	for len(records) < n {
+		fetches := client.PollFetches(ctx)
+		if err := ctx.Err(); err != nil {
+			t.Fatalf("got %d of %d records of %s: %v", len(records), n, topic, err)
+		}
+		records = append(records, fetches.Records()...)
+	}
+	return records
+}
+
+func metricRecord(deviceID, name string, value any, birth bool) Record {
+	return Record{Type: RecordMetric, Metric: &store.MetricUpdate{
+		GroupID: "g1", NodeID: "n1", DeviceID: deviceID, Name: name, DataType: "Double", Value: value,
+		Timestamp: time.UnixMilli(1700000000000), ReceivedAt: time.UnixMilli(1700000000100), Quality: store.QualityGood, Birth: birth,
+	}}
+}
+
+func TestKafkaKeyTemplateAndJSONValue(t *testing.T) {
+	brokers := startKafka(t, "values")
+	produce(t, KafkaOptions{Brokers: brokers, Topic: "values", Key: "{group}/{node}/{device}/{metric}"},
+		metricRecord("", "temp", 21.5, false),
+		metricRecord("d1", "speed", 3.0, false),
+	)
+
+	records := consume(t, brokers, "values", 2)
+	wantKeys := []string{"g1/n1/temp", "g1/n1/d1/speed"}
+	for i, r := range records {
+		if string(r.Key) != wantKeys[i] {
+			t.Errorf("got key %q, want %q", r.Key, wantKeys[i])
+		}
+		if len(r.Headers) != 1 || r.Headers[0].Key != "content-type" || string(r.Headers[0].Value) != "application/json" {
+			t.Errorf("got headers %v, want the JSON content type", r.Headers)
+		}
+	}
+	var u store.MetricUpdate
+	if err := json.Unmarshal(records[0].Value, &u); err != nil {
+		t.Fatal(err)
+	}
+	if u.Name != "temp" || u.Value != 21.5 || u.GroupID != "g1" || u.DeviceID != "" {
+		t.Errorf("got %+v, want the metric temp of node g1/n1 with value 21.5", u)
+	}
+}
+
+func TestKafkaProtobufValue(t *testing.T) {
+	brokers := startKafka(t, "values")
+	produce(t, KafkaOptions{Brokers: brokers, Topic: "values", Format: FormatProtobuf, Mode: ModeMessage},
+		metricRecord("", "temp", 21.5, false),
+		metricRecord("", "pressure", 1.2, false),
+	)
+
+	records := consume(t, brokers, "values", 1)
+	if string(records[0].Key) != "g1/n1" {
+		t.Errorf("got key %q, want the default key g1/n1", records[0].Key)
+	}
+	var payload sparkplugb.Payload
+	if err := proto.Unmarshal(records[0].Value, &payload); err != nil {
+		t.Fatal(err)
+	}
+	if payload.GetTimestamp() != 1700000000100 || len(payload.Metrics) != 2 {
+		t.Fatalf("got %v, want both metrics of the message", &payload)
+	}
+	if m := payload.Metrics[0]; m.GetName() != "temp" || m.GetDoubleValue() != 21.5 || m.GetDatatype() != uint32(sparkplugb.DataType_Double) {
+		t.Errorf("got %v, want the Double temp of 21.5", m)
+	}
+}
+
+func TestKafkaBirthsGoToBirthTopic(t *testing.T) {
+	brokers := startKafka(t, "values", "births")
+	produce(t, KafkaOptions{Brokers: brokers, Topic: "values", BirthTopic: "births"},
+		metricRecord("d1", "speed", 1.0, true),
+		metricRecord("d1", "speed", 2.0, false),
+	)
+
+	births := consume(t, brokers, "births", 1)
+	if string(births[0].Key) != "g1/n1/d1/speed" {
+		t.Errorf("got birth key %q, want the path of the metric", births[0].Key)
+	}
+	var u store.MetricUpdate
+	if err := json.Unmarshal(births[0].Value, &u); err != nil {
+		t.Fatal(err)
+	}
+	if !u.Birth || u.Value != 1.0 {
+		t.Errorf("got %+v on the birth topic, want the birth value 1", u)
+	}
+	// the birth value is written to the value topic as well
+	if values := consume(t, brokers, "values", 2); string(values[0].Key) != "g1/n1/d1" {
+		t.Errorf("got value key %q, want g1/n1/d1", values[0].Key)
+	}
+}
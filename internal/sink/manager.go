@@ -0,0 +1,233 @@
+package sink
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/metrics"
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/store"
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/util"
+	"github.com/sirupsen/logrus"
+)
+
+// Forwards the metric updates and lifecycle events of the store to the configured sinks
+type Manager struct {
+	mu        sync.RWMutex
+	pipelines []*pipeline
+	closed    bool
+}
+
+// Opens the sinks of the given definitions
+func New(definitions []Definition) (*Manager, error) {
+	m := &Manager{}
+	if err := m.SetDefinitions(definitions); err != nil {
+		return nil, err
+	}
+	m.registerMetrics()
+	return m, nil
+}
+
+// The time a changed sink may take to write its queued records before its successor is opened
+const replaceTimeout = 10 * time.Second
+
+// Replaces the sinks. Sinks whose definition did not change keep running. A changed sink is closed after writing
+// its queued records before its successor is opened, as both may write the same file; records of the sink in between
+// are not forwarded. If a sink fails to open, the previous sinks are kept.
+func (m *Manager) SetDefinitions(definitions []Definition) error {
+	compiled, err := compileDefinitions(definitions)
+	if err != nil {
+		return err
+	}
+
+	// the sinks are opened without the lock, which would block the store while connecting
+	m.mu.RLock()
+	running := make(map[string]*pipeline, len(m.pipelines))
+	for _, p := range m.pipelines {
+		running[p.definition.Name] = p
+	}
+	previous := m.pipelines
+	m.mu.RUnlock()
+
+	// the new sinks are opened first, so the running ones are kept if any of them fails
+	next := make(map[string]*pipeline, len(compiled))
+	opened := make([]*pipeline, 0)
+	changed := make([]*definition, 0)
+	abort := func() {
+		for _, p := range opened {
+			p.close(context.Background())
+		}
+	}
+	for _, d := range compiled {
+		p, ok := running[d.Name]
+		switch {
+		case ok && reflect.DeepEqual(p.definition.Definition, d.Definition):
+			next[d.Name] = p
+			delete(running, d.Name)
+		case ok:
+			changed = append(changed, d)
+		default:
+			if p, err = startPipeline(d); err != nil {
+				abort()
+				return err
+			}
+			next[d.Name] = p
+			opened = append(opened, p)
+		}
+	}
+
+	if len(changed) > 0 {
+		m.mu.Lock()
+		m.pipelines = without(previous, changed)
+		m.mu.Unlock()
+
+		replaced := make([]*pipeline, 0, len(changed))
+		for _, d := range changed {
+			p := running[d.Name]
+			delete(running, d.Name)
+			ctx, cancel := context.WithTimeout(context.Background(), replaceTimeout)
+			if err := p.close(ctx); err != nil {
+				logrus.Warnf("Sink %s: timed out writing the queued records before it is replaced: %v", d.Name, err)
+			}
+			cancel()
+			replaced = append(replaced, p)
+		}
+		for _, d := range changed {
+			p, err := startPipeline(d)
+			if err != nil {
+				abort()
+				m.restore(previous, replaced)
+				return err
+			}
+			next[d.Name] = p
+			opened = append(opened, p)
+		}
+	}
+
+	pipelines := make([]*pipeline, 0, len(compiled))
+	for _, d := range compiled {
+		pipelines = append(pipelines, next[d.Name])
+	}
+	m.mu.Lock()
+	m.pipelines = pipelines
+	m.mu.Unlock()
+
+	// the removed sinks write their queued records in the background before they are closed
+	for _, p := range running {
+		go p.close(context.Background())
+	}
+	return nil
+}
+
+// Returns the pipelines except the ones of the given definitions
+func without(pipelines []*pipeline, definitions []*definition) []*pipeline {
+	names := make([]string, len(definitions))
+	for i, d := range definitions {
+		names[i] = d.Name
+	}
+	remaining := make([]*pipeline, 0, len(pipelines))
+	for _, p := range pipelines {
+		if !util.Contains(names, p.definition.Name) {
+			remaining = append(remaining, p)
+		}
+	}
+	return remaining
+}
+
+// Reopens the replaced sinks with their previous definitions after a successor failed to open
+func (m *Manager) restore(previous, replaced []*pipeline) {
+	reopened := make(map[string]*pipeline, len(replaced))
+	for _, old := range replaced {
+		p, err := startPipeline(old.definition)
+		if err != nil {
+			logrus.Errorf("Sink %s: failed to reopen with the previous definition: %v", old.definition.Name, err)
+			continue
+		}
+		reopened[old.definition.Name] = p
+	}
+
+	pipelines := make([]*pipeline, 0, len(previous))
+	for _, p := range previous {
+		if r, ok := reopened[p.definition.Name]; ok {
+			pipelines = append(pipelines, r)
+		} else if !util.Contains(replaced, p) {
+			pipelines = append(pipelines, p)
+		}
+	}
+	m.mu.Lock()
+	m.pipelines = pipelines
+	m.mu.Unlock()
+}
+
+// Forwards a metric update, to be used as update handler of the store
+func (m *Manager) HandleUpdate(u store.MetricUpdate) {
+	m.forward(Record{Type: RecordMetric, Metric: &u})
+}
+
+// Forwards a lifecycle event, to be used as event handler of the store
+func (m *Manager) HandleEvent(e store.Event) {
+	m.forward(Record{Type: RecordEvent, Event: &e})
+}
+
+// Queues the record for every matching sink
+func (m *Manager) forward(r Record) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.closed {
+		return
+	}
+	for _, p := range m.pipelines {
+		if p.definition.matches(r) {
+			p.enqueue(r)
+		}
+	}
+}
+
+// Returns an error listing the sinks whose last write failed, nil if all of them are healthy
+func (m *Manager) Check() error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var failed []string
+	for _, p := range m.pipelines {
+		if err := p.err(); err != nil {
+			failed = append(failed, fmt.Sprintf("sink %s: %v", p.definition.Name, err))
+		}
+	}
+	if len(failed) > 0 {
+		return errors.New(strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+// Stops forwarding records and waits until the sinks wrote the queued ones and are closed, or the context is done
+func (m *Manager) Close(ctx context.Context) error {
+	m.mu.Lock()
+	pipelines := m.pipelines
+	m.pipelines = nil
+	m.closed = true
+	m.mu.Unlock()
+
+	var firstErr error
+	for _, p := range pipelines {
+		if err := p.close(ctx); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// Registers the gauge of the buffered records of each sink, which is computed when scraped
+func (m *Manager) registerMetrics() {
+	metrics.NewGaugeFunc("sparkplug_primary_sink_queue_length", "Records waiting to be written by sink", []string{"sink"},
+		func(emit func(v float64, labelValues ...string)) {
+			m.mu.RLock()
+			defer m.mu.RUnlock()
+			for _, p := range m.pipelines {
+				emit(float64(len(p.queue)), p.definition.Name)
+			}
+		})
+}
@@ -0,0 +1,131 @@
+package sink
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/store"
+)
+
+// The options of the test sink: the resource it writes, which must not be opened twice, and whether opening or writing fails
+type testOptions struct {
+	Target     string `yaml:"target"`
+	Fail       bool   `yaml:"fail"`
+	FailWrites bool   `yaml:"failWrites"`
+}
+
+func (o testOptions) Validate() error { return nil }
+
+// Tracks the targets opened by test sinks
+var (
+	openTargetsMu sync.Mutex
+	openTargets   = make(map[string]int)
+)
+
+type testSink struct {
+	target     string
+	failWrites bool
+}
+
+func (s *testSink) Write(ctx context.Context, records []Record) error {
+	if s.failWrites {
+		return errors.New("failed to write")
+	}
+	return nil
+}
+
+func (s *testSink) Close() error {
+	openTargetsMu.Lock()
+	defer openTargetsMu.Unlock()
+	openTargets[s.target]--
+	return nil
+}
+
+func init() {
+	Register("test", func(name string, o testOptions) (Sink, error) {
+		if o.Fail {
+			return nil, errors.New("failed to open")
+		}
+		openTargetsMu.Lock()
+		defer openTargetsMu.Unlock()
+		if openTargets[o.Target] > 0 {
+			return nil, errors.New("target already open")
+		}
+		openTargets[o.Target]++
+		return &testSink{target: o.Target, failWrites: o.FailWrites}, nil
+	})
+}
+
+func testDefinition(target string, batchSize int, fail bool) Definition {
+	return Definition{Name: "archive", Type: "test", BatchSize: batchSize, Options: Options{"target": target, "fail": fail}}
+}
+
+func TestSetDefinitionsClosesChangedSinkFirst(t *testing.T) {
+	m, err := New([]Definition{testDefinition("archive.jsonl", 10, false)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close(context.Background())
+
+	// the changed definition writes the same target, which the test sink refuses to open twice
+	if err := m.SetDefinitions([]Definition{testDefinition("archive.jsonl", 20, false)}); err != nil {
+		t.Fatal(err)
+	}
+	if len(m.pipelines) != 1 || m.pipelines[0].definition.BatchSize != 20 {
+		t.Errorf("the changed sink was not replaced")
+	}
+}
+
+func TestSetDefinitionsRestoresSinkIfSuccessorFails(t *testing.T) {
+	m, err := New([]Definition{testDefinition("restore.jsonl", 10, false)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close(context.Background())
+
+	if err := m.SetDefinitions([]Definition{testDefinition("restore.jsonl", 20, true)}); err == nil {
+		t.Fatal("got no error opening a failing sink")
+	}
+	if len(m.pipelines) != 1 || m.pipelines[0].definition.BatchSize != 10 {
+		t.Errorf("the previous sink was not restored")
+	}
+}
+
+func TestCheckReportsFailingSinks(t *testing.T) {
+	noRetries := 0
+	failing := Definition{Name: "failing", Type: "test", BatchSize: 1, MaxRetries: &noRetries, Options: Options{"target": "failing.jsonl", "failWrites": true}}
+	healthy := Definition{Name: "healthy", Type: "test", BatchSize: 1, Options: Options{"target": "healthy.jsonl"}}
+	m, err := New([]Definition{failing, healthy})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close(context.Background())
+	if err := m.Check(); err != nil {
+		t.Fatalf("sinks which did not write yet are unhealthy: %v", err)
+	}
+
+	m.HandleEvent(store.Event{GroupID: "g1", NodeID: "n1"})
+	deadline := time.Now().Add(5 * time.Second)
+	for m.Check() == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("the failing sink is reported healthy")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := m.Check(); !strings.Contains(err.Error(), "sink failing:") || strings.Contains(err.Error(), "healthy") {
+		t.Errorf("got %v, want only the failing sink", err)
+	}
+
+	// the replaced sink did not write yet
+	failing.Options = Options{"target": "failing.jsonl"}
+	if err := m.SetDefinitions([]Definition{failing, healthy}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Check(); err != nil {
+		t.Errorf("got %v after replacing the failing sink", err)
+	}
+}
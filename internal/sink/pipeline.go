@@ -0,0 +1,149 @@
+package sink
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sirupsen/logrus"
+)
+
+var forwarded = promauto.NewCounterVec(prometheus.CounterOpts{Name: "sparkplug_primary_sink_records_total", Help: "Records forwarded to the sinks by sink and result"}, []string{"sink", "result"})
+
+// Buffers the records of a single sink and writes them in batches, so a slow or failing sink never blocks ingest or the other sinks
+type pipeline struct {
+	definition *definition
+	sink       Sink
+	queue      chan Record
+	ctx        context.Context // canceled to abort the retries on shutdown
+	cancel     context.CancelFunc
+	done       chan struct{}
+
+	mu      sync.Mutex
+	lastErr error // the error of the last write attempt, nil if it succeeded
+}
+
+// Opens the sink of the definition and starts writing its records
+func startPipeline(d *definition) (*pipeline, error) {
+	s, err := d.factory.open(d.Name, d.Options)
+	if err != nil {
+		return nil, fmt.Errorf("sink %s: %v", d.Name, err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &pipeline{
+		definition: d,
+		sink:       s,
+		queue:      make(chan Record, d.BufferSize),
+		ctx:        ctx,
+		cancel:     cancel,
+		done:       make(chan struct{}),
+	}
+	go p.run()
+	return p, nil
+}
+
+// Queues the record without blocking, dropping it if the buffer is full
+func (p *pipeline) enqueue(r Record) {
+	select {
+	case p.queue <- r:
+	default:
+		forwarded.WithLabelValues(p.definition.Name, "dropped").Inc()
+	}
+}
+
+// Collects the queued records into batches until the queue is closed, then writes the last batch and closes the sink
+func (p *pipeline) run() {
+	defer close(p.done)
+	ticker := time.NewTicker(p.definition.FlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]Record, 0, p.definition.BatchSize)
+	flush := func() {
+		if len(batch) > 0 {
+			p.write(batch)
+			batch = make([]Record, 0, p.definition.BatchSize)
+		}
+	}
+	for {
+		select {
+		case r, ok := <-p.queue:
+			if !ok {
+				flush()
+				if err := p.sink.Close(); err != nil {
+					logrus.Warnf("Sink %s: failed to close: %v", p.definition.Name, err)
+				}
+				return
+			}
+			if batch = append(batch, r); len(batch) >= p.definition.BatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// Writes the batch, retrying with exponential backoff, and drops it if it still fails
+func (p *pipeline) write(batch []Record) {
+	d := p.definition
+	backoff := d.InitialBackoff
+	for attempt := 1; ; attempt++ {
+		err := p.writeOnce(batch)
+		p.mu.Lock()
+		p.lastErr = err
+		p.mu.Unlock()
+		if err == nil {
+			forwarded.WithLabelValues(d.Name, "written").Add(float64(len(batch)))
+			return
+		}
+		if attempt > d.maxRetries || p.ctx.Err() != nil || errors.As(err, &permanentError{}) {
+			logrus.Errorf("Sink %s: dropping %d records after %d attempts: %v", d.Name, len(batch), attempt, err)
+			forwarded.WithLabelValues(d.Name, "failed").Add(float64(len(batch)))
+			return
+		}
+		logrus.Warnf("Sink %s: attempt %d to write %d records failed, retrying in %v: %v", d.Name, attempt, len(batch), backoff, err)
+		select {
+		case <-p.ctx.Done():
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > d.MaxBackoff {
+			backoff = d.MaxBackoff
+		}
+	}
+}
+
+// Writes the batch once, turning a panic of the sink into an error
+func (p *pipeline) writeOnce(batch []Record) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return p.sink.Write(p.ctx, batch)
+}
+
+// Returns the error of the last write attempt, nil if it succeeded or nothing was written yet
+func (p *pipeline) err() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.lastErr
+}
+
+// Stops accepting records and waits until the queued ones are written or the context is done,
+// which aborts the pending retries
+func (p *pipeline) close(ctx context.Context) error {
+	close(p.queue)
+	select {
+	case <-p.done:
+		p.cancel()
+		return nil
+	case <-ctx.Done():
+		p.cancel()
+		<-p.done
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,89 @@
+package sink
+
+import (
+	"fmt"
+	"os"
+)
+
+// The rotated files kept by default
+const defaultMaxFiles = 5
+
+// A file which is rotated when it would exceed its maximum size, keeping the rotated files as <path>.1 to <path>.<maxFiles>
+type rotatingFile struct {
+	path     string
+	maxSize  int64 // never rotated if 0
+	maxFiles int
+	file     *os.File
+	size     int64
+}
+
+// Opens the file for appending, creating it if needed
+func openRotatingFile(path string, maxSize int64, maxFiles int) (*rotatingFile, error) {
+	if maxFiles == 0 {
+		maxFiles = defaultMaxFiles
+	}
+	f := &rotatingFile{path: path, maxSize: maxSize, maxFiles: maxFiles}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file, f.size = file, info.Size()
+	return nil
+}
+
+// Writes the content at once, rotating the file first if it would exceed its maximum size
+func (f *rotatingFile) Write(content []byte) error {
+	if len(content) == 0 {
+		return nil
+	}
+	if f.file == nil {
+		// the previous rotation failed to reopen the file
+		if err := f.open(); err != nil {
+			return err
+		}
+	}
+	if f.maxSize > 0 && f.size > 0 && f.size+int64(len(content)) > f.maxSize {
+		if err := f.rotate(); err != nil {
+			return fmt.Errorf("rotating %s: %v", f.path, err)
+		}
+	}
+	n, err := f.file.Write(content)
+	f.size += int64(n)
+	return err
+}
+
+// Renames the file to <path>.1, shifting the older ones and removing the oldest, and opens a new file
+func (f *rotatingFile) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+	f.file = nil
+	for i := f.maxFiles - 1; i >= 1; i-- {
+		if err := os.Rename(fmt.Sprintf("%s.%d", f.path, i), fmt.Sprintf("%s.%d", f.path, i+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := os.Rename(f.path, f.path+".1"); err != nil {
+		return err
+	}
+	return f.open()
+}
+
+func (f *rotatingFile) Close() error {
+	if f.file == nil {
+		return nil
+	}
+	return f.file.Close()
+}
@@ -0,0 +1,284 @@
+package sink
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/store"
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/util"
+	"gopkg.in/yaml.v2"
+)
+
+// The kind of a record forwarded to the sinks
+type RecordType string
+
+const (
+	RecordMetric RecordType = "metric" // A metric value applied to the store
+	RecordEvent  RecordType = "event"  // A lifecycle event of a node or device
+)
+
+// A normalized, alias-resolved metric update or lifecycle event forwarded to the sinks
+type Record struct {
+	Type   RecordType          `json:"type"`
+	Metric *store.MetricUpdate `json:"metric,omitempty"`
+	Event  *store.Event        `json:"event,omitempty"`
+}
+
+// Returns the path of the record, "<group>/<node>[/<device>]/<metric>" for metrics and "<group>/<node>[/<device>]" for events
+func (r Record) Path() string {
+	if r.Metric != nil {
+		return r.Metric.Path()
+	}
+	if r.Event.DeviceID == "" {
+		return r.Event.GroupID + "/" + r.Event.NodeID
+	}
+	return r.Event.GroupID + "/" + r.Event.NodeID + "/" + r.Event.DeviceID
+}
+
+// A destination of records, e.g. a file or a database.
+// Write and Close are called by a single goroutine per sink, so implementations need no locking.
+type Sink interface {
+	// Writes a batch of records. On an error the whole batch is retried, so writes should be idempotent or atomic.
+	Write(ctx context.Context, records []Record) error
+	// Flushes and releases the resources of the sink
+	Close() error
+}
+
+// An error of a write which is not worth retrying, e.g. a request rejected as invalid
+type permanentError struct {
+	err error
+}
+
+func (e permanentError) Error() string { return e.err.Error() }
+func (e permanentError) Unwrap() error { return e.err }
+
+// Marks the error of a write as permanent, so the batch is dropped instead of retried
+func Permanent(err error) error {
+	return permanentError{err: err}
+}
+
+// The options of a sink type, validated before a sink is opened
+type Validator interface {
+	Validate() error
+}
+
+// Opens the sink of the given name with its decoded options
+type factory struct {
+	validate func(options Options) error
+	open     func(name string, options Options) (Sink, error)
+}
+
+var (
+	factories   = make(map[string]factory)
+	factoriesMu sync.RWMutex
+)
+
+// Registers a sink type. Its options are decoded from the options of the sink definition into T, which is validated first.
+func Register[T Validator](sinkType string, open func(name string, options T) (Sink, error)) {
+	decode := func(options Options) (T, error) {
+		var o T
+		if err := options.Decode(&o); err != nil {
+			return o, err
+		}
+		return o, o.Validate()
+	}
+	factoriesMu.Lock()
+	defer factoriesMu.Unlock()
+	factories[sinkType] = factory{
+		validate: func(options Options) error {
+			_, err := decode(options)
+			return err
+		},
+		open: func(name string, options Options) (Sink, error) {
+			o, err := decode(options)
+			if err != nil {
+				return nil, err
+			}
+			return open(name, o)
+		},
+	}
+}
+
+// Returns the registered sink types, sorted
+func Types() []string {
+	factoriesMu.RLock()
+	defer factoriesMu.RUnlock()
+	return util.SortedKeys(factories)
+}
+
+func lookup(sinkType string) (factory, bool) {
+	factoriesMu.RLock()
+	defer factoriesMu.RUnlock()
+	f, ok := factories[sinkType]
+	return f, ok
+}
+
+// The type specific settings of a sink definition
+type Options map[string]any
+
+// Decodes the options into the given struct, rejecting unknown options
+func (o Options) Decode(target any) error {
+	content, err := yaml.Marshal(o)
+	if err != nil {
+		return err
+	}
+	return yaml.UnmarshalStrict(content, target)
+}
+
+// The defaults of the delivery settings of a sink
+const (
+	defaultBufferSize     = 10000
+	defaultBatchSize      = 100
+	defaultFlushInterval  = time.Second
+	defaultMaxRetries     = 5
+	defaultInitialBackoff = time.Second
+	defaultMaxBackoff     = time.Minute
+)
+
+// A sink of the sinks file with the records it receives and how they are delivered
+type Definition struct {
+	Name           string        `yaml:"name"`
+	Type           string        `yaml:"type"`
+	Records        []RecordType  `yaml:"records"`        // The record types, all if empty
+	Include        []string      `yaml:"include"`        // Patterns of the paths of the records, all if empty
+	Exclude        []string      `yaml:"exclude"`        // Patterns of the paths of records which are not forwarded, even if included
+	BufferSize     int           `yaml:"bufferSize"`     // Records waiting to be written, more are dropped
+	BatchSize      int           `yaml:"batchSize"`      // Records written at once
+	FlushInterval  time.Duration `yaml:"flushInterval"`  // Maximum time a record waits for its batch to fill up
+	MaxRetries     *int          `yaml:"maxRetries"`     // Retries of a failed batch before it is dropped
+	InitialBackoff time.Duration `yaml:"initialBackoff"` // Doubled after every failed attempt up to maxBackoff
+	MaxBackoff     time.Duration `yaml:"maxBackoff"`
+	Options        Options       `yaml:"options"` // The settings of the sink type
+}
+
+// The sinks file
+type definitionsFile struct {
+	Sinks []Definition `yaml:"sinks"`
+}
+
+// Reads and validates the sink definitions of the given file
+func LoadDefinitions(path string) ([]Definition, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file definitionsFile
+	if err := yaml.UnmarshalStrict(content, &file); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if _, err := compileDefinitions(file.Sinks); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return file.Sinks, nil
+}
+
+// A validated definition with its defaults and compiled filters
+type definition struct {
+	Definition
+	maxRetries int
+	include    []*regexp.Regexp
+	exclude    []*regexp.Regexp
+	factory    factory
+}
+
+func compileDefinitions(definitions []Definition) ([]*definition, error) {
+	compiled := make([]*definition, 0, len(definitions))
+	names := make(map[string]bool)
+	for i, d := range definitions {
+		if d.Name == "" || d.Type == "" {
+			return nil, fmt.Errorf("sinks[%d]: name and type are required", i)
+		}
+		if names[d.Name] {
+			return nil, fmt.Errorf("sinks[%d]: duplicate name %q", i, d.Name)
+		}
+		names[d.Name] = true
+		f, ok := lookup(d.Type)
+		if !ok {
+			return nil, fmt.Errorf("sink %s: unknown type %q, must be one of %v", d.Name, d.Type, Types())
+		}
+		for _, t := range d.Records {
+			if t != RecordMetric && t != RecordEvent {
+				return nil, fmt.Errorf("sink %s: unknown record type %q, must be metric or event", d.Name, t)
+			}
+		}
+		if d.BufferSize < 0 || d.BatchSize < 0 || d.FlushInterval < 0 || d.InitialBackoff < 0 || d.MaxBackoff < 0 ||
+			(d.MaxRetries != nil && *d.MaxRetries < 0) {
+			return nil, fmt.Errorf("sink %s: bufferSize, batchSize, flushInterval, maxRetries, initialBackoff and maxBackoff must not be negative", d.Name)
+		}
+
+		c := &definition{Definition: d, maxRetries: defaultMaxRetries, factory: f}
+		if d.MaxRetries != nil {
+			c.maxRetries = *d.MaxRetries
+		}
+		if c.BufferSize == 0 {
+			c.BufferSize = defaultBufferSize
+		}
+		if c.BatchSize == 0 {
+			c.BatchSize = defaultBatchSize
+		}
+		if c.FlushInterval == 0 {
+			c.FlushInterval = defaultFlushInterval
+		}
+		if c.InitialBackoff == 0 {
+			c.InitialBackoff = defaultInitialBackoff
+		}
+		if c.MaxBackoff == 0 {
+			c.MaxBackoff = defaultMaxBackoff
+		}
+		var err error
+		if c.include, err = globs(d.Include); err != nil {
+			return nil, fmt.Errorf("sink %s: include: %v", d.Name, err)
+		}
+		if c.exclude, err = globs(d.Exclude); err != nil {
+			return nil, fmt.Errorf("sink %s: exclude: %v", d.Name, err)
+		}
+		if err := f.validate(d.Options); err != nil {
+			return nil, fmt.Errorf("sink %s: options: %v", d.Name, err)
+		}
+		compiled = append(compiled, c)
+	}
+	return compiled, nil
+}
+
+func globs(patterns []string) ([]*regexp.Regexp, error) {
+	compiled := make([]*regexp.Regexp, 0, len(patterns))
+	for _, pattern := range patterns {
+		re, err := util.Glob(pattern)
+		if err != nil {
+			return nil, err
+		}
+		compiled = append(compiled, re)
+	}
+	return compiled, nil
+}
+
+// Returns true if the record passes the filters of the definition
+func (d *definition) matches(r Record) bool {
+	if len(d.Records) > 0 && !util.Contains(d.Records, r.Type) {
+		return false
+	}
+	if len(d.include) == 0 && len(d.exclude) == 0 {
+		return true
+	}
+	path := r.Path()
+	included := len(d.include) == 0
+	for _, re := range d.include {
+		if re.MatchString(path) {
+			included = true
+			break
+		}
+	}
+	if !included {
+		return false
+	}
+	for _, re := range d.exclude {
+		if re.MatchString(path) {
+			return false
+		}
+	}
+	return true
+}
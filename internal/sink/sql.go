@@ -0,0 +1,319 @@
+package sink
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/store"
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/sirupsen/logrus"
+)
+
+func init() {
+	Register("sql", openSQL)
+}
+
+// The databases of the SQL sink
+const (
+	SQLPostgres = "postgres" // PostgreSQL and TimescaleDB
+	SQLSQLite   = "sqlite"   // Needs a build with cgo
+)
+
+// How often the values and events beyond the retention are deleted, after a successful write
+const retentionInterval = time.Hour
+
+// The settings of the SQL sink
+type SQLOptions struct {
+	Driver       string        `yaml:"driver"`       // postgres or sqlite
+	DSN          string        `yaml:"dsn"`          // The connection string of PostgreSQL, the database file of SQLite
+	Timescale    bool          `yaml:"timescale"`    // Turns the values and events tables into TimescaleDB hypertables
+	Retention    time.Duration `yaml:"retention"`    // Deletes older values and events, keeps them forever if 0
+	MaxOpenConns int           `yaml:"maxOpenConns"` // 4 if 0, always 1 for SQLite
+}
+
+func (o SQLOptions) Validate() error {
+	if _, ok := sqlDialects[o.Driver]; !ok {
+		return fmt.Errorf("driver must be %s or %s, got %q", SQLPostgres, SQLSQLite, o.Driver)
+	}
+	if o.DSN == "" {
+		return fmt.Errorf("dsn is required")
+	}
+	if o.Timescale && o.Driver != SQLPostgres {
+		return fmt.Errorf("timescale requires the %s driver", SQLPostgres)
+	}
+	if o.Retention < 0 || o.MaxOpenConns < 0 {
+		return fmt.Errorf("retention and maxOpenConns must not be negative")
+	}
+	return nil
+}
+
+// Identifies a row of sparkplug_entities
+type sqlEntity struct {
+	groupID, nodeID, deviceID string
+}
+
+// Identifies a row of sparkplug_metrics
+type sqlMetric struct {
+	entityID int64
+	name     string
+}
+
+// The columns of sparkplug_values
+const sqlValueColumns = "metric_id, time, received_at, quality, birth, value_double, value_int, value_bool, value_text"
+
+// The rows inserted by a single statement, which stays below the parameter limits of both databases
+const sqlRowsPerInsert = 500
+
+// Writes the records into the normalized tables of a SQL database: the nodes and devices, the metrics with the
+// definitions of their birth certificates, the metric values and the lifecycle events
+type sqlSink struct {
+	name     string
+	options  SQLOptions
+	dialect  sqlDialect
+	db       *sql.DB
+	migrated bool
+	entities map[sqlEntity]int64 // the IDs of the committed rows
+	metrics  map[sqlMetric]int64
+	retained time.Time // when the expired values and events were deleted last
+}
+
+func openSQL(name string, o SQLOptions) (Sink, error) {
+	dialect := sqlDialects[o.Driver]
+	dsn := o.DSN
+	if o.Driver == SQLSQLite {
+		// concurrent readers, e.g. reporting scripts, do not fail the writes right away
+		separator := "?"
+		if strings.Contains(dsn, "?") {
+			separator = "&"
+		}
+		dsn += separator + "_busy_timeout=5000&_journal_mode=WAL&_foreign_keys=1"
+	}
+	// does not connect yet, the schema is migrated on the first write so an unavailable database is retried
+	db, err := sql.Open(dialect.driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case o.Driver == SQLSQLite:
+		db.SetMaxOpenConns(1)
+	case o.MaxOpenConns > 0:
+		db.SetMaxOpenConns(o.MaxOpenConns)
+	default:
+		db.SetMaxOpenConns(4)
+	}
+	return &sqlSink{
+		name:     name,
+		options:  o,
+		dialect:  dialect,
+		db:       db,
+		entities: make(map[sqlEntity]int64),
+		metrics:  make(map[sqlMetric]int64),
+	}, nil
+}
+
+// Writes the records in a single transaction
+func (s *sqlSink) Write(ctx context.Context, records []Record) error {
+	if !s.migrated {
+		if err := s.migrate(ctx); err != nil {
+			return fmt.Errorf("migrating the schema: %w", err)
+		}
+		s.migrated = true
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// the IDs of the rows inserted by the transaction are cached after it is committed
+	entities := make(map[sqlEntity]int64)
+	metrics := make(map[sqlMetric]int64)
+	var values, events [][]any
+	for _, r := range records {
+		if e := r.Event; e != nil {
+			entityID, err := s.entityID(ctx, tx, entities, sqlEntity{e.GroupID, e.NodeID, e.DeviceID})
+			if err != nil {
+				return err
+			}
+			events = append(events, []any{entityID, e.Time.UTC(), string(e.Type), e.Cause, e.Online, e.Stale})
+			continue
+		}
+		u := r.Metric
+		entityID, err := s.entityID(ctx, tx, entities, sqlEntity{u.GroupID, u.NodeID, u.DeviceID})
+		if err != nil {
+			return err
+		}
+		metricID, err := s.metricID(ctx, tx, metrics, entityID, u)
+		if err != nil {
+			return err
+		}
+		values = append(values, append([]any{metricID, u.Timestamp.UTC(), u.ReceivedAt.UTC(), string(u.Quality), u.Birth}, sqlValue(u)...))
+	}
+
+	if err := s.insert(ctx, tx, "sparkplug_values", sqlValueColumns, values); err != nil {
+		return err
+	}
+	if err := s.insert(ctx, tx, "sparkplug_events", "entity_id, time, type, cause, online, stale", events); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	for k, id := range entities {
+		s.entities[k] = id
+	}
+	for k, id := range metrics {
+		s.metrics[k] = id
+	}
+
+	if s.options.Retention > 0 && time.Since(s.retained) >= retentionInterval {
+		s.retained = time.Now()
+		if err := s.deleteExpired(ctx); err != nil {
+			logrus.Warnf("Sink %s: deleting expired records failed: %v", s.name, err)
+		}
+	}
+	return nil
+}
+
+// Returns the ID of the node or device, inserting it if it is not known yet
+func (s *sqlSink) entityID(ctx context.Context, tx *sql.Tx, inserted map[sqlEntity]int64, e sqlEntity) (int64, error) {
+	if id, ok := s.entities[e]; ok {
+		return id, nil
+	}
+	if id, ok := inserted[e]; ok {
+		return id, nil
+	}
+	// the no-op update makes RETURNING return the ID of an existing row
+	query := s.dialect.rebind(`INSERT INTO sparkplug_entities (group_id, node_id, device_id) VALUES (?, ?, ?)
+		ON CONFLICT (group_id, node_id, device_id) DO UPDATE SET group_id = excluded.group_id RETURNING id`)
+	var id int64
+	if err := tx.QueryRowContext(ctx, query, e.groupID, e.nodeID, e.deviceID).Scan(&id); err != nil {
+		return 0, fmt.Errorf("inserting %s/%s/%s: %w", e.groupID, e.nodeID, e.deviceID, err)
+	}
+	inserted[e] = id
+	return id, nil
+}
+
+// Returns the ID of the metric, inserting it if it is not known yet. The values of birth certificates also update the
+// data type and units of the metric, which may change with every birth.
+func (s *sqlSink) metricID(ctx context.Context, tx *sql.Tx, inserted map[sqlMetric]int64, entityID int64, u *store.MetricUpdate) (int64, error) {
+	key := sqlMetric{entityID, u.Name}
+	if !u.Birth {
+		if id, ok := s.metrics[key]; ok {
+			return id, nil
+		}
+		if id, ok := inserted[key]; ok {
+			return id, nil
+		}
+	}
+
+	query := `INSERT INTO sparkplug_metrics (entity_id, name, data_type, units, birth_at) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (entity_id, name) DO UPDATE SET name = excluded.name RETURNING id`
+	var birthAt any
+	if u.Birth {
+		birthAt = u.ReceivedAt.UTC()
+		query = `INSERT INTO sparkplug_metrics (entity_id, name, data_type, units, birth_at) VALUES (?, ?, ?, ?, ?)
+			ON CONFLICT (entity_id, name) DO UPDATE SET data_type = excluded.data_type, units = excluded.units, birth_at = excluded.birth_at
+			RETURNING id`
+	}
+	var id int64
+	if err := tx.QueryRowContext(ctx, s.dialect.rebind(query), entityID, u.Name, u.DataType, u.Units, birthAt).Scan(&id); err != nil {
+		return 0, fmt.Errorf("inserting %s: %w", u.Path(), err)
+	}
+	inserted[key] = id
+	return id, nil
+}
+
+// Inserts the rows with multi-row statements
+func (s *sqlSink) insert(ctx context.Context, tx *sql.Tx, table, columns string, rows [][]any) error {
+	for len(rows) > 0 {
+		n := len(rows)
+		if n > sqlRowsPerInsert {
+			n = sqlRowsPerInsert
+		}
+		var query strings.Builder
+		args := make([]any, 0, n*len(rows[0]))
+		fmt.Fprintf(&query, "INSERT INTO %s (%s) VALUES ", table, columns)
+		for i, row := range rows[:n] {
+			if i > 0 {
+				query.WriteString(", ")
+			}
+			query.WriteString("(?" + strings.Repeat(", ?", len(row)-1) + ")")
+			args = append(args, row...)
+		}
+		if _, err := tx.ExecContext(ctx, s.dialect.rebind(query.String()), args...); err != nil {
+			return fmt.Errorf("inserting into %s: %w", table, err)
+		}
+		rows = rows[n:]
+	}
+	return nil
+}
+
+// Returns the value_double, value_int, value_bool and value_text columns of the value
+func sqlValue(u *store.MetricUpdate) []any {
+	columns := make([]any, 4)
+	if u.IsNull {
+		return columns
+	}
+	switch v := u.Value.(type) {
+	case float32:
+		columns[0] = float64(v)
+	case float64:
+		columns[0] = v
+	case int8:
+		columns[1] = int64(v)
+	case int16:
+		columns[1] = int64(v)
+	case int32:
+		columns[1] = int64(v)
+	case int64:
+		columns[1] = v
+	case uint8:
+		columns[1] = int64(v)
+	case uint16:
+		columns[1] = int64(v)
+	case uint32:
+		columns[1] = int64(v)
+	case uint64:
+		if v > math.MaxInt64 {
+			columns[3] = strconv.FormatUint(v, 10)
+		} else {
+			columns[1] = int64(v)
+		}
+	case bool:
+		columns[2] = v
+	case string:
+		columns[3] = v
+	}
+	return columns
+}
+
+// Deletes the values and events older than the retention, whole chunks with TimescaleDB
+func (s *sqlSink) deleteExpired(ctx context.Context) error {
+	before := time.Now().Add(-s.options.Retention).UTC()
+	for _, table := range []string{"sparkplug_values", "sparkplug_events"} {
+		query := fmt.Sprintf(`DELETE FROM %s WHERE time < ?`, table)
+		if s.options.Timescale {
+			query = fmt.Sprintf(`SELECT drop_chunks('%s', older_than => ?::timestamptz)`, table)
+		}
+		result, err := s.db.ExecContext(ctx, s.dialect.rebind(query), before)
+		if err != nil {
+			return fmt.Errorf("%s: %w", table, err)
+		}
+		if n, err := result.RowsAffected(); err == nil && n > 0 {
+			logrus.Debugf("Sink %s: deleted %d rows of %s older than %s", s.name, n, table, s.options.Retention)
+		}
+	}
+	return nil
+}
+
+func (s *sqlSink) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,145 @@
+package sink
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// A SQL dialect, the column types and placeholders of a database
+type sqlDialect struct {
+	driver string
+	types  *strings.Replacer // replaces the type placeholders of the migrations
+	rebind func(query string) string
+}
+
+var sqlDialects = map[string]sqlDialect{
+	SQLPostgres: {
+		driver: "postgres",
+		types: strings.NewReplacer("{id}", "BIGSERIAL PRIMARY KEY", "{time}", "TIMESTAMPTZ", "{int}", "BIGINT",
+			"{double}", "DOUBLE PRECISION", "{bool}", "BOOLEAN"),
+		rebind: numberedPlaceholders,
+	},
+	SQLSQLite: {
+		driver: "sqlite3",
+		types: strings.NewReplacer("{id}", "INTEGER PRIMARY KEY", "{time}", "TIMESTAMP", "{int}", "INTEGER",
+			"{double}", "REAL", "{bool}", "BOOLEAN"),
+		rebind: func(query string) string { return query },
+	},
+}
+
+// Replaces the ? placeholders by $1, $2, ... of PostgreSQL
+func numberedPlaceholders(query string) string {
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			fmt.Fprintf(&b, "$%d", n)
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// The migrations of the schema, applied in order and recorded in sparkplug_migrations.
+// Released migrations must never change, changes of the schema are appended as new migrations.
+var sqlMigrations = [][]string{
+	{
+		`CREATE TABLE sparkplug_entities (
+			id {id},
+			group_id TEXT NOT NULL,
+			node_id TEXT NOT NULL,
+			device_id TEXT NOT NULL, -- empty for nodes
+			UNIQUE (group_id, node_id, device_id)
+		)`,
+		`CREATE TABLE sparkplug_metrics (
+			id {id},
+			entity_id {int} NOT NULL REFERENCES sparkplug_entities (id),
+			name TEXT NOT NULL,
+			data_type TEXT NOT NULL,
+			units TEXT NOT NULL,
+			birth_at {time}, -- the receive time of the last birth certificate
+			UNIQUE (entity_id, name)
+		)`,
+		`CREATE TABLE sparkplug_values (
+			metric_id {int} NOT NULL REFERENCES sparkplug_metrics (id),
+			time {time} NOT NULL,
+			received_at {time} NOT NULL,
+			quality TEXT NOT NULL,
+			birth {bool} NOT NULL,
+			value_double {double},
+			value_int {int},
+			value_bool {bool},
+			value_text TEXT -- strings and unsigned integers beyond the range of value_int
+		)`,
+		`CREATE INDEX sparkplug_values_metric_time ON sparkplug_values (metric_id, time)`,
+		`CREATE INDEX sparkplug_values_time ON sparkplug_values (time)`,
+		`CREATE TABLE sparkplug_events (
+			entity_id {int} NOT NULL REFERENCES sparkplug_entities (id),
+			time {time} NOT NULL,
+			type TEXT NOT NULL,
+			cause TEXT NOT NULL,
+			online {bool} NOT NULL,
+			stale {bool} NOT NULL
+		)`,
+		`CREATE INDEX sparkplug_events_entity_time ON sparkplug_events (entity_id, time)`,
+		`CREATE INDEX sparkplug_events_time ON sparkplug_events (time)`,
+	},
+}
+
+// Applies the pending migrations, each in its own transaction
+func (s *sqlSink) migrate(ctx context.Context) error {
+	create := s.dialect.types.Replace(`CREATE TABLE IF NOT EXISTS sparkplug_migrations (version {int} PRIMARY KEY, applied_at {time} NOT NULL)`)
+	if _, err := s.db.ExecContext(ctx, create); err != nil {
+		return err
+	}
+	for i, statements := range sqlMigrations {
+		version := i + 1
+		if err := s.applyMigration(ctx, version, statements); err != nil {
+			return fmt.Errorf("migration %d: %w", version, err)
+		}
+	}
+	if s.options.Timescale {
+		for _, table := range []string{"sparkplug_values", "sparkplug_events"} {
+			query := fmt.Sprintf(`SELECT create_hypertable('%s', 'time', if_not_exists => TRUE, migrate_data => TRUE)`, table)
+			if _, err := s.db.ExecContext(ctx, query); err != nil {
+				return fmt.Errorf("hypertable %s: %w", table, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Applies the migration unless it is recorded already. Concurrent primaries on PostgreSQL wait for each other.
+func (s *sqlSink) applyMigration(ctx context.Context, version int, statements []string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if s.options.Driver == SQLPostgres {
+		if _, err := tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock(7170617)`); err != nil {
+			return err
+		}
+	}
+	var applied int
+	if err := tx.QueryRowContext(ctx, s.dialect.rebind(`SELECT COUNT(*) FROM sparkplug_migrations WHERE version = ?`), version).Scan(&applied); err != nil {
+		return err
+	}
+	if applied > 0 {
+		return nil
+	}
+	for _, statement := range statements {
+		if _, err := tx.ExecContext(ctx, s.dialect.types.Replace(statement)); err != nil {
+			return err
+		}
+	}
+	insert := s.dialect.rebind(`INSERT INTO sparkplug_migrations (version, applied_at) VALUES (?, ?)`)
+	if _, err := tx.ExecContext(ctx, insert, version, time.Now().UTC()); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
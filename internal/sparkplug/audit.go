@@ -0,0 +1,107 @@
+package sparkplug
+
+import (
+	"crypto/sha256"
+	"time"
+
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/audit"
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/store"
+	"github.com/DATATRONiQ/go-sparkplug-primary/third_party/sparkplugb"
+)
+
+// How long a published command is remembered to recognize it when it is received back from the broker
+const ownCommandTTL = time.Minute
+
+// Returns the key identifying a published command
+func commandKey(topic string, rawPayload []byte) [sha256.Size]byte {
+	return sha256.Sum256(append([]byte(topic+"\x00"), rawPayload...))
+}
+
+// Remembers a command published by this instance, so it is not audited as command of another host
+func (c *Client) rememberCommand(topic string, rawPayload []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	for key, publishedAt := range c.ownCommands {
+		if now.Sub(publishedAt) > ownCommandTTL {
+			delete(c.ownCommands, key)
+		}
+	}
+	c.ownCommands[commandKey(topic, rawPayload)] = now
+}
+
+// Returns true iff the command was published by this instance, forgetting it
+func (c *Client) ownCommand(topic string, rawPayload []byte) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := commandKey(topic, rawPayload)
+	if _, ok := c.ownCommands[key]; !ok {
+		return false
+	}
+	delete(c.ownCommands, key)
+	return true
+}
+
+// Records an NCMD or DCMD published by another host with the values known before the command.
+// Commands only requesting a rebirth are recorded as rebirth requests.
+func (c *Client) auditCommand(msg store.Message) {
+	known, _ := c.sm.FetchMetrics(msg.GroupID, msg.NodeID, msg.DeviceID)
+	entry := audit.Entry{
+		Time:     msg.ReceivedAt,
+		Action:   audit.Command,
+		Source:   audit.MQTT,
+		GroupID:  msg.GroupID,
+		NodeID:   msg.NodeID,
+		DeviceID: msg.DeviceID,
+		Details:  "published by another host",
+		Success:  true,
+	}
+
+	for _, metric := range msg.Payload.Metrics {
+		var old *store.FetchedMetric
+		for i := range known {
+			if (metric.Name != nil && known[i].Name == metric.GetName()) || (metric.Name == nil && metric.Alias != nil && known[i].Alias == metric.GetAlias()) {
+				old = &known[i]
+				break
+			}
+		}
+
+		m := audit.Metric{Name: metric.GetName()}
+		dataType := sparkplugb.DataType(metric.GetDatatype())
+		if old != nil {
+			m.Name = old.Name
+			m.OldValue = old.Value
+			if metric.Datatype == nil {
+				dataType = sparkplugb.DataType(sparkplugb.DataType_value[old.DataType])
+			}
+		}
+		m.DataType = dataType.String()
+		if value, err := store.MetricValue(metric, dataType); err == nil {
+			m.NewValue = value
+		}
+		entry.Metrics = append(entry.Metrics, m)
+	}
+	if len(entry.Metrics) == 1 && entry.Metrics[0].Name == rebirthMetric {
+		entry.Action = audit.Rebirth
+	}
+	c.audit.Record(entry)
+}
+
+// Records a rebirth request issued automatically by this instance, if published also in the lifecycle events of the node
+func (c *Client) auditRebirth(groupID, nodeID, reason string, err error) {
+	if err == nil {
+		c.sm.RecordRebirthRequest(groupID, nodeID, reason)
+	}
+	entry := audit.Entry{
+		Action:  audit.Rebirth,
+		Source:  audit.Primary,
+		GroupID: groupID,
+		NodeID:  nodeID,
+		Details: reason,
+		Success: err == nil,
+	}
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	c.audit.Record(entry)
+}
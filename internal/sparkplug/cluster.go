@@ -0,0 +1,271 @@
+package sparkplug
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/cluster"
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/store"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/sirupsen/logrus"
+)
+
+// Subscribes to the heartbeats of the cluster members and the messages forwarded to this instance
+func (c *Client) subscribeCluster(client mqtt.Client) {
+	cl := c.cluster
+	token := client.Subscribe(cl.HeartbeatFilter(), 1, func(client mqtt.Client, m mqtt.Message) {
+		if err := cl.HandleHeartbeat(m.Topic(), m.Payload()); err != nil {
+			logrus.Warnf("Invalid cluster heartbeat on %s: %v", m.Topic(), err)
+			return
+		}
+		c.membershipMayHaveChanged()
+	})
+	token.Wait()
+	if token.Error() != nil {
+		logrus.Debug(token.Error())
+	}
+
+	token = client.Subscribe(cl.ForwardFilter(), 1, func(client mqtt.Client, m mqtt.Message) {
+		topic, ok := cl.ForwardedTopic(m.Topic())
+		if !ok {
+			return
+		}
+		groupID, nodeID, ok := edgeNodeOf(topic)
+		if !ok {
+			return
+		}
+		c.see(groupID, nodeID)
+		// forwarded messages are always processed, even if the membership views differ, to prevent forwarding loops
+		c.reorder.add(topic, store.EdgeNode{GroupID: groupID, NodeID: nodeID}, m.Payload())
+	})
+	token.Wait()
+	if token.Error() != nil {
+		logrus.Debug(token.Error())
+	}
+	logrus.Debugf("Subscribed to cluster topics as %s", cl.ID())
+
+	// announces this instance right away, so the other members take it into account
+	c.publishHeartbeat(client)
+}
+
+// Handles a message received via the shared subscription: messages of edge nodes owned by other instances are forwarded to them,
+// the messages of owned nodes are passed on in the order of their sequence numbers
+func (c *Client) receiveShared(client mqtt.Client, topic string, payload []byte) {
+	groupID, nodeID, ok := edgeNodeOf(topic)
+	if !ok {
+		c.handleMessage(topic, payload)
+		return
+	}
+	c.see(groupID, nodeID)
+	if owner := c.cluster.Owner(groupID, nodeID); owner.ID != c.cluster.ID() {
+		logrus.Tracef("Forwarding message of %s to %s", topic, owner.ID)
+		client.Publish(c.cluster.ForwardTopic(owner.ID, topic), 1, false, payload)
+		return
+	}
+	c.reorder.add(topic, store.EdgeNode{GroupID: groupID, NodeID: nodeID}, payload)
+}
+
+// Records that messages of the edge node were received, whether it is owned by this instance or not
+func (c *Client) see(groupID, nodeID string) {
+	c.seenMu.Lock()
+	defer c.seenMu.Unlock()
+	c.seen[store.EdgeNode{GroupID: groupID, NodeID: nodeID}] = struct{}{}
+}
+
+// Returns the edge nodes messages were received of
+func (c *Client) seenNodes() []store.EdgeNode {
+	c.seenMu.Lock()
+	defer c.seenMu.Unlock()
+	edgeNodes := make([]store.EdgeNode, 0, len(c.seen))
+	for edgeNode := range c.seen {
+		edgeNodes = append(edgeNodes, edgeNode)
+	}
+	return edgeNodes
+}
+
+// Returns the group and node ID of a sparkplug node or device topic
+func edgeNodeOf(topic string) (string, string, bool) {
+	topicParts := strings.Split(topic, "/")
+	if len(topicParts) < 4 || topicParts[0] != namespace {
+		return "", "", false
+	}
+	return topicParts[1], topicParts[3], true
+}
+
+// Publishes the heartbeat of this instance
+func (c *Client) publishHeartbeat(client mqtt.Client) {
+	client.Publish(c.cluster.HeartbeatTopic(), 0, false, c.cluster.Heartbeat())
+}
+
+// Lets the heartbeat loop check the members of the cluster
+func (c *Client) membershipMayHaveChanged() {
+	select {
+	case c.membershipChanged <- struct{}{}:
+	default:
+	}
+}
+
+// Publishes a heartbeat of this instance every heartbeat interval and checks the members of the cluster
+// whenever a heartbeat was received or members may have died
+func (c *Client) publishHeartbeats() {
+	ticker := time.NewTicker(c.cluster.HeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		c.checkMembership()
+		select {
+		case <-ticker.C:
+			if client := c.mqtt(); client.IsConnected() {
+				c.publishHeartbeat(client)
+			}
+		case <-c.membershipChanged:
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// Updates the holder of the STATE and the owners of the edge nodes if members joined or left the cluster.
+// Only called by the heartbeat loop.
+func (c *Client) checkMembership() {
+	members := c.cluster.Members()
+	previous := c.members
+	c.members = members
+	c.updateStateOwner()
+
+	if memberIDs(previous) == memberIDs(members) {
+		return
+	}
+	logrus.Infof("Cluster members changed from [%s] to [%s]", memberIDs(previous), memberIDs(members))
+	if client := c.mqtt(); client.IsConnected() {
+		// lets a joining member learn about this instance without waiting for the next heartbeat
+		c.publishHeartbeat(client)
+	}
+	c.reassign(previous, members)
+}
+
+func memberIDs(members []cluster.Member) string {
+	ids := make([]string, len(members))
+	for i, member := range members {
+		ids[i] = member.ID
+	}
+	return strings.Join(ids, ", ")
+}
+
+// Requests rebirths of the edge nodes which moved from or to this instance, as their new owner holds no birth certificate of them.
+// The previous owner requests the rebirth if it is still a member, otherwise the new owner does.
+func (c *Client) reassign(previous, members []cluster.Member) {
+	self := c.cluster.ID()
+	for _, edgeNode := range c.seenNodes() {
+		oldOwner := cluster.OwnerOf(previous, edgeNode.GroupID, edgeNode.NodeID).ID
+		newOwner := cluster.OwnerOf(members, edgeNode.GroupID, edgeNode.NodeID).ID
+		if oldOwner == newOwner {
+			continue
+		}
+		if oldOwner == self {
+			c.reorder.forget(edgeNode)
+		}
+		requester := newOwner
+		for _, member := range members {
+			if member.ID == oldOwner {
+				requester = oldOwner
+			}
+		}
+		if requester == self {
+			// via the store, so the rebirth is not requested again for the messages of the still unknown node
+			c.sm.RequestRebirth(edgeNode, fmt.Sprintf("ownership moved from instance %s to %s", oldOwner, newOwner))
+		}
+	}
+}
+
+// Opens the connection holding the STATE will if this instance is the leader of the cluster and closes it otherwise,
+// so a member leaving the cluster does not take the primary host OFFLINE unless it is the last one
+func (c *Client) updateStateOwner() {
+	leader := c.Active() && c.cluster.Leader().ID == c.cluster.ID()
+	c.mu.Lock()
+	stateClient := c.stateClient
+	stopping := c.stopping
+	c.mu.Unlock()
+
+	switch {
+	case stopping:
+	case leader && stateClient == nil:
+		logrus.Infof("Instance %s leads the cluster, publishing STATE of host %s", c.cluster.ID(), c.cfg.HostID)
+		c.connectState()
+	case !leader && stateClient != nil:
+		logrus.Infof("Instance %s no longer leads the cluster, handing over STATE of host %s", c.cluster.ID(), c.cfg.HostID)
+		c.mu.Lock()
+		c.stateClient = nil
+		c.statePublished = false
+		c.mu.Unlock()
+		// a clean disconnect does not trigger the will, so the STATE stays ONLINE for the new leader
+		stateClient.Disconnect(250)
+	}
+}
+
+// Connects the connection of the cluster leader holding the STATE will, retried by the next membership check if it fails
+func (c *Client) connectState() {
+	opts := c.clientOptions(c.cfg.ClientID + "-state")
+	// as specified in the Sparkplug B Specification
+	opts.SetWill(c.stateTopic(), stateOffline, 1, true)
+	opts.SetOnConnectHandler(func(client mqtt.Client) {
+		c.watchLeaderState(client)
+		c.publishOnline(client)
+	})
+	opts.SetConnectionLostHandler(func(client mqtt.Client, err error) {
+		logrus.Warnf("Lost STATE connection to MQTT broker: %v", err)
+		c.mu.Lock()
+		c.statePublished = false
+		c.mu.Unlock()
+	})
+
+	client := mqtt.NewClient(opts)
+	if token := client.Connect(); token.Wait() && token.Error() != nil {
+		logrus.Errorf("Failed to connect the STATE connection of host %s: %v", c.cfg.HostID, token.Error())
+		return
+	}
+	c.mu.Lock()
+	c.stateClient = client
+	c.mu.Unlock()
+}
+
+// Subscribes to the STATE of the primary host to republish ONLINE if the will of a previous leader fired
+func (c *Client) watchLeaderState(client mqtt.Client) {
+	token := client.Subscribe(c.stateTopic(), 1, func(client mqtt.Client, m mqtt.Message) {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if string(m.Payload()) != stateOffline || c.stopping {
+			return
+		}
+		logrus.Infof("STATE of host %s went OFFLINE while this instance leads the cluster, republishing ONLINE", c.cfg.HostID)
+		client.Publish(c.stateTopic(), 1, true, stateOnline)
+	})
+	token.Wait()
+	if token.Error() != nil {
+		logrus.Debug(token.Error())
+	}
+}
+
+// Leaves the cluster on shutdown: the other members take over the edge nodes of this instance right away,
+// and the STATE goes OFFLINE only if this instance is the last member
+func (c *Client) leaveCluster(client mqtt.Client, timeout time.Duration) {
+	c.reorder.close()
+	if client.IsConnected() {
+		token := client.Publish(c.cluster.HeartbeatTopic(), 1, false, c.cluster.Farewell())
+		if !token.WaitTimeout(timeout) || token.Error() != nil {
+			logrus.Warnf("Failed to announce leaving the cluster: %v", token.Error())
+		}
+	}
+
+	c.mu.Lock()
+	stateClient := c.stateClient
+	c.stateClient = nil
+	c.mu.Unlock()
+	if stateClient == nil {
+		return
+	}
+	if len(c.cluster.Members()) == 1 && stateClient.IsConnected() {
+		c.publishOffline(stateClient, timeout)
+	}
+	stateClient.Disconnect(250)
+}
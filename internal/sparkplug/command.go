@@ -0,0 +1,199 @@
+package sparkplug
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"time"
+
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/store"
+	"github.com/DATATRONiQ/go-sparkplug-primary/third_party/sparkplugb"
+	"google.golang.org/protobuf/proto"
+)
+
+// The node control metric requesting an edge node to republish its birth certificates
+const rebirthMetric = "Node Control/Rebirth"
+
+// Publishes an NCMD requesting the given edge node to republish its NBIRTH and DBIRTH messages
+func (c *Client) RequestRebirth(groupID, nodeID string) error {
+	metric := &sparkplugb.Payload_Metric{
+		Name:      proto.String(rebirthMetric),
+		Timestamp: proto.Uint64(uint64(time.Now().UnixMilli())),
+		Datatype:  proto.Uint32(uint32(sparkplugb.DataType_Boolean)),
+		Value:     &sparkplugb.Payload_Metric_BooleanValue{BooleanValue: true},
+	}
+	topic := fmt.Sprintf("%s/%s/%s/%s", namespace, groupID, store.NodeCommand, nodeID)
+	return c.publishCommand(topic, []*sparkplugb.Payload_Metric{metric})
+}
+
+// Returned if a metric of a command cannot be converted to its data type
+var ErrInvalidCommand = errors.New("invalid command")
+
+// The value range [min, max] of the integer data types
+var integerBounds = map[sparkplugb.DataType][2]*big.Int{
+	sparkplugb.DataType_Int8:   {big.NewInt(math.MinInt8), big.NewInt(math.MaxInt8)},
+	sparkplugb.DataType_Int16:  {big.NewInt(math.MinInt16), big.NewInt(math.MaxInt16)},
+	sparkplugb.DataType_Int32:  {big.NewInt(math.MinInt32), big.NewInt(math.MaxInt32)},
+	sparkplugb.DataType_Int64:  {big.NewInt(math.MinInt64), big.NewInt(math.MaxInt64)},
+	sparkplugb.DataType_UInt8:  {big.NewInt(0), big.NewInt(math.MaxUint8)},
+	sparkplugb.DataType_UInt16: {big.NewInt(0), big.NewInt(math.MaxUint16)},
+	sparkplugb.DataType_UInt32: {big.NewInt(0), big.NewInt(math.MaxUint32)},
+	sparkplugb.DataType_UInt64: {big.NewInt(0), new(big.Int).SetUint64(math.MaxUint64)},
+}
+
+// A metric written by a command
+type CommandMetric struct {
+	Name     string
+	DataType sparkplugb.DataType
+	// The value as decoded from JSON with numbers as json.Number (bool, json.Number or string), or an int64, uint64 or float64,
+	// converted to the data type
+	Value any
+}
+
+// Publishes an NCMD writing the given metrics of an edge node, or a DCMD if a device ID is given
+func (c *Client) SendCommand(groupID, nodeID, deviceID string, metrics []CommandMetric) error {
+	payloadMetrics := make([]*sparkplugb.Payload_Metric, 0, len(metrics))
+	for _, m := range metrics {
+		metric, err := commandMetric(m)
+		if err != nil {
+			return err
+		}
+		payloadMetrics = append(payloadMetrics, metric)
+	}
+
+	topic := fmt.Sprintf("%s/%s/%s/%s", namespace, groupID, store.NodeCommand, nodeID)
+	if deviceID != "" {
+		topic = fmt.Sprintf("%s/%s/%s/%s/%s", namespace, groupID, store.DeviceCommand, nodeID, deviceID)
+	}
+	return c.publishCommand(topic, payloadMetrics)
+}
+
+// Converts a command metric into a payload metric of its data type
+func commandMetric(m CommandMetric) (*sparkplugb.Payload_Metric, error) {
+	metric := &sparkplugb.Payload_Metric{
+		Name:      proto.String(m.Name),
+		Timestamp: proto.Uint64(uint64(time.Now().UnixMilli())),
+		Datatype:  proto.Uint32(uint32(m.DataType)),
+	}
+	if m.Value == nil {
+		metric.IsNull = proto.Bool(true)
+		return metric, nil
+	}
+
+	invalid := fmt.Errorf("%w: metric %s: invalid %s value %v", ErrInvalidCommand, m.Name, m.DataType, m.Value)
+	if bounds, ok := integerBounds[m.DataType]; ok {
+		i, ok := integerOf(m.Value)
+		if !ok || i.Cmp(bounds[0]) < 0 || i.Cmp(bounds[1]) > 0 {
+			return nil, invalid
+		}
+		switch m.DataType {
+		case sparkplugb.DataType_Int64:
+			metric.Value = &sparkplugb.Payload_Metric_LongValue{LongValue: uint64(i.Int64())}
+		case sparkplugb.DataType_UInt64:
+			metric.Value = &sparkplugb.Payload_Metric_LongValue{LongValue: i.Uint64()}
+		default:
+			// smaller signed integers are transmitted in two's complement
+			metric.Value = &sparkplugb.Payload_Metric_IntValue{IntValue: uint32(i.Int64())}
+		}
+		return metric, nil
+	}
+
+	switch m.DataType {
+	case sparkplugb.DataType_Boolean:
+		b, ok := m.Value.(bool)
+		if !ok {
+			return nil, invalid
+		}
+		metric.Value = &sparkplugb.Payload_Metric_BooleanValue{BooleanValue: b}
+	case sparkplugb.DataType_Double:
+		f, ok := floatOf(m.Value)
+		if !ok {
+			return nil, invalid
+		}
+		metric.Value = &sparkplugb.Payload_Metric_DoubleValue{DoubleValue: f}
+	case sparkplugb.DataType_Float:
+		f, ok := floatOf(m.Value)
+		if !ok || math.Abs(f) > math.MaxFloat32 {
+			return nil, invalid
+		}
+		metric.Value = &sparkplugb.Payload_Metric_FloatValue{FloatValue: float32(f)}
+	case sparkplugb.DataType_String, sparkplugb.DataType_UUID, sparkplugb.DataType_Text:
+		str, ok := m.Value.(string)
+		if !ok {
+			return nil, invalid
+		}
+		metric.Value = &sparkplugb.Payload_Metric_StringValue{StringValue: str}
+	default:
+		return nil, fmt.Errorf("%w: metric %s: unsupported data type %s", ErrInvalidCommand, m.Name, m.DataType)
+	}
+	return metric, nil
+}
+
+// Returns the exact integer of a command value, false if it is no whole number
+func integerOf(value any) (*big.Int, bool) {
+	switch v := value.(type) {
+	case json.Number:
+		if i, ok := new(big.Int).SetString(string(v), 10); ok {
+			return i, true
+		}
+		// e.g. 1e3 or 5.0
+		f, err := v.Float64()
+		if err != nil {
+			return nil, false
+		}
+		return integerOf(f)
+	case float64:
+		if math.IsNaN(v) || math.IsInf(v, 0) || v != math.Trunc(v) {
+			return nil, false
+		}
+		i, _ := big.NewFloat(v).Int(nil)
+		return i, true
+	case int64:
+		return big.NewInt(v), true
+	case uint64:
+		return new(big.Int).SetUint64(v), true
+	}
+	return nil, false
+}
+
+// Returns the floating point number of a command value
+func floatOf(value any) (float64, bool) {
+	switch v := value.(type) {
+	case json.Number:
+		f, err := v.Float64()
+		return f, err == nil
+	case float64:
+		return v, true
+	case int64:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	}
+	return 0, false
+}
+
+// Publishes a command payload with the given metrics. Only the active instance may publish commands.
+func (c *Client) publishCommand(topic string, metrics []*sparkplugb.Payload_Metric) error {
+	if !c.Active() {
+		return ErrStandby
+	}
+
+	payload := &sparkplugb.Payload{
+		Timestamp: proto.Uint64(uint64(time.Now().UnixMilli())),
+		Metrics:   metrics,
+	}
+	rawPayload, err := proto.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	// remembered before publishing, as the command may be received back before Publish returns
+	c.rememberCommand(topic, rawPayload)
+
+	// as specified in the Sparkplug B Specification, commands are published with QoS 0 and not retained
+	token := c.mqtt().Publish(topic, 0, false, rawPayload)
+	token.Wait()
+	return token.Error()
+}
@@ -0,0 +1,52 @@
+package sparkplug
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+
+	"github.com/DATATRONiQ/go-sparkplug-primary/third_party/sparkplugb"
+)
+
+func TestCommandMetricKeepsIntegersExact(t *testing.T) {
+	tests := []struct {
+		dataType sparkplugb.DataType
+		value    any
+		want     uint64
+	}{
+		{sparkplugb.DataType_Int64, json.Number("9007199254740993"), 9007199254740993},
+		{sparkplugb.DataType_Int64, json.Number("-9223372036854775808"), 1 << 63},
+		{sparkplugb.DataType_UInt64, json.Number("18446744073709551615"), math.MaxUint64},
+		{sparkplugb.DataType_UInt64, uint64(math.MaxUint64), math.MaxUint64},
+		{sparkplugb.DataType_Int64, int64(-1), math.MaxUint64},
+		{sparkplugb.DataType_Int64, json.Number("1e3"), 1000},
+	}
+	for _, test := range tests {
+		metric, err := commandMetric(CommandMetric{Name: "m", DataType: test.dataType, Value: test.value})
+		if err != nil {
+			t.Errorf("%s %v: %v", test.dataType, test.value, err)
+			continue
+		}
+		if got := metric.GetLongValue(); got != test.want {
+			t.Errorf("%s %v: got %d, want %d", test.dataType, test.value, got, test.want)
+		}
+	}
+}
+
+func TestCommandMetricRejectsInvalidIntegers(t *testing.T) {
+	tests := []struct {
+		dataType sparkplugb.DataType
+		value    any
+	}{
+		{sparkplugb.DataType_Int64, json.Number("9223372036854775808")},
+		{sparkplugb.DataType_UInt64, json.Number("-1")},
+		{sparkplugb.DataType_UInt8, json.Number("256")},
+		{sparkplugb.DataType_Int32, json.Number("1.5")},
+		{sparkplugb.DataType_Int32, "1"},
+	}
+	for _, test := range tests {
+		if _, err := commandMetric(CommandMetric{Name: "m", DataType: test.dataType, Value: test.value}); err == nil {
+			t.Errorf("%s %v: got no error", test.dataType, test.value)
+		}
+	}
+}
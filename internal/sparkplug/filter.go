@@ -0,0 +1,153 @@
+package sparkplug
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/store"
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/util"
+)
+
+// The sparkplug B topic namespace
+const namespace = "spBv1.0"
+
+// The node and device message types the primary subscribes to
+var nodeTypes = []store.Type{store.NodeBirth, store.NodeDeath, store.NodeData, store.NodeCommand}
+var deviceTypes = []store.Type{store.DeviceBirth, store.DeviceDeath, store.DeviceData, store.DeviceCommand}
+
+// Restricts the sparkplug messages consumed by the primary
+type TopicFilter struct {
+	Groups  []string // The group IDs to subscribe to (all groups if empty)
+	Filters []string // Raw MQTT topic filters to subscribe to instead of the per-group subscriptions
+	Exclude []string // Group IDs or MQTT topic filters whose messages are dropped
+}
+
+// Returns an error if any of the configured topic filters is invalid
+func (f TopicFilter) Validate() error {
+	for _, groupID := range f.Groups {
+		if groupID == "" || strings.ContainsAny(groupID, "/+#") {
+			return fmt.Errorf("invalid group ID %q", groupID)
+		}
+	}
+	for _, filter := range append(append([]string{}, f.Filters...), f.Exclude...) {
+		if err := validateTopicFilter(filter); err != nil {
+			return err
+		}
+	}
+	for _, exclude := range f.Exclude {
+		// excludes without a slash are group IDs, in which wildcards would never match
+		if !strings.Contains(exclude, "/") && strings.ContainsAny(exclude, "+#") {
+			return fmt.Errorf("invalid exclude %q: group IDs must not contain wildcards, use a topic filter like %s/+/#", exclude, namespace)
+		}
+	}
+	return nil
+}
+
+// Returns the MQTT subscriptions (topic filter -> QoS) for this filter
+func (f TopicFilter) subscriptions() map[string]byte {
+	subs := make(map[string]byte)
+	if len(f.Filters) > 0 {
+		for _, filter := range f.Filters {
+			subs[filter] = 1
+		}
+		return subs
+	}
+
+	groups := f.Groups
+	if len(groups) == 0 {
+		groups = []string{"+"}
+	}
+	for _, groupID := range groups {
+		for _, t := range nodeTypes {
+			subs[fmt.Sprintf("%s/%s/%s/+", namespace, groupID, t)] = 1
+		}
+		for _, t := range deviceTypes {
+			subs[fmt.Sprintf("%s/%s/%s/+/+", namespace, groupID, t)] = 1
+		}
+	}
+	return subs
+}
+
+// Returns true iff a message of the given topic and group should be consumed
+func (f TopicFilter) accepts(topic, groupID string) bool {
+	if len(f.Filters) > 0 && len(f.Groups) > 0 && !util.Contains(f.Groups, groupID) {
+		return false
+	}
+	for _, exclude := range f.Exclude {
+		if !strings.Contains(exclude, "/") {
+			if exclude == groupID {
+				return false
+			}
+			continue
+		}
+		if matchTopic(exclude, topic) {
+			return false
+		}
+	}
+	return true
+}
+
+// The prefix of MQTT shared subscriptions, "$share/<share name>/<topic filter>"
+const sharePrefix = "$share/"
+
+// Splits a shared subscription into its share name and topic filter, returns the filter unchanged if it is not shared
+func splitShared(filter string) (string, string, bool) {
+	if !strings.HasPrefix(filter, sharePrefix) {
+		return "", filter, false
+	}
+	rest := strings.TrimPrefix(filter, sharePrefix)
+	i := strings.Index(rest, "/")
+	if i < 0 {
+		return rest, "", true
+	}
+	return rest[:i], rest[i+1:], true
+}
+
+// Returns an error if the given string is not a valid MQTT topic filter (or group ID without slashes)
+func validateTopicFilter(filter string) error {
+	if filter == "" {
+		return fmt.Errorf("empty topic filter")
+	}
+	share, topicFilter, shared := splitShared(filter)
+	if shared {
+		if share == "" || strings.ContainsAny(share, "+#") {
+			return fmt.Errorf("invalid topic filter %q: the share name must not be empty or contain wildcards", filter)
+		}
+		if topicFilter == "" {
+			return fmt.Errorf("invalid topic filter %q: the shared subscription has no topic filter", filter)
+		}
+	}
+	levels := strings.Split(topicFilter, "/")
+	for i, level := range levels {
+		if strings.Contains(level, "#") && (level != "#" || i != len(levels)-1) {
+			return fmt.Errorf("invalid topic filter %q: '#' must be the last level", filter)
+		}
+		if strings.Contains(level, "+") && level != "+" {
+			return fmt.Errorf("invalid topic filter %q: '+' must occupy a whole level", filter)
+		}
+	}
+	return nil
+}
+
+// Returns true iff the topic matches the MQTT topic filter, which may be a shared subscription.
+// Like the broker, wildcards in the first level do not match topics starting with '$'.
+func matchTopic(filter, topic string) bool {
+	_, filter, _ = splitShared(filter)
+	filterLevels := strings.Split(filter, "/")
+	topicLevels := strings.Split(topic, "/")
+	if strings.HasPrefix(topic, "$") && (filterLevels[0] == "+" || filterLevels[0] == "#") {
+		return false
+	}
+	for i, level := range filterLevels {
+		if level == "#" {
+			return true
+		}
+		if i >= len(topicLevels) {
+			return false
+		}
+		if level != "+" && level != topicLevels[i] {
+			return false
+		}
+	}
+	return len(filterLevels) == len(topicLevels)
+}
@@ -0,0 +1,119 @@
+package sparkplug
+
+import "testing"
+
+func TestMatchTopic(t *testing.T) {
+	tests := []struct {
+		filter string
+		topic  string
+		want   bool
+	}{
+		{"spBv1.0/g1/NDATA/n1", "spBv1.0/g1/NDATA/n1", true},
+		{"spBv1.0/g1/NDATA/n1", "spBv1.0/g1/NDATA/n2", false},
+		{"spBv1.0/+/NDATA/+", "spBv1.0/g1/NDATA/n1", true},
+		{"spBv1.0/+/NDATA/+", "spBv1.0/g1/DDATA/n1/d1", false},
+		{"spBv1.0/+/NDATA/+", "spBv1.0/g1/NDATA", false},
+		{"spBv1.0/+/+/+/+", "spBv1.0/g1/DDATA/n1/d1", true},
+		{"spBv1.0/+", "spBv1.0/", true},
+		{"spBv1.0/g1/#", "spBv1.0/g1/DDATA/n1/d1", true},
+		{"spBv1.0/g1/#", "spBv1.0/g1", true},
+		{"spBv1.0/g1/#", "spBv1.0/g2/NDATA/n1", false},
+		{"#", "spBv1.0/g1/NDATA/n1", true},
+		{"+/#", "spBv1.0/STATE/primary", true},
+		{"#", "$SYS/broker/uptime", false},
+		{"+/broker/uptime", "$SYS/broker/uptime", false},
+		{"$SYS/#", "$SYS/broker/uptime", true},
+		{"$share/primaries/spBv1.0/+/NDATA/+", "spBv1.0/g1/NDATA/n1", true},
+		{"$share/primaries/spBv1.0/g2/#", "spBv1.0/g1/NDATA/n1", false},
+		{"$share/primaries/#", "spBv1.0/g1/NDATA/n1", true},
+	}
+	for _, test := range tests {
+		if got := matchTopic(test.filter, test.topic); got != test.want {
+			t.Errorf("matchTopic(%q, %q) = %t, want %t", test.filter, test.topic, got, test.want)
+		}
+	}
+}
+
+func TestValidateTopicFilter(t *testing.T) {
+	tests := []struct {
+		filter string
+		valid  bool
+	}{
+		{"spBv1.0/g1/NDATA/n1", true},
+		{"spBv1.0/+/NDATA/+", true},
+		{"spBv1.0/g1/#", true},
+		{"#", true},
+		{"+", true},
+		{"g1", true},
+		{"$share/primaries/spBv1.0/+/NDATA/+", true},
+		{"$share/primaries/#", true},
+		{"", false},
+		{"spBv1.0/g1/#/n1", false},
+		{"spBv1.0/g1#", false},
+		{"spBv1.0/g+/NDATA", false},
+		{"spBv1.0/++/NDATA", false},
+		{"$share/primaries", false},
+		{"$share/primaries/", false},
+		{"$share//spBv1.0/#", false},
+		{"$share/+/spBv1.0/#", false},
+		{"$share/primaries/spBv1.0/#/n1", false},
+	}
+	for _, test := range tests {
+		if err := validateTopicFilter(test.filter); (err == nil) != test.valid {
+			t.Errorf("validateTopicFilter(%q) = %v, want valid %t", test.filter, err, test.valid)
+		}
+	}
+}
+
+func TestTopicFilterValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		filter TopicFilter
+		valid  bool
+	}{
+		{"empty", TopicFilter{}, true},
+		{"groups", TopicFilter{Groups: []string{"g1", "g2"}}, true},
+		{"group with slash", TopicFilter{Groups: []string{"g1/n1"}}, false},
+		{"group with wildcard", TopicFilter{Groups: []string{"g+"}}, false},
+		{"empty group", TopicFilter{Groups: []string{""}}, false},
+		{"filters", TopicFilter{Filters: []string{"spBv1.0/g1/#", "$share/primaries/spBv1.0/+/NDATA/+"}}, true},
+		{"invalid filter", TopicFilter{Filters: []string{"spBv1.0/#/NDATA"}}, false},
+		{"exclude group", TopicFilter{Exclude: []string{"g1"}}, true},
+		{"exclude filter", TopicFilter{Exclude: []string{"spBv1.0/+/DDATA/+/+"}}, true},
+		{"exclude group with wildcard", TopicFilter{Exclude: []string{"g#"}}, false},
+		{"exclude wildcard without slash", TopicFilter{Exclude: []string{"+"}}, false},
+		{"invalid exclude filter", TopicFilter{Exclude: []string{"spBv1.0/g+"}}, false},
+	}
+	for _, test := range tests {
+		if err := test.filter.Validate(); (err == nil) != test.valid {
+			t.Errorf("%s: Validate() = %v, want valid %t", test.name, err, test.valid)
+		}
+	}
+}
+
+func TestTopicFilterAccepts(t *testing.T) {
+	tests := []struct {
+		name   string
+		filter TopicFilter
+		topic  string
+		group  string
+		want   bool
+	}{
+		{"no filter", TopicFilter{}, "spBv1.0/g1/NDATA/n1", "g1", true},
+		{"subscribed group", TopicFilter{Groups: []string{"g1"}}, "spBv1.0/g1/NDATA/n1", "g1", true},
+		{"raw filter restricted to groups", TopicFilter{Groups: []string{"g1"}, Filters: []string{"spBv1.0/#"}}, "spBv1.0/g2/NDATA/n1", "g2", false},
+		{"raw filter of a group", TopicFilter{Groups: []string{"g1"}, Filters: []string{"spBv1.0/#"}}, "spBv1.0/g1/NDATA/n1", "g1", true},
+		{"excluded group", TopicFilter{Exclude: []string{"g1"}}, "spBv1.0/g1/NDATA/n1", "g1", false},
+		{"other group", TopicFilter{Exclude: []string{"g1"}}, "spBv1.0/g2/NDATA/n1", "g2", true},
+		{"excluded by +", TopicFilter{Exclude: []string{"spBv1.0/+/DDATA/+/+"}}, "spBv1.0/g1/DDATA/n1/d1", "g1", false},
+		{"not excluded by +", TopicFilter{Exclude: []string{"spBv1.0/+/DDATA/+/+"}}, "spBv1.0/g1/NDATA/n1", "g1", true},
+		{"excluded by #", TopicFilter{Exclude: []string{"spBv1.0/g1/#"}}, "spBv1.0/g1/NBIRTH/n1", "g1", false},
+		{"excluded by shared filter", TopicFilter{Exclude: []string{"$share/primaries/spBv1.0/g1/#"}}, "spBv1.0/g1/NDATA/n1", "g1", false},
+		{"not excluded by shared filter", TopicFilter{Exclude: []string{"$share/primaries/spBv1.0/g1/#"}}, "spBv1.0/g2/NDATA/n1", "g2", true},
+	}
+	for _, test := range tests {
+		if got := test.filter.accepts(test.topic, test.group); got != test.want {
+			t.Errorf("%s: accepts(%q) = %t, want %t", test.name, test.topic, got, test.want)
+		}
+	}
+}
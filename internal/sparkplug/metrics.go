@@ -0,0 +1,31 @@
+package sparkplug
+
+import (
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	messagesReceived  = promauto.NewCounterVec(prometheus.CounterOpts{Name: "sparkplug_primary_messages_received_total", Help: "Sparkplug messages received by type"}, []string{"type"})
+	unmarshalFailures = promauto.NewCounterVec(prometheus.CounterOpts{Name: "sparkplug_primary_unmarshal_failures_total", Help: "Sparkplug messages whose payload could not be unmarshalled by type"}, []string{"type"})
+)
+
+// Registers the gauges of the MQTT connection, which are computed when scraped
+func (c *Client) registerMetrics() {
+	metrics.NewGaugeFunc("sparkplug_primary_mqtt_connected", "1 if the client is connected to the MQTT broker, 0 otherwise", nil,
+		func(emit func(v float64, labelValues ...string)) {
+			emit(boolValue(c.IsConnected()))
+		})
+	metrics.NewGaugeFunc("sparkplug_primary_active", "1 if this instance is the active primary host publishing STATE, 0 if it is standby", nil,
+		func(emit func(v float64, labelValues ...string)) {
+			emit(boolValue(c.Active()))
+		})
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
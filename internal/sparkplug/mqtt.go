@@ -1,115 +1,711 @@
 package sparkplug
 
 import (
+	"crypto/sha256"
+	"errors"
 	"fmt"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/audit"
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/cluster"
 	"github.com/DATATRONiQ/go-sparkplug-primary/internal/store"
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/util"
 	"github.com/DATATRONiQ/go-sparkplug-primary/third_party/sparkplugb"
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 	"github.com/sirupsen/logrus"
 	"google.golang.org/protobuf/proto"
 )
 
-func StartMQTTClient(endpoint, clientID, hostID, user, pass string, msgChan chan<- store.Message) {
+// Returned when publishing is attempted by a standby instance
+var ErrStandby = errors.New("primary host is in standby")
+
+// Returned when connecting after the client was stopped
+var errStopping = errors.New("client is stopping")
+
+// The delays between the attempts of a standby to reconnect as active primary host, doubled after every failed attempt
+const (
+	takeoverInitialBackoff = time.Second
+	takeoverMaxBackoff     = 30 * time.Second
+)
+
+// The version of the Sparkplug B Specification implemented, e.g. with plain text STATE payloads
+const SpecVersion = "2.2"
+
+// The payloads of the STATE message as specified in the Sparkplug B Specification
+const (
+	stateOnline  = "ONLINE"
+	stateOffline = "OFFLINE"
+)
+
+// The settings of the MQTT connection
+type MQTTConfig struct {
+	Endpoints []string // The brokers, tried in order
+	ClientID  string
+	HostID    string // The primary host ID used for the STATE topic
+	Username  string
+	Password  string
+	Filter    TopicFilter // The initial topic filter, see SetFilter
+
+	// If true, the instance starts as standby: it consumes all messages to keep a warm store,
+	// but only publishes STATE after the active instance's STATE went OFFLINE
+	// or no active instance was seen for TakeoverDelay.
+	Standby       bool
+	TakeoverDelay time.Duration
+}
+
+// A sparkplug primary host connection to the MQTT broker
+type Client struct {
+	cfg     MQTTConfig
+	cluster *cluster.Cluster
+	sm      *store.StoreManager
+	audit   *audit.Log
+	msgChan chan<- store.Message
+
+	mu             sync.Mutex
+	client         mqtt.Client
+	active         bool
+	stopping       bool           // set by Stop, after which nothing is published but the shutdown messages
+	takingOver     sync.WaitGroup // the running takeover, waited for by Stop
+	pendingEchoes  int
+	takeover       *time.Timer
+	subscribed     bool                            // whether the broker acknowledged the sparkplug subscriptions of the current connection
+	statePublished bool                            // whether STATE ONLINE was published on the current connection
+	reconnecting   bool                            // whether the connection was lost, so the state of all edge nodes is unknown
+	currentFilter  atomic.Value                    // TopicFilter, replaced on configuration reload
+	ownCommands    map[[sha256.Size]byte]time.Time // the commands recently published by this instance
+
+	// the handlers called for every received message, see AddMessageHandler
+	messageHandlers   atomic.Value // []func(RawMessage)
+	messageHandlersMu sync.Mutex
+
+	// the state of a cluster member, see cluster.go
+	reorder           *reorderer
+	stateClient       mqtt.Client                 // the connection holding the STATE will, only opened by the leader
+	members           []cluster.Member            // the members at the last membership check
+	membershipChanged chan struct{}               // signals the heartbeat loop to check the members
+	heartbeatsStopped chan struct{}               // closed when the heartbeat loop returned
+	seen              map[store.EdgeNode]struct{} // the edge nodes messages were received of, owned or not
+	seenMu            sync.Mutex
+
+	// guards msgChan, so no message is sent after Stop returned
+	sendMu  sync.RWMutex
+	stopped bool
+	done    chan struct{}
+}
+
+// Connects to the MQTT broker and passes all received sparkplug messages to the store, returning an error if the connection fails.
+// If a cluster is given, the sparkplug topics are consumed via shared subscriptions and
+// messages of edge nodes owned by other instances are forwarded to them.
+// Commands of other hosts and the rebirth requests of this instance are recorded in the audit log.
+func StartMQTTClient(cfg MQTTConfig, cl *cluster.Cluster, sm *store.StoreManager, auditLog *audit.Log, msgChan chan<- store.Message) (*Client, error) {
+	c := &Client{
+		cfg:         cfg,
+		cluster:     cl,
+		sm:          sm,
+		audit:       auditLog,
+		msgChan:     msgChan,
+		active:      !cfg.Standby,
+		ownCommands: make(map[[sha256.Size]byte]time.Time),
+		done:        make(chan struct{}),
+	}
+	c.currentFilter.Store(cfg.Filter)
+	if cl != nil {
+		c.reorder = newReorderer(cl.ReorderTimeout, c.handleMessage)
+		c.members = cl.Members()
+		c.membershipChanged = make(chan struct{}, 1)
+		c.heartbeatsStopped = make(chan struct{})
+		c.seen = make(map[store.EdgeNode]struct{})
+	}
+
+	sm.SetRebirthHandler(func(groupID, nodeID, reason string) bool {
+		if !c.Active() {
+			return false
+		}
+		logrus.Infof("Requesting rebirth of node %s in group %s: %s", nodeID, groupID, reason)
+		err := c.RequestRebirth(groupID, nodeID)
+		c.auditRebirth(groupID, nodeID, reason, err)
+		if err != nil {
+			logrus.Warnf("Failed to request rebirth of node %s in group %s: %v", nodeID, groupID, err)
+			return false
+		}
+		return true
+	})
+
+	if err := c.connect(); err != nil {
+		return nil, err
+	}
+	c.registerMetrics()
+	if cl != nil {
+		go func() {
+			defer close(c.heartbeatsStopped)
+			c.publishHeartbeats()
+		}()
+	}
+	return c, nil
+}
+
+// A sparkplug message of an edge node or device as received from the broker
+type RawMessage struct {
+	Topic      string
+	GroupID    string
+	Type       store.Type
+	NodeID     string
+	DeviceID   string // Empty for messages of the node
+	Payload    []byte
+	ReceivedAt time.Time
+}
+
+// Adds a handler called for every message accepted by the topic filter, before its payload is unmarshalled.
+// It is called by the MQTT client while receiving, so it must be fast and must not modify the payload.
+func (c *Client) AddMessageHandler(handler func(RawMessage)) {
+	c.messageHandlersMu.Lock()
+	defer c.messageHandlersMu.Unlock()
+	handlers, _ := c.messageHandlers.Load().([]func(RawMessage))
+	c.messageHandlers.Store(append(append([]func(RawMessage){}, handlers...), handler))
+}
+
+// Returns true iff this instance is the active primary host publishing STATE
+func (c *Client) Active() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.active
+}
+
+// Publishes a message to the broker without waiting for its acknowledgement. Only the active instance may publish,
+// so a standby does not duplicate the messages of the active one.
+func (c *Client) Publish(topic string, qos byte, retained bool, payload []byte) error {
+	if !c.Active() {
+		return ErrStandby
+	}
+	token := c.mqtt().Publish(topic, qos, retained, payload)
+	select {
+	case <-token.Done():
+		// e.g. not connected
+		return token.Error()
+	default:
+		return nil
+	}
+}
+
+// The state of the connection to the MQTT broker
+type Status struct {
+	Endpoints      []string `json:"endpoints"`      // The configured brokers, tried in order
+	ClientID       string   `json:"clientId"`       // The MQTT client ID
+	HostID         string   `json:"hostId"`         // The primary host ID of the STATE topic
+	Connected      bool     `json:"connected"`      // Whether the client is connected to a broker
+	Subscribed     bool     `json:"subscribed"`     // Whether the broker acknowledged the sparkplug subscriptions
+	Active         bool     `json:"active"`         // Whether this instance is the active primary host, false for a standby
+	StateOwner     bool     `json:"stateOwner"`     // Whether this instance publishes STATE, false for a standby and cluster members but the leader
+	StatePublished bool     `json:"statePublished"` // Whether the STATE owner published STATE ONLINE
+}
+
+// Returns the current state of the connection to the MQTT broker
+func (c *Client) Status() Status {
+	connected := c.IsConnected()
+	leader := c.cluster == nil || c.cluster.Leader().ID == c.cluster.ID()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stateOwner := c.active && leader
+	stateConnected := connected
+	if c.cluster != nil {
+		stateConnected = c.stateClient != nil && c.stateClient.IsConnectionOpen()
+	}
+	return Status{
+		Endpoints:      c.cfg.Endpoints,
+		ClientID:       c.cfg.ClientID,
+		HostID:         c.cfg.HostID,
+		Connected:      connected,
+		Subscribed:     connected && c.subscribed,
+		Active:         c.active,
+		StateOwner:     stateOwner,
+		StatePublished: stateConnected && stateOwner && c.statePublished,
+	}
+}
+
+// Returns true iff the client is currently connected to the MQTT broker
+func (c *Client) IsConnected() bool {
+	// IsConnected of the MQTT client is also true while reconnecting
+	return c.mqtt().IsConnectionOpen()
+}
+
+func (c *Client) mqtt() mqtt.Client {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.client
+}
+
+func (c *Client) stateTopic() string {
+	return fmt.Sprintf("STATE/%s", c.cfg.HostID)
+}
+
+// Returns the options of a connection to the configured brokers with the given client ID
+func (c *Client) clientOptions(clientID string) *mqtt.ClientOptions {
 	opts := mqtt.NewClientOptions()
-	opts.AddBroker(endpoint)
-	if user != "" {
-		opts.SetUsername(user)
-		opts.SetPassword(pass)
+	for _, endpoint := range c.cfg.Endpoints {
+		opts.AddBroker(endpoint)
+	}
+	if c.cfg.Username != "" {
+		opts.SetUsername(c.cfg.Username)
+		opts.SetPassword(c.cfg.Password)
 	}
 	opts.SetClientID(clientID)
+	return opts
+}
 
-	stateTopic := fmt.Sprintf("STATE/%s", hostID)
-	// as specified in the Sparkplug B Specification
-	opts.SetWill(stateTopic, "OFFLINE", 1, true)
-
-	opts.SetOnConnectHandler(func(c mqtt.Client) {
-		logrus.Debug("Connected to MQTT broker")
+// Creates and connects a new MQTT client. Only the active instance registers the STATE will,
+// in a cluster the leader holds it on a separate connection and this one announces leaving the cluster instead.
+func (c *Client) connect() error {
+	opts := c.clientOptions(c.cfg.ClientID)
+	switch {
+	case c.cluster != nil:
+		opts.SetWill(c.cluster.HeartbeatTopic(), string(c.cluster.Farewell()), 1, false)
+	case c.Active():
 		// as specified in the Sparkplug B Specification
-		c.Publish(stateTopic, 1, true, "ONLINE")
+		opts.SetWill(c.stateTopic(), stateOffline, 1, true)
+	}
 
-		nodeTopics := map[string]byte{
-			fmt.Sprintf("spBv1.0/+/%s/+", store.NodeBirth):   1,
-			fmt.Sprintf("spBv1.0/+/%s/+", store.NodeDeath):   1,
-			fmt.Sprintf("spBv1.0/+/%s/+", store.NodeData):    1,
-			fmt.Sprintf("spBv1.0/+/%s/+", store.NodeCommand): 1,
-		}
+	opts.SetOnConnectHandler(c.onConnect)
+	opts.SetConnectionLostHandler(c.onConnectionLost)
 
-		token := c.SubscribeMultiple(nodeTopics, func(c mqtt.Client, m mqtt.Message) {
-			logrus.Debug("node message received")
+	// the client is set before connecting, as messages may be received before Connect returns
+	client := mqtt.NewClient(opts)
+	c.mu.Lock()
+	if c.stopping {
+		c.mu.Unlock()
+		return errStopping
+	}
+	c.client = client
+	c.mu.Unlock()
 
-			if m.Payload() == nil {
-				logrus.Warnf("Payload is nil for %s\n", m.Topic())
-				return
-			}
+	if token := client.Connect(); token.Wait() && token.Error() != nil {
+		return token.Error()
+	}
+	return nil
+}
 
-			topicParts := strings.Split(m.Topic(), "/")
+func (c *Client) onConnect(client mqtt.Client) {
+	logrus.Debug("Connected to MQTT broker")
+	c.resetStatus()
 
-			var payload sparkplugb.Payload
-			err := proto.Unmarshal(m.Payload(), &payload)
-			if err != nil {
-				logrus.Errorf("Failed to unmarshal node message payload of topic %s: %v", m.Topic(), err)
-				return
-			}
+	if c.cfg.Standby {
+		c.watchState(client)
+	}
+	if c.Active() && c.cluster == nil {
+		c.publishOnline(client)
+	}
+
+	if c.cluster != nil {
+		c.subscribeCluster(client)
+	}
+
+	if err := c.subscribe(client, c.filter()); err != nil {
+		logrus.Errorf("Failed to subscribe to the sparkplug topics: %v", err)
+		return
+	}
+	c.mu.Lock()
+	c.subscribed = true
+	reconnected := c.reconnecting
+	c.reconnecting = false
+	active := c.active
+	c.mu.Unlock()
+
+	// messages may have been missed while disconnected
+	if reconnected && active {
+		c.rebirthAll(store.CausePrimaryReconnected)
+	}
+}
+
+func (c *Client) onConnectionLost(client mqtt.Client, err error) {
+	logrus.Warnf("Lost connection to MQTT broker: %v", err)
+	c.resetStatus()
+	c.mu.Lock()
+	c.reconnecting = true
+	c.mu.Unlock()
+	c.sm.Disconnected()
+}
+
+// Resets the state of the subscriptions and STATE of the previous connection
+func (c *Client) resetStatus() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.subscribed = false
+	if c.cluster == nil {
+		c.statePublished = false
+	}
+}
 
-			msgChan <- store.Message{
-				ReceivedAt: time.Now(),
-				GroupID:    topicParts[1],
-				Type:       store.Type(topicParts[2]),
-				NodeID:     topicParts[3],
-				Payload:    &payload,
+// Returns the MQTT subscriptions of the given filter, as shared subscriptions if running in a cluster
+func (c *Client) topics(filter TopicFilter) map[string]byte {
+	topics := filter.subscriptions()
+	if c.cluster != nil {
+		sharedTopics := make(map[string]byte, len(topics))
+		for topic, qos := range topics {
+			if _, _, shared := splitShared(topic); shared {
+				sharedTopics[topic] = qos
+				continue
 			}
-		})
+			sharedTopics[c.cluster.SharedTopic(topic)] = qos
+		}
+		topics = sharedTopics
+	}
+	return topics
+}
+
+// Subscribes to the sparkplug topics of the given filter, returning an error if the broker rejected any of them
+func (c *Client) subscribe(client mqtt.Client, filter TopicFilter) error {
+	topics := c.topics(filter)
+	token := client.SubscribeMultiple(topics, c.onMessage)
+	token.Wait()
+	if err := subscribeError(token); err != nil {
+		return err
+	}
+	logrus.Debugf("Subscribed to %v", util.SortedKeys(topics))
+	return nil
+}
+
+// Returns the error of a subscription, including the topics rejected by the broker with return code 0x80
+func subscribeError(token mqtt.Token) error {
+	if token.Error() != nil {
+		return token.Error()
+	}
+	subscribeToken, ok := token.(*mqtt.SubscribeToken)
+	if !ok {
+		return nil
+	}
+	rejected := make([]string, 0)
+	for topic, code := range subscribeToken.Result() {
+		if code == 0x80 {
+			rejected = append(rejected, topic)
+		}
+	}
+	if len(rejected) > 0 {
+		sort.Strings(rejected)
+		return fmt.Errorf("broker rejected subscriptions %v", rejected)
+	}
+	return nil
+}
+
+func (c *Client) onMessage(client mqtt.Client, m mqtt.Message) {
+	if c.cluster != nil {
+		c.receiveShared(client, m.Topic(), m.Payload())
+		return
+	}
+	c.handleMessage(m.Topic(), m.Payload())
+}
+
+// Returns the current topic filter
+func (c *Client) filter() TopicFilter {
+	return c.currentFilter.Load().(TopicFilter)
+}
+
+// Replaces the topic filter without reconnecting: subscriptions no longer needed are removed
+// and new ones are added, so the MQTT session and STATE are kept.
+func (c *Client) SetFilter(filter TopicFilter) error {
+	if err := filter.Validate(); err != nil {
+		return err
+	}
+
+	oldTopics := c.topics(c.filter())
+	newTopics := c.topics(filter)
+	c.currentFilter.Store(filter)
+
+	client := c.mqtt()
+	if !client.IsConnected() {
+		// the new filter is subscribed to when connecting
+		return nil
+	}
+
+	removed := make([]string, 0)
+	for topic := range oldTopics {
+		if _, ok := newTopics[topic]; !ok {
+			removed = append(removed, topic)
+		}
+	}
+	if len(removed) > 0 {
+		token := client.Unsubscribe(removed...)
 		token.Wait()
 		if token.Error() != nil {
-			logrus.Debug(token.Error())
+			return token.Error()
 		}
-		logrus.Debug("Subscribed to node messages")
+		logrus.Infof("Unsubscribed from %v", removed)
+	}
 
-		deviceTopics := map[string]byte{
-			fmt.Sprintf("spBv1.0/+/%s/+/+", store.DeviceBirth):   1,
-			fmt.Sprintf("spBv1.0/+/%s/+/+", store.DeviceDeath):   1,
-			fmt.Sprintf("spBv1.0/+/%s/+/+", store.DeviceData):    1,
-			fmt.Sprintf("spBv1.0/+/%s/+/+", store.DeviceCommand): 1,
+	added := make(map[string]byte)
+	for topic, qos := range newTopics {
+		if _, ok := oldTopics[topic]; !ok {
+			added[topic] = qos
 		}
+	}
+	if len(added) > 0 {
+		token := client.SubscribeMultiple(added, c.onMessage)
+		token.Wait()
+		if err := subscribeError(token); err != nil {
+			return err
+		}
+		logrus.Infof("Subscribed to %v", util.SortedKeys(added))
+	}
+	return nil
+}
 
-		token = c.SubscribeMultiple(deviceTopics, func(c mqtt.Client, m mqtt.Message) {
-			logrus.Debug("device message received")
+// Publishes the retained STATE ONLINE message as specified in the Sparkplug B Specification, unless the client is stopping
+func (c *Client) publishOnline(client mqtt.Client) {
+	c.mu.Lock()
+	if c.stopping {
+		c.mu.Unlock()
+		return
+	}
+	if c.cfg.Standby {
+		c.pendingEchoes++
+	}
+	// published with the lock held, so it is queued before the STATE OFFLINE of Stop
+	token := client.Publish(c.stateTopic(), 1, true, stateOnline)
+	c.mu.Unlock()
+	token.Wait()
+	if token.Error() != nil {
+		logrus.Errorf("Failed to publish STATE ONLINE for host %s: %v", c.cfg.HostID, token.Error())
+		return
+	}
+	c.mu.Lock()
+	c.statePublished = true
+	c.mu.Unlock()
+}
 
-			if m.Payload() == nil {
-				logrus.Warnf("Payload is nil for %s\n", m.Topic())
-				return
-			}
+// Subscribes to the STATE topic of the primary host ID to detect the death of the active instance
+func (c *Client) watchState(client mqtt.Client) {
+	c.mu.Lock()
+	if !c.active {
+		// take over if no active instance announces itself
+		c.scheduleTakeover()
+	}
+	c.mu.Unlock()
 
-			topicParts := strings.Split(m.Topic(), "/")
+	token := client.Subscribe(c.stateTopic(), 1, func(client mqtt.Client, m mqtt.Message) {
+		state := string(m.Payload())
 
-			var payload sparkplugb.Payload
-			err := proto.Unmarshal(m.Payload(), &payload)
-			if err != nil {
-				logrus.Errorf("Failed to unmarshal node message payload of topic %s: %v", m.Topic(), err)
-				return
+		c.mu.Lock()
+		defer c.mu.Unlock()
+
+		if c.active {
+			switch {
+			case state == stateOnline && c.pendingEchoes > 0:
+				c.pendingEchoes--
+			case state == stateOnline:
+				logrus.Warnf("Another instance published STATE %s for host %s while this instance is active", state, c.cfg.HostID)
+			case state == stateOffline && c.stopping:
+			case state == stateOffline:
+				// e.g. the delayed will of the previously active instance
+				logrus.Infof("STATE of host %s went OFFLINE while this instance is active, republishing ONLINE", c.cfg.HostID)
+				c.pendingEchoes++
+				client.Publish(c.stateTopic(), 1, true, stateOnline)
 			}
+			return
+		}
 
-			msgChan <- store.Message{
-				ReceivedAt: time.Now(),
-				GroupID:    topicParts[1],
-				Type:       store.Type(topicParts[2]),
-				NodeID:     topicParts[3],
-				DeviceID:   topicParts[4],
-				Payload:    &payload,
+		switch state {
+		case stateOnline:
+			logrus.Infof("Primary host %s is active on another instance, staying standby", c.cfg.HostID)
+			if c.takeover != nil {
+				c.takeover.Stop()
+				c.takeover = nil
 			}
-		})
-		token.Wait()
-		if token.Error() != nil {
-			logrus.Debug(token.Error())
+		case stateOffline:
+			logrus.Warnf("Primary host %s went OFFLINE, taking over in %v", c.cfg.HostID, c.cfg.TakeoverDelay)
+			c.scheduleTakeover()
 		}
-		logrus.Debug("Subscribed to device messages")
 	})
+	token.Wait()
+	if token.Error() != nil {
+		logrus.Debug(token.Error())
+	}
+}
 
-	client := mqtt.NewClient(opts)
-	if token := client.Connect(); token.Wait() && token.Error() != nil {
-		panic(token.Error())
+// Schedules the takeover after the takeover delay. Must be called with the lock held.
+func (c *Client) scheduleTakeover() {
+	if c.takeover != nil {
+		c.takeover.Stop()
+	}
+	c.takeover = time.AfterFunc(c.cfg.TakeoverDelay, c.takeOver)
+}
+
+// Makes this instance the active primary host: it reconnects with the STATE will,
+// publishes STATE ONLINE and requests rebirths of all known edge nodes
+func (c *Client) takeOver() {
+	c.mu.Lock()
+	if c.active || c.stopping {
+		c.mu.Unlock()
+		return
+	}
+	c.active = true
+	c.takeover = nil
+	old := c.client
+	c.takingOver.Add(1)
+	c.mu.Unlock()
+	defer c.takingOver.Done()
+
+	logrus.Infof("Taking over as active primary host %s", c.cfg.HostID)
+
+	// the will can only be set when connecting, so the client reconnects
+	old.Disconnect(250)
+	for backoff := takeoverInitialBackoff; ; backoff *= 2 {
+		err := c.connect()
+		if err == errStopping {
+			return
+		}
+		if err == nil {
+			break
+		}
+		if backoff > takeoverMaxBackoff {
+			backoff = takeoverMaxBackoff
+		}
+		logrus.Errorf("Failed to reconnect as active primary host %s, retrying in %v: %v", c.cfg.HostID, backoff, err)
+		select {
+		case <-time.After(backoff):
+		case <-c.done:
+			return
+		}
+	}
+	c.rebirthAll("takeover as active primary host")
+}
+
+// Requests rebirths of all edge nodes in the store for the given reason
+func (c *Client) rebirthAll(reason string) {
+	for _, edgeNode := range c.sm.EdgeNodes() {
+		err := c.RequestRebirth(edgeNode.GroupID, edgeNode.NodeID)
+		c.auditRebirth(edgeNode.GroupID, edgeNode.NodeID, reason, err)
+		if err != nil {
+			logrus.Warnf("Failed to request rebirth of node %s in group %s: %v", edgeNode.NodeID, edgeNode.GroupID, err)
+		}
+	}
+}
+
+// Stops sending received messages to the store, so the message channel can be closed and drained while the client
+// is still connected, e.g. for the unified namespace bridge publishing the resulting values. In a cluster, the messages
+// waiting for missing sequence numbers are sent first.
+func (c *Client) StopReceiving() {
+	if c.reorder != nil {
+		c.reorder.close()
+	}
+	c.sendMu.Lock()
+	c.stopped = true
+	c.sendMu.Unlock()
+}
+
+// Stops the client: the active instance explicitly publishes STATE OFFLINE before disconnecting,
+// as a clean disconnect does not trigger the will. After Stop returns, no more messages are sent to the store,
+// so the message channel can be closed.
+func (c *Client) Stop(timeout time.Duration) {
+	c.mu.Lock()
+	c.stopping = true
+	if c.takeover != nil {
+		c.takeover.Stop()
+		c.takeover = nil
+	}
+	c.mu.Unlock()
+
+	close(c.done)
+	// a takeover already running may have reconnected, so STATE OFFLINE is published on its connection
+	c.takingOver.Wait()
+	c.mu.Lock()
+	active := c.active
+	client := c.client
+	c.mu.Unlock()
+	if c.cluster != nil {
+		<-c.heartbeatsStopped
+		c.leaveCluster(client, timeout)
+	} else if active && client.IsConnected() {
+		c.publishOffline(client, timeout)
+	}
+	client.Disconnect(250)
+
+	c.sendMu.Lock()
+	c.stopped = true
+	c.sendMu.Unlock()
+}
+
+// Publishes the retained STATE OFFLINE message on shutdown
+func (c *Client) publishOffline(client mqtt.Client, timeout time.Duration) {
+	token := client.Publish(c.stateTopic(), 1, true, stateOffline)
+	if !token.WaitTimeout(timeout) {
+		logrus.Warnf("Timed out publishing STATE OFFLINE for host %s", c.cfg.HostID)
+	} else if token.Error() != nil {
+		logrus.Warnf("Failed to publish STATE OFFLINE for host %s: %v", c.cfg.HostID, token.Error())
+	} else {
+		logrus.Infof("Published STATE OFFLINE for host %s", c.cfg.HostID)
+	}
+}
+
+// Parses a node or device message and passes it to the store
+func (c *Client) handleMessage(topic string, rawPayload []byte) {
+	topicParts := strings.Split(topic, "/")
+	if len(topicParts) < 4 || len(topicParts) > 5 || topicParts[0] != namespace {
+		logrus.Debugf("Ignoring message of non sparkplug topic %s", topic)
+		return
+	}
+
+	msgType := store.Type(topicParts[2])
+	isNode := len(topicParts) == 4 && util.Contains(nodeTypes, msgType)
+	isDevice := len(topicParts) == 5 && util.Contains(deviceTypes, msgType)
+	if !isNode && !isDevice {
+		logrus.Debugf("Ignoring message of unknown topic %s", topic)
+		return
+	}
+
+	if !c.filter().accepts(topic, topicParts[1]) {
+		logrus.Tracef("Ignoring message of excluded topic %s", topic)
+		return
+	}
+
+	logrus.Debugf("%s message received", msgType)
+	messagesReceived.WithLabelValues(string(msgType)).Inc()
+
+	receivedAt := time.Now()
+	if handlers, _ := c.messageHandlers.Load().([]func(RawMessage)); len(handlers) > 0 {
+		raw := RawMessage{Topic: topic, GroupID: topicParts[1], Type: msgType, NodeID: topicParts[3], Payload: rawPayload, ReceivedAt: receivedAt}
+		if isDevice {
+			raw.DeviceID = topicParts[4]
+		}
+		for _, handler := range handlers {
+			handler(raw)
+		}
+	}
+
+	if rawPayload == nil {
+		logrus.Warnf("Payload is nil for %s\n", topic)
+		return
+	}
+
+	var payload sparkplugb.Payload
+	err := proto.Unmarshal(rawPayload, &payload)
+	if err != nil {
+		logrus.Errorf("Failed to unmarshal message payload of topic %s: %v", topic, err)
+		unmarshalFailures.WithLabelValues(string(msgType)).Inc()
+		return
+	}
+
+	msg := store.Message{
+		ReceivedAt: receivedAt,
+		GroupID:    topicParts[1],
+		Type:       msgType,
+		NodeID:     topicParts[3],
+		Payload:    &payload,
+	}
+	if isDevice {
+		msg.DeviceID = topicParts[4]
+	}
+
+	if (msgType == store.NodeCommand || msgType == store.DeviceCommand) && !c.ownCommand(topic, rawPayload) {
+		c.auditCommand(msg)
+	}
+
+	c.sendMu.RLock()
+	defer c.sendMu.RUnlock()
+	if c.stopped {
+		logrus.Debugf("Dropping %s message of %s received during shutdown", msgType, topic)
+		return
 	}
+	c.msgChan <- msg
 }
@@ -0,0 +1,274 @@
+package sparkplug
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/audit"
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/cluster"
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/store"
+	"github.com/DATATRONiQ/go-sparkplug-primary/third_party/sparkplugb"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	mochi "github.com/mochi-mqtt/server/v2"
+	mochiauth "github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/listeners"
+	"github.com/rs/zerolog"
+	"google.golang.org/protobuf/proto"
+)
+
+// The time the tests wait for the clients to react to a message
+const reactionTimeout = 5 * time.Second
+
+// Starts an in-process MQTT broker supporting shared subscriptions and returns its URL
+func startBroker(t *testing.T) string {
+	t.Helper()
+	// the listener does not report the port it bound to, so a free port is picked beforehand
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := l.Addr().String()
+	l.Close()
+
+	logger := zerolog.Nop()
+	// the defaults are modified by every new broker, while the broker of the last test may still be closing
+	capabilities := *mochi.DefaultServerCapabilities
+	broker := mochi.New(&mochi.Options{Logger: &logger, Capabilities: &capabilities})
+	if err := broker.AddHook(new(mochiauth.AllowHook), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := broker.AddListener(listeners.NewTCP("tcp", address, nil)); err != nil {
+		t.Fatal(err)
+	}
+	if err := broker.Serve(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { broker.Close() })
+	return "tcp://" + address
+}
+
+// Connects a plain MQTT client, e.g. playing the other primary instance or an edge node
+func connectPeer(t *testing.T, broker, clientID string) mqtt.Client {
+	t.Helper()
+	client := mqtt.NewClient(mqtt.NewClientOptions().AddBroker(broker).SetClientID(clientID))
+	if token := client.Connect(); !token.WaitTimeout(reactionTimeout) || token.Error() != nil {
+		t.Fatalf("connecting %s: %v", clientID, token.Error())
+	}
+	t.Cleanup(func() { client.Disconnect(0) })
+	return client
+}
+
+func publish(t *testing.T, client mqtt.Client, topic string, retained bool, payload []byte) {
+	t.Helper()
+	if token := client.Publish(topic, 1, retained, payload); !token.WaitTimeout(reactionTimeout) || token.Error() != nil {
+		t.Fatalf("publishing %s: %v", topic, token.Error())
+	}
+}
+
+// Starts a client, returning the channel of the messages it passes to the store
+func startClient(t *testing.T, cfg MQTTConfig, cl *cluster.Cluster) (*Client, <-chan store.Message) {
+	t.Helper()
+	storeChan := make(chan store.Message)
+	sm := store.NewStoreManager(storeChan, 1)
+	auditLog, err := audit.Open("", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgChan := make(chan store.Message, 1000)
+	c, err := StartMQTTClient(cfg, cl, sm, auditLog, msgChan)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		c.Stop(time.Second)
+		close(storeChan)
+	})
+	return c, msgChan
+}
+
+// Fails the test unless the condition holds within the reaction timeout
+func waitFor(t *testing.T, what string, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(reactionTimeout)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Records the payloads of the STATE topic of the primary host
+type stateWatcher struct {
+	mu     sync.Mutex
+	states []string
+}
+
+func watchStates(t *testing.T, client mqtt.Client, hostID string) *stateWatcher {
+	t.Helper()
+	w := &stateWatcher{}
+	token := client.Subscribe("STATE/"+hostID, 1, func(_ mqtt.Client, m mqtt.Message) {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		w.states = append(w.states, string(m.Payload()))
+	})
+	if !token.WaitTimeout(reactionTimeout) || token.Error() != nil {
+		t.Fatalf("subscribing to STATE: %v", token.Error())
+	}
+	return w
+}
+
+func (w *stateWatcher) last() string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.states) == 0 {
+		return ""
+	}
+	return w.states[len(w.states)-1]
+}
+
+func TestStandbyTakesOverAfterDelay(t *testing.T) {
+	broker := startBroker(t)
+	peer := connectPeer(t, broker, "active")
+	publish(t, peer, "STATE/primary", true, []byte(stateOnline))
+	states := watchStates(t, peer, "primary")
+
+	const delay = 300 * time.Millisecond
+	c, _ := startClient(t, MQTTConfig{Endpoints: []string{broker}, ClientID: "standby", HostID: "primary", Standby: true, TakeoverDelay: delay}, nil)
+	time.Sleep(2 * delay)
+	if c.Active() {
+		t.Fatal("standby took over while the active instance is ONLINE")
+	}
+	if err := c.Publish("spBv1.0/g1/NCMD/n1", 0, false, nil); err != ErrStandby {
+		t.Errorf("publish of standby: got %v, want %v", err, ErrStandby)
+	}
+
+	// the will of the active instance
+	offline := time.Now()
+	publish(t, peer, "STATE/primary", true, []byte(stateOffline))
+	waitFor(t, "the takeover", c.Active)
+	if elapsed := time.Since(offline); elapsed < delay {
+		t.Errorf("took over after %v, before the delay of %v", elapsed, delay)
+	}
+	waitFor(t, "STATE ONLINE of the new active instance", func() bool { return states.last() == stateOnline && c.Status().StatePublished })
+}
+
+func TestStandbyTakesOverWithoutActiveInstance(t *testing.T) {
+	broker := startBroker(t)
+	c, _ := startClient(t, MQTTConfig{Endpoints: []string{broker}, ClientID: "standby", HostID: "primary", Standby: true, TakeoverDelay: 100 * time.Millisecond}, nil)
+	waitFor(t, "the takeover", c.Active)
+	waitFor(t, "STATE ONLINE", func() bool { return c.Status().StatePublished })
+}
+
+func TestStandbyYieldsToOnlinePeer(t *testing.T) {
+	broker := startBroker(t)
+	peer := connectPeer(t, broker, "active")
+	publish(t, peer, "STATE/primary", true, []byte(stateOnline))
+
+	const delay = 500 * time.Millisecond
+	c, _ := startClient(t, MQTTConfig{Endpoints: []string{broker}, ClientID: "standby", HostID: "primary", Standby: true, TakeoverDelay: delay}, nil)
+	time.Sleep(delay / 5)
+
+	// the active instance reconnects before the takeover delay passed
+	publish(t, peer, "STATE/primary", true, []byte(stateOffline))
+	time.Sleep(delay / 5)
+	publish(t, peer, "STATE/primary", true, []byte(stateOnline))
+	time.Sleep(2 * delay)
+	if c.Active() {
+		t.Fatal("standby took over although the active instance came back ONLINE")
+	}
+	if status := c.Status(); status.StateOwner || status.StatePublished {
+		t.Errorf("status of standby: %+v", status)
+	}
+}
+
+// Returns the sequence numbers of the messages of each edge node, until the wanted amount was received or none arrived for the reaction timeout
+func collectSeqs(msgChan <-chan store.Message, want int) map[string][]uint64 {
+	seqs := make(map[string][]uint64)
+	received := 0
+	for received < want {
+		select {
+		case msg := <-msgChan:
+			key := msg.GroupID + "/" + msg.NodeID
+			seqs[key] = append(seqs[key], msg.Payload.GetSeq())
+			received++
+		case <-time.After(reactionTimeout):
+			return seqs
+		}
+	}
+	return seqs
+}
+
+func TestClusterKeepsOrderOfSharedMessages(t *testing.T) {
+	broker := startBroker(t)
+	const nodes, messages = 8, 60
+
+	clusters := []*cluster.Cluster{
+		cluster.New("a", "", "primaries", "cluster", 100*time.Millisecond),
+		cluster.New("b", "", "primaries", "cluster", 100*time.Millisecond),
+	}
+	channels := make([]<-chan store.Message, len(clusters))
+	for i, cl := range clusters {
+		cl.ReorderTimeout = reactionTimeout
+		_, channels[i] = startClient(t, MQTTConfig{Endpoints: []string{broker}, ClientID: cl.ID(), HostID: "primary"}, cl)
+	}
+	for _, cl := range clusters {
+		cl := cl
+		waitFor(t, "the members of "+cl.ID(), func() bool { return len(cl.Members()) == len(clusters) })
+	}
+
+	edgeNode := connectPeer(t, broker, "edge")
+	var forwarded int64
+	if token := edgeNode.Subscribe("cluster/forward/#", 1, func(mqtt.Client, mqtt.Message) { atomic.AddInt64(&forwarded, 1) }); !token.WaitTimeout(reactionTimeout) || token.Error() != nil {
+		t.Fatalf("subscribing to the forwarded messages: %v", token.Error())
+	}
+	owned := make(map[string]int)
+	for n := 0; n < nodes; n++ {
+		nodeID := fmt.Sprintf("n%d", n)
+		owned[clusters[0].Owner("g1", nodeID).ID] += messages
+	}
+	if owned["a"] == 0 || owned["b"] == 0 {
+		t.Fatalf("the %d nodes are not spread over both members: %v", nodes, owned)
+	}
+	for seq := 0; seq < messages; seq++ {
+		for n := 0; n < nodes; n++ {
+			msgType := store.NodeData
+			if seq == 0 {
+				msgType = store.NodeBirth
+			}
+			payload, _ := proto.Marshal(&sparkplugb.Payload{Seq: proto.Uint64(uint64(seq))})
+			publish(t, edgeNode, fmt.Sprintf("spBv1.0/g1/%s/n%d", msgType, n), false, payload)
+		}
+	}
+
+	// each member receives the messages of the nodes it owns, directly or forwarded by the other, in the order of their sequence numbers
+	for i, cl := range clusters {
+		seqs := collectSeqs(channels[i], owned[cl.ID()])
+		for n := 0; n < nodes; n++ {
+			key := fmt.Sprintf("g1/n%d", n)
+			if clusters[i].Owner("g1", fmt.Sprintf("n%d", n)).ID != cl.ID() {
+				if len(seqs[key]) > 0 {
+					t.Errorf("%s received %d messages of %s owned by the other member", cl.ID(), len(seqs[key]), key)
+				}
+				continue
+			}
+			if len(seqs[key]) != messages {
+				t.Errorf("%s received %d of the %d messages of %s", cl.ID(), len(seqs[key]), messages, key)
+				continue
+			}
+			for j, seq := range seqs[key] {
+				if seq != uint64(j) {
+					t.Errorf("%s received the messages of %s out of order: %v", cl.ID(), key, seqs[key])
+					break
+				}
+			}
+		}
+	}
+	if atomic.LoadInt64(&forwarded) == 0 {
+		t.Error("no message was forwarded, so the members did not share the subscription")
+	}
+}
@@ -0,0 +1,181 @@
+package sparkplug
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/store"
+	"github.com/DATATRONiQ/go-sparkplug-primary/third_party/sparkplugb"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// The field number of the sequence number in the sparkplug payload
+var seqField = (&sparkplugb.Payload{}).ProtoReflect().Descriptor().Fields().ByName("seq").Number()
+
+// Restores the order of the messages of each edge node by their sequence numbers.
+// In a cluster, the messages of a node reach its owner either directly via the shared subscription
+// or forwarded by another instance, which takes a second broker hop, so they may arrive out of order.
+// Messages ahead of the expected sequence number wait for the missing ones until the timeout,
+// after which they are passed on and the store detects the gap.
+type reorderer struct {
+	timeout time.Duration
+	deliver func(topic string, payload []byte)
+
+	mu    sync.Mutex
+	nodes map[store.EdgeNode]*nodeOrder
+}
+
+// The order of the messages of an edge node
+type nodeOrder struct {
+	nextSeq  uint64 // the sequence number of the next message to pass on
+	seqKnown bool
+	pending  map[uint64]pendingMessage // the messages waiting for the missing ones, by sequence number
+	timer    *time.Timer
+}
+
+type pendingMessage struct {
+	topic   string
+	payload []byte
+}
+
+func newReorderer(timeout time.Duration, deliver func(topic string, payload []byte)) *reorderer {
+	return &reorderer{timeout: timeout, deliver: deliver, nodes: make(map[store.EdgeNode]*nodeOrder)}
+}
+
+// Passes on the message of the edge node once all messages before it were passed on
+func (r *reorderer) add(topic string, edgeNode store.EdgeNode, payload []byte) {
+	msgType := store.Type(strings.Split(topic, "/")[2])
+	seq, hasSeq := payloadSeq(payload)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	node := r.nodes[edgeNode]
+
+	switch {
+	case msgType == store.NodeCommand || msgType == store.DeviceCommand:
+		// commands are not published by the node, so they are not part of its sequence
+		r.deliver(topic, payload)
+	case msgType == store.NodeDeath:
+		// the will of the node follows all of its messages
+		if node != nil {
+			r.flush(node)
+			delete(r.nodes, edgeNode)
+		}
+		r.deliver(topic, payload)
+	case !hasSeq:
+		r.deliver(topic, payload)
+	case node == nil || !node.seqKnown || msgType == store.NodeBirth:
+		// a birth starts a new sequence
+		if node == nil {
+			node = &nodeOrder{pending: make(map[uint64]pendingMessage)}
+			r.nodes[edgeNode] = node
+		}
+		r.deliver(topic, payload)
+		node.nextSeq, node.seqKnown = (seq+1)%256, true
+		r.drain(node)
+	case seq == node.nextSeq:
+		r.deliver(topic, payload)
+		node.nextSeq = (seq + 1) % 256
+		r.drain(node)
+	case (seq+256-node.nextSeq)%256 < 128:
+		node.pending[seq] = pendingMessage{topic: topic, payload: payload}
+		if node.timer == nil {
+			node.timer = time.AfterFunc(r.timeout, func() { r.expire(edgeNode, node) })
+		}
+	default:
+		// a duplicate or a message of a previous sequence, the store decides what to do with it
+		r.deliver(topic, payload)
+	}
+}
+
+// Passes on the pending messages continuing the sequence. Must be called with the lock held.
+func (r *reorderer) drain(node *nodeOrder) {
+	for {
+		m, ok := node.pending[node.nextSeq]
+		if !ok {
+			break
+		}
+		delete(node.pending, node.nextSeq)
+		r.deliver(m.topic, m.payload)
+		node.nextSeq = (node.nextSeq + 1) % 256
+	}
+	if len(node.pending) == 0 && node.timer != nil {
+		node.timer.Stop()
+		node.timer = nil
+	}
+}
+
+// Passes on all pending messages in the order of their sequence numbers. Must be called with the lock held.
+func (r *reorderer) flush(node *nodeOrder) {
+	seqs := make([]uint64, 0, len(node.pending))
+	for seq := range node.pending {
+		seqs = append(seqs, seq)
+	}
+	// ordered by their distance to the expected sequence number, as it wraps from 255 to 0
+	sort.Slice(seqs, func(i, j int) bool {
+		return (seqs[i]+256-node.nextSeq)%256 < (seqs[j]+256-node.nextSeq)%256
+	})
+	for _, seq := range seqs {
+		m := node.pending[seq]
+		delete(node.pending, seq)
+		r.deliver(m.topic, m.payload)
+		node.nextSeq = (seq + 1) % 256
+	}
+	if node.timer != nil {
+		node.timer.Stop()
+		node.timer = nil
+	}
+}
+
+// Gives up waiting for the missing messages of the edge node
+func (r *reorderer) expire(edgeNode store.EdgeNode, node *nodeOrder) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.nodes[edgeNode] != node || node.timer == nil {
+		return
+	}
+	r.flush(node)
+}
+
+// Passes on the pending messages of the edge node and forgets its sequence, e.g. when it is owned by another instance
+func (r *reorderer) forget(edgeNode store.EdgeNode) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if node, ok := r.nodes[edgeNode]; ok {
+		r.flush(node)
+		delete(r.nodes, edgeNode)
+	}
+}
+
+// Passes on the pending messages of all edge nodes
+func (r *reorderer) close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for edgeNode, node := range r.nodes {
+		r.flush(node)
+		delete(r.nodes, edgeNode)
+	}
+}
+
+// Returns the sequence number of a sparkplug payload without unmarshalling its metrics
+func payloadSeq(payload []byte) (uint64, bool) {
+	for len(payload) > 0 {
+		num, typ, n := protowire.ConsumeTag(payload)
+		if n < 0 {
+			return 0, false
+		}
+		payload = payload[n:]
+		if num == seqField && typ == protowire.VarintType {
+			seq, n := protowire.ConsumeVarint(payload)
+			return seq, n >= 0
+		}
+		n = protowire.ConsumeFieldValue(num, typ, payload)
+		if n < 0 {
+			return 0, false
+		}
+		payload = payload[n:]
+	}
+	return 0, false
+}
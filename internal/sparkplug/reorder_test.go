@@ -0,0 +1,113 @@
+package sparkplug
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/store"
+	"github.com/DATATRONiQ/go-sparkplug-primary/third_party/sparkplugb"
+	"google.golang.org/protobuf/proto"
+)
+
+var testNode = store.EdgeNode{GroupID: "g1", NodeID: "n1"}
+
+// Collects the sequence numbers of the passed on messages
+type delivered struct {
+	mu   sync.Mutex
+	seqs []string
+}
+
+func (d *delivered) deliver(topic string, payload []byte) {
+	var p sparkplugb.Payload
+	if err := proto.Unmarshal(payload, &p); err != nil {
+		panic(err)
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if p.Seq == nil {
+		d.seqs = append(d.seqs, topic)
+	} else {
+		d.seqs = append(d.seqs, fmt.Sprint(p.GetSeq()))
+	}
+}
+
+func (d *delivered) get() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]string{}, d.seqs...)
+}
+
+func receive(r *reorderer, msgType store.Type, seq int) {
+	payload := &sparkplugb.Payload{}
+	if seq >= 0 {
+		payload.Seq = proto.Uint64(uint64(seq))
+	}
+	data, _ := proto.Marshal(payload)
+	r.add(fmt.Sprintf("spBv1.0/g1/%s/n1", msgType), testNode, data)
+}
+
+func TestReorderRestoresOrder(t *testing.T) {
+	d := &delivered{}
+	r := newReorderer(time.Hour, d.deliver)
+	receive(r, store.NodeBirth, 254)
+	receive(r, store.NodeData, 0)
+	receive(r, store.NodeData, 255)
+	receive(r, store.NodeData, 2)
+	receive(r, store.NodeData, 1)
+
+	if want := []string{"254", "255", "0", "1", "2"}; !reflect.DeepEqual(d.get(), want) {
+		t.Errorf("got %v, want %v", d.get(), want)
+	}
+}
+
+func TestReorderPassesOnAfterTimeout(t *testing.T) {
+	d := &delivered{}
+	r := newReorderer(50*time.Millisecond, d.deliver)
+	receive(r, store.NodeBirth, 0)
+	receive(r, store.NodeData, 3)
+	receive(r, store.NodeData, 2)
+	if want := []string{"0"}; !reflect.DeepEqual(d.get(), want) {
+		t.Fatalf("got %v before the timeout, want %v", d.get(), want)
+	}
+
+	time.Sleep(200 * time.Millisecond)
+	if want := []string{"0", "2", "3"}; !reflect.DeepEqual(d.get(), want) {
+		t.Fatalf("got %v after the timeout, want %v", d.get(), want)
+	}
+	receive(r, store.NodeData, 4)
+	if want := []string{"0", "2", "3", "4"}; !reflect.DeepEqual(d.get(), want) {
+		t.Errorf("got %v, want %v", d.get(), want)
+	}
+}
+
+func TestReorderDeathFlushesPending(t *testing.T) {
+	d := &delivered{}
+	r := newReorderer(time.Hour, d.deliver)
+	receive(r, store.NodeBirth, 0)
+	receive(r, store.NodeData, 2)
+	receive(r, store.NodeCommand, -1)
+	receive(r, store.NodeDeath, -1)
+
+	want := []string{"0", "spBv1.0/g1/NCMD/n1", "2", "spBv1.0/g1/NDEATH/n1"}
+	if !reflect.DeepEqual(d.get(), want) {
+		t.Errorf("got %v, want %v", d.get(), want)
+	}
+}
+
+func TestPayloadSeq(t *testing.T) {
+	data, _ := proto.Marshal(&sparkplugb.Payload{
+		Timestamp: proto.Uint64(1),
+		Metrics:   []*sparkplugb.Payload_Metric{{Name: proto.String("m"), Value: &sparkplugb.Payload_Metric_DoubleValue{DoubleValue: 1}}},
+		Seq:       proto.Uint64(42),
+	})
+	if seq, ok := payloadSeq(data); !ok || seq != 42 {
+		t.Errorf("got %d, %v, want 42, true", seq, ok)
+	}
+	data, _ = proto.Marshal(&sparkplugb.Payload{Timestamp: proto.Uint64(1)})
+	if _, ok := payloadSeq(data); ok {
+		t.Error("got a sequence number of a payload without one")
+	}
+}
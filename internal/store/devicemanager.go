@@ -14,9 +14,12 @@ type DeviceManager struct {
 	NodeID        string             // The node this device belongs to
 	DeviceID      string             // The device ID
 	Online        bool               // Whether the device is online
+	Stale         bool               // Whether the online device has not sent messages for its inactivity timeout
 	LastMessageAt time.Time          // The last time a message was received regarding this device
 	Metrics       map[uint64]*Metric // The metrics of this device (Alias -> Metric)
 
+	born bool // whether the device was online before
+
 	mu sync.RWMutex
 }
 
@@ -26,6 +29,7 @@ type FetchedDevice struct {
 	NodeID        string          `json:"nodeId"`        // The node ID
 	GroupID       string          `json:"groupId"`       // The group ID
 	Online        bool            `json:"online"`        // Whether the device is online
+	Stale         bool            `json:"stale"`         // Whether the online device has not sent messages for its inactivity timeout
 	LastMessageAt time.Time       `json:"lastMessageAt"` // The last time a message was received regarding this device
 	Metrics       []FetchedMetric `json:"metrics"`       // The metrics of this device
 }
@@ -45,12 +49,21 @@ func (dm *DeviceManager) deviceBirth(msg Message) {
 	dm.mu.Lock()
 	defer dm.mu.Unlock()
 
+	if msg.Payload == nil {
+		logrus.Warnf("DBIRTH: Device %s got message with nil payload", dm.DeviceID)
+		return
+	}
+
 	if msg.ReceivedAt.After(dm.LastMessageAt) {
 		dm.LastMessageAt = msg.ReceivedAt
 	}
+	addEvent(birthEvent(msg, dm.born, dm.Online))
 	dm.Online = true
+	dm.Stale = false
+	dm.born = true
 
 	dm.Metrics = make(map[uint64]*Metric)
+	dropHistory(entity{GroupID: dm.GroupID, NodeID: dm.NodeID, DeviceID: dm.DeviceID})
 
 	for _, metric := range msg.Payload.Metrics {
 		alias := metric.Alias
@@ -60,15 +73,19 @@ func (dm *DeviceManager) deviceBirth(msg Message) {
 			} else {
 				logrus.Warnf("DBIRTH: Device %s has no alias for metric %s", dm.DeviceID, *metric.Name)
 			}
+			metricsDropped.WithLabelValues(string(msg.Type), "no_alias").Inc()
 			continue
 		}
 
 		newMetric, err := NewMetric(metric)
 		if err != nil {
-			logrus.Warnf("DBIRTH: Device %s has an invalid metric %d: %s", dm.DeviceID, metric.Name, err)
+			logrus.Warnf("DBIRTH: Device %s has an invalid metric with alias %d: %s", dm.DeviceID, *alias, err)
+			metricsDropped.WithLabelValues(string(msg.Type), "invalid").Inc()
 			continue
 		}
+		newMetric.ReceivedAt = msg.ReceivedAt
 		dm.Metrics[*alias] = newMetric
+		notifyUpdate(msg, dm.DeviceID, newMetric)
 	}
 }
 
@@ -89,6 +106,10 @@ func (dm *DeviceManager) deviceData(msg Message) {
 	if msg.ReceivedAt.After(dm.LastMessageAt) {
 		dm.LastMessageAt = msg.ReceivedAt
 	}
+	if dm.Stale {
+		addEvent(recoveredEvent(msg, dm.DeviceID))
+		dm.Stale = false
+	}
 
 	for _, metric := range msg.Payload.Metrics {
 		alias := metric.Alias
@@ -98,19 +119,25 @@ func (dm *DeviceManager) deviceData(msg Message) {
 			} else {
 				logrus.Warnf("DDATA: Device %s got metric with nil alias and name: %s", dm.DeviceID, *metric.Name)
 			}
+			metricsDropped.WithLabelValues(string(msg.Type), "no_alias").Inc()
 			continue
 		}
 
 		currMetric, ok := dm.Metrics[*alias]
 		if !ok {
 			logrus.Warnf("DDATA: Device %s got metric with unknown alias %d", dm.DeviceID, *alias)
+			metricsDropped.WithLabelValues(string(msg.Type), "unknown_alias").Inc()
 			continue
 		}
 
 		err := currMetric.Update(metric)
 		if err != nil {
 			logrus.Warnf("DDATA: Device %s got an invalid metric with name %s: %v", dm.DeviceID, currMetric.Name, err)
+			metricsDropped.WithLabelValues(string(msg.Type), "invalid").Inc()
+			continue
 		}
+		currMetric.ReceivedAt = msg.ReceivedAt
+		notifyUpdate(msg, dm.DeviceID, currMetric)
 	}
 }
 
@@ -121,14 +148,41 @@ func (dm *DeviceManager) deviceDeath(msg Message) {
 	if msg.ReceivedAt.After(dm.LastMessageAt) {
 		dm.LastMessageAt = msg.ReceivedAt
 	}
-	dm.Online = false
+	dm.setOffline(msg.ReceivedAt, string(msg.Type))
 }
 
-func (dm *DeviceManager) offline() {
+// Marks the device offline for the given cause, e.g. the death of its node
+func (dm *DeviceManager) offline(at time.Time, cause string) {
 	dm.mu.Lock()
 	defer dm.mu.Unlock()
+	dm.setOffline(at, cause)
+}
 
+// Marks the device offline. Must be called with the lock held.
+func (dm *DeviceManager) setOffline(at time.Time, cause string) {
+	if dm.Online {
+		addEvent(Event{Time: at, Type: EventDeath, GroupID: dm.GroupID, NodeID: dm.NodeID, DeviceID: dm.DeviceID, Cause: cause})
+	}
 	dm.Online = false
+	dm.Stale = false
+}
+
+// Flags the device stale if it did not send a message within its timeout.
+// Returns true if the device timed out just now.
+func (dm *DeviceManager) checkTimeout(w *watchdogSettings, now time.Time) bool {
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+
+	if !dm.Online || dm.Stale {
+		return false
+	}
+	timeout := w.entityTimeout(dm.GroupID + "/" + dm.NodeID + "/" + dm.DeviceID)
+	if timeout == 0 || now.Sub(dm.LastMessageAt) <= timeout {
+		return false
+	}
+	addEvent(timeoutEvent(dm.GroupID, dm.NodeID, dm.DeviceID, timeout, now))
+	dm.Stale = true
+	return true
 }
 
 // Returns the current state of the device
@@ -136,10 +190,13 @@ func (dm *DeviceManager) Fetch() *FetchedDevice {
 	dm.mu.RLock()
 	defer dm.mu.RUnlock()
 
+	w, now := currentWatchdog(), time.Now()
 	sortedAliases := util.SortedKeys(dm.Metrics)
 	metrics := make([]FetchedMetric, 0, len(dm.Metrics))
 	for _, alias := range sortedAliases {
-		fetchedMetric := dm.Metrics[alias].Fetch(!dm.Online)
+		metric := dm.Metrics[alias]
+		path := dm.GroupID + "/" + dm.NodeID + "/" + dm.DeviceID + "/" + metric.Name
+		fetchedMetric := metric.Fetch(!dm.Online || dm.Stale || w.metricStale(path, metric.ReceivedAt, now))
 		metrics = append(metrics, *fetchedMetric)
 	}
 
@@ -148,6 +205,7 @@ func (dm *DeviceManager) Fetch() *FetchedDevice {
 		NodeID:        dm.NodeID,
 		GroupID:       dm.GroupID,
 		Online:        dm.Online,
+		Stale:         dm.Stale,
 		LastMessageAt: dm.LastMessageAt,
 		Metrics:       metrics,
 	}
@@ -0,0 +1,238 @@
+package store
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The kind of a lifecycle event of a node or device
+type EventType string
+
+const (
+	EventBirth          EventType = "birth"           // The entity came online for the first time or rebirthed while online
+	EventReconnect      EventType = "reconnect"       // The entity came online again after it was offline
+	EventDeath          EventType = "death"           // The entity went offline, the cause tells why
+	EventRebirthRequest EventType = "rebirth_request" // A rebirth of the node was requested
+	EventTimeout        EventType = "timeout"         // The entity has not sent messages for its inactivity timeout and is stale
+	EventRecovered      EventType = "recovered"       // The stale entity sent a message again
+)
+
+// Causes of lifecycle events which are not the type of the received message
+const (
+	CauseNodeDeath          = "NDEATH of node"
+	CausePrimaryDisconnect  = "primary disconnected from broker"
+	CauseSeqGap             = "seq gap"
+	CauseUnknownEdgeNode    = "unknown edge node"
+	CausePrimaryReconnected = "primary reconnected to broker"
+	CauseTimeout            = "timeout"
+)
+
+// A lifecycle event of a node or device
+type Event struct {
+	Time     time.Time `json:"time"`
+	Type     EventType `json:"type"`
+	GroupID  string    `json:"groupId"`
+	NodeID   string    `json:"nodeId"`
+	DeviceID string    `json:"deviceId,omitempty"` // Empty for events of the node
+	Cause    string    `json:"cause"`
+	Online   bool      `json:"online"`          // Whether the entity is online after the event
+	Stale    bool      `json:"stale,omitempty"` // Whether the online entity is silent beyond its inactivity timeout after the event
+}
+
+// Identifies a node, or a device if the device ID is not empty
+type entity struct {
+	GroupID  string
+	NodeID   string
+	DeviceID string
+}
+
+// The maximum amount of events kept per node and device
+var EventHistorySize = 1000
+
+// the lifecycle events of each entity, each a ring buffer of EventHistorySize entries
+var eventLog = make(map[entity]*eventHistory)
+var eventLogMutex sync.RWMutex
+
+// Returns the event of the birth of the entity of the given message.
+// A birth of an entity which was online before is a rebirth, of an entity which was offline a reconnect.
+func birthEvent(msg Message, born, online bool) Event {
+	e := Event{
+		Time:     msg.ReceivedAt,
+		Type:     EventBirth,
+		GroupID:  msg.GroupID,
+		NodeID:   msg.NodeID,
+		DeviceID: msg.DeviceID,
+		Cause:    string(msg.Type),
+		Online:   true,
+	}
+	switch {
+	case online:
+		e.Cause += " while online"
+	case born:
+		e.Type = EventReconnect
+	}
+	return e
+}
+
+type eventHistory struct {
+	events []Event
+	next   int
+}
+
+// the handlers called for every recorded event, see AddEventHandler
+var (
+	eventHandlers   atomic.Value // []func(Event)
+	eventHandlersMu sync.Mutex
+)
+
+// Adds a handler called for every recorded lifecycle event.
+// It may be called while a node is locked, so it must be fast and must not call back into the store.
+func AddEventHandler(handler func(Event)) {
+	eventHandlersMu.Lock()
+	defer eventHandlersMu.Unlock()
+	handlers, _ := eventHandlers.Load().([]func(Event))
+	eventHandlers.Store(append(append([]func(Event){}, handlers...), handler))
+}
+
+func addEvent(e Event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	handlers, _ := eventHandlers.Load().([]func(Event))
+	for _, handler := range handlers {
+		handler(e)
+	}
+	key := entity{GroupID: e.GroupID, NodeID: e.NodeID, DeviceID: e.DeviceID}
+
+	eventLogMutex.Lock()
+	defer eventLogMutex.Unlock()
+	if EventHistorySize <= 0 {
+		return
+	}
+	history, ok := eventLog[key]
+	if !ok {
+		history = &eventHistory{events: make([]Event, 0)}
+		eventLog[key] = history
+	}
+	if len(history.events) < EventHistorySize {
+		history.events = append(history.events, e)
+		return
+	}
+	history.events[history.next] = e
+	history.next = (history.next + 1) % len(history.events)
+}
+
+// Returns the events of the given node, or of its device if a device ID is given, oldest first
+func FetchEvents(groupID, nodeID, deviceID string) []Event {
+	eventLogMutex.RLock()
+	defer eventLogMutex.RUnlock()
+
+	history, ok := eventLog[entity{GroupID: groupID, NodeID: nodeID, DeviceID: deviceID}]
+	if !ok {
+		return make([]Event, 0)
+	}
+	events := make([]Event, 0, len(history.events))
+	events = append(events, history.events[history.next:]...)
+	events = append(events, history.events[:history.next]...)
+	return events
+}
+
+// The time a node or device was online, stale, offline or unknown to the primary within a window
+type Availability struct {
+	From           time.Time `json:"from"`
+	To             time.Time `json:"to"`
+	OnlineSeconds  float64   `json:"onlineSeconds"`
+	StaleSeconds   float64   `json:"staleSeconds"` // Online, but silent beyond the inactivity timeout
+	OfflineSeconds float64   `json:"offlineSeconds"`
+	UnknownSeconds float64   `json:"unknownSeconds"` // Before the first known event, e.g. before the first birth
+	Availability   *float64  `json:"availability"`   // The online and not stale percentage of the known time, nil if nothing is known
+}
+
+// Returns the availability of the given node or device within the window, which is cut off at the current time
+func ComputeAvailability(groupID, nodeID, deviceID string, from, to time.Time) Availability {
+	if now := time.Now(); to.After(now) {
+		to = now
+	}
+	a := Availability{From: from, To: to}
+	if !to.After(from) {
+		return a
+	}
+
+	// the state before the first event is unknown, afterwards it is the state after the last event
+	var online, stale, known bool
+	cursor := from
+	add := func(until time.Time) {
+		if until.After(to) {
+			until = to
+		}
+		if !until.After(cursor) {
+			return
+		}
+		seconds := until.Sub(cursor).Seconds()
+		switch {
+		case !known:
+			a.UnknownSeconds += seconds
+		case online && stale:
+			a.StaleSeconds += seconds
+		case online:
+			a.OnlineSeconds += seconds
+		default:
+			a.OfflineSeconds += seconds
+		}
+		cursor = until
+	}
+	for _, e := range FetchEvents(groupID, nodeID, deviceID) {
+		add(e.Time)
+		if e.Type != EventRebirthRequest {
+			online, stale, known = e.Online, e.Stale, true
+		}
+	}
+	add(to)
+
+	if knownSeconds := a.OnlineSeconds + a.StaleSeconds + a.OfflineSeconds; knownSeconds > 0 {
+		percentage := 100 * a.OnlineSeconds / knownSeconds
+		a.Availability = &percentage
+	}
+	return a
+}
+
+// Records that a rebirth of the given node was requested
+func (sm *StoreManager) RecordRebirthRequest(groupID, nodeID, cause string) {
+	online, stale := false, false
+	if groupManager, ok := sm.group(groupID, false); ok {
+		groupManager.mu.RLock()
+		nodeManager, ok := groupManager.Nodes[nodeID]
+		groupManager.mu.RUnlock()
+		if ok {
+			nodeManager.mu.RLock()
+			online, stale = nodeManager.Online, nodeManager.Stale
+			nodeManager.mu.RUnlock()
+		}
+	}
+	addEvent(Event{Type: EventRebirthRequest, GroupID: groupID, NodeID: nodeID, Cause: cause, Online: online, Stale: stale})
+}
+
+// Marks all nodes and devices offline, as their state is unknown while the primary is disconnected from the broker
+func (sm *StoreManager) Disconnected() {
+	sm.mu.RLock()
+	groupManagers := make([]*GroupManager, 0, len(sm.Groups))
+	for _, groupManager := range sm.Groups {
+		groupManagers = append(groupManagers, groupManager)
+	}
+	sm.mu.RUnlock()
+
+	now := time.Now()
+	for _, groupManager := range groupManagers {
+		groupManager.mu.RLock()
+		nodeManagers := make([]*NodeManager, 0, len(groupManager.Nodes))
+		for _, nodeManager := range groupManager.Nodes {
+			nodeManagers = append(nodeManagers, nodeManager)
+		}
+		groupManager.mu.RUnlock()
+
+		for _, nodeManager := range nodeManagers {
+			nodeManager.offline(now, CausePrimaryDisconnect)
+		}
+	}
+}
@@ -33,117 +33,100 @@ func NewGroupManager(groupID string) *GroupManager {
 	}
 }
 
-func (gm *GroupManager) nodeBirth(msg Message) {
+// Returns the node manager for the given message's node, creating it if create is true.
+// The group lock is only held for the lookup, so nodes of the same group can be processed in parallel.
+func (gm *GroupManager) node(msg Message, create bool) (*NodeManager, bool) {
 	gm.mu.Lock()
 	defer gm.mu.Unlock()
 
 	nodeManager, ok := gm.Nodes[msg.NodeID]
 	if !ok {
-		gm.Nodes[msg.NodeID] = NewNodeManager(gm.GroupID, msg.NodeID)
-		nodeManager = gm.Nodes[msg.NodeID]
+		if !create {
+			logrus.Debugf("%s: Node %s is currently not in group %s", msg.Type, msg.NodeID, gm.GroupID)
+			return nil, false
+		}
+		nodeManager = NewNodeManager(gm.GroupID, msg.NodeID)
+		gm.Nodes[msg.NodeID] = nodeManager
 	}
 
 	if msg.ReceivedAt.After(gm.LastMessageAt) {
 		gm.LastMessageAt = msg.ReceivedAt
 	}
-	nodeManager.nodeBirth(msg)
+	return nodeManager, true
 }
 
-func (gm *GroupManager) nodeData(msg Message) {
-	gm.mu.Lock()
-	defer gm.mu.Unlock()
+// Returns true iff the given node is in the group
+func (gm *GroupManager) hasNode(nodeID string) bool {
+	gm.mu.RLock()
+	defer gm.mu.RUnlock()
+	_, ok := gm.Nodes[nodeID]
+	return ok
+}
 
-	nodeManager, ok := gm.Nodes[msg.NodeID]
-	if !ok {
-		logrus.Debugf("NDATA: Node %s is currently not in group %s", msg.NodeID, gm.GroupID)
-		return
+// Checks the sequence number of a message of a node in the group, see NodeManager.checkSeq
+func (gm *GroupManager) checkSeq(msg Message) (uint64, bool) {
+	if nodeManager, ok := gm.node(msg, false); ok {
+		return nodeManager.checkSeq(msg)
 	}
+	return 0, true
+}
 
-	if msg.ReceivedAt.After(gm.LastMessageAt) {
-		gm.LastMessageAt = msg.ReceivedAt
+func (gm *GroupManager) nodeBirth(msg Message) {
+	if nodeManager, ok := gm.node(msg, true); ok {
+		nodeManager.nodeBirth(msg)
 	}
-	nodeManager.nodeData(msg)
 }
 
-func (gm *GroupManager) nodeDeath(msg Message) {
-	gm.mu.Lock()
-	defer gm.mu.Unlock()
-
-	nodeManager, ok := gm.Nodes[msg.NodeID]
-	if !ok {
-		logrus.Debugf("NDEATH: Node %s is currently not in group %s", msg.NodeID, gm.GroupID)
-		return
+func (gm *GroupManager) nodeData(msg Message) {
+	if nodeManager, ok := gm.node(msg, false); ok {
+		nodeManager.nodeData(msg)
 	}
+}
 
-	if msg.ReceivedAt.After(gm.LastMessageAt) {
-		gm.LastMessageAt = msg.ReceivedAt
+func (gm *GroupManager) nodeDeath(msg Message) {
+	if nodeManager, ok := gm.node(msg, false); ok {
+		nodeManager.nodeDeath(msg)
 	}
-	nodeManager.nodeDeath(msg)
 }
 
 func (gm *GroupManager) deviceBirth(msg Message) {
-	gm.mu.Lock()
-	defer gm.mu.Unlock()
-
-	nodeManager, ok := gm.Nodes[msg.NodeID]
-	if !ok {
-		logrus.Debugf("DBIRTH: Node %s is currently not in group %s", msg.NodeID, gm.GroupID)
-		return
+	if nodeManager, ok := gm.node(msg, false); ok {
+		nodeManager.deviceBirth(msg)
 	}
-
-	if msg.ReceivedAt.After(gm.LastMessageAt) {
-		gm.LastMessageAt = msg.ReceivedAt
-	}
-	nodeManager.deviceBirth(msg)
 }
 
 func (gm *GroupManager) deviceData(msg Message) {
-	gm.mu.Lock()
-	defer gm.mu.Unlock()
-
-	nodeManager, ok := gm.Nodes[msg.NodeID]
-	if !ok {
-		logrus.Debugf("DDATA: Node %s is currently not in group %s", msg.NodeID, gm.GroupID)
-		return
-	}
-
-	if msg.ReceivedAt.After(gm.LastMessageAt) {
-		gm.LastMessageAt = msg.ReceivedAt
+	if nodeManager, ok := gm.node(msg, false); ok {
+		nodeManager.deviceData(msg)
 	}
-	nodeManager.deviceData(msg)
 }
 
 func (gm *GroupManager) deviceDeath(msg Message) {
-	gm.mu.Lock()
-	defer gm.mu.Unlock()
-
-	nodeManager, ok := gm.Nodes[msg.NodeID]
-	if !ok {
-		logrus.Debugf("DDEATH: Node %s is currently not in group %s", msg.NodeID, gm.GroupID)
-		return
+	if nodeManager, ok := gm.node(msg, false); ok {
+		nodeManager.deviceDeath(msg)
 	}
-
-	if msg.ReceivedAt.After(gm.LastMessageAt) {
-		gm.LastMessageAt = msg.ReceivedAt
-	}
-	nodeManager.deviceDeath(msg)
 }
 
 // Returns the current state of the group and its nodes
 func (gm *GroupManager) Fetch() *FetchedGroup {
 	gm.mu.RLock()
-	defer gm.mu.RUnlock()
-
+	lastMessageAt := gm.LastMessageAt
 	sortedNodeIDs := util.SortedKeys(gm.Nodes)
-	nodes := make([]FetchedNode, 0, len(gm.Nodes))
+	nodeManagers := make([]*NodeManager, 0, len(sortedNodeIDs))
 	for _, nodeID := range sortedNodeIDs {
-		fetchedNode := gm.Nodes[nodeID].Fetch()
-		nodes = append(nodes, *fetchedNode)
+		nodeManagers = append(nodeManagers, gm.Nodes[nodeID])
+	}
+	gm.mu.RUnlock()
+
+	// the nodes are fetched without holding the group lock, so ingest of other nodes is not blocked
+	nodes := make([]FetchedNode, 0, len(nodeManagers))
+	for _, nodeManager := range nodeManagers {
+		nodes = append(nodes, *nodeManager.Fetch())
 	}
 
 	return &FetchedGroup{
 		ID:            gm.GroupID,
-		LastMessageAt: gm.LastMessageAt,
+		LastMessageAt: lastMessageAt,
 		Nodes:         nodes,
 	}
 }
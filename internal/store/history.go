@@ -0,0 +1,69 @@
+package store
+
+import "sync"
+
+// The maximum amount of values kept per metric, none if 0
+var ValueHistorySize = 0
+
+// the values of the metrics of each node and device by metric name, each a ring buffer of ValueHistorySize entries
+var valueLog = make(map[entity]map[string]*valueHistory)
+var valueLogMutex sync.RWMutex
+
+// The values of a metric, locked on its own as the store workers add values of different nodes in parallel
+type valueHistory struct {
+	mu     sync.Mutex
+	values []MetricUpdate
+	next   int
+}
+
+func addValue(u MetricUpdate) {
+	key := entity{GroupID: u.GroupID, NodeID: u.NodeID, DeviceID: u.DeviceID}
+
+	valueLogMutex.RLock()
+	history, ok := valueLog[key][u.Name]
+	valueLogMutex.RUnlock()
+	if !ok {
+		valueLogMutex.Lock()
+		if history, ok = valueLog[key][u.Name]; !ok {
+			if valueLog[key] == nil {
+				valueLog[key] = make(map[string]*valueHistory)
+			}
+			history = &valueHistory{values: make([]MetricUpdate, 0)}
+			valueLog[key][u.Name] = history
+		}
+		valueLogMutex.Unlock()
+	}
+
+	history.mu.Lock()
+	defer history.mu.Unlock()
+	if len(history.values) < ValueHistorySize {
+		history.values = append(history.values, u)
+		return
+	}
+	history.values[history.next] = u
+	history.next = (history.next + 1) % len(history.values)
+}
+
+// Drops the values of all metrics of the given node or device, e.g. as its rebirth may remove or redefine metrics
+func dropHistory(e entity) {
+	valueLogMutex.Lock()
+	defer valueLogMutex.Unlock()
+	delete(valueLog, e)
+}
+
+// Returns the last values of the given metric of a node, or of its device if a device ID is given, oldest first
+func FetchHistory(groupID, nodeID, deviceID, name string) []MetricUpdate {
+	valueLogMutex.RLock()
+	history, ok := valueLog[entity{GroupID: groupID, NodeID: nodeID, DeviceID: deviceID}][name]
+	valueLogMutex.RUnlock()
+	if !ok {
+		return make([]MetricUpdate, 0)
+	}
+
+	history.mu.Lock()
+	defer history.mu.Unlock()
+	values := make([]MetricUpdate, 0, len(history.values))
+	values = append(values, history.values[history.next:]...)
+	values = append(values, history.values[:history.next]...)
+	return values
+}
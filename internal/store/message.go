@@ -5,6 +5,7 @@ import (
 	"time"
 
 	"github.com/DATATRONiQ/go-sparkplug-primary/third_party/sparkplugb"
+	"github.com/sirupsen/logrus"
 )
 
 // The sparkplug-B message type for node and device messages
@@ -41,37 +42,50 @@ type FetchedMessage struct {
 	ReceivedAt   time.Time `json:"receivedAt"`   // The time the message was received
 }
 
-// basically our in-memory database
-var msgLog = make([]Message, 0)
+// The maximum amount of messages kept in the message log, all messages are kept if 0
+var MessageLogSize = 0
+
+// basically our in-memory database, used as a ring buffer if MessageLogSize is set
+var msgLog = make([]FetchedMessage, 0)
+var msgLogNext int
+var msgLogFull bool
 var msgLogMutex sync.RWMutex
 
 func addMessage(msg Message) {
+	metricAmount := 0
+	if msg.Payload != nil {
+		metricAmount = len(msg.Payload.Metrics)
+	}
+	fetchedMsg := FetchedMessage{
+		GroupID:      msg.GroupID,
+		NodeID:       msg.NodeID,
+		DeviceID:     msg.DeviceID,
+		Type:         msg.Type,
+		MetricAmount: metricAmount,
+		ReceivedAt:   msg.ReceivedAt,
+	}
+
 	msgLogMutex.Lock()
 	defer msgLogMutex.Unlock()
-	msgLog = append(msgLog, msg)
+	if MessageLogSize <= 0 || len(msgLog) < MessageLogSize {
+		msgLog = append(msgLog, fetchedMsg)
+		return
+	}
+	if !msgLogFull {
+		msgLogFull = true
+		logrus.Warnf("Message log reached its size of %d messages, dropping the oldest messages from now on", MessageLogSize)
+	}
+	msgLog[msgLogNext] = fetchedMsg
+	msgLogNext = (msgLogNext + 1) % len(msgLog)
 }
 
-// Returns all messages received since the start of the application
+// Returns the messages received since the start of the application, or the last MessageLogSize of them, oldest first
 func Fetch() *[]FetchedMessage {
 	msgLogMutex.RLock()
 	defer msgLogMutex.RUnlock()
 
-	fetchedMsgs := make([]FetchedMessage, 0)
-	for _, msg := range msgLog {
-		metricAmount := 0
-		if msg.Payload != nil {
-			metricAmount = len(msg.Payload.Metrics)
-		}
-
-		fetchedMsgs = append(fetchedMsgs, FetchedMessage{
-			GroupID:      msg.GroupID,
-			NodeID:       msg.NodeID,
-			DeviceID:     msg.DeviceID,
-			Type:         msg.Type,
-			MetricAmount: metricAmount,
-			ReceivedAt:   msg.ReceivedAt,
-		})
-	}
-
+	fetchedMsgs := make([]FetchedMessage, 0, len(msgLog))
+	fetchedMsgs = append(fetchedMsgs, msgLog[msgLogNext:]...)
+	fetchedMsgs = append(fetchedMsgs, msgLog[:msgLogNext]...)
 	return &fetchedMsgs
 }
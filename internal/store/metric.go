@@ -14,16 +14,128 @@ type Metric struct {
 	LastTimeStamp *time.Time
 	IsNull        bool
 	Value         any
+	Units         string    // The engineering units of the "engUnit" property of the birth certificate
+	Quality       Quality   // The quality of the "Quality" property of the last value, good if it sent none
+	ReceivedAt    time.Time // The time the last value was received
+
+	// The properties of the birth certificate, updated by the properties of data messages.
+	// The map is replaced on updates and never modified, so fetched metrics can share it.
+	Properties map[string]any
+}
+
+// The quality of a metric value, from the Sparkplug "Quality" property
+type Quality string
+
+const (
+	QualityGood      Quality = "good"
+	QualityBad       Quality = "bad"
+	QualityStale     Quality = "stale"
+	QualityUncertain Quality = "uncertain" // Any other quality code
+)
+
+// Returns the quality of the "Quality" property of the metric, good if it has none
+func metricQuality(metric *sparkplugb.Payload_Metric) Quality {
+	value := property(metric, "Quality")
+	if value == nil {
+		return QualityGood
+	}
+	switch int32(value.GetIntValue()) {
+	case 0:
+		return QualityBad
+	case 192:
+		return QualityGood
+	case 500:
+		return QualityStale
+	}
+	return QualityUncertain
+}
+
+// Returns the value of the given property of the metric, nil if it has none
+func property(metric *sparkplugb.Payload_Metric, key string) *sparkplugb.Payload_PropertyValue {
+	properties := metric.GetProperties()
+	values := properties.GetValues()
+	for i, k := range properties.GetKeys() {
+		if k == key && i < len(values) && !values[i].GetIsNull() {
+			return values[i]
+		}
+	}
+	return nil
+}
+
+// Returns the property set of the metric as plain values, nil if it has none
+func metricProperties(metric *sparkplugb.Payload_Metric) map[string]any {
+	if len(metric.GetProperties().GetKeys()) == 0 {
+		return nil
+	}
+	return propertySet(metric.GetProperties())
+}
+
+func propertySet(set *sparkplugb.Payload_PropertySet) map[string]any {
+	values := set.GetValues()
+	result := make(map[string]any, len(set.GetKeys()))
+	for i, key := range set.GetKeys() {
+		if i < len(values) {
+			result[key] = propertyValue(values[i])
+		}
+	}
+	return result
+}
+
+// Returns the value of a property converted according to its data type, nil if it is null or of an unsupported type
+func propertyValue(value *sparkplugb.Payload_PropertyValue) any {
+	if value.GetIsNull() {
+		return nil
+	}
+	switch sparkplugb.DataType(value.GetType()) {
+	case sparkplugb.DataType_Int8:
+		return int8(value.GetIntValue())
+	case sparkplugb.DataType_Int16:
+		return int16(value.GetIntValue())
+	case sparkplugb.DataType_Int32:
+		return int32(value.GetIntValue())
+	case sparkplugb.DataType_Int64:
+		return int64(value.GetLongValue())
+	case sparkplugb.DataType_UInt8:
+		return uint8(value.GetIntValue())
+	case sparkplugb.DataType_UInt16:
+		return uint16(value.GetIntValue())
+	case sparkplugb.DataType_UInt32:
+		return value.GetIntValue()
+	case sparkplugb.DataType_UInt64:
+		return value.GetLongValue()
+	case sparkplugb.DataType_Float:
+		return value.GetFloatValue()
+	case sparkplugb.DataType_Double:
+		return value.GetDoubleValue()
+	case sparkplugb.DataType_Boolean:
+		return value.GetBooleanValue()
+	case sparkplugb.DataType_String, sparkplugb.DataType_Text, sparkplugb.DataType_UUID:
+		return value.GetStringValue()
+	case sparkplugb.DataType_DateTime:
+		return time.UnixMilli(int64(value.GetLongValue())).UTC()
+	case sparkplugb.DataType_PropertySet:
+		return propertySet(value.GetPropertysetValue())
+	case sparkplugb.DataType_PropertySetList:
+		sets := make([]map[string]any, 0)
+		for _, set := range value.GetPropertysetsValue().GetPropertyset() {
+			sets = append(sets, propertySet(set))
+		}
+		return sets
+	}
+	return nil
 }
 
 type FetchedMetric struct {
-	Name      string    `json:"name"`
-	Alias     uint64    `json:"alias"`
-	Stale     bool      `json:"stale"`
-	DataType  string    `json:"dataType"`
-	Timestamp time.Time `json:"timestamp"`
-	IsNull    bool      `json:"isNull"`
-	Value     any       `json:"value"`
+	Name       string         `json:"name"`
+	Alias      uint64         `json:"alias"`
+	Stale      bool           `json:"stale"`
+	DataType   string         `json:"dataType"`
+	Timestamp  time.Time      `json:"timestamp"`
+	IsNull     bool           `json:"isNull"`
+	Value      any            `json:"value"`
+	Units      string         `json:"units,omitempty"`
+	Quality    Quality        `json:"quality"`
+	Properties map[string]any `json:"properties,omitempty"`
 }
 
 func NewMetric(metric *sparkplugb.Payload_Metric) (*Metric, error) {
@@ -44,9 +156,14 @@ func NewMetric(metric *sparkplugb.Payload_Metric) (*Metric, error) {
 	}
 
 	newMetric := Metric{
-		Name:     *metric.Name,
-		Alias:    *metric.Alias,
-		DataType: sparkplugb.DataType(*metric.Datatype),
+		Name:       *metric.Name,
+		Alias:      *metric.Alias,
+		DataType:   sparkplugb.DataType(*metric.Datatype),
+		Quality:    metricQuality(metric),
+		Properties: metricProperties(metric),
+	}
+	if units := property(metric, "engUnit"); units != nil {
+		newMetric.Units = units.GetStringValue()
 	}
 
 	if metric.Timestamp != nil {
@@ -66,6 +183,13 @@ func NewMetric(metric *sparkplugb.Payload_Metric) (*Metric, error) {
 	return &newMetric, err
 }
 
+// Returns the value of the given payload metric converted to the given data type, nil if the metric is null
+func MetricValue(metric *sparkplugb.Payload_Metric, dataType sparkplugb.DataType) (any, error) {
+	m := Metric{DataType: dataType, IsNull: metric.IsNull != nil && *metric.IsNull}
+	err := m.addValue(metric)
+	return m.Value, err
+}
+
 func (m *Metric) addValue(metric *sparkplugb.Payload_Metric) error {
 	if m.IsNull {
 		// metric is null so there is no value to add
@@ -119,6 +243,17 @@ func (m *Metric) Update(metric *sparkplugb.Payload_Metric) error {
 		ts := time.UnixMilli(int64(*metric.Timestamp))
 		m.LastTimeStamp = &ts
 	}
+	m.Quality = metricQuality(metric)
+	if properties := metricProperties(metric); properties != nil {
+		merged := make(map[string]any, len(m.Properties)+len(properties))
+		for key, value := range m.Properties {
+			merged[key] = value
+		}
+		for key, value := range properties {
+			merged[key] = value
+		}
+		m.Properties = merged
+	}
 
 	// only when IsNull exists in the payload and its value is true
 	newIsNull := metric.IsNull != nil && *metric.IsNull
@@ -135,12 +270,15 @@ func (m *Metric) Update(metric *sparkplugb.Payload_Metric) error {
 
 func (m *Metric) Fetch(isStale bool) *FetchedMetric {
 	metric := FetchedMetric{
-		Name:     m.Name,
-		Alias:    m.Alias,
-		Stale:    isStale,
-		DataType: m.DataType.String(),
-		IsNull:   m.IsNull,
-		Value:    m.Value,
+		Name:       m.Name,
+		Alias:      m.Alias,
+		Stale:      isStale,
+		DataType:   m.DataType.String(),
+		IsNull:     m.IsNull,
+		Value:      m.Value,
+		Units:      m.Units,
+		Quality:    m.Quality,
+		Properties: m.Properties,
 	}
 	if m.LastTimeStamp != nil {
 		metric.Timestamp = *m.LastTimeStamp
@@ -148,3 +286,35 @@ func (m *Metric) Fetch(isStale bool) *FetchedMetric {
 	// TODO: add value
 	return &metric
 }
+
+// Returns the value of a metric as float, or false if it is not numeric or boolean
+func NumericValue(value any) (float64, bool) {
+	switch v := value.(type) {
+	case bool:
+		if v {
+			return 1, true
+		}
+		return 0, true
+	case int8:
+		return float64(v), true
+	case int16:
+		return float64(v), true
+	case int32:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case uint8:
+		return float64(v), true
+	case uint16:
+		return float64(v), true
+	case uint32:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	case float32:
+		return float64(v), true
+	case float64:
+		return v, true
+	}
+	return 0, false
+}
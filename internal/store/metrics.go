@@ -0,0 +1,102 @@
+package store
+
+import (
+	"sort"
+
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	messagesDropped    = promauto.NewCounterVec(prometheus.CounterOpts{Name: "sparkplug_primary_messages_dropped_total", Help: "Messages dropped by the store because their group, node or device is unknown"}, []string{"type", "reason"})
+	metricsDropped     = promauto.NewCounterVec(prometheus.CounterOpts{Name: "sparkplug_primary_metrics_dropped_total", Help: "Metrics of messages dropped by the store because of a missing or unknown alias or an invalid value"}, []string{"type", "reason"})
+	processingDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{Name: "sparkplug_primary_message_processing_seconds", Help: "Duration of processing a message in the store", Buckets: metrics.DefaultBuckets}, []string{"type"})
+	messageLatency     = promauto.NewHistogramVec(prometheus.HistogramOpts{Name: "sparkplug_primary_message_latency_seconds", Help: "Duration from receiving a message until it was processed by the store, including queueing", Buckets: metrics.DefaultBuckets}, []string{"type"})
+)
+
+// The number of online and offline nodes and devices of a group
+type GroupStats struct {
+	GroupID        string
+	NodesOnline    int
+	NodesOffline   int
+	DevicesOnline  int
+	DevicesOffline int
+}
+
+// Returns the number of online and offline nodes and devices per group, sorted by group ID
+func (sm *StoreManager) Stats() []GroupStats {
+	sm.mu.RLock()
+	groupManagers := make([]*GroupManager, 0, len(sm.Groups))
+	for _, groupManager := range sm.Groups {
+		groupManagers = append(groupManagers, groupManager)
+	}
+	sm.mu.RUnlock()
+
+	stats := make([]GroupStats, 0, len(groupManagers))
+	for _, groupManager := range groupManagers {
+		groupManager.mu.RLock()
+		nodeManagers := make([]*NodeManager, 0, len(groupManager.Nodes))
+		for _, nodeManager := range groupManager.Nodes {
+			nodeManagers = append(nodeManagers, nodeManager)
+		}
+		groupManager.mu.RUnlock()
+
+		s := GroupStats{GroupID: groupManager.GroupID}
+		for _, nodeManager := range nodeManagers {
+			nodeManager.mu.RLock()
+			if nodeManager.Online {
+				s.NodesOnline++
+			} else {
+				s.NodesOffline++
+			}
+			for _, deviceManager := range nodeManager.Devices {
+				deviceManager.mu.RLock()
+				if deviceManager.Online {
+					s.DevicesOnline++
+				} else {
+					s.DevicesOffline++
+				}
+				deviceManager.mu.RUnlock()
+			}
+			nodeManager.mu.RUnlock()
+		}
+		stats = append(stats, s)
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].GroupID < stats[j].GroupID
+	})
+	return stats
+}
+
+// Registers the gauges of the store manager, which are computed when scraped
+func (sm *StoreManager) registerMetrics(msgChan <-chan Message) {
+	metrics.NewGaugeFunc("sparkplug_primary_message_queue_length", "Messages waiting to be processed by the store", []string{"queue"},
+		func(emit func(v float64, labelValues ...string)) {
+			queued := 0
+			for _, partition := range sm.partitions {
+				queued += len(partition)
+			}
+			emit(float64(len(msgChan)), "incoming")
+			emit(float64(queued), "partitions")
+		})
+	metrics.NewGaugeFunc("sparkplug_primary_message_queue_capacity", "Capacity of the message queues of the store", []string{"queue"},
+		func(emit func(v float64, labelValues ...string)) {
+			emit(float64(cap(msgChan)), "incoming")
+			emit(float64(len(sm.partitions)*cap(sm.partitions[0])), "partitions")
+		})
+	metrics.NewGaugeFunc("sparkplug_primary_nodes", "Edge nodes in the store by group and state", []string{"group", "state"},
+		func(emit func(v float64, labelValues ...string)) {
+			for _, s := range sm.Stats() {
+				emit(float64(s.NodesOnline), s.GroupID, "online")
+				emit(float64(s.NodesOffline), s.GroupID, "offline")
+			}
+		})
+	metrics.NewGaugeFunc("sparkplug_primary_devices", "Devices in the store by group and state", []string{"group", "state"},
+		func(emit func(v float64, labelValues ...string)) {
+			for _, s := range sm.Stats() {
+				emit(float64(s.DevicesOnline), s.GroupID, "online")
+				emit(float64(s.DevicesOffline), s.GroupID, "offline")
+			}
+		})
+}
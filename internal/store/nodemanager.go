@@ -13,10 +13,15 @@ type NodeManager struct {
 	GroupID       string                    // The group this node belongs to
 	NodeID        string                    // The node ID
 	Online        bool                      // Whether the node is online
+	Stale         bool                      // Whether the online node has not sent messages for its inactivity timeout
 	LastMessageAt time.Time                 // The last time a message was received regarding this node
 	Devices       map[string]*DeviceManager // The device managers for each device of this node (DeviceID -> DeviceManager)
 	Metrics       map[uint64]*Metric        // The metrics of this node (Alias -> Metric)
 
+	born     bool   // whether the node was online before
+	nextSeq  uint64 // the expected sequence number of the next message
+	seqKnown bool
+
 	mu sync.RWMutex
 }
 
@@ -25,6 +30,7 @@ type FetchedNode struct {
 	ID            string          `json:"id"`            // The node ID
 	GroupID       string          `json:"groupId"`       // The group ID
 	Online        bool            `json:"online"`        // Whether the node is online
+	Stale         bool            `json:"stale"`         // Whether the online node has not sent messages for its inactivity timeout
 	LastMessageAt time.Time       `json:"lastMessageAt"` // The last time a message was received regarding this node
 	Devices       []FetchedDevice `json:"devices"`       // The state of the devices
 	Metrics       []FetchedMetric `json:"metrics"`       // The metrics of this node
@@ -60,9 +66,13 @@ func (nm *NodeManager) nodeBirth(msg Message) {
 	if msg.ReceivedAt.After(nm.LastMessageAt) {
 		nm.LastMessageAt = msg.ReceivedAt
 	}
+	addEvent(birthEvent(msg, nm.born, nm.Online))
 	nm.Online = true
+	nm.Stale = false
+	nm.born = true
 
 	nm.Metrics = make(map[uint64]*Metric)
+	dropHistory(entity{GroupID: nm.GroupID, NodeID: nm.NodeID})
 
 	for _, metric := range msg.Payload.Metrics {
 		alias := metric.Alias
@@ -72,19 +82,23 @@ func (nm *NodeManager) nodeBirth(msg Message) {
 			} else {
 				logrus.Warnf("NBIRTH: Node %s got metric with nil alias and name: %s", nm.NodeID, *metric.Name)
 			}
+			metricsDropped.WithLabelValues(string(msg.Type), "no_alias").Inc()
 			continue
 		}
 
 		newMetric, err := NewMetric(metric)
 		if err != nil {
 			if metric.Name == nil {
-				logrus.Warnf("NBIRTH: Node %s got an invalid metric with alias %d and name %s: %v", nm.NodeID, *metric.Alias, *metric.Name, err)
+				logrus.Warnf("NBIRTH: Node %s got an invalid metric with alias %d: %v", nm.NodeID, *metric.Alias, err)
 			} else {
-				logrus.Warnf("NBIRTH: Node %s got an invalid metric with alias %d: %v", nm.NodeID, *metric.Name, err)
+				logrus.Warnf("NBIRTH: Node %s got an invalid metric with alias %d and name %s: %v", nm.NodeID, *metric.Alias, *metric.Name, err)
 			}
+			metricsDropped.WithLabelValues(string(msg.Type), "invalid").Inc()
 			continue
 		}
+		newMetric.ReceivedAt = msg.ReceivedAt
 		nm.Metrics[*alias] = newMetric
+		notifyUpdate(msg, "", newMetric)
 	}
 }
 
@@ -104,9 +118,7 @@ func (nm *NodeManager) nodeData(msg Message) {
 		return
 	}
 
-	if msg.ReceivedAt.After(nm.LastMessageAt) {
-		nm.LastMessageAt = msg.ReceivedAt
-	}
+	nm.touch(msg)
 
 	for _, metric := range msg.Payload.Metrics {
 		alias := metric.Alias
@@ -116,19 +128,25 @@ func (nm *NodeManager) nodeData(msg Message) {
 			} else {
 				logrus.Warnf("NDATA: Node %s got metric with nil alias and name: %s", nm.NodeID, *metric.Name)
 			}
+			metricsDropped.WithLabelValues(string(msg.Type), "no_alias").Inc()
 			continue
 		}
 
 		currMetric, ok := nm.Metrics[*alias]
 		if !ok {
 			logrus.Warnf("NDATA: Node %s got metric with unknown alias %d", nm.NodeID, *alias)
+			metricsDropped.WithLabelValues(string(msg.Type), "unknown_alias").Inc()
 			continue
 		}
 
 		err := currMetric.Update(metric)
 		if err != nil {
 			logrus.Warnf("NDATA: Node %s got an invalid metric with name %s: %v", nm.NodeID, currMetric.Name, err)
+			metricsDropped.WithLabelValues(string(msg.Type), "invalid").Inc()
+			continue
 		}
+		currMetric.ReceivedAt = msg.ReceivedAt
+		notifyUpdate(msg, "", currMetric)
 	}
 }
 
@@ -141,11 +159,86 @@ func (nm *NodeManager) nodeDeath(msg Message) {
 	if msg.ReceivedAt.After(nm.LastMessageAt) {
 		nm.LastMessageAt = msg.ReceivedAt
 	}
+	nm.setOffline(msg.ReceivedAt, string(msg.Type))
+}
+
+// Marks the node and its devices offline for the given cause
+func (nm *NodeManager) offline(at time.Time, cause string) {
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+	nm.setOffline(at, cause)
+}
+
+// Marks the node and its devices offline. Must be called with the lock held.
+func (nm *NodeManager) setOffline(at time.Time, cause string) {
+	if nm.Online {
+		addEvent(Event{Time: at, Type: EventDeath, GroupID: nm.GroupID, NodeID: nm.NodeID, Cause: cause})
+	}
 	nm.Online = false
+	nm.Stale = false
+	nm.seqKnown = false
 
+	deviceCause := cause
+	if cause == string(NodeDeath) {
+		deviceCause = CauseNodeDeath
+	}
 	for _, device := range nm.Devices {
-		device.offline()
+		device.offline(at, deviceCause)
+	}
+}
+
+// Checks the sequence number of a message of the node, which increases by one per message from 0 to 255 starting with the NBIRTH.
+// Returns false and the expected sequence number if messages were missed.
+func (nm *NodeManager) checkSeq(msg Message) (uint64, bool) {
+	if msg.Payload == nil || msg.Payload.Seq == nil || msg.Type == NodeDeath || msg.Type == NodeCommand || msg.Type == DeviceCommand {
+		return 0, true
 	}
+
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+	seq := msg.Payload.GetSeq()
+	expected, known := nm.nextSeq, nm.seqKnown
+	nm.nextSeq = (seq + 1) % 256
+	nm.seqKnown = true
+	if msg.Type == NodeBirth || !known {
+		return 0, true
+	}
+	return expected, seq == expected
+}
+
+// Updates the time of the last message of the node, which recovers a stale node. Must be called with the lock held.
+func (nm *NodeManager) touch(msg Message) {
+	if msg.ReceivedAt.After(nm.LastMessageAt) {
+		nm.LastMessageAt = msg.ReceivedAt
+	}
+	if nm.Stale {
+		addEvent(recoveredEvent(msg, ""))
+		nm.Stale = false
+	}
+}
+
+// Flags the node and its devices stale if they did not send a message within their timeout.
+// Returns true if the node or one of its devices timed out just now.
+func (nm *NodeManager) checkTimeout(w *watchdogSettings, now time.Time) bool {
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+
+	if !nm.Online {
+		return false
+	}
+	timedOut := false
+	timeout := w.entityTimeout(nm.GroupID + "/" + nm.NodeID)
+	if timeout > 0 && !nm.Stale && now.Sub(nm.LastMessageAt) > timeout {
+		addEvent(timeoutEvent(nm.GroupID, nm.NodeID, "", timeout, now))
+		nm.Stale = true
+		timedOut = true
+	}
+	for _, device := range nm.Devices {
+		if device.checkTimeout(w, now) {
+			timedOut = true
+		}
+	}
+	return timedOut
 }
 
 func (nm *NodeManager) deviceBirth(msg Message) {
@@ -158,9 +251,7 @@ func (nm *NodeManager) deviceBirth(msg Message) {
 		deviceManager = nm.Devices[msg.DeviceID]
 	}
 
-	if msg.ReceivedAt.After(nm.LastMessageAt) {
-		nm.LastMessageAt = msg.ReceivedAt
-	}
+	nm.touch(msg)
 	deviceManager.deviceBirth(msg)
 }
 
@@ -171,12 +262,11 @@ func (nm *NodeManager) deviceData(msg Message) {
 	deviceManager, ok := nm.Devices[msg.DeviceID]
 	if !ok {
 		logrus.Debugf("DDATA: Device %s is currently not in node %s", msg.NodeID, nm.NodeID)
+		messagesDropped.WithLabelValues(string(msg.Type), "unknown_device").Inc()
 		return
 	}
 
-	if msg.ReceivedAt.After(nm.LastMessageAt) {
-		nm.LastMessageAt = msg.ReceivedAt
-	}
+	nm.touch(msg)
 	deviceManager.deviceData(msg)
 }
 
@@ -187,12 +277,11 @@ func (nm *NodeManager) deviceDeath(msg Message) {
 	deviceManager, ok := nm.Devices[msg.DeviceID]
 	if !ok {
 		logrus.Debugf("DDEATH: Device %s is currently not in node %s", msg.NodeID, nm.NodeID)
+		messagesDropped.WithLabelValues(string(msg.Type), "unknown_device").Inc()
 		return
 	}
 
-	if msg.ReceivedAt.After(nm.LastMessageAt) {
-		nm.LastMessageAt = msg.ReceivedAt
-	}
+	nm.touch(msg)
 	deviceManager.deviceDeath(msg)
 }
 
@@ -201,6 +290,7 @@ func (nm *NodeManager) Fetch() *FetchedNode {
 	nm.mu.RLock()
 	defer nm.mu.RUnlock()
 
+	w, now := currentWatchdog(), time.Now()
 	sortedDeviceIDs := util.SortedKeys(nm.Devices)
 	devices := make([]FetchedDevice, 0, len(nm.Devices))
 	for _, deviceID := range sortedDeviceIDs {
@@ -211,7 +301,9 @@ func (nm *NodeManager) Fetch() *FetchedNode {
 	sortedAliases := util.SortedKeys(nm.Metrics)
 	metrics := make([]FetchedMetric, 0, len(nm.Metrics))
 	for _, alias := range sortedAliases {
-		fetchedMetric := nm.Metrics[alias].Fetch(!nm.Online)
+		metric := nm.Metrics[alias]
+		path := nm.GroupID + "/" + nm.NodeID + "/" + metric.Name
+		fetchedMetric := metric.Fetch(!nm.Online || nm.Stale || w.metricStale(path, metric.ReceivedAt, now))
 		metrics = append(metrics, *fetchedMetric)
 	}
 
@@ -219,6 +311,7 @@ func (nm *NodeManager) Fetch() *FetchedNode {
 		ID:            nm.NodeID,
 		GroupID:       nm.GroupID,
 		Online:        nm.Online,
+		Stale:         nm.Stale,
 		LastMessageAt: nm.LastMessageAt,
 		Devices:       devices,
 		Metrics:       metrics,
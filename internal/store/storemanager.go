@@ -1,91 +1,339 @@
 package store
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sort"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/sirupsen/logrus"
 )
 
+// Returned by Ping once all messages are processed after the message channel was closed
+var ErrStopped = errors.New("store is stopped")
+
+// The buffer size of each partition's message queue
+const partitionQueueSize = 100
+
+// The minimum interval between two rebirth requests for the same edge node
+const rebirthRequestInterval = 10 * time.Second
+
 type StoreManager struct {
 	mu     sync.RWMutex
 	Groups map[string]*GroupManager
+
+	partitions []chan Message
+	pings      []chan chan struct{} // the workers close the received channel, see Ping
+	processed  uint64
+	done       chan struct{}
+
+	rebirthMu        sync.Mutex
+	rebirthHandler   func(groupID, nodeID, reason string) bool
+	rebirthRequested map[EdgeNode]time.Time
 }
 
-func NewStoreManager(msgChan <-chan Message) *StoreManager {
+// Creates a new StoreManager consuming the given channel.
+// Messages are partitioned by group and node onto the given amount of workers,
+// so messages of a single node are processed in order while different nodes are processed in parallel.
+func NewStoreManager(msgChan <-chan Message, workers int) *StoreManager {
+	if workers < 1 {
+		workers = 1
+	}
+
 	sm := &StoreManager{
-		Groups: make(map[string]*GroupManager),
+		Groups:           make(map[string]*GroupManager),
+		partitions:       make([]chan Message, workers),
+		pings:            make([]chan chan struct{}, workers),
+		done:             make(chan struct{}),
+		rebirthRequested: make(map[EdgeNode]time.Time),
+	}
+	for i := range sm.partitions {
+		sm.partitions[i] = make(chan Message, partitionQueueSize)
+		sm.pings[i] = make(chan chan struct{})
 	}
 
+	sm.registerMetrics(msgChan)
 	go sm.start(msgChan)
+	go sm.watch()
 	return sm
 }
 
 func (sm *StoreManager) start(msgChan <-chan Message) {
+	var wg sync.WaitGroup
+	for i, partition := range sm.partitions {
+		wg.Add(1)
+		go func(partition <-chan Message, ping <-chan chan struct{}) {
+			defer wg.Done()
+			for {
+				select {
+				case msg, ok := <-partition:
+					if !ok {
+						return
+					}
+					start := time.Now()
+					sm.processMessage(msg)
+					atomic.AddUint64(&sm.processed, 1)
+					processingDuration.WithLabelValues(string(msg.Type)).Observe(time.Since(start).Seconds())
+					messageLatency.WithLabelValues(string(msg.Type)).Observe(time.Since(msg.ReceivedAt).Seconds())
+				case reply := <-ping:
+					close(reply)
+				}
+			}
+		}(partition, sm.pings[i])
+	}
+
 	for msg := range msgChan {
-		sm.processMessage(msg)
+		sm.partitions[sm.partitionOf(msg)] <- msg
 	}
+
+	for _, partition := range sm.partitions {
+		close(partition)
+	}
+	wg.Wait()
+	close(sm.done)
 }
 
-func (sm *StoreManager) processMessage(msg Message) {
+// Returns the index of the partition responsible for the node of the given message
+func (sm *StoreManager) partitionOf(msg Message) int {
+	h := fnv.New32a()
+	h.Write([]byte(msg.GroupID))
+	h.Write([]byte{'/'})
+	h.Write([]byte(msg.NodeID))
+	return int(h.Sum32() % uint32(len(sm.partitions)))
+}
+
+// Returns the amount of messages processed since the start of the application
+func (sm *StoreManager) Processed() uint64 {
+	return atomic.LoadUint64(&sm.processed)
+}
+
+// Returns an error if any worker does not respond before the context is done, e.g. because it is blocked
+func (sm *StoreManager) Ping(ctx context.Context) error {
+	for i, ping := range sm.pings {
+		reply := make(chan struct{})
+		select {
+		case ping <- reply:
+		case <-sm.done:
+			return ErrStopped
+		case <-ctx.Done():
+			return fmt.Errorf("store worker %d is not responding: %w", i, ctx.Err())
+		}
+	}
+	return nil
+}
+
+// Returns a channel which is closed once the message channel has been closed and all messages are processed
+func (sm *StoreManager) Done() <-chan struct{} {
+	return sm.done
+}
+
+// Returns the group manager for the given group ID, creating it if create is true
+func (sm *StoreManager) group(groupID string, create bool) (*GroupManager, bool) {
+	sm.mu.RLock()
+	groupManager, ok := sm.Groups[groupID]
+	sm.mu.RUnlock()
+	if ok || !create {
+		return groupManager, ok
+	}
+
 	sm.mu.Lock()
 	defer sm.mu.Unlock()
+	groupManager, ok = sm.Groups[groupID]
+	if !ok {
+		groupManager = NewGroupManager(groupID)
+		sm.Groups[groupID] = groupManager
+	}
+	return groupManager, true
+}
+
+// Sets the handler called when messages of an edge node unknown to the store are received or messages of a node were missed,
+// so the node can be requested to republish its birth certificates.
+// The handler returns false if no rebirth was requested.
+func (sm *StoreManager) SetRebirthHandler(handler func(groupID, nodeID, reason string) bool) {
+	sm.rebirthMu.Lock()
+	defer sm.rebirthMu.Unlock()
+	sm.rebirthHandler = handler
+}
 
+// Requests a rebirth of the node of a message unknown to the store
+func (sm *StoreManager) unknownNode(msg Message) {
+	if msg.Type == NodeDeath || msg.Type == NodeCommand || msg.Type == DeviceCommand {
+		return
+	}
+	sm.requestRebirth(msg, CauseUnknownEdgeNode)
+}
+
+// Calls the rebirth handler for the node of the given message, at most once per rebirthRequestInterval
+func (sm *StoreManager) requestRebirth(msg Message, reason string) {
+	sm.RequestRebirth(EdgeNode{GroupID: msg.GroupID, NodeID: msg.NodeID}, reason)
+}
+
+// Calls the rebirth handler for the given node, unless a rebirth of it was requested within rebirthRequestInterval
+func (sm *StoreManager) RequestRebirth(edgeNode EdgeNode, reason string) {
+	sm.rebirthMu.Lock()
+	defer sm.rebirthMu.Unlock()
+	if sm.rebirthHandler == nil || time.Since(sm.rebirthRequested[edgeNode]) < rebirthRequestInterval {
+		return
+	}
+	if sm.rebirthHandler(edgeNode.GroupID, edgeNode.NodeID, reason) {
+		sm.rebirthRequested[edgeNode] = time.Now()
+	}
+}
+
+func (sm *StoreManager) processMessage(msg Message) {
 	addMessage(msg)
+
+	groupManager, ok := sm.group(msg.GroupID, msg.Type == NodeBirth)
+	if !ok {
+		logrus.Debugf("%s: Group %s is currently not in store", msg.Type, msg.GroupID)
+		messagesDropped.WithLabelValues(string(msg.Type), "unknown_group").Inc()
+		sm.unknownNode(msg)
+		return
+	}
+	if msg.Type != NodeBirth && !groupManager.hasNode(msg.NodeID) {
+		logrus.Debugf("%s: Node %s is currently not in group %s", msg.Type, msg.NodeID, msg.GroupID)
+		messagesDropped.WithLabelValues(string(msg.Type), "unknown_node").Inc()
+		sm.unknownNode(msg)
+		return
+	}
+
 	switch msg.Type {
 	case NodeBirth:
-		groupManager, ok := sm.Groups[msg.GroupID]
-		if !ok {
-			sm.Groups[msg.GroupID] = NewGroupManager(msg.GroupID)
-			groupManager = sm.Groups[msg.GroupID]
-		}
 		groupManager.nodeBirth(msg)
 	case NodeData:
-		groupManager, ok := sm.Groups[msg.GroupID]
-		if !ok {
-			logrus.Debugf("NDATA: Group %s is currently not in store", msg.GroupID)
-			return
-		}
 		groupManager.nodeData(msg)
 	case NodeDeath:
-		groupManager, ok := sm.Groups[msg.GroupID]
-		if !ok {
-			logrus.Debugf("NDEATH: Group %s is currently not in store", msg.GroupID)
-			return
-		}
 		groupManager.nodeDeath(msg)
 	case DeviceBirth:
-		groupManager, ok := sm.Groups[msg.GroupID]
-		if !ok {
-			logrus.Debugf("DBIRTH: Group %s is currently not in store", msg.GroupID)
-			return
-		}
 		groupManager.deviceBirth(msg)
 	case DeviceData:
-		groupManager, ok := sm.Groups[msg.GroupID]
-		if !ok {
-			logrus.Debugf("DDATA: Group %s is currently not in store", msg.GroupID)
-			return
-		}
 		groupManager.deviceData(msg)
 	case DeviceDeath:
-		groupManager, ok := sm.Groups[msg.GroupID]
-		if !ok {
-			logrus.Debugf("DDEATH: Group %s is currently not in store", msg.GroupID)
-			return
-		}
 		groupManager.deviceDeath(msg)
+	case NodeCommand, DeviceCommand:
+		// commands do not change the state of the store, they are only recorded by the audit log
 	default:
 		logrus.Warnf("Unimplemented message type: %s", msg.Type)
 	}
+
+	// a gap in the sequence numbers means messages were missed, so the state of the node may be wrong
+	if expected, ok := groupManager.checkSeq(msg); !ok {
+		logrus.Warnf("%s: Node %s in group %s sent seq %d, expected %d", msg.Type, msg.NodeID, msg.GroupID, msg.Payload.GetSeq(), expected)
+		sm.requestRebirth(msg, CauseSeqGap)
+	}
 }
 
+// Returns the current state of all groups, sorted by group ID
 func (sm *StoreManager) Fetch() *[]FetchedGroup {
 	sm.mu.RLock()
-	defer sm.mu.RUnlock()
-
-	fetchedGroups := make([]FetchedGroup, 0)
+	groupManagers := make([]*GroupManager, 0, len(sm.Groups))
 	for _, groupManager := range sm.Groups {
+		groupManagers = append(groupManagers, groupManager)
+	}
+	sm.mu.RUnlock()
+
+	sort.Slice(groupManagers, func(i, j int) bool {
+		return groupManagers[i].GroupID < groupManagers[j].GroupID
+	})
+
+	fetchedGroups := make([]FetchedGroup, 0, len(groupManagers))
+	for _, groupManager := range groupManagers {
 		fetchedGroups = append(fetchedGroups, *groupManager.Fetch())
 	}
 	return &fetchedGroups
 }
+
+// Returns the current state of a single node, or false if the node is not in the store
+func (sm *StoreManager) FetchNode(groupID, nodeID string) (*FetchedNode, bool) {
+	groupManager, ok := sm.group(groupID, false)
+	if !ok {
+		return nil, false
+	}
+
+	groupManager.mu.RLock()
+	nodeManager, ok := groupManager.Nodes[nodeID]
+	groupManager.mu.RUnlock()
+	if !ok {
+		return nil, false
+	}
+	return nodeManager.Fetch(), true
+}
+
+// Returns the metrics of the given node, or of its device if a device ID is given
+func (sm *StoreManager) FetchMetrics(groupID, nodeID, deviceID string) ([]FetchedMetric, bool) {
+	node, ok := sm.FetchNode(groupID, nodeID)
+	if !ok {
+		return nil, false
+	}
+	if deviceID == "" {
+		return node.Metrics, true
+	}
+	for _, device := range node.Devices {
+		if device.ID == deviceID {
+			return device.Metrics, true
+		}
+	}
+	return nil, false
+}
+
+// Identifies an edge node of a group
+type EdgeNode struct {
+	GroupID string `json:"groupId"`
+	NodeID  string `json:"nodeId"`
+}
+
+// Returns all edge nodes currently in the store, sorted by group and node ID
+func (sm *StoreManager) EdgeNodes() []EdgeNode {
+	sm.mu.RLock()
+	groupManagers := make([]*GroupManager, 0, len(sm.Groups))
+	for _, groupManager := range sm.Groups {
+		groupManagers = append(groupManagers, groupManager)
+	}
+	sm.mu.RUnlock()
+
+	edgeNodes := make([]EdgeNode, 0)
+	for _, groupManager := range groupManagers {
+		groupManager.mu.RLock()
+		for nodeID := range groupManager.Nodes {
+			edgeNodes = append(edgeNodes, EdgeNode{GroupID: groupManager.GroupID, NodeID: nodeID})
+		}
+		groupManager.mu.RUnlock()
+	}
+	sort.Slice(edgeNodes, func(i, j int) bool {
+		if edgeNodes[i].GroupID != edgeNodes[j].GroupID {
+			return edgeNodes[i].GroupID < edgeNodes[j].GroupID
+		}
+		return edgeNodes[i].NodeID < edgeNodes[j].NodeID
+	})
+	return edgeNodes
+}
+
+// Drops the recorded messages, events and metric values as well as the update and event handlers shared by all stores.
+// It is meant for tests, which start a new store each while the stopped store of the last test must not be processing messages.
+func Reset() {
+	msgLogMutex.Lock()
+	msgLog = make([]FetchedMessage, 0)
+	msgLogNext = 0
+	msgLogFull = false
+	msgLogMutex.Unlock()
+
+	eventLogMutex.Lock()
+	eventLog = make(map[entity]*eventHistory)
+	eventLogMutex.Unlock()
+
+	valueLogMutex.Lock()
+	valueLog = make(map[entity]map[string]*valueHistory)
+	valueLogMutex.Unlock()
+
+	updateHandlersMu.Lock()
+	updateHandlers.Store([]func(MetricUpdate){})
+	updateHandlersMu.Unlock()
+
+	eventHandlersMu.Lock()
+	eventHandlers.Store([]func(Event){})
+	eventHandlersMu.Unlock()
+}
@@ -0,0 +1,131 @@
+package store
+
+import (
+	"fmt"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/DATATRONiQ/go-sparkplug-primary/third_party/sparkplugb"
+	"google.golang.org/protobuf/proto"
+)
+
+// Returns a message of the given node, or of its device if a device ID is given, with the Int64 metric value
+func testMessage(groupID, nodeID, deviceID string, msgType Type, seq uint64, value int64) Message {
+	return Message{
+		ReceivedAt: time.Now(),
+		GroupID:    groupID,
+		NodeID:     nodeID,
+		DeviceID:   deviceID,
+		Type:       msgType,
+		Payload: &sparkplugb.Payload{
+			Timestamp: proto.Uint64(uint64(time.Now().UnixMilli())),
+			Seq:       proto.Uint64(seq),
+			Metrics: []*sparkplugb.Payload_Metric{{
+				Name:     proto.String("value"),
+				Alias:    proto.Uint64(1),
+				Datatype: proto.Uint32(uint32(sparkplugb.DataType_Int64)),
+				Value:    &sparkplugb.Payload_Metric_LongValue{LongValue: uint64(value)},
+			}},
+		},
+	}
+}
+
+// Waits until the store stopped after its message channel was closed
+func waitDone(t testing.TB, sm *StoreManager) {
+	t.Helper()
+	select {
+	case <-sm.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatalf("store did not stop, processed %d messages", sm.Processed())
+	}
+}
+
+func TestStoreManagerOrder(t *testing.T) {
+	Reset()
+	t.Cleanup(Reset)
+	const workers, nodes, values = 4, 16, 200
+
+	var mu sync.Mutex
+	received := make(map[string][]int64)
+	AddUpdateHandler(func(u MetricUpdate) {
+		mu.Lock()
+		defer mu.Unlock()
+		key := u.GroupID + "/" + u.NodeID + "/" + u.DeviceID
+		received[key] = append(received[key], u.Value.(int64))
+	})
+
+	msgChan := make(chan Message, 10)
+	sm := NewStoreManager(msgChan, workers)
+	partitions := make(map[int]bool)
+	for n := 0; n < nodes; n++ {
+		msg := testMessage("g1", fmt.Sprintf("n%d", n), "", NodeBirth, 0, 0)
+		partitions[sm.partitionOf(msg)] = true
+		// the devices of a node are processed by the worker of the node
+		if device := testMessage("g1", fmt.Sprintf("n%d", n), "d1", DeviceBirth, 0, 0); sm.partitionOf(device) != sm.partitionOf(msg) {
+			t.Errorf("device of node n%d is partitioned onto worker %d instead of %d", n, sm.partitionOf(device), sm.partitionOf(msg))
+		}
+	}
+	if len(partitions) < 2 {
+		t.Fatalf("%d nodes partitioned onto %d of %d workers", nodes, len(partitions), workers)
+	}
+
+	go func() {
+		for n := 0; n < nodes; n++ {
+			msgChan <- testMessage("g1", fmt.Sprintf("n%d", n), "", NodeBirth, 0, 0)
+			msgChan <- testMessage("g1", fmt.Sprintf("n%d", n), "d1", DeviceBirth, 1, 0)
+		}
+		// interleaves the values of all nodes, so the workers process them in parallel
+		for v := int64(1); v <= values; v++ {
+			for n := 0; n < nodes; n++ {
+				seq := uint64(2*v) % 256
+				msgChan <- testMessage("g1", fmt.Sprintf("n%d", n), "", NodeData, seq, v)
+				msgChan <- testMessage("g1", fmt.Sprintf("n%d", n), "d1", DeviceData, seq+1, v)
+			}
+		}
+		close(msgChan)
+	}()
+	waitDone(t, sm)
+
+	if total := uint64(2 * nodes * (values + 1)); sm.Processed() != total {
+		t.Errorf("processed %d messages, want %d", sm.Processed(), total)
+	}
+	if len(received) != 2*nodes {
+		t.Fatalf("got updates of %d nodes and devices, want %d", len(received), 2*nodes)
+	}
+	for key, got := range received {
+		if len(got) != values+1 {
+			t.Errorf("%s: got %d updates, want %d", key, len(got), values+1)
+			continue
+		}
+		for i, value := range got {
+			if value != int64(i) {
+				t.Errorf("%s: update %d has value %d, the updates are out of order", key, i, value)
+				break
+			}
+		}
+	}
+}
+
+func BenchmarkStoreManager(b *testing.B) {
+	Reset()
+	b.Cleanup(Reset)
+	const nodes = 1000
+
+	msgChan := make(chan Message, 1000)
+	sm := NewStoreManager(msgChan, runtime.NumCPU())
+	for n := 0; n < nodes; n++ {
+		msgChan <- testMessage("g1", fmt.Sprintf("n%d", n), "", NodeBirth, 0, 0)
+	}
+	for sm.Processed() < nodes {
+		time.Sleep(time.Millisecond)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		msgChan <- testMessage("g1", fmt.Sprintf("n%d", i%nodes), "", NodeData, uint64(i/nodes+1)%256, int64(i))
+	}
+	close(msgChan)
+	waitDone(b, sm)
+}
@@ -0,0 +1,131 @@
+// Package storetest provides a store fed by the test itself and a commander recording its commands,
+// for the tests of the APIs serving the store.
+package storetest
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/sparkplug"
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/store"
+	"github.com/DATATRONiQ/go-sparkplug-primary/third_party/sparkplugb"
+	"google.golang.org/protobuf/proto"
+)
+
+// The time a published message may take until it is processed by the store
+const processTimeout = 5 * time.Second
+
+// A store processing the messages published by the test
+type Store struct {
+	*store.StoreManager
+	messages chan store.Message
+}
+
+// Resets the shared state of the store package and starts a store with a single worker, stopped when the test ends
+func New(t testing.TB) *Store {
+	t.Helper()
+	store.Reset()
+	s := &Store{messages: make(chan store.Message, 10)}
+	s.StoreManager = store.NewStoreManager(s.messages, 1)
+	t.Cleanup(func() {
+		close(s.messages)
+		select {
+		case <-s.Done():
+		case <-time.After(processTimeout):
+			t.Errorf("store did not stop within %v", processTimeout)
+		}
+		store.Reset()
+	})
+	return s
+}
+
+// Passes the message to the store and waits until it is processed, failing the test if that takes longer than processTimeout
+func (s *Store) Publish(t testing.TB, msg store.Message) {
+	t.Helper()
+	if msg.ReceivedAt.IsZero() {
+		msg.ReceivedAt = time.Now()
+	}
+	processed := s.Processed()
+	deadline := time.Now().Add(processTimeout)
+	select {
+	case s.messages <- msg:
+	case <-time.After(processTimeout):
+		t.Fatalf("%s of %s/%s not accepted by the store within %v", msg.Type, msg.GroupID, msg.NodeID, processTimeout)
+	}
+	for s.Processed() == processed {
+		if time.Now().After(deadline) {
+			t.Fatalf("%s of %s/%s not processed by the store within %v", msg.Type, msg.GroupID, msg.NodeID, processTimeout)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// Publishes a message of the given edge node with a single metric, timestamped now
+func (s *Store) PublishMetric(t testing.TB, groupID, nodeID string, msgType store.Type, seq uint64, metric *sparkplugb.Payload_Metric) {
+	t.Helper()
+	now := proto.Uint64(uint64(time.Now().UnixMilli()))
+	if metric.Timestamp == nil {
+		metric.Timestamp = now
+	}
+	s.Publish(t, store.Message{GroupID: groupID, NodeID: nodeID, Type: msgType, Payload: &sparkplugb.Payload{
+		Timestamp: now,
+		Seq:       proto.Uint64(seq),
+		Metrics:   []*sparkplugb.Payload_Metric{metric},
+	}})
+}
+
+// Returns an Int64 metric with the given name, alias and value
+func Int64Metric(name string, alias uint64, value int64) *sparkplugb.Payload_Metric {
+	return &sparkplugb.Payload_Metric{
+		Name:     proto.String(name),
+		Alias:    proto.Uint64(alias),
+		Datatype: proto.Uint32(uint32(sparkplugb.DataType_Int64)),
+		Value:    &sparkplugb.Payload_Metric_LongValue{LongValue: uint64(value)},
+	}
+}
+
+// Returns a Double metric with the given name, alias and value
+func DoubleMetric(name string, alias uint64, value float64) *sparkplugb.Payload_Metric {
+	return &sparkplugb.Payload_Metric{
+		Name:     proto.String(name),
+		Alias:    proto.Uint64(alias),
+		Datatype: proto.Uint32(uint32(sparkplugb.DataType_Double)),
+		Value:    &sparkplugb.Payload_Metric_DoubleValue{DoubleValue: value},
+	}
+}
+
+// Records the commands and rebirth requests sent through it
+type Commander struct {
+	mu       sync.Mutex
+	commands []sparkplug.CommandMetric
+	rebirths []string
+}
+
+func (c *Commander) SendCommand(groupID, nodeID, deviceID string, metrics []sparkplug.CommandMetric) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.commands = append(c.commands, metrics...)
+	return nil
+}
+
+func (c *Commander) RequestRebirth(groupID, nodeID string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.rebirths = append(c.rebirths, groupID+"/"+nodeID)
+	return nil
+}
+
+// Returns the metrics of all commands sent so far
+func (c *Commander) Commands() []sparkplug.CommandMetric {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]sparkplug.CommandMetric{}, c.commands...)
+}
+
+// Returns the edge nodes "<group>/<node>" of all rebirth requests sent so far
+func (c *Commander) Rebirths() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]string{}, c.rebirths...)
+}
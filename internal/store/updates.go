@@ -0,0 +1,77 @@
+package store
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A metric value applied to the store by a birth or data message
+type MetricUpdate struct {
+	GroupID    string    `json:"groupId"`
+	NodeID     string    `json:"nodeId"`
+	DeviceID   string    `json:"deviceId,omitempty"` // Empty for metrics of the node
+	Name       string    `json:"name"`
+	DataType   string    `json:"dataType"`
+	IsNull     bool      `json:"isNull"`
+	Value      any       `json:"value"`
+	Timestamp  time.Time `json:"timestamp"`       // The timestamp of the value sent by the edge node, the receive time if it sent none
+	Units      string    `json:"units,omitempty"` // The engineering units of the birth certificate, if any
+	Quality    Quality   `json:"quality"`
+	Birth      bool      `json:"birth,omitempty"` // Whether the value is of a birth certificate
+	ReceivedAt time.Time `json:"receivedAt"`
+}
+
+// Returns the path of the metric, "<group>/<node>[/<device>]/<metric>"
+func (u MetricUpdate) Path() string {
+	if u.DeviceID == "" {
+		return u.GroupID + "/" + u.NodeID + "/" + u.Name
+	}
+	return u.GroupID + "/" + u.NodeID + "/" + u.DeviceID + "/" + u.Name
+}
+
+// the handlers called for every applied metric value, see AddUpdateHandler
+var (
+	updateHandlers   atomic.Value // []func(MetricUpdate)
+	updateHandlersMu sync.Mutex
+)
+
+// Adds a handler called for every metric value applied to the store.
+// It is called by the store workers while the node is locked, so it must be fast and must not call back into the store.
+func AddUpdateHandler(handler func(MetricUpdate)) {
+	updateHandlersMu.Lock()
+	defer updateHandlersMu.Unlock()
+	handlers, _ := updateHandlers.Load().([]func(MetricUpdate))
+	updateHandlers.Store(append(append([]func(MetricUpdate){}, handlers...), handler))
+}
+
+// Adds the current value of the given metric to its history and calls the update handlers, if any
+func notifyUpdate(msg Message, deviceID string, metric *Metric) {
+	handlers, _ := updateHandlers.Load().([]func(MetricUpdate))
+	if len(handlers) == 0 && ValueHistorySize <= 0 {
+		return
+	}
+	u := MetricUpdate{
+		GroupID:    msg.GroupID,
+		NodeID:     msg.NodeID,
+		DeviceID:   deviceID,
+		Name:       metric.Name,
+		DataType:   metric.DataType.String(),
+		IsNull:     metric.IsNull,
+		Value:      metric.Value,
+		Timestamp:  msg.ReceivedAt,
+		Units:      metric.Units,
+		Quality:    metric.Quality,
+		Birth:      msg.Type == NodeBirth || msg.Type == DeviceBirth,
+		ReceivedAt: msg.ReceivedAt,
+	}
+	if metric.LastTimeStamp != nil {
+		u.Timestamp = *metric.LastTimeStamp
+	}
+	if ValueHistorySize > 0 {
+		addValue(u)
+	}
+	for _, handler := range handlers {
+		handler(u)
+	}
+}
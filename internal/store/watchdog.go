@@ -0,0 +1,208 @@
+package store
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/util"
+)
+
+// The interval in which the watchdog checks the inactivity timeouts
+const watchdogInterval = time.Second
+
+// A timeout of the nodes, devices or metrics whose path matches the glob pattern
+type Timeout struct {
+	Pattern string
+	Timeout time.Duration
+}
+
+// Parses timeouts of the form "<pattern>=<duration>", a duration of 0 disables the timeout
+func ParseTimeouts(values []string) ([]Timeout, error) {
+	timeouts := make([]Timeout, 0, len(values))
+	for _, value := range values {
+		i := strings.LastIndex(value, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("timeout %q: must be of the form <pattern>=<duration>", value)
+		}
+		d, err := time.ParseDuration(value[i+1:])
+		if err != nil || d < 0 {
+			return nil, fmt.Errorf("timeout %q: must be a non-negative duration", value)
+		}
+		timeouts = append(timeouts, Timeout{Pattern: value[:i], Timeout: d})
+	}
+	return timeouts, nil
+}
+
+// The settings of the watchdog flagging nodes, devices and metrics as stale which have not sent messages for their timeout
+type WatchdogConfig struct {
+	Timeout        time.Duration // The timeout of all nodes and devices without matching timeout, disabled if 0
+	Timeouts       []Timeout     // Timeouts of nodes and devices matching "<group>/<node>" or "<group>/<node>/<device>", the first match applies
+	MetricTimeouts []Timeout     // Timeouts of metrics matching "<group>/<node>[/<device>]/<metric>", e.g. their expected scan rate
+	Rebirth        bool          // Whether a rebirth of a node is requested when it or one of its devices timed out
+}
+
+type compiledTimeout struct {
+	pattern *regexp.Regexp
+	timeout time.Duration
+}
+
+// The compiled watchdog settings
+type watchdogSettings struct {
+	timeout        time.Duration
+	timeouts       []compiledTimeout
+	metricTimeouts []compiledTimeout
+	rebirth        bool
+}
+
+// the current watchdog settings, replaced on configuration reload
+var watchdog atomic.Value // *watchdogSettings
+
+func init() {
+	watchdog.Store(&watchdogSettings{})
+}
+
+func compileTimeouts(timeouts []Timeout) ([]compiledTimeout, error) {
+	compiled := make([]compiledTimeout, 0, len(timeouts))
+	for _, t := range timeouts {
+		re, err := util.Glob(t.Pattern)
+		if err != nil {
+			return nil, err
+		}
+		compiled = append(compiled, compiledTimeout{pattern: re, timeout: t.Timeout})
+	}
+	return compiled, nil
+}
+
+// Returns an error if a pattern of the settings is invalid
+func (cfg WatchdogConfig) Validate() error {
+	_, err := cfg.compile()
+	return err
+}
+
+func (cfg WatchdogConfig) compile() (*watchdogSettings, error) {
+	if cfg.Timeout < 0 {
+		return nil, fmt.Errorf("timeout must not be negative, got %v", cfg.Timeout)
+	}
+	timeouts, err := compileTimeouts(cfg.Timeouts)
+	if err != nil {
+		return nil, err
+	}
+	metricTimeouts, err := compileTimeouts(cfg.MetricTimeouts)
+	if err != nil {
+		return nil, err
+	}
+	return &watchdogSettings{
+		timeout:        cfg.Timeout,
+		timeouts:       timeouts,
+		metricTimeouts: metricTimeouts,
+		rebirth:        cfg.Rebirth,
+	}, nil
+}
+
+// Replaces the watchdog settings
+func SetWatchdog(cfg WatchdogConfig) error {
+	settings, err := cfg.compile()
+	if err != nil {
+		return err
+	}
+	watchdog.Store(settings)
+	return nil
+}
+
+func currentWatchdog() *watchdogSettings {
+	return watchdog.Load().(*watchdogSettings)
+}
+
+// Returns the timeout of the node or device of the given path, 0 if it never times out
+func (w *watchdogSettings) entityTimeout(path string) time.Duration {
+	for _, t := range w.timeouts {
+		if t.pattern.MatchString(path) {
+			return t.timeout
+		}
+	}
+	return w.timeout
+}
+
+// Returns true iff the metric of the given path has a timeout which passed since it was last received
+func (w *watchdogSettings) metricStale(path string, receivedAt, now time.Time) bool {
+	for _, t := range w.metricTimeouts {
+		if t.pattern.MatchString(path) {
+			return now.Sub(receivedAt) > t.timeout
+		}
+	}
+	return false
+}
+
+// Checks the timeouts of all nodes and devices in the watchdog interval until the store is stopped
+func (sm *StoreManager) watch() {
+	ticker := time.NewTicker(watchdogInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-sm.done:
+			return
+		case now := <-ticker.C:
+			sm.checkTimeouts(now)
+		}
+	}
+}
+
+// Flags nodes and devices stale which did not send a message within their timeout
+func (sm *StoreManager) checkTimeouts(now time.Time) {
+	w := currentWatchdog()
+	if w.timeout == 0 && len(w.timeouts) == 0 {
+		return
+	}
+
+	sm.mu.RLock()
+	groupManagers := make([]*GroupManager, 0, len(sm.Groups))
+	for _, groupManager := range sm.Groups {
+		groupManagers = append(groupManagers, groupManager)
+	}
+	sm.mu.RUnlock()
+
+	for _, groupManager := range groupManagers {
+		groupManager.mu.RLock()
+		nodeManagers := make([]*NodeManager, 0, len(groupManager.Nodes))
+		for _, nodeManager := range groupManager.Nodes {
+			nodeManagers = append(nodeManagers, nodeManager)
+		}
+		groupManager.mu.RUnlock()
+
+		for _, nodeManager := range nodeManagers {
+			if nodeManager.checkTimeout(w, now) && w.rebirth {
+				sm.requestRebirth(Message{GroupID: nodeManager.GroupID, NodeID: nodeManager.NodeID}, CauseTimeout)
+			}
+		}
+	}
+}
+
+// Returns the event of an entity which has not sent messages for the given timeout
+func timeoutEvent(groupID, nodeID, deviceID string, timeout time.Duration, now time.Time) Event {
+	return Event{
+		Time:     now,
+		Type:     EventTimeout,
+		GroupID:  groupID,
+		NodeID:   nodeID,
+		DeviceID: deviceID,
+		Cause:    fmt.Sprintf("no message for %v", timeout),
+		Online:   true,
+		Stale:    true,
+	}
+}
+
+// Returns the event of a stale entity which sent a message again
+func recoveredEvent(msg Message, deviceID string) Event {
+	return Event{
+		Time:     msg.ReceivedAt,
+		Type:     EventRecovered,
+		GroupID:  msg.GroupID,
+		NodeID:   msg.NodeID,
+		DeviceID: deviceID,
+		Cause:    string(msg.Type),
+		Online:   true,
+	}
+}
@@ -0,0 +1,207 @@
+package uns
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/sparkplug"
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/store"
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/util"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sirupsen/logrus"
+)
+
+// The buffer size of the publish queue, messages are dropped if it is full
+const queueSize = 10000
+
+var messages = promauto.NewCounterVec(prometheus.CounterOpts{Name: "sparkplug_primary_uns_messages_total", Help: "Messages republished to the unified namespace by kind and result"}, []string{"kind", "result"})
+
+// The settings of the unified namespace. The topic templates contain the placeholders {group}, {node}, {device} and {metric};
+// a topic level consisting only of {device} is left out for metrics and status of the node.
+type Config struct {
+	TopicTemplate       string // The topic of the metric values
+	StatusTopicTemplate string // The topic of the online status of the nodes and devices, none if empty
+	QoS                 byte
+	Retain              bool
+}
+
+// Returns an error if the templates or the QoS are invalid
+func (c Config) Validate() error {
+	if !strings.Contains(c.TopicTemplate, "{metric}") {
+		return fmt.Errorf("topic template must contain {metric}, got %q", c.TopicTemplate)
+	}
+	if c.StatusTopicTemplate != "" && !strings.Contains(c.StatusTopicTemplate, "{node}") {
+		return fmt.Errorf("status topic template must contain {node}, got %q", c.StatusTopicTemplate)
+	}
+	for _, t := range []string{c.TopicTemplate, c.StatusTopicTemplate} {
+		if strings.ContainsAny(t, "+#") {
+			return fmt.Errorf("topic templates must not contain wildcards, got %q", t)
+		}
+	}
+	if c.QoS > 2 {
+		return fmt.Errorf("QoS must be 0, 1 or 2, got %d", c.QoS)
+	}
+	return nil
+}
+
+// Publishes MQTT messages, implemented by the sparkplug client
+type Publisher interface {
+	Publish(topic string, qos byte, retained bool, payload []byte) error
+}
+
+// The JSON payload of a metric value
+type Value struct {
+	Value     any           `json:"value"`
+	Type      string        `json:"type"`
+	Timestamp time.Time     `json:"timestamp"`
+	Quality   store.Quality `json:"quality"`
+	Units     string        `json:"units,omitempty"`
+}
+
+// The JSON payload of the status of a node or device
+type Status struct {
+	Online    bool            `json:"online"`
+	Stale     bool            `json:"stale"`
+	Event     store.EventType `json:"event"` // The lifecycle event which changed the status
+	Cause     string          `json:"cause,omitempty"`
+	Timestamp time.Time       `json:"timestamp"`
+}
+
+// A message waiting to be published
+type message struct {
+	kind    string // "value" or "status"
+	topic   string
+	payload any
+	cfg     Config
+}
+
+// Republishes the metric values and lifecycle events of the store as plain JSON to the unified namespace.
+// The store handlers only queue the messages, a single worker publishes them in order.
+type Bridge struct {
+	publisher Publisher
+	cfg       atomic.Value // Config
+	mu        sync.RWMutex
+	queue     chan message
+	closed    bool
+	done      chan struct{}
+}
+
+// Creates a bridge publishing with the given publisher
+func New(publisher Publisher, cfg Config) (*Bridge, error) {
+	b := &Bridge{publisher: publisher, queue: make(chan message, queueSize), done: make(chan struct{})}
+	if err := b.SetConfig(cfg); err != nil {
+		return nil, err
+	}
+	go b.run()
+	return b, nil
+}
+
+// Replaces the settings, applying to the messages queued from now on
+func (b *Bridge) SetConfig(cfg Config) error {
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	b.cfg.Store(cfg)
+	return nil
+}
+
+// Queues the value of a metric update, to be used as update handler of the store
+func (b *Bridge) PublishMetric(u store.MetricUpdate) {
+	cfg := b.cfg.Load().(Config)
+	b.enqueue(message{
+		kind:  "value",
+		topic: topic(cfg.TopicTemplate, u.GroupID, u.NodeID, u.DeviceID, u.Name),
+		payload: Value{
+			Value:     u.Value,
+			Type:      u.DataType,
+			Timestamp: u.Timestamp,
+			Quality:   u.Quality,
+			Units:     u.Units,
+		},
+		cfg: cfg,
+	})
+}
+
+// Queues the status of the node or device of a lifecycle event, to be used as event handler of the store
+func (b *Bridge) PublishStatus(e store.Event) {
+	cfg := b.cfg.Load().(Config)
+	if cfg.StatusTopicTemplate == "" || e.Type == store.EventRebirthRequest {
+		return
+	}
+	b.enqueue(message{
+		kind:  "status",
+		topic: topic(cfg.StatusTopicTemplate, e.GroupID, e.NodeID, e.DeviceID, ""),
+		payload: Status{
+			Online:    e.Online,
+			Stale:     e.Stale,
+			Event:     e.Type,
+			Cause:     e.Cause,
+			Timestamp: e.Time,
+		},
+		cfg: cfg,
+	})
+}
+
+// Queues the message without blocking the store, dropping it if the queue is full
+func (b *Bridge) enqueue(m message) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if b.closed {
+		return
+	}
+	select {
+	case b.queue <- m:
+	default:
+		messages.WithLabelValues(m.kind, "dropped").Inc()
+	}
+}
+
+// Publishes the queued messages until the queue is closed
+func (b *Bridge) run() {
+	defer close(b.done)
+	for m := range b.queue {
+		payload, err := json.Marshal(m.payload)
+		if err != nil {
+			logrus.Warnf("UNS: Failed to encode %s of %s: %v", m.kind, m.topic, err)
+			messages.WithLabelValues(m.kind, "failed").Inc()
+			continue
+		}
+		switch err := b.publisher.Publish(m.topic, m.cfg.QoS, m.cfg.Retain, payload); {
+		case err == nil:
+			messages.WithLabelValues(m.kind, "published").Inc()
+		case errors.Is(err, sparkplug.ErrStandby):
+			// the active instance publishes the namespace
+			messages.WithLabelValues(m.kind, "standby").Inc()
+		default:
+			logrus.Debugf("UNS: Failed to publish %s: %v", m.topic, err)
+			messages.WithLabelValues(m.kind, "failed").Inc()
+		}
+	}
+}
+
+// Stops accepting messages and waits until the queued ones are published
+func (b *Bridge) Close() {
+	b.mu.Lock()
+	if !b.closed {
+		b.closed = true
+		close(b.queue)
+	}
+	b.mu.Unlock()
+	<-b.done
+}
+
+// Renders a topic template, replacing wildcards in the IDs and names
+func topic(template, groupID, nodeID, deviceID, metric string) string {
+	return util.ExpandPath(template, clean(groupID), clean(nodeID), clean(deviceID), clean(metric))
+}
+
+// Replaces the MQTT wildcards, which are not allowed in published topics
+func clean(s string) string {
+	return strings.NewReplacer("+", "_", "#", "_").Replace(s)
+}
@@ -1,7 +1,10 @@
 package util
 
 import (
+	"fmt"
+	"regexp"
 	"sort"
+	"strings"
 
 	"golang.org/x/exp/constraints"
 )
@@ -27,3 +30,45 @@ func SortedKeys[K constraints.Ordered, V any](m map[K]V) []K {
 	})
 	return keys
 }
+
+// Splits a comma separated list, trimming whitespace and dropping empty entries
+func SplitList(list string) []string {
+	items := make([]string, 0)
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// Compiles a glob pattern, where '*' matches any characters including '/' and '?' a single character
+func Glob(pattern string) (*regexp.Regexp, error) {
+	if pattern == "" {
+		return nil, fmt.Errorf("empty pattern")
+	}
+	expr := regexp.QuoteMeta(pattern)
+	expr = strings.ReplaceAll(expr, `\*`, ".*")
+	expr = strings.ReplaceAll(expr, `\?`, ".")
+	re, err := regexp.Compile("^" + expr + "$")
+	if err != nil {
+		return nil, fmt.Errorf("invalid pattern %q: %v", pattern, err)
+	}
+	return re, nil
+}
+
+// Expands the placeholders {group}, {node}, {device} and {metric} of a topic or key template.
+// A level consisting only of {device} or {metric} is left out if the value is empty, e.g. {device} for nodes.
+func ExpandPath(template, groupID, nodeID, deviceID, metric string) string {
+	r := strings.NewReplacer("{group}", groupID, "{node}", nodeID, "{device}", deviceID, "{metric}", metric)
+	levels := strings.Split(template, "/")
+	expanded := make([]string, 0, len(levels))
+	for _, level := range levels {
+		if (level == "{device}" && deviceID == "") || (level == "{metric}" && metric == "") {
+			continue
+		}
+		expanded = append(expanded, r.Replace(level))
+	}
+	return strings.Join(expanded, "/")
+}
@@ -0,0 +1,176 @@
+package webhook
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"regexp"
+	"text/template"
+	"time"
+
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/util"
+	"gopkg.in/yaml.v2"
+)
+
+// The defaults of the delivery settings of a subscription
+const (
+	defaultTimeout        = 10 * time.Second
+	defaultMaxRetries     = 5
+	defaultInitialBackoff = time.Second
+	defaultMaxBackoff     = 5 * time.Minute
+)
+
+// A webhook subscription of the subscriptions file, posting the matching notifications to its URL
+type Subscription struct {
+	Name           string            `yaml:"name"`
+	URL            string            `yaml:"url"`
+	Secret         string            `yaml:"secret"`     // Signs the requests with HMAC-SHA256 if given
+	Headers        map[string]string `yaml:"headers"`    // Additional request headers, e.g. Authorization
+	Events         []string          `yaml:"events"`     // The event types, all if empty
+	Groups         []string          `yaml:"groups"`     // Glob patterns of the group IDs, all if empty
+	Nodes          []string          `yaml:"nodes"`      // Glob patterns of the node IDs, all if empty
+	Priorities     []string          `yaml:"priorities"` // The priorities of alarm notifications, all if empty; lifecycle events always match
+	Template       string            `yaml:"template"`   // A Go template rendering the JSON body, the notification itself if empty
+	Timeout        time.Duration     `yaml:"timeout"`
+	MaxRetries     *int              `yaml:"maxRetries"`
+	InitialBackoff time.Duration     `yaml:"initialBackoff"` // Doubled after every failed attempt up to maxBackoff
+	MaxBackoff     time.Duration     `yaml:"maxBackoff"`
+}
+
+// The webhook subscriptions file
+type subscriptionsFile struct {
+	Subscriptions []Subscription `yaml:"subscriptions"`
+}
+
+// Reads and validates the subscriptions of the given file
+func LoadSubscriptions(path string) ([]Subscription, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file subscriptionsFile
+	if err := yaml.UnmarshalStrict(content, &file); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if _, err := compileSubscriptions(file.Subscriptions); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return file.Subscriptions, nil
+}
+
+// A validated subscription with its compiled filters and template
+type subscription struct {
+	Subscription
+	maxRetries int
+	groups     []*regexp.Regexp
+	nodes      []*regexp.Regexp
+	template   *template.Template
+}
+
+func compileSubscriptions(subscriptions []Subscription) ([]*subscription, error) {
+	compiled := make([]*subscription, 0, len(subscriptions))
+	names := make(map[string]bool)
+	for i, s := range subscriptions {
+		if s.Name == "" || s.URL == "" {
+			return nil, fmt.Errorf("subscriptions[%d]: name and url are required", i)
+		}
+		if names[s.Name] {
+			return nil, fmt.Errorf("subscriptions[%d]: duplicate name %q", i, s.Name)
+		}
+		names[s.Name] = true
+		if u, err := url.Parse(s.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("subscription %s: url must be an http or https URL, got %q", s.Name, s.URL)
+		}
+		if s.Timeout < 0 || s.InitialBackoff < 0 || s.MaxBackoff < 0 || (s.MaxRetries != nil && *s.MaxRetries < 0) {
+			return nil, fmt.Errorf("subscription %s: timeout, maxRetries, initialBackoff and maxBackoff must not be negative", s.Name)
+		}
+
+		c := &subscription{Subscription: s, maxRetries: defaultMaxRetries}
+		if s.MaxRetries != nil {
+			c.maxRetries = *s.MaxRetries
+		}
+		if c.Timeout == 0 {
+			c.Timeout = defaultTimeout
+		}
+		if c.InitialBackoff == 0 {
+			c.InitialBackoff = defaultInitialBackoff
+		}
+		if c.MaxBackoff == 0 {
+			c.MaxBackoff = defaultMaxBackoff
+		}
+		var err error
+		if c.groups, err = globs(s.Groups); err != nil {
+			return nil, fmt.Errorf("subscription %s: groups: %v", s.Name, err)
+		}
+		if c.nodes, err = globs(s.Nodes); err != nil {
+			return nil, fmt.Errorf("subscription %s: nodes: %v", s.Name, err)
+		}
+		if s.Template != "" {
+			c.template, err = template.New(s.Name).Funcs(template.FuncMap{"json": toJSON}).Option("missingkey=error").Parse(s.Template)
+			if err != nil {
+				return nil, fmt.Errorf("subscription %s: template: %v", s.Name, err)
+			}
+		}
+		compiled = append(compiled, c)
+	}
+	return compiled, nil
+}
+
+func globs(patterns []string) ([]*regexp.Regexp, error) {
+	compiled := make([]*regexp.Regexp, 0, len(patterns))
+	for _, pattern := range patterns {
+		re, err := util.Glob(pattern)
+		if err != nil {
+			return nil, err
+		}
+		compiled = append(compiled, re)
+	}
+	return compiled, nil
+}
+
+// Returns true if any of the patterns matches the value, or if there are no patterns
+func matchesAny(patterns []*regexp.Regexp, value string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, re := range patterns {
+		if re.MatchString(value) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns true if the notification passes the filters of the subscription
+func (s *subscription) matches(n Notification) bool {
+	if len(s.Events) > 0 && !util.Contains(s.Events, n.Type) {
+		return false
+	}
+	if n.Alarm != nil && len(s.Priorities) > 0 && !util.Contains(s.Priorities, n.Priority) {
+		return false
+	}
+	return matchesAny(s.groups, n.GroupID) && matchesAny(s.nodes, n.NodeID)
+}
+
+// Renders the request body of the notification, which has to be valid JSON
+func (s *subscription) body(n Notification) ([]byte, error) {
+	if s.template == nil {
+		return json.Marshal(n)
+	}
+	var buf bytes.Buffer
+	if err := s.template.Execute(&buf, n); err != nil {
+		return nil, fmt.Errorf("template: %v", err)
+	}
+	if !json.Valid(buf.Bytes()) {
+		return nil, fmt.Errorf("template: rendered body is not valid JSON: %s", buf.String())
+	}
+	return buf.Bytes(), nil
+}
+
+// Returns the value as JSON, so templates can embed strings and objects safely
+func toJSON(value any) (string, error) {
+	b, err := json.Marshal(value)
+	return string(b), err
+}
@@ -0,0 +1,361 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/alarm"
+	"github.com/DATATRONiQ/go-sparkplug-primary/internal/store"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sirupsen/logrus"
+)
+
+// The buffer size of the delivery queue of each subscription
+const queueSize = 1000
+
+// Returned for dead letters which do not exist
+var ErrNotFound = errors.New("dead letter not found")
+
+var deliveries = promauto.NewCounterVec(prometheus.CounterOpts{Name: "sparkplug_primary_webhook_deliveries_total", Help: "Webhook delivery attempts by subscription and result"}, []string{"subscription", "result"})
+
+// The payload of a webhook, a lifecycle event of a node or device or a change of an alarm
+type Notification struct {
+	ID       string       `json:"id"` // Unique per notification, so receivers can detect retried deliveries
+	Time     time.Time    `json:"time"`
+	Type     string       `json:"type"` // The type of the lifecycle event, or of the alarm change (e.g. alarm_raised)
+	GroupID  string       `json:"groupId"`
+	NodeID   string       `json:"nodeId"`
+	DeviceID string       `json:"deviceId,omitempty"`
+	Priority string       `json:"priority,omitempty"` // The priority of the alarm
+	Event    *store.Event `json:"event,omitempty"`
+	Alarm    *alarm.Alarm `json:"alarm,omitempty"`
+}
+
+// A notification which could not be delivered to a subscription
+type DeadLetter struct {
+	ID           string       `json:"id"`
+	Subscription string       `json:"subscription"`
+	Notification Notification `json:"notification"`
+	Attempts     int          `json:"attempts"`
+	Error        string       `json:"error"`
+	FailedAt     time.Time    `json:"failedAt"`
+}
+
+// Posts notifications to the matching webhook subscriptions, retrying failed deliveries with exponential backoff
+type Dispatcher struct {
+	mu          sync.Mutex
+	workers     []*worker
+	deadLetters []DeadLetter // ring buffer of the most recent dead letters
+	next        int
+	size        int
+	client      *http.Client
+	ctx         context.Context
+	cancel      context.CancelFunc
+	wg          sync.WaitGroup
+}
+
+// Delivers the notifications of a single subscription in order
+type worker struct {
+	subscription *subscription
+	queue        chan Notification
+}
+
+// Creates a dispatcher delivering to the given subscriptions and keeping the given amount of dead letters
+func New(subscriptions []Subscription, deadLetterSize int) (*Dispatcher, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	d := &Dispatcher{
+		deadLetters: make([]DeadLetter, 0),
+		size:        deadLetterSize,
+		client:      &http.Client{},
+		ctx:         ctx,
+		cancel:      cancel,
+	}
+	if err := d.SetSubscriptions(subscriptions); err != nil {
+		cancel()
+		return nil, err
+	}
+	return d, nil
+}
+
+// Replaces the subscriptions. Notifications already queued are delivered with the previous settings.
+func (d *Dispatcher) SetSubscriptions(subscriptions []Subscription) error {
+	compiled, err := compileSubscriptions(subscriptions)
+	if err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, w := range d.workers {
+		close(w.queue)
+	}
+	d.workers = make([]*worker, 0, len(compiled))
+	for _, s := range compiled {
+		w := &worker{subscription: s, queue: make(chan Notification, queueSize)}
+		d.workers = append(d.workers, w)
+		d.wg.Add(1)
+		go d.run(w)
+	}
+	return nil
+}
+
+// Queues the notification for every matching subscription. Never blocks, notifications are dead letters if a queue is full.
+func (d *Dispatcher) Notify(n Notification) {
+	if n.ID == "" {
+		n.ID = newID()
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.ctx.Err() != nil {
+		return
+	}
+	for _, w := range d.workers {
+		if !w.subscription.matches(n) {
+			continue
+		}
+		select {
+		case w.queue <- n:
+		default:
+			d.addDeadLetter(w.subscription.Name, n, 0, errors.New("delivery queue is full"))
+		}
+	}
+}
+
+// Notifies the subscriptions of a lifecycle event
+func (d *Dispatcher) NotifyEvent(e store.Event) {
+	d.Notify(Notification{
+		Time:     e.Time,
+		Type:     string(e.Type),
+		GroupID:  e.GroupID,
+		NodeID:   e.NodeID,
+		DeviceID: e.DeviceID,
+		Event:    &e,
+	})
+}
+
+// Notifies the subscriptions of a change of an alarm
+func (d *Dispatcher) NotifyAlarm(t alarm.EventType, a alarm.Alarm) {
+	d.Notify(Notification{
+		Time:     time.Now(),
+		Type:     string(t),
+		GroupID:  a.GroupID,
+		NodeID:   a.NodeID,
+		DeviceID: a.DeviceID,
+		Priority: a.Priority,
+		Alarm:    &a,
+	})
+}
+
+// Delivers the queued notifications of the worker until its queue is closed or the dispatcher is closed
+func (d *Dispatcher) run(w *worker) {
+	defer d.wg.Done()
+	for n := range w.queue {
+		attempts, err := d.deliver(w.subscription, n)
+		if err == nil {
+			continue
+		}
+		if d.ctx.Err() != nil {
+			logrus.Warnf("Webhook %s: dropping notification %s on shutdown: %v", w.subscription.Name, n.ID, err)
+			continue
+		}
+		logrus.Errorf("Webhook %s: giving up on notification %s after %d attempts: %v", w.subscription.Name, n.ID, attempts, err)
+		d.mu.Lock()
+		d.addDeadLetter(w.subscription.Name, n, attempts, err)
+		d.mu.Unlock()
+	}
+}
+
+// Posts the notification, retrying with exponential backoff. Returns the number of attempts and the last error.
+func (d *Dispatcher) deliver(s *subscription, n Notification) (int, error) {
+	body, err := s.body(n)
+	if err != nil {
+		deliveries.WithLabelValues(s.Name, "failed").Inc()
+		return 0, err
+	}
+
+	backoff := s.InitialBackoff
+	for attempt := 1; ; attempt++ {
+		retry, err := d.post(s, n, body)
+		if err == nil {
+			deliveries.WithLabelValues(s.Name, "delivered").Inc()
+			return attempt, nil
+		}
+		if !retry || attempt > s.maxRetries {
+			deliveries.WithLabelValues(s.Name, "failed").Inc()
+			return attempt, err
+		}
+		deliveries.WithLabelValues(s.Name, "retried").Inc()
+		logrus.Warnf("Webhook %s: attempt %d of notification %s failed, retrying in %v: %v", s.Name, attempt, n.ID, backoff, err)
+		select {
+		case <-d.ctx.Done():
+			return attempt, err
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > s.MaxBackoff {
+			backoff = s.MaxBackoff
+		}
+	}
+}
+
+// Posts the body once. Returns whether a failure is worth retrying: network errors, 429 and 5xx responses.
+func (d *Dispatcher) post(s *subscription, n Notification, body []byte) (bool, error) {
+	ctx, cancel := context.WithTimeout(d.ctx, s.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "go-sparkplug-primary")
+	req.Header.Set("X-Sparkplug-Event", n.Type)
+	req.Header.Set("X-Sparkplug-Delivery", n.ID)
+	if s.Secret != "" {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set("X-Sparkplug-Timestamp", timestamp)
+		req.Header.Set("X-Sparkplug-Signature", "sha256="+Sign(s.Secret, timestamp, body))
+	}
+	for name, value := range s.Headers {
+		req.Header.Set(name, value)
+	}
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+	return resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500, fmt.Errorf("%s responded %s", s.URL, resp.Status)
+}
+
+// Returns the hex encoded HMAC-SHA256 of "<timestamp>.<body>", which receivers recompute to verify a request
+func Sign(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Adds a dead letter, dropping the oldest if the list is full. Must be called with the lock held.
+func (d *Dispatcher) addDeadLetter(subscription string, n Notification, attempts int, err error) {
+	if d.size <= 0 {
+		return
+	}
+	letter := DeadLetter{ID: newID(), Subscription: subscription, Notification: n, Attempts: attempts, Error: err.Error(), FailedAt: time.Now()}
+	if len(d.deadLetters) < d.size {
+		d.deadLetters = append(d.deadLetters, letter)
+		return
+	}
+	d.deadLetters[d.next] = letter
+	d.next = (d.next + 1) % d.size
+}
+
+// Returns the dead letters, oldest first
+func (d *Dispatcher) DeadLetters() []DeadLetter {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	letters := make([]DeadLetter, 0, len(d.deadLetters))
+	letters = append(letters, d.deadLetters[d.next:]...)
+	letters = append(letters, d.deadLetters[:d.next]...)
+	return letters
+}
+
+// Removes the dead letter and queues its notification for its subscription again
+func (d *Dispatcher) Redeliver(id string) (DeadLetter, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for i, letter := range d.deadLetters {
+		if letter.ID != id {
+			continue
+		}
+		for _, w := range d.workers {
+			if w.subscription.Name != letter.Subscription {
+				continue
+			}
+			select {
+			case w.queue <- letter.Notification:
+			default:
+				return letter, errors.New("delivery queue is full")
+			}
+			d.removeDeadLetter(i)
+			return letter, nil
+		}
+		return letter, fmt.Errorf("subscription %s no longer exists", letter.Subscription)
+	}
+	return DeadLetter{}, ErrNotFound
+}
+
+// Removes the dead letter without delivering it
+func (d *Dispatcher) Discard(id string) (DeadLetter, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for i, letter := range d.deadLetters {
+		if letter.ID == id {
+			d.removeDeadLetter(i)
+			return letter, nil
+		}
+	}
+	return DeadLetter{}, ErrNotFound
+}
+
+// Removes the dead letter at the given index, keeping the order. Must be called with the lock held.
+func (d *Dispatcher) removeDeadLetter(i int) {
+	letters := make([]DeadLetter, 0, len(d.deadLetters))
+	letters = append(letters, d.deadLetters[d.next:]...)
+	letters = append(letters, d.deadLetters[:d.next]...)
+	// the index is of the ring buffer, so it is rotated like the letters
+	i = (i - d.next + len(letters)) % len(letters)
+	d.deadLetters = append(letters[:i], letters[i+1:]...)
+	d.next = 0
+}
+
+// Stops accepting notifications and waits until the queued ones are delivered or the context is done,
+// which aborts the pending deliveries
+func (d *Dispatcher) Close(ctx context.Context) error {
+	d.mu.Lock()
+	for _, w := range d.workers {
+		close(w.queue)
+	}
+	d.workers = nil
+	d.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		d.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		d.cancel()
+		return nil
+	case <-ctx.Done():
+		d.cancel()
+		<-done
+		return ctx.Err()
+	}
+}
+
+// Returns a random ID
+func newID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
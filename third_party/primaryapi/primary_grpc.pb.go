@@ -0,0 +1,442 @@
+// The gRPC API of go-sparkplug-primary, giving typed access to the groups, edge nodes, devices and metrics
+// known to the primary host, streams of metric updates and received Sparkplug messages, and commands.
+
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.3.0
+// - protoc             (unknown)
+// source: third_party/primaryapi/primary.proto
+
+package primaryapi
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+const (
+	Primary_ListGroups_FullMethodName          = "/sparkplug.primary.v1.Primary/ListGroups"
+	Primary_GetNode_FullMethodName             = "/sparkplug.primary.v1.Primary/GetNode"
+	Primary_GetDevice_FullMethodName           = "/sparkplug.primary.v1.Primary/GetDevice"
+	Primary_ReadMetrics_FullMethodName         = "/sparkplug.primary.v1.Primary/ReadMetrics"
+	Primary_StreamMetricUpdates_FullMethodName = "/sparkplug.primary.v1.Primary/StreamMetricUpdates"
+	Primary_WriteMetrics_FullMethodName        = "/sparkplug.primary.v1.Primary/WriteMetrics"
+	Primary_RequestRebirth_FullMethodName      = "/sparkplug.primary.v1.Primary/RequestRebirth"
+	Primary_StreamMessages_FullMethodName      = "/sparkplug.primary.v1.Primary/StreamMessages"
+)
+
+// PrimaryClient is the client API for Primary service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type PrimaryClient interface {
+	// Returns the groups with their nodes and devices
+	ListGroups(ctx context.Context, in *ListGroupsRequest, opts ...grpc.CallOption) (*ListGroupsResponse, error)
+	// Returns a node with its devices and metrics
+	GetNode(ctx context.Context, in *GetNodeRequest, opts ...grpc.CallOption) (*Node, error)
+	// Returns a device with its metrics
+	GetDevice(ctx context.Context, in *GetDeviceRequest, opts ...grpc.CallOption) (*Device, error)
+	// Returns the current values of the metrics whose paths match the patterns
+	ReadMetrics(ctx context.Context, in *ReadMetricsRequest, opts ...grpc.CallOption) (*ReadMetricsResponse, error)
+	// Streams the metric values applied to the store by birth and data messages
+	StreamMetricUpdates(ctx context.Context, in *StreamMetricUpdatesRequest, opts ...grpc.CallOption) (Primary_StreamMetricUpdatesClient, error)
+	// Writes metrics of a node or device by publishing an NCMD or DCMD, requires the operator role for the node
+	WriteMetrics(ctx context.Context, in *WriteMetricsRequest, opts ...grpc.CallOption) (*WriteMetricsResponse, error)
+	// Requests a node to republish its birth certificates, requires the operator role for the node
+	RequestRebirth(ctx context.Context, in *RequestRebirthRequest, opts ...grpc.CallOption) (*RequestRebirthResponse, error)
+	// Streams the Sparkplug messages received from the broker as they arrive, before they are applied to the store
+	StreamMessages(ctx context.Context, in *StreamMessagesRequest, opts ...grpc.CallOption) (Primary_StreamMessagesClient, error)
+}
+
+type primaryClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewPrimaryClient(cc grpc.ClientConnInterface) PrimaryClient {
+	return &primaryClient{cc}
+}
+
+func (c *primaryClient) ListGroups(ctx context.Context, in *ListGroupsRequest, opts ...grpc.CallOption) (*ListGroupsResponse, error) {
+	out := new(ListGroupsResponse)
+	err := c.cc.Invoke(ctx, Primary_ListGroups_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *primaryClient) GetNode(ctx context.Context, in *GetNodeRequest, opts ...grpc.CallOption) (*Node, error) {
+	out := new(Node)
+	err := c.cc.Invoke(ctx, Primary_GetNode_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *primaryClient) GetDevice(ctx context.Context, in *GetDeviceRequest, opts ...grpc.CallOption) (*Device, error) {
+	out := new(Device)
+	err := c.cc.Invoke(ctx, Primary_GetDevice_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *primaryClient) ReadMetrics(ctx context.Context, in *ReadMetricsRequest, opts ...grpc.CallOption) (*ReadMetricsResponse, error) {
+	out := new(ReadMetricsResponse)
+	err := c.cc.Invoke(ctx, Primary_ReadMetrics_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *primaryClient) StreamMetricUpdates(ctx context.Context, in *StreamMetricUpdatesRequest, opts ...grpc.CallOption) (Primary_StreamMetricUpdatesClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Primary_ServiceDesc.Streams[0], Primary_StreamMetricUpdates_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &primaryStreamMetricUpdatesClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Primary_StreamMetricUpdatesClient interface {
+	Recv() (*MetricUpdate, error)
+	grpc.ClientStream
+}
+
+type primaryStreamMetricUpdatesClient struct {
+	grpc.ClientStream
+}
+
+func (x *primaryStreamMetricUpdatesClient) Recv() (*MetricUpdate, error) {
+	m := new(MetricUpdate)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *primaryClient) WriteMetrics(ctx context.Context, in *WriteMetricsRequest, opts ...grpc.CallOption) (*WriteMetricsResponse, error) {
+	out := new(WriteMetricsResponse)
+	err := c.cc.Invoke(ctx, Primary_WriteMetrics_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *primaryClient) RequestRebirth(ctx context.Context, in *RequestRebirthRequest, opts ...grpc.CallOption) (*RequestRebirthResponse, error) {
+	out := new(RequestRebirthResponse)
+	err := c.cc.Invoke(ctx, Primary_RequestRebirth_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *primaryClient) StreamMessages(ctx context.Context, in *StreamMessagesRequest, opts ...grpc.CallOption) (Primary_StreamMessagesClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Primary_ServiceDesc.Streams[1], Primary_StreamMessages_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &primaryStreamMessagesClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Primary_StreamMessagesClient interface {
+	Recv() (*SparkplugMessage, error)
+	grpc.ClientStream
+}
+
+type primaryStreamMessagesClient struct {
+	grpc.ClientStream
+}
+
+func (x *primaryStreamMessagesClient) Recv() (*SparkplugMessage, error) {
+	m := new(SparkplugMessage)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// PrimaryServer is the server API for Primary service.
+// All implementations must embed UnimplementedPrimaryServer
+// for forward compatibility
+type PrimaryServer interface {
+	// Returns the groups with their nodes and devices
+	ListGroups(context.Context, *ListGroupsRequest) (*ListGroupsResponse, error)
+	// Returns a node with its devices and metrics
+	GetNode(context.Context, *GetNodeRequest) (*Node, error)
+	// Returns a device with its metrics
+	GetDevice(context.Context, *GetDeviceRequest) (*Device, error)
+	// Returns the current values of the metrics whose paths match the patterns
+	ReadMetrics(context.Context, *ReadMetricsRequest) (*ReadMetricsResponse, error)
+	// Streams the metric values applied to the store by birth and data messages
+	StreamMetricUpdates(*StreamMetricUpdatesRequest, Primary_StreamMetricUpdatesServer) error
+	// Writes metrics of a node or device by publishing an NCMD or DCMD, requires the operator role for the node
+	WriteMetrics(context.Context, *WriteMetricsRequest) (*WriteMetricsResponse, error)
+	// Requests a node to republish its birth certificates, requires the operator role for the node
+	RequestRebirth(context.Context, *RequestRebirthRequest) (*RequestRebirthResponse, error)
+	// Streams the Sparkplug messages received from the broker as they arrive, before they are applied to the store
+	StreamMessages(*StreamMessagesRequest, Primary_StreamMessagesServer) error
+	mustEmbedUnimplementedPrimaryServer()
+}
+
+// UnimplementedPrimaryServer must be embedded to have forward compatible implementations.
+type UnimplementedPrimaryServer struct {
+}
+
+func (UnimplementedPrimaryServer) ListGroups(context.Context, *ListGroupsRequest) (*ListGroupsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListGroups not implemented")
+}
+func (UnimplementedPrimaryServer) GetNode(context.Context, *GetNodeRequest) (*Node, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetNode not implemented")
+}
+func (UnimplementedPrimaryServer) GetDevice(context.Context, *GetDeviceRequest) (*Device, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetDevice not implemented")
+}
+func (UnimplementedPrimaryServer) ReadMetrics(context.Context, *ReadMetricsRequest) (*ReadMetricsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ReadMetrics not implemented")
+}
+func (UnimplementedPrimaryServer) StreamMetricUpdates(*StreamMetricUpdatesRequest, Primary_StreamMetricUpdatesServer) error {
+	return status.Errorf(codes.Unimplemented, "method StreamMetricUpdates not implemented")
+}
+func (UnimplementedPrimaryServer) WriteMetrics(context.Context, *WriteMetricsRequest) (*WriteMetricsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method WriteMetrics not implemented")
+}
+func (UnimplementedPrimaryServer) RequestRebirth(context.Context, *RequestRebirthRequest) (*RequestRebirthResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method RequestRebirth not implemented")
+}
+func (UnimplementedPrimaryServer) StreamMessages(*StreamMessagesRequest, Primary_StreamMessagesServer) error {
+	return status.Errorf(codes.Unimplemented, "method StreamMessages not implemented")
+}
+func (UnimplementedPrimaryServer) mustEmbedUnimplementedPrimaryServer() {}
+
+// UnsafePrimaryServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to PrimaryServer will
+// result in compilation errors.
+type UnsafePrimaryServer interface {
+	mustEmbedUnimplementedPrimaryServer()
+}
+
+func RegisterPrimaryServer(s grpc.ServiceRegistrar, srv PrimaryServer) {
+	s.RegisterService(&Primary_ServiceDesc, srv)
+}
+
+func _Primary_ListGroups_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListGroupsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(PrimaryServer).ListGroups(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Primary_ListGroups_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(PrimaryServer).ListGroups(ctx, req.(*ListGroupsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Primary_GetNode_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetNodeRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(PrimaryServer).GetNode(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Primary_GetNode_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(PrimaryServer).GetNode(ctx, req.(*GetNodeRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Primary_GetDevice_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetDeviceRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(PrimaryServer).GetDevice(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Primary_GetDevice_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(PrimaryServer).GetDevice(ctx, req.(*GetDeviceRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Primary_ReadMetrics_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ReadMetricsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(PrimaryServer).ReadMetrics(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Primary_ReadMetrics_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(PrimaryServer).ReadMetrics(ctx, req.(*ReadMetricsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Primary_StreamMetricUpdates_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(StreamMetricUpdatesRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(PrimaryServer).StreamMetricUpdates(m, &primaryStreamMetricUpdatesServer{stream})
+}
+
+type Primary_StreamMetricUpdatesServer interface {
+	Send(*MetricUpdate) error
+	grpc.ServerStream
+}
+
+type primaryStreamMetricUpdatesServer struct {
+	grpc.ServerStream
+}
+
+func (x *primaryStreamMetricUpdatesServer) Send(m *MetricUpdate) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _Primary_WriteMetrics_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(WriteMetricsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(PrimaryServer).WriteMetrics(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Primary_WriteMetrics_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(PrimaryServer).WriteMetrics(ctx, req.(*WriteMetricsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Primary_RequestRebirth_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RequestRebirthRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(PrimaryServer).RequestRebirth(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Primary_RequestRebirth_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(PrimaryServer).RequestRebirth(ctx, req.(*RequestRebirthRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Primary_StreamMessages_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(StreamMessagesRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(PrimaryServer).StreamMessages(m, &primaryStreamMessagesServer{stream})
+}
+
+type Primary_StreamMessagesServer interface {
+	Send(*SparkplugMessage) error
+	grpc.ServerStream
+}
+
+type primaryStreamMessagesServer struct {
+	grpc.ServerStream
+}
+
+func (x *primaryStreamMessagesServer) Send(m *SparkplugMessage) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+// Primary_ServiceDesc is the grpc.ServiceDesc for Primary service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Primary_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "sparkplug.primary.v1.Primary",
+	HandlerType: (*PrimaryServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "ListGroups",
+			Handler:    _Primary_ListGroups_Handler,
+		},
+		{
+			MethodName: "GetNode",
+			Handler:    _Primary_GetNode_Handler,
+		},
+		{
+			MethodName: "GetDevice",
+			Handler:    _Primary_GetDevice_Handler,
+		},
+		{
+			MethodName: "ReadMetrics",
+			Handler:    _Primary_ReadMetrics_Handler,
+		},
+		{
+			MethodName: "WriteMetrics",
+			Handler:    _Primary_WriteMetrics_Handler,
+		},
+		{
+			MethodName: "RequestRebirth",
+			Handler:    _Primary_RequestRebirth_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "StreamMetricUpdates",
+			Handler:       _Primary_StreamMetricUpdates_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "StreamMessages",
+			Handler:       _Primary_StreamMessages_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "third_party/primaryapi/primary.proto",
+}